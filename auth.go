@@ -0,0 +1,351 @@
+package sip
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DigestAlgorithmMD5 = "MD5"
+	DigestQopAuth      = "auth"
+
+	defaultNonceTTL = time.Minute * 5
+	nonceSize       = 8 + 8 + 16
+)
+
+var (
+	ErrorAuthorizationMissing = errors.New("authorization header missing")
+	ErrorAuthorizationInvalid = errors.New("authorization invalid")
+	ErrorAuthorizationStale   = errors.New("authorization nonce stale")
+	ErrorAuthorizationReplay  = errors.New("authorization nonce count replayed")
+	ErrorCredentialNotFound   = errors.New("credential not found")
+)
+
+type (
+	//CredentialStore 用户凭证存储，只保存HA1=MD5(username:realm:password)
+	CredentialStore interface {
+		Lookup(username, realm string) (ha1 string, err error)
+	}
+
+	//Credential 单个用户凭证
+	Credential struct {
+		Username string `json:"username" yaml:"username"`
+		Realm    string `json:"realm" yaml:"realm"`
+		HA1      string `json:"ha1" yaml:"ha1"`
+	}
+
+	//MemoryCredentialStore 内存凭证存储
+	MemoryCredentialStore struct {
+		mutex       sync.RWMutex
+		credentials map[string]string
+	}
+
+	//FileCredentialStore 基于yaml文件的凭证存储
+	FileCredentialStore struct {
+		path  string
+		store *MemoryCredentialStore
+	}
+
+	nonceState struct {
+		nc        uint64
+		expiredAt time.Time
+	}
+
+	//DigestAuthenticator 服务端摘要认证
+	DigestAuthenticator struct {
+		Realm       string
+		NonceTTL    time.Duration
+		store       CredentialStore
+		secret      []byte
+		nonceMutex  sync.Mutex
+		nonces      map[string]*nonceState
+		lastCleanAt time.Time
+	}
+)
+
+//HA1 计算用户的HA1值
+func HA1(username, realm, password string) string {
+	return hex.EncodeToString(MD5([]byte(username + ":" + realm + ":" + password)))
+}
+
+func credentialKey(username, realm string) string {
+	return username + "@" + realm
+}
+
+//Add 添加一个明文密码的用户
+func (s *MemoryCredentialStore) Add(username, realm, password string) {
+	s.AddHA1(username, realm, HA1(username, realm, password))
+}
+
+//AddHA1 添加一个HA1形式的用户
+func (s *MemoryCredentialStore) AddHA1(username, realm, ha1 string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.credentials[credentialKey(username, realm)] = strings.ToLower(ha1)
+}
+
+//Remove 删除用户
+func (s *MemoryCredentialStore) Remove(username, realm string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.credentials, credentialKey(username, realm))
+}
+
+func (s *MemoryCredentialStore) Lookup(username, realm string) (ha1 string, err error) {
+	var ok bool
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if ha1, ok = s.credentials[credentialKey(username, realm)]; !ok {
+		err = ErrorCredentialNotFound
+	}
+	return
+}
+
+func (s *MemoryCredentialStore) reset(credentials []*Credential) {
+	m := make(map[string]string, len(credentials))
+	for _, c := range credentials {
+		m[credentialKey(c.Username, c.Realm)] = strings.ToLower(c.HA1)
+	}
+	s.mutex.Lock()
+	s.credentials = m
+	s.mutex.Unlock()
+}
+
+//Reload 重新加载凭证文件
+func (s *FileCredentialStore) Reload() (err error) {
+	var (
+		buf         []byte
+		credentials []*Credential
+	)
+	if buf, err = os.ReadFile(s.path); err != nil {
+		return
+	}
+	if err = yaml.Unmarshal(buf, &credentials); err != nil {
+		return
+	}
+	s.store.reset(credentials)
+	return
+}
+
+func (s *FileCredentialStore) Lookup(username, realm string) (ha1 string, err error) {
+	return s.store.Lookup(username, realm)
+}
+
+//makeNonce 生成带签名和时间戳的nonce
+func (a *DigestAuthenticator) makeNonce() string {
+	buf := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(buf[:8], uint64(time.Now().UnixNano()))
+	_, _ = rand.Read(buf[8:16])
+	copy(buf[16:], a.sign(buf[:16]))
+	return hex.EncodeToString(buf)
+}
+
+func (a *DigestAuthenticator) sign(b []byte) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(b)
+	return mac.Sum(nil)[:16]
+}
+
+//checkNonce 校验nonce签名，返回nonce是否过期
+func (a *DigestAuthenticator) checkNonce(nonce string) (stale bool, err error) {
+	var buf []byte
+	if buf, err = hex.DecodeString(nonce); err != nil || len(buf) != nonceSize {
+		err = ErrorAuthorizationInvalid
+		return
+	}
+	if !hmac.Equal(a.sign(buf[:16]), buf[16:]) {
+		err = ErrorAuthorizationInvalid
+		return
+	}
+	issuedAt := time.Unix(0, int64(binary.BigEndian.Uint64(buf[:8])))
+	stale = time.Since(issuedAt) > a.NonceTTL
+	return
+}
+
+//checkNonceCount nc必须严格递增，防止重放
+func (a *DigestAuthenticator) checkNonceCount(nonce string, nc uint64) (err error) {
+	now := time.Now()
+	a.nonceMutex.Lock()
+	defer a.nonceMutex.Unlock()
+	if now.Sub(a.lastCleanAt) > a.NonceTTL {
+		for k, v := range a.nonces {
+			if now.After(v.expiredAt) {
+				delete(a.nonces, k)
+			}
+		}
+		a.lastCleanAt = now
+	}
+	state, ok := a.nonces[nonce]
+	if !ok {
+		state = &nonceState{expiredAt: now.Add(a.NonceTTL * 2)}
+		a.nonces[nonce] = state
+	}
+	if nc <= state.nc {
+		err = ErrorAuthorizationReplay
+		return
+	}
+	state.nc = nc
+	return
+}
+
+//authorization 查找属于当前realm的认证头
+func (a *DigestAuthenticator) authorization(req *Request) *AuthorizationHeader {
+	for _, name := range []string{HeaderAuthorization, HeaderProxyAuthorization} {
+		if !req.Header.Has(name) {
+			continue
+		}
+		if head, ok := req.Header.Get(name).(*AuthorizationHeader); ok && head.Realm == a.Realm {
+			return head
+		}
+	}
+	return nil
+}
+
+//Challenge 生成一个认证挑战响应，code为401或者407
+func (a *DigestAuthenticator) Challenge(req *Request, code int, stale bool) *Response {
+	res := NewResponse(code, req)
+	if toHead, ok := res.Header.Get(HeaderTo).(*AddressHeader); ok && toHead.Params.Get("tag") == "" {
+		toHead.Params.Set("tag", strconv.FormatInt(time.Now().UnixNano(), 36))
+	}
+	head := &AuthorizationHeader{
+		Method:    "Digest",
+		Realm:     a.Realm,
+		Nonce:     a.makeNonce(),
+		Algorithm: DigestAlgorithmMD5,
+		QOP:       DigestQopAuth,
+		Stale:     stale,
+	}
+	if code == StatusProxyAuthenticationRequired {
+		res.Header.Set(HeaderProxyAuthenticate, head)
+	} else {
+		res.Header.Set(HeaderWWWAuthenticate, head)
+	}
+	return res
+}
+
+//Verify 校验请求的认证信息，成功返回用户名
+func (a *DigestAuthenticator) Verify(req *Request) (username string, err error) {
+	var (
+		ha1   string
+		ha2   string
+		uri   string
+		stale bool
+		nc    uint64
+		want  string
+	)
+	head := a.authorization(req)
+	if head == nil {
+		err = ErrorAuthorizationMissing
+		return
+	}
+	if !strings.EqualFold(head.Method, "Digest") || head.Username == "" || head.Response == "" {
+		err = ErrorAuthorizationInvalid
+		return
+	}
+	if head.Algorithm != "" && !strings.EqualFold(head.Algorithm, DigestAlgorithmMD5) {
+		err = ErrorAuthorizationInvalid
+		return
+	}
+	//挑战总是提供qop="auth", 没有qop的响应无法防止重放, auth-int没有实现
+	if head.QOP != DigestQopAuth || head.NC == "" || head.CNonce == "" {
+		err = ErrorAuthorizationInvalid
+		return
+	}
+	if !matchUri(head.Uri, req.Uri()) {
+		err = ErrorAuthorizationInvalid
+		return
+	}
+	if stale, err = a.checkNonce(head.Nonce); err != nil {
+		return
+	}
+	if ha1, err = a.store.Lookup(head.Username, a.Realm); err != nil {
+		return
+	}
+	if uri = head.rawUri; uri == "" && head.Uri != nil {
+		uri = head.Uri.String()
+	}
+	ha2 = hex.EncodeToString(MD5([]byte(req.Method.String() + ":" + uri)))
+	want = hex.EncodeToString(MD5([]byte(ha1 + ":" + head.Nonce + ":" + head.NC + ":" + head.CNonce + ":" + head.QOP + ":" + ha2)))
+	if !hmac.Equal([]byte(want), []byte(strings.ToLower(head.Response))) {
+		err = ErrorAuthorizationInvalid
+		return
+	}
+	//凭证正确但是nonce过期, 客户端只需要使用新的nonce重试
+	if stale {
+		err = ErrorAuthorizationStale
+		return
+	}
+	if nc, err = strconv.ParseUint(head.NC, 16, 64); err != nil {
+		err = ErrorAuthorizationInvalid
+		return
+	}
+	if err = a.checkNonceCount(head.Nonce, nc); err != nil {
+		return
+	}
+	username = head.Username
+	return
+}
+
+//NewDigestAuthorization 客户端根据挑战计算认证头, nc为同一个nonce已经使用的次数
+func NewDigestAuthorization(challenge *AuthorizationHeader, method Method, uri *Uri, username, password string, nc int) *AuthorizationHeader {
+	head := &AuthorizationHeader{
+		Method:    "Digest",
+		Realm:     challenge.Realm,
+		Nonce:     challenge.Nonce,
+		Algorithm: challenge.Algorithm,
+		Opaque:    challenge.Opaque,
+		Username:  username,
+		Uri:       uri,
+	}
+	ha1 := HA1(username, challenge.Realm, password)
+	ha2 := hex.EncodeToString(MD5([]byte(method.String() + ":" + uri.String())))
+	for _, qop := range strings.Split(challenge.QOP, ",") {
+		if strings.TrimSpace(qop) == DigestQopAuth {
+			head.QOP = DigestQopAuth
+		}
+	}
+	if head.QOP == "" {
+		head.Response = hex.EncodeToString(MD5([]byte(ha1 + ":" + challenge.Nonce + ":" + ha2)))
+		return head
+	}
+	head.NC = fmt.Sprintf("%08x", nc)
+	head.CNonce = NewTag()
+	head.Response = hex.EncodeToString(MD5([]byte(ha1 + ":" + challenge.Nonce + ":" + head.NC + ":" + head.CNonce + ":" + head.QOP + ":" + ha2)))
+	return head
+}
+
+//NewMemoryCredentialStore 创建内存凭证存储
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{credentials: make(map[string]string)}
+}
+
+//NewFileCredentialStore 从yaml文件加载凭证
+func NewFileCredentialStore(path string) (store *FileCredentialStore, err error) {
+	store = &FileCredentialStore{path: path, store: NewMemoryCredentialStore()}
+	err = store.Reload()
+	return
+}
+
+//NewDigestAuthenticator 创建摘要认证器
+func NewDigestAuthenticator(realm string, store CredentialStore) *DigestAuthenticator {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return &DigestAuthenticator{
+		Realm:    realm,
+		NonceTTL: defaultNonceTTL,
+		store:    store,
+		secret:   secret,
+		nonces:   make(map[string]*nonceState),
+	}
+}
@@ -0,0 +1,124 @@
+package sip
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newAuthTestRequest() *Request {
+	req := NewRequest(MethodRegister, "example.com")
+	req.Header.Set(HeaderVia, &ViaHeader{Uri: NewUri("", "127.0.0.1:5060", Map{"branch": "z9hG4bK-test"})})
+	req.Header.Set(HeaderFrom, &AddressHeader{Uri: NewUri("1001", "example.com", Map{}).EnableProtocol(), Params: Map{"tag": "abc"}})
+	req.Header.Set(HeaderTo, &AddressHeader{Uri: NewUri("1001", "example.com", Map{}).EnableProtocol()})
+	req.Header.Set(HeaderCallID, NewPlainHeader("auth-test"))
+	req.Header.Set(HeaderCSeq, NewSequenceHeader(MethodRegister, 1))
+	return req
+}
+
+func authorize(t *testing.T, req *Request, res *Response, password string) {
+	var (
+		err    error
+		head   Value
+		parsed *Response
+	)
+	if parsed, err = ReadResponse(bufio.NewReader(bytes.NewReader(res.Bytes()))); err != nil {
+		t.Fatal(err)
+	}
+	if head = parsed.Header.Get(HeaderWWWAuthenticate); head == nil {
+		t.Fatal("missing WWW-Authenticate")
+	}
+	req.Header.Set(HeaderAuthorization, NewAuthorizationResponseHeader("1001", password, head.(*AuthorizationHeader)))
+}
+
+func TestDigestAuthenticator_Verify(t *testing.T) {
+	store := NewMemoryCredentialStore()
+	store.Add("1001", "example.com", "secret")
+	authenticator := NewDigestAuthenticator("example.com", store)
+
+	req := newAuthTestRequest()
+	if _, err := authenticator.Verify(req); err != ErrorAuthorizationMissing {
+		t.Fatalf("expect missing, got %v", err)
+	}
+	res := authenticator.Challenge(req, StatusUnauthorized, false)
+	if res.StatusCode != StatusUnauthorized || !res.Header.Has(HeaderVia) {
+		t.Fatalf("unexpected challenge %s", res.String())
+	}
+	authorize(t, req, res, "secret")
+	if username, err := authenticator.Verify(req); err != nil || username != "1001" {
+		t.Fatalf("verify failed: %v", err)
+	}
+	//重复的nc需要被拒绝
+	if _, err := authenticator.Verify(req); err != ErrorAuthorizationReplay {
+		t.Fatalf("expect replay, got %v", err)
+	}
+
+	authorize(t, req, authenticator.Challenge(req, StatusUnauthorized, false), "wrong")
+	if _, err := authenticator.Verify(req); err != ErrorAuthorizationInvalid {
+		t.Fatalf("expect invalid, got %v", err)
+	}
+
+	authorize(t, req, authenticator.Challenge(req, StatusUnauthorized, false), "secret")
+	authenticator.NonceTTL = -1
+	if _, err := authenticator.Verify(req); err != ErrorAuthorizationStale {
+		t.Fatalf("expect stale, got %v", err)
+	}
+}
+
+func TestDigestAuthenticator_VerifyQop(t *testing.T) {
+	store := NewMemoryCredentialStore()
+	store.Add("1001", "example.com", "secret")
+	authenticator := NewDigestAuthenticator("example.com", store)
+	req := newAuthTestRequest()
+	challenge := authenticator.Challenge(req, StatusUnauthorized, false).Header.Get(HeaderWWWAuthenticate).(*AuthorizationHeader)
+
+	//没有qop的响应每次都会被拒绝, 不能重放
+	noQop := NewAuthorizationResponseHeader("1001", "secret", challenge)
+	noQop.QOP, noQop.NC, noQop.CNonce = "", "", ""
+	req.Header.Set(HeaderAuthorization, noQop)
+	for i := 0; i < 3; i++ {
+		if _, err := authenticator.Verify(req); err != ErrorAuthorizationInvalid {
+			t.Fatalf("expect invalid without qop, got %v", err)
+		}
+	}
+
+	head := NewAuthorizationResponseHeader("1001", "secret", challenge)
+	head.QOP = "auth-int"
+	req.Header.Set(HeaderAuthorization, head)
+	if _, err := authenticator.Verify(req); err != ErrorAuthorizationInvalid {
+		t.Fatalf("expect invalid for auth-int, got %v", err)
+	}
+
+	//摘要中的uri和Request-URI不同
+	head = NewAuthorizationResponseHeader("1001", "secret", challenge)
+	head.Uri = NewUri("", "other.com", Map{})
+	req.Header.Set(HeaderAuthorization, head)
+	if _, err := authenticator.Verify(req); err != ErrorAuthorizationInvalid {
+		t.Fatalf("expect invalid for uri mismatch, got %v", err)
+	}
+
+	req.Header.Set(HeaderAuthorization, NewAuthorizationResponseHeader("1001", "secret", challenge))
+	if _, err := authenticator.Verify(req); err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+}
+
+func TestFileCredentialStore_Lookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.yaml")
+	content := "- username: \"1001\"\n  realm: example.com\n  ha1: " + HA1("1001", "example.com", "secret") + "\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileCredentialStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ha1, err := store.Lookup("1001", "example.com"); err != nil || ha1 != HA1("1001", "example.com", "secret") {
+		t.Errorf("lookup failed: %s %v", ha1, err)
+	}
+	if _, err = store.Lookup("1002", "example.com"); err != ErrorCredentialNotFound {
+		t.Errorf("expect not found, got %v", err)
+	}
+}
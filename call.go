@@ -0,0 +1,408 @@
+package sip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CallEventRinging = iota + 1
+	CallEventEarlyMedia
+	CallEventAnswered
+	CallEventHold
+	CallEventResume
+	CallEventTransferProgress
+	CallEventTerminated
+)
+
+const (
+	CallCauseLocal = iota + 1
+	CallCauseRemote
+)
+
+const (
+	DirectionSendRecv = "sendrecv"
+	DirectionSendOnly = "sendonly"
+	DirectionRecvOnly = "recvonly"
+	DirectionInactive = "inactive"
+)
+
+var (
+	ErrorCallTerminated     = errors.New("call terminated")
+	ErrorCallSessionMissing = errors.New("call session description missing")
+	ErrorInvalidDTMF        = errors.New("invalid dtmf digit")
+)
+
+type (
+	//CallEvent 呼叫的事件, Terminated事件之后事件通道会被关闭
+	CallEvent struct {
+		Type       int
+		StatusCode int       //TransferProgress事件中转接目标的状态码
+		Cause      int       //Terminated事件的挂断方
+		Request    *Request  //触发事件的请求
+		Response   *Response //触发事件的响应
+	}
+
+	//Call 呼叫句柄, 呼叫接通后由Invite返回
+	Call struct {
+		client     *Client
+		invite     *Request
+		response   *Response
+		ack        *Request //最后一个2xx的ACK, 收到重传的2xx时重新发送
+		dialog     *Dialog
+		events     chan *CallEvent
+		mutex      sync.Mutex
+		sdp        []byte
+		direction  string //本地要求的媒体方向, 由Hold以及Resume修改
+		trying     bool
+		terminated bool
+	}
+)
+
+//Request 呼叫的INVITE请求
+func (c *Call) Request() *Request {
+	return c.invite
+}
+
+//Response 呼叫的2xx响应
+func (c *Call) Response() *Response {
+	return c.response
+}
+
+//Dialog 呼叫的对话
+func (c *Call) Dialog() *Dialog {
+	return c.dialog
+}
+
+//Events 呼叫的事件, 事件没有及时读取时会被丢弃
+func (c *Call) Events() <-chan *CallEvent {
+	return c.events
+}
+
+//emit 发送呼叫事件
+func (c *Call) emit(e *CallEvent) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.terminated {
+		return
+	}
+	select {
+	case c.events <- e:
+	default:
+	}
+}
+
+//progress 处理INVITE的临时响应
+func (c *Call) progress(res *Response) {
+	c.mutex.Lock()
+	c.trying = true
+	c.mutex.Unlock()
+	switch {
+	case res.StatusCode == StatusRinging:
+		c.emit(&CallEvent{Type: CallEventRinging, Response: res})
+	case res.StatusCode == StatusSessionProgress && len(res.Body) > 0:
+		c.emit(&CallEvent{Type: CallEventEarlyMedia, Response: res})
+	}
+}
+
+//proceeding 是否收到过临时响应
+func (c *Call) proceeding() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.trying
+}
+
+//terminate 结束呼叫并关闭事件通道
+func (c *Call) terminate(cause int, req *Request) {
+	c.mutex.Lock()
+	if c.terminated {
+		c.mutex.Unlock()
+		return
+	}
+	c.terminated = true
+	c.mutex.Unlock()
+	c.dialog.Terminate()
+	c.client.removeCall(c)
+	select {
+	case c.events <- &CallEvent{Type: CallEventTerminated, Cause: cause, Request: req}:
+	default:
+	}
+	close(c.events)
+}
+
+//exchange 发送对话中的请求, 使用2xx响应更新对话, 认证后重发的请求会更新对话的本地CSeq
+func (c *Call) exchange(ctx context.Context, req *Request) (last *Request, res *Response, err error) {
+	var seq int
+	req.RemoteAddr = c.invite.RemoteAddr
+	last, seq, res, err = c.client.exchange(ctx, req, c.client.account, nil)
+	c.dialog.advanceLocalSeq(seq)
+	if err != nil {
+		return
+	}
+	c.dialog.Update(res)
+	return
+}
+
+//reinvite 使用指定的媒体方向重新协商会话
+func (c *Call) reinvite(ctx context.Context, direction string) (err error) {
+	var res *Response
+	if c.dialog.State() == DialogStateTerminated {
+		return ErrorCallTerminated
+	}
+	c.mutex.Lock()
+	if len(c.sdp) == 0 {
+		c.mutex.Unlock()
+		return ErrorCallSessionMissing
+	}
+	sdp := setDirection(c.sdp, direction)
+	c.mutex.Unlock()
+	req := c.dialog.NewRequest(MethodInvite)
+	req.Header.Set(HeaderContact, c.client.contact(c.client.account))
+	req.Header.Set(HeaderContentType, NewPlainHeader("application/sdp"))
+	req.Body = sdp
+	if _, res, err = c.exchange(ctx, req); err != nil {
+		return
+	}
+	c.mutex.Lock()
+	c.sdp = sdp
+	c.direction = direction
+	c.mutex.Unlock()
+	//exchange已经使用认证后重发的INVITE的CSeq更新了对话, ACK和最后的INVITE一致
+	ack := c.dialog.NewRequest(MethodAck)
+	ack.RemoteAddr = c.invite.RemoteAddr
+	err = c.client.write(ack)
+	c.mutex.Lock()
+	c.ack = ack
+	c.mutex.Unlock()
+	if err == nil {
+		c.response = res
+	}
+	return
+}
+
+//lastAck 重传的2xx对应的ACK, CSeq不一致时返回空
+func (c *Call) lastAck(res *Response) *Request {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.ack == nil {
+		return nil
+	}
+	seq, ok := res.Header.Get(HeaderCSeq).(*SequenceHeader)
+	if !ok || seq.Method != MethodInvite {
+		return nil
+	}
+	if ackSeq, ok := c.ack.Header.Get(HeaderCSeq).(*SequenceHeader); !ok || ackSeq.Sequence != seq.Sequence {
+		return nil
+	}
+	return c.ack
+}
+
+//Hold 保持呼叫, 重新协商的会话为sendonly
+func (c *Call) Hold(ctx context.Context) (err error) {
+	return c.reinvite(ctx, DirectionSendOnly)
+}
+
+//Resume 恢复保持的呼叫, 重新协商的会话为sendrecv
+func (c *Call) Resume(ctx context.Context) (err error) {
+	return c.reinvite(ctx, DirectionSendRecv)
+}
+
+//SendDTMF 通过INFO发送DTMF
+func (c *Call) SendDTMF(ctx context.Context, digit string, duration time.Duration) (err error) {
+	if len(digit) != 1 || !strings.Contains("0123456789*#ABCD", strings.ToUpper(digit)) {
+		return ErrorInvalidDTMF
+	}
+	if c.dialog.State() == DialogStateTerminated {
+		return ErrorCallTerminated
+	}
+	req := c.dialog.NewRequest(MethodInfo)
+	req.Header.Set(HeaderContentType, NewPlainHeader("application/dtmf-relay"))
+	req.Body = []byte(fmt.Sprintf("Signal=%s\r\nDuration=%d\r\n", strings.ToUpper(digit), duration.Milliseconds()))
+	_, _, err = c.exchange(ctx, req)
+	return
+}
+
+//Transfer 通过REFER将对端转接到target, 转接的进度通过TransferProgress事件通知
+func (c *Call) Transfer(ctx context.Context, target string) (err error) {
+	var (
+		uri *Uri
+	)
+	if c.dialog.State() == DialogStateTerminated {
+		return ErrorCallTerminated
+	}
+	if uri, err = parseTarget(target); err != nil {
+		return
+	}
+	req := c.dialog.NewRequest(MethodRefer)
+	req.Header.Set(HeaderContact, c.client.contact(c.client.account))
+	req.Header.Set(HeaderReferTo, &AddressHeader{Uri: uri})
+	req.Header.Set(HeaderReferredBy, &AddressHeader{Uri: c.client.account.Uri()})
+	_, _, err = c.exchange(ctx, req)
+	return
+}
+
+//Hangup 挂断呼叫
+func (c *Call) Hangup(ctx context.Context) (err error) {
+	return c.client.Bye(ctx, c)
+}
+
+//respond 回复对话中的请求
+func (c *Call) respond(req *Request, code int) *Response {
+	res := NewResponse(code, req)
+	_ = c.client.transport.Respond(res)
+	return res
+}
+
+//receive 处理对话中收到的请求, 请求已经通过对话的校验
+func (c *Call) receive(req *Request) {
+	switch req.Method {
+	case MethodAck:
+	case MethodBye:
+		c.respond(req, StatusOK)
+		c.terminate(CallCauseRemote, req)
+	case MethodInvite:
+		c.receiveInvite(req)
+	case MethodNotify:
+		c.receiveNotify(req)
+	case MethodInfo:
+		c.respond(req, StatusOK)
+	default:
+		c.respond(req, StatusMethodNotAllowed)
+	}
+}
+
+//receiveInvite 处理对端的重新协商, 对端的保持以及恢复通过事件通知
+func (c *Call) receiveInvite(req *Request) {
+	direction := sdpDirection(req.Body)
+	res := NewResponse(StatusOK, req)
+	res.Header.Set(HeaderContact, c.client.contact(c.client.account))
+	c.mutex.Lock()
+	if len(c.sdp) > 0 {
+		//本地保持时应答需要继续保持
+		c.sdp = setDirection(c.sdp, intersectDirection(answerDirection(direction), c.direction))
+		res.Header.Set(HeaderContentType, NewPlainHeader("application/sdp"))
+		res.Body = c.sdp
+	}
+	c.mutex.Unlock()
+	_ = c.client.transport.Respond(res)
+	if direction == DirectionSendOnly || direction == DirectionInactive {
+		c.emit(&CallEvent{Type: CallEventHold, Request: req})
+	} else {
+		c.emit(&CallEvent{Type: CallEventResume, Request: req})
+	}
+}
+
+//receiveNotify 处理REFER订阅的通知, 消息体为message/sipfrag
+func (c *Call) receiveNotify(req *Request) {
+	if event := req.Header.Get(HeaderEvent); event == nil || !strings.HasPrefix(strings.ToLower(event.String()), "refer") {
+		c.respond(req, StatusBadEvent)
+		return
+	}
+	c.respond(req, StatusOK)
+	c.emit(&CallEvent{Type: CallEventTransferProgress, StatusCode: parseSipfrag(req.Body), Request: req})
+}
+
+//parseSipfrag 解析sipfrag中的状态码, 解析失败返回0
+func parseSipfrag(b []byte) int {
+	line := b
+	if pos := bytes.IndexByte(b, '\n'); pos > -1 {
+		line = b[:pos]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "SIP/") {
+		return 0
+	}
+	code, _ := strconv.Atoi(fields[1])
+	return code
+}
+
+//sdpDirection 会话描述中的媒体方向, 连接地址为0.0.0.0时视为inactive
+func sdpDirection(sdp []byte) string {
+	direction := DirectionSendRecv
+	for _, line := range strings.Split(string(sdp), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "a="+DirectionSendOnly, line == "a="+DirectionRecvOnly, line == "a="+DirectionInactive:
+			return line[2:]
+		case strings.HasPrefix(line, "c=") && strings.HasSuffix(line, " 0.0.0.0"):
+			direction = DirectionInactive
+		}
+	}
+	return direction
+}
+
+//answerDirection 应答方使用的媒体方向
+func answerDirection(offer string) string {
+	switch offer {
+	case DirectionSendOnly:
+		return DirectionRecvOnly
+	case DirectionRecvOnly:
+		return DirectionSendOnly
+	case DirectionInactive:
+		return DirectionInactive
+	}
+	return DirectionSendRecv
+}
+
+//intersectDirection 两个方向都允许的发送以及接收
+func intersectDirection(a, b string) string {
+	send := a != DirectionRecvOnly && a != DirectionInactive && b != DirectionRecvOnly && b != DirectionInactive
+	recv := a != DirectionSendOnly && a != DirectionInactive && b != DirectionSendOnly && b != DirectionInactive
+	switch {
+	case send && recv:
+		return DirectionSendRecv
+	case send:
+		return DirectionSendOnly
+	case recv:
+		return DirectionRecvOnly
+	}
+	return DirectionInactive
+}
+
+//setDirection 修改会话描述中每个媒体的方向, 并增加o=的版本号
+func setDirection(sdp []byte, direction string) []byte {
+	var (
+		media bool
+		lines = make([]string, 0)
+	)
+	for _, line := range strings.Split(string(sdp), "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "":
+			continue
+		case line == "a="+DirectionSendRecv, line == "a="+DirectionSendOnly, line == "a="+DirectionRecvOnly, line == "a="+DirectionInactive:
+			continue
+		case strings.HasPrefix(line, "o="):
+			fields := strings.Fields(line)
+			if len(fields) == 6 {
+				if version, err := strconv.ParseUint(fields[2], 10, 64); err == nil {
+					fields[2] = strconv.FormatUint(version+1, 10)
+					line = strings.Join(fields, " ")
+				}
+			}
+		case strings.HasPrefix(line, "m="):
+			if media {
+				lines = append(lines, "a="+direction)
+			}
+			media = true
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "a="+direction)
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func newCall(client *Client, sdp []byte) *Call {
+	return &Call{
+		client:    client,
+		events:    make(chan *CallEvent, 64),
+		sdp:       sdp,
+		direction: sdpDirection(sdp),
+	}
+}
@@ -0,0 +1,301 @@
+package sip
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testOffer = "v=0\r\no=1001 1 1 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\na=sendrecv\r\n"
+
+const testAnswer = "v=0\r\no=2001 1 1 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=audio 5000 RTP/AVP 0\r\n"
+
+//callServer 测试呼叫使用的用户代理服务端, 立即应答所有的呼叫
+type callServer struct {
+	t          *testing.T
+	tp         Transport
+	dialogs    *DialogStore
+	dialog     *Dialog
+	addr       net.Addr
+	answered   chan struct{}
+	directions chan string
+	infos      chan string
+	byes       chan *Request
+	challenges int32 //需要认证的重新协商的数量
+}
+
+func (s *callServer) serve() {
+	for req := range s.tp.Request() {
+		d, res := s.dialogs.Receive(req)
+		if res != nil {
+			_ = s.tp.Respond(res)
+			continue
+		}
+		if d == nil {
+			if req.Method != MethodInvite {
+				_ = s.tp.Respond(NewResponse(StatusMethodNotAllowed, req))
+				continue
+			}
+			_ = s.tp.Respond(NewResponse(StatusRinging, req))
+			res = NewResponse(StatusSessionProgress, req)
+			res.Header.Set(HeaderContentType, NewPlainHeader("application/sdp"))
+			res.Body = []byte(testAnswer)
+			_ = s.tp.Respond(res)
+			res = NewResponse(StatusOK, req)
+			res.Header.Set(HeaderContact, &AddressHeader{Uri: NewUri("2001", s.tp.LocalAddr().String(), Map{}).EnableProtocol()})
+			res.Header.Set(HeaderContentType, NewPlainHeader("application/sdp"))
+			res.Body = []byte(testAnswer)
+			dialog, err := NewDialogFromRequest(req, res)
+			if err != nil {
+				s.t.Error(err)
+				continue
+			}
+			s.dialogs.Add(dialog)
+			s.dialog, s.addr = dialog, req.RemoteAddr
+			_ = s.tp.Respond(res)
+			continue
+		}
+		switch req.Method {
+		case MethodAck:
+			select {
+			case s.answered <- struct{}{}:
+			default:
+			}
+		case MethodInfo:
+			_ = s.tp.Respond(NewResponse(StatusOK, req))
+			s.infos <- string(req.Body)
+		case MethodInvite:
+			if atomic.AddInt32(&s.challenges, -1) >= 0 {
+				_ = s.tp.Respond(NewDigestAuthenticator("example.com", NewMemoryCredentialStore()).Challenge(req, StatusProxyAuthenticationRequired, false))
+				continue
+			}
+			res = NewResponse(StatusOK, req)
+			res.Header.Set(HeaderContentType, NewPlainHeader("application/sdp"))
+			res.Body = setDirection([]byte(testAnswer), answerDirection(sdpDirection(req.Body)))
+			_ = s.tp.Respond(res)
+			s.directions <- sdpDirection(req.Body)
+		case MethodRefer:
+			_ = s.tp.Respond(NewResponse(StatusAccepted, req))
+			go func() {
+				s.notify("SIP/2.0 100 Trying\r\n", "active")
+				s.notify("SIP/2.0 200 OK\r\n", "terminated;reason=noresource")
+			}()
+		case MethodBye:
+			_ = s.tp.Respond(NewResponse(StatusOK, req))
+			s.byes <- req
+		default:
+			_ = s.tp.Respond(NewResponse(StatusOK, req))
+		}
+	}
+}
+
+//request 在对话中向客户端发送请求
+func (s *callServer) request(req *Request) (res *Response, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req.RemoteAddr = s.addr
+	err = s.tp.Do(ctx, req, func(r *Response) (bool, error) {
+		if r.StatusCode < 200 {
+			return false, nil
+		}
+		res = r
+		return true, nil
+	})
+	return
+}
+
+func (s *callServer) notify(frag string, state string) {
+	req := s.dialog.NewRequest(MethodNotify)
+	req.Header.Set(HeaderEvent, NewPlainHeader("refer"))
+	req.Header.Set(HeaderSubscriptionState, NewPlainHeader(state))
+	req.Header.Set(HeaderContentType, NewPlainHeader("message/sipfrag"))
+	req.Body = []byte(frag)
+	if _, err := s.request(req); err != nil {
+		s.t.Error(err)
+	}
+}
+
+func newTestCall(t *testing.T) (*Call, *callServer) {
+	tp := NewUDPTransport()
+	if err := tp.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	server := &callServer{
+		t:          t,
+		tp:         tp,
+		dialogs:    NewDialogStore(),
+		answered:   make(chan struct{}, 1),
+		directions: make(chan string, 1),
+		infos:      make(chan string, 1),
+		byes:       make(chan *Request, 1),
+	}
+	go server.serve()
+	t.Cleanup(func() {
+		_ = tp.Close()
+	})
+	clientTransport := NewUDPTransport()
+	if err := clientTransport.Dial(tp.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = clientTransport.Close()
+	})
+	client := NewClient(clientTransport, &Account{Username: "1001", Domain: "example.com"})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go client.Serve(ctx)
+
+	call, err := client.Invite(ctx, "sip:2001@127.0.0.1", []byte(testOffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-server.answered:
+	case <-time.After(time.Second):
+		t.Fatal("ack not received")
+	}
+	return call, server
+}
+
+func nextCallEvent(t *testing.T, call *Call) *CallEvent {
+	select {
+	case e := <-call.Events():
+		if e == nil {
+			t.Fatal("events closed")
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("call event timeout")
+	}
+	return nil
+}
+
+func TestCall_Events(t *testing.T) {
+	call, server := newTestCall(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	for _, typ := range []int{CallEventRinging, CallEventEarlyMedia, CallEventAnswered} {
+		if e := nextCallEvent(t, call); e.Type != typ {
+			t.Fatalf("unexpected event %d, expected %d", e.Type, typ)
+		}
+	}
+
+	if err := call.SendDTMF(ctx, "X", time.Millisecond*100); err != ErrorInvalidDTMF {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := call.SendDTMF(ctx, "5", time.Millisecond*160); err != nil {
+		t.Fatal(err)
+	}
+	if info := <-server.infos; info != "Signal=5\r\nDuration=160\r\n" {
+		t.Errorf("unexpected info %q", info)
+	}
+
+	//保持需要认证, 认证后重发的INVITE使用新的CSeq
+	atomic.StoreInt32(&server.challenges, 1)
+	if err := call.Hold(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if direction := <-server.directions; direction != DirectionSendOnly {
+		t.Errorf("unexpected hold direction %s", direction)
+	}
+	if local, remote := call.Dialog().LocalSeq(), server.dialog.RemoteSeq(); local != remote {
+		t.Errorf("local cseq %d not updated to %d", local, remote)
+	}
+	if err := call.SendDTMF(ctx, "1", time.Millisecond*100); err != nil {
+		t.Fatal(err)
+	}
+	<-server.infos
+
+	//本地保持时对端的重新协商不能恢复媒体
+	req := server.dialog.NewRequest(MethodInvite)
+	req.Header.Set(HeaderContentType, NewPlainHeader("application/sdp"))
+	req.Body = setDirection([]byte(testAnswer), DirectionSendRecv)
+	res, err := server.request(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if direction := sdpDirection(res.Body); direction != DirectionSendOnly {
+		t.Errorf("unexpected answer direction while held %s", direction)
+	}
+	if e := nextCallEvent(t, call); e.Type != CallEventResume {
+		t.Fatalf("unexpected event %d", e.Type)
+	}
+
+	if err := call.Resume(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if direction := <-server.directions; direction != DirectionSendRecv {
+		t.Errorf("unexpected resume direction %s", direction)
+	}
+
+	if err := call.Transfer(ctx, "sip:2002@127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{StatusTrying, StatusOK} {
+		if e := nextCallEvent(t, call); e.Type != CallEventTransferProgress || e.StatusCode != code {
+			t.Fatalf("unexpected transfer progress %d %d", e.Type, e.StatusCode)
+		}
+	}
+
+	//对端保持呼叫
+	req = server.dialog.NewRequest(MethodInvite)
+	req.Header.Set(HeaderContentType, NewPlainHeader("application/sdp"))
+	req.Body = setDirection([]byte(testAnswer), DirectionSendOnly)
+	res, err = server.request(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if direction := sdpDirection(res.Body); direction != DirectionRecvOnly {
+		t.Errorf("unexpected answer direction %s", direction)
+	}
+	if e := nextCallEvent(t, call); e.Type != CallEventHold {
+		t.Fatalf("unexpected event %d", e.Type)
+	}
+
+	if err = call.Hangup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-server.byes
+	if e := nextCallEvent(t, call); e.Type != CallEventTerminated || e.Cause != CallCauseLocal {
+		t.Fatalf("unexpected event %d cause %d", e.Type, e.Cause)
+	}
+	if _, ok := <-call.Events(); ok {
+		t.Error("events not closed")
+	}
+	if err = call.Hold(ctx); err != ErrorCallTerminated {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCall_RemoteHangup(t *testing.T) {
+	call, server := newTestCall(t)
+	res, err := server.request(server.dialog.NewRequest(MethodBye))
+	if err != nil || res.StatusCode != StatusOK {
+		t.Fatalf("bye failed: %v", err)
+	}
+	for e := range call.Events() {
+		if e.Type == CallEventTerminated {
+			if e.Cause != CallCauseRemote {
+				t.Errorf("unexpected cause %d", e.Cause)
+			}
+			return
+		}
+	}
+	t.Error("terminated event missing")
+}
+
+func Test_setDirection(t *testing.T) {
+	sdp := setDirection([]byte(testOffer+"m=video 4002 RTP/AVP 96\r\n"), DirectionInactive)
+	if bytes.Count(sdp, []byte("a=inactive")) != 2 || bytes.Contains(sdp, []byte("a=sendrecv")) {
+		t.Errorf("unexpected sdp %s", sdp)
+	}
+	if !bytes.Contains(sdp, []byte("o=1001 1 2 IN IP4")) {
+		t.Errorf("version not increased %s", sdp)
+	}
+	if code := parseSipfrag([]byte("SIP/2.0 180 Ringing\r\n")); code != StatusRinging {
+		t.Errorf("unexpected sipfrag code %d", code)
+	}
+}
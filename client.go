@@ -0,0 +1,672 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//DefaultExpires 默认的注册有效期
+	DefaultExpires = time.Hour
+
+	//maxAuthAttempts 同一个请求最多的认证次数
+	maxAuthAttempts = 3
+	//maxRedirects 最多跟随的重定向次数
+	maxRedirects = 5
+)
+
+var (
+	ErrorAuthenticationFailed = errors.New("authentication failed")
+	ErrorTooManyRedirects     = errors.New("too many redirects")
+	ErrorInvalidTarget        = errors.New("invalid target")
+
+	defaultUserAgentHead = NewPlainHeader("uole-sip")
+)
+
+type (
+	//Account sip账号
+	Account struct {
+		Username     string
+		Password     string
+		Domain       string //注册服务器的域名, 可以包含端口
+		DisplayName  string
+		AuthUsername string //认证使用的用户名, 为空时使用Username
+		Expires      time.Duration
+	}
+
+	//Client 基于传输层的sip用户代理客户端, 传输层需要连接到sip服务器,
+	//或者通过SetProxy设置出口代理
+	Client struct {
+		UserAgent     string
+		OnRequest     func(req *Request) //不属于任何呼叫的请求, 为空时回复405
+		transport     Transport
+		account       *Account
+		proxy         net.Addr
+		public        string //服务器在响应中返回的公网地址
+		locator       *Locator
+		mutex         sync.Mutex
+		dialogs       *DialogStore
+		calls         map[string]*Call
+		registrations map[string]*registration
+		nonces        map[string]*nonceCount //每个realm当前使用的nonce
+	}
+
+	//nonceCount 服务器下发的nonce以及已经使用的次数
+	nonceCount struct {
+		nonce string
+		count int
+	}
+
+	//registration 同一个账号的注册需要使用相同的Call-ID以及递增的CSeq
+	registration struct {
+		callID     string
+		tag        string
+		seq        int
+		minExpires time.Duration
+	}
+)
+
+//Uri 账号的地址
+func (a *Account) Uri() *Uri {
+	return NewUri(a.Username, a.Domain, Map{}).EnableProtocol()
+}
+
+func (a *Account) authUsername() string {
+	if a.AuthUsername != "" {
+		return a.AuthUsername
+	}
+	return a.Username
+}
+
+func (a *Account) expires() time.Duration {
+	if a.Expires > 0 {
+		return a.Expires
+	}
+	return DefaultExpires
+}
+
+//Transport 客户端使用的传输层
+func (c *Client) Transport() Transport {
+	return c.transport
+}
+
+//Account 客户端默认的账号
+func (c *Client) Account() *Account {
+	return c.account
+}
+
+//SetProxy 设置出口代理, 所有的请求都发送到该地址
+func (c *Client) SetProxy(addr net.Addr) {
+	c.proxy = addr
+}
+
+//SetLocator 设置服务器定位器, 没有出口代理时按照RFC 3263定位请求的目标
+func (c *Client) SetLocator(locator *Locator) {
+	c.locator = locator
+}
+
+//PublicAddr 服务器看到的客户端地址, 从响应Via的received以及rport获取, 还没有收到时为空
+func (c *Client) PublicAddr() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.public
+}
+
+//learn 记录响应中服务器看到的客户端地址
+func (c *Client) learn(res *Response) {
+	via, ok := res.Header.Get(HeaderVia).(*ViaHeader)
+	if !ok {
+		return
+	}
+	if addr, ok := via.PublicAddress(); ok {
+		c.mutex.Lock()
+		c.public = addr
+		c.mutex.Unlock()
+	}
+}
+
+//contact 本地的Contact地址, 已经知道公网地址时使用公网地址
+func (c *Client) contact(account *Account) *AddressHeader {
+	host := "0.0.0.0"
+	if addr := c.transport.LocalAddr(); addr != nil {
+		host = addr.String()
+	}
+	if public := c.PublicAddr(); public != "" {
+		host = public
+	}
+	uri := NewUri(account.Username, host, Map{}).EnableProtocol()
+	if protocol := c.transport.Protocol(); protocol != ProtoUDP {
+		uri.Params.Set("transport", strings.ToLower(protocol))
+	}
+	return &AddressHeader{Uri: uri}
+}
+
+//newRequest 创建对话外的请求
+func (c *Client) newRequest(method Method, target *Uri, account *Account) *Request {
+	req := NewRequest(method, "")
+	req.SetUri(target)
+	req.Header.Set(HeaderMaxForwards, NewMaxForwardHeader(70))
+	req.Header.Set(HeaderFrom, &AddressHeader{DisplayName: account.DisplayName, Uri: account.Uri(), Params: Map{"tag": NewTag()}})
+	req.Header.Set(HeaderTo, &AddressHeader{Uri: target.Clone(), Params: Map{}})
+	req.Header.Set(HeaderCallID, NewPlainHeader(NewTag()))
+	req.Header.Set(HeaderCSeq, NewSequenceHeader(method, 1))
+	req.Header.Set(HeaderContact, c.contact(account))
+	return req
+}
+
+//prepare 设置请求的User-Agent以及发送地址
+func (c *Client) prepare(req *Request) {
+	if !req.Header.Has(HeaderUserAgent) {
+		if c.UserAgent != "" {
+			req.Header.Set(HeaderUserAgent, NewPlainHeader(c.UserAgent))
+		} else {
+			req.Header.Set(HeaderUserAgent, defaultUserAgentHead)
+		}
+	}
+	if req.RemoteAddr == nil && c.proxy != nil {
+		req.RemoteAddr = c.proxy
+	}
+}
+
+//write 不通过事物直接发送请求, 用于2xx的ACK
+func (c *Client) write(req *Request) (err error) {
+	c.prepare(req)
+	prepareVia(c.transport, req)
+	if req.RemoteAddr != nil {
+		_, err = c.transport.WriteTo(req.Bytes(), req.RemoteAddr)
+	} else {
+		_, err = c.transport.Write(req.Bytes())
+	}
+	return
+}
+
+//exchange 发送请求并等待最终响应, 自动处理认证以及重定向, 返回最后发送的请求以及它的CSeq,
+//认证以及重定向会增加CSeq, 调用方需要使用返回的seq更新本地的CSeq
+func (c *Client) exchange(ctx context.Context, req *Request, account *Account, provisional func(res *Response)) (last *Request, seq int, res *Response, err error) {
+	var (
+		auths     int
+		redirects int
+	)
+	last = req
+	for {
+		if cseq, ok := last.Header.Get(HeaderCSeq).(*SequenceHeader); ok {
+			seq = cseq.Sequence
+		}
+		c.prepare(last)
+		if res, err = c.send(ctx, last, provisional); err != nil {
+			return
+		}
+		switch {
+		case res.StatusCode < 300:
+			return
+		case res.StatusCode == StatusUnauthorized || res.StatusCode == StatusProxyAuthenticationRequired:
+			if auths++; auths > maxAuthAttempts || account == nil {
+				err = ErrorAuthenticationFailed
+				return
+			}
+			if last, err = c.authorize(last, res, account); err != nil {
+				return
+			}
+		case res.StatusCode < 400 && last.Method != MethodRegister:
+			contact, ok := res.Header.Get(HeaderContact).(*AddressHeader)
+			if !ok {
+				err = newSipError(res.StatusCode, res.Status)
+				return
+			}
+			if redirects++; redirects > maxRedirects {
+				err = ErrorTooManyRedirects
+				return
+			}
+			last = nextRequest(last)
+			last.SetUri(contact.Uri)
+			last.RemoteAddr = c.proxy
+		default:
+			err = newSipError(res.StatusCode, res.Status)
+			return
+		}
+	}
+}
+
+//do 通过事物发送请求并等待最终响应
+func (c *Client) do(ctx context.Context, req *Request, provisional func(res *Response)) (res *Response, err error) {
+	var answered int32
+	err = c.transport.Do(ctx, req, func(r *Response) (bool, error) {
+		if r.StatusCode < 200 {
+			if provisional != nil {
+				provisional(r)
+			}
+			return false, nil
+		}
+		//事物返回后收到的是重传的2xx
+		if !atomic.CompareAndSwapInt32(&answered, 0, 1) {
+			c.acknowledge(r)
+			return true, nil
+		}
+		res = r
+		return true, nil
+	})
+	if err == nil && res == nil {
+		err = ErrorTransactionTimeout
+	}
+	if res != nil {
+		c.learn(res)
+	}
+	return
+}
+
+//send 发送请求, 设置了定位器并且请求没有指定地址时, 依次尝试定位到的服务器地址
+func (c *Client) send(ctx context.Context, req *Request, provisional func(res *Response)) (res *Response, err error) {
+	var (
+		attempts int
+		targets  []*Target
+	)
+	if c.locator == nil || req.RemoteAddr != nil {
+		return c.do(ctx, req, provisional)
+	}
+	if targets, err = c.locate(ctx, req); err != nil {
+		return
+	}
+	return Failover(ctx, targets, func(target *Target) (res *Response, err error) {
+		if req.RemoteAddr, err = targetAddr(target); err != nil {
+			return
+		}
+		//每个地址使用新的事物
+		if attempts++; attempts > 1 {
+			if via, ok := req.Header.Get(HeaderVia).(*ViaHeader); ok {
+				via.Uri.Params.Set("branch", NewBranch())
+			}
+		}
+		return c.do(ctx, req, provisional)
+	})
+}
+
+//locate 定位请求的下一跳, 有Route时使用第一个路由, 只保留客户端传输协议的地址
+func (c *Client) locate(ctx context.Context, req *Request) (targets []*Target, err error) {
+	var located []*Target
+	uri := req.Uri()
+	if route, ok := req.Header.Get(HeaderRoute).(*RouteHeader); ok && len(route.Values) > 0 {
+		uri = route.Values[0].Uri
+	}
+	if located, err = c.locator.Locate(ctx, uri); err != nil {
+		return
+	}
+	for _, target := range located {
+		if target.Protocol == c.transport.Protocol() {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		err = ErrorNoTarget
+	}
+	return
+}
+
+//authorize 根据401或者407响应创建带认证信息的请求
+func (c *Client) authorize(req *Request, res *Response, account *Account) (next *Request, err error) {
+	var (
+		ok        bool
+		name      string
+		challenge *AuthorizationHeader
+	)
+	if res.StatusCode == StatusProxyAuthenticationRequired {
+		challenge, ok = res.Header.Get(HeaderProxyAuthenticate).(*AuthorizationHeader)
+		name = HeaderProxyAuthorization
+	} else {
+		challenge, ok = res.Header.Get(HeaderWWWAuthenticate).(*AuthorizationHeader)
+		name = HeaderAuthorization
+	}
+	if !ok || !strings.EqualFold(challenge.Method, "Digest") {
+		err = ErrorAuthenticationFailed
+		return
+	}
+	//使用相同的nonce仍然被拒绝, 说明密码错误
+	if head, ok := req.Header.Get(name).(*AuthorizationHeader); ok && head.Nonce == challenge.Nonce && !challenge.Stale {
+		err = ErrorAuthenticationFailed
+		return
+	}
+	//每个realm只保留当前的nonce, 新的挑战或者stale时替换
+	c.mutex.Lock()
+	current, ok := c.nonces[challenge.Realm]
+	if !ok || current.nonce != challenge.Nonce || challenge.Stale {
+		current = &nonceCount{nonce: challenge.Nonce}
+		c.nonces[challenge.Realm] = current
+	}
+	current.count++
+	nc := current.count
+	c.mutex.Unlock()
+	next = nextRequest(req)
+	next.Header.Set(name, NewDigestAuthorization(challenge, req.Method, req.Uri(), account.authUsername(), account.Password, nc))
+	return
+}
+
+//Register 注册账号, account为空时使用客户端默认的账号, 返回服务器允许的有效期.
+//服务器回复423时使用Min-Expires重新注册, 之后的注册都会使用该有效期
+func (c *Client) Register(ctx context.Context, account *Account) (expires time.Duration, err error) {
+	var (
+		seq int
+		req *Request
+		res *Response
+	)
+	if account == nil {
+		account = c.account
+	}
+	for retried := false; ; retried = true {
+		req, expires = c.newRegister(account, account.expires())
+		_, seq, res, err = c.exchange(ctx, req, account, nil)
+		c.advanceRegister(account, seq)
+		if err == nil {
+			break
+		}
+		if retried || res == nil || res.StatusCode != StatusIntervalTooBrief || !res.Header.Has(HeaderMinExpires) {
+			return
+		}
+		n, convErr := strconv.Atoi(res.Header.Get(HeaderMinExpires).String())
+		if convErr != nil {
+			return
+		}
+		c.mutex.Lock()
+		c.registrations[account.Uri().String()].minExpires = time.Duration(n) * time.Second
+		c.mutex.Unlock()
+	}
+	if contact := registeredContact(req, res); contact != nil && contact.Params.Get("expires") != "" {
+		if n, err := strconv.Atoi(contact.Params.Get("expires")); err == nil {
+			expires = time.Duration(n) * time.Second
+		}
+	} else if res.Header.Has(HeaderExpires) {
+		if n, err := strconv.Atoi(res.Header.Get(HeaderExpires).String()); err == nil {
+			expires = time.Duration(n) * time.Second
+		}
+	}
+	return
+}
+
+//registeredContact 在注册的响应中查找本次注册的Contact, 响应会列出该AOR的所有绑定
+func registeredContact(req *Request, res *Response) *AddressHeader {
+	own, ok := req.Header.Get(HeaderContact).(*AddressHeader)
+	if !ok {
+		return nil
+	}
+	contact, _ := res.Header.Get(HeaderContact).(*AddressHeader)
+	for ; contact != nil; contact = contact.Next() {
+		if matchUri(contact.Uri, own.Uri) {
+			return contact
+		}
+	}
+	return nil
+}
+
+//advanceRegister 认证后重发的注册使用了新的CSeq, 之后的注册需要在此基础上增加
+func (c *Client) advanceRegister(account *Account, seq int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if reg, ok := c.registrations[account.Uri().String()]; ok && seq > reg.seq {
+		reg.seq = seq
+	}
+}
+
+//Unregister 注销账号在当前客户端的绑定, 其他设备的绑定不受影响
+func (c *Client) Unregister(ctx context.Context, account *Account) (err error) {
+	return c.unregister(ctx, account, false)
+}
+
+//UnregisterAll 使用Contact: *注销账号的所有绑定, 包括其他设备的绑定
+func (c *Client) UnregisterAll(ctx context.Context, account *Account) (err error) {
+	return c.unregister(ctx, account, true)
+}
+
+//unregister 发送有效期为0的注册, all为false时只注销自己的Contact
+func (c *Client) unregister(ctx context.Context, account *Account, all bool) (err error) {
+	if account == nil {
+		account = c.account
+	}
+	var seq int
+	req, _ := c.newRegister(account, 0)
+	if all {
+		req.Header.Set(HeaderContact, NewPlainHeader("*"))
+	} else if contact, ok := req.Header.Get(HeaderContact).(*AddressHeader); ok {
+		contact.Params.Set("expires", "0")
+	}
+	_, seq, _, err = c.exchange(ctx, req, account, nil)
+	c.advanceRegister(account, seq)
+	return
+}
+
+//newRegister 创建注册请求, 同一个账号使用相同的Call-ID, 返回请求的有效期
+func (c *Client) newRegister(account *Account, expires time.Duration) (req *Request, requested time.Duration) {
+	aor := account.Uri()
+	c.mutex.Lock()
+	reg, ok := c.registrations[aor.String()]
+	if !ok {
+		reg = &registration{callID: NewTag(), tag: NewTag()}
+		c.registrations[aor.String()] = reg
+	}
+	reg.seq++
+	seq := reg.seq
+	if expires > 0 && expires < reg.minExpires {
+		expires = reg.minExpires
+	}
+	c.mutex.Unlock()
+	req = c.newRequest(MethodRegister, NewUri("", account.Domain, Map{}).EnableProtocol(), account)
+	req.Header.Set(HeaderFrom, &AddressHeader{DisplayName: account.DisplayName, Uri: aor, Params: Map{"tag": reg.tag}})
+	req.Header.Set(HeaderTo, &AddressHeader{DisplayName: account.DisplayName, Uri: aor.Clone(), Params: Map{}})
+	req.Header.Set(HeaderCallID, NewPlainHeader(reg.callID))
+	req.Header.Set(HeaderCSeq, NewSequenceHeader(MethodRegister, seq))
+	req.Header.Set(HeaderExpires, NewPlainHeader(int(expires.Seconds())))
+	requested = expires
+	return
+}
+
+//Invite 发起呼叫, 等待呼叫接通后返回, 振铃以及早期媒体通过呼叫的事件通知.
+//ctx结束时如果已经收到临时响应会发送CANCEL
+func (c *Client) Invite(ctx context.Context, target string, sdp []byte) (call *Call, err error) {
+	var (
+		uri *Uri
+		req *Request
+		res *Response
+	)
+	if uri, err = parseTarget(target); err != nil {
+		return
+	}
+	req = c.newRequest(MethodInvite, uri, c.account)
+	if len(sdp) > 0 {
+		req.Header.Set(HeaderContentType, NewPlainHeader("application/sdp"))
+		req.Body = sdp
+	}
+	call = newCall(c, sdp)
+	req, _, res, err = c.exchange(ctx, req, c.account, call.progress)
+	if err != nil {
+		if ctx.Err() != nil && call.proceeding() {
+			cancelCtx, cancelFunc := context.WithTimeout(context.Background(), T1*64)
+			_ = c.Cancel(cancelCtx, req)
+			cancelFunc()
+		}
+		call = nil
+		return
+	}
+	if call.dialog, err = NewDialogFromResponse(req, res); err != nil {
+		call = nil
+		return
+	}
+	call.invite, call.response = req, res
+	c.addCall(call)
+	ack := call.dialog.NewRequest(MethodAck)
+	ack.RemoteAddr = req.RemoteAddr
+	err = c.write(ack)
+	call.mutex.Lock()
+	call.ack = ack
+	call.mutex.Unlock()
+	call.emit(&CallEvent{Type: CallEventAnswered, Response: res})
+	return
+}
+
+//Cancel 取消一个还没有收到最终响应的INVITE请求
+func (c *Client) Cancel(ctx context.Context, invite *Request) (err error) {
+	req := NewRequest(MethodCancel, "")
+	req.SetUri(invite.Uri())
+	req.RemoteAddr = invite.RemoteAddr
+	if via, ok := invite.Header.Get(HeaderVia).(*ViaHeader); ok {
+		req.Header.Set(HeaderVia, via.Clone().(*ViaHeader).SetNext(nil))
+	}
+	req.Header.Set(HeaderMaxForwards, NewMaxForwardHeader(70))
+	for _, name := range []string{HeaderFrom, HeaderTo, HeaderCallID, HeaderRoute} {
+		if invite.Header.Has(name) {
+			req.Header.Set(name, invite.Header.Get(name).Clone())
+		}
+	}
+	if seq, ok := invite.Header.Get(HeaderCSeq).(*SequenceHeader); ok {
+		req.Header.Set(HeaderCSeq, NewSequenceHeader(MethodCancel, seq.Sequence))
+	}
+	_, _, _, err = c.exchange(ctx, req, nil, nil)
+	return
+}
+
+//Bye 挂断呼叫
+func (c *Client) Bye(ctx context.Context, call *Call) (err error) {
+	req := call.dialog.NewRequest(MethodBye)
+	_, _, err = call.exchange(ctx, req)
+	call.terminate(CallCauseLocal, nil)
+	return
+}
+
+//Serve 处理对话中收到的请求, 不属于任何呼叫的请求交给OnRequest处理
+func (c *Client) Serve(ctx context.Context) (err error) {
+	for {
+		select {
+		case req, ok := <-c.transport.Request():
+			if !ok {
+				return ErrorTransportClosed
+			}
+			c.handle(req)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//handle 将对话中的请求交给对应的呼叫
+func (c *Client) handle(req *Request) {
+	d, res := c.dialogs.Receive(req)
+	if res != nil {
+		_ = c.transport.Respond(res)
+		return
+	}
+	if d != nil {
+		c.mutex.Lock()
+		call, ok := c.calls[d.ID()]
+		c.mutex.Unlock()
+		if ok {
+			call.receive(req)
+			return
+		}
+	}
+	if c.OnRequest != nil {
+		c.OnRequest(req)
+	} else if req.Method != MethodAck {
+		_ = c.transport.Respond(NewResponse(StatusMethodNotAllowed, req))
+	}
+}
+
+func (c *Client) addCall(call *Call) {
+	c.dialogs.Add(call.dialog)
+	c.mutex.Lock()
+	c.calls[call.dialog.ID()] = call
+	c.mutex.Unlock()
+}
+
+func (c *Client) removeCall(call *Call) {
+	c.dialogs.Remove(call.dialog)
+	c.mutex.Lock()
+	delete(c.calls, call.dialog.ID())
+	c.mutex.Unlock()
+}
+
+//acknowledge 收到重传的2xx时重新发送对应呼叫的ACK
+func (c *Client) acknowledge(res *Response) {
+	var (
+		err       error
+		localTag  string
+		remoteTag string
+	)
+	if localTag, err = headerTag(res.Header, HeaderFrom); err != nil {
+		return
+	}
+	if remoteTag, err = headerTag(res.Header, HeaderTo); err != nil {
+		return
+	}
+	c.mutex.Lock()
+	call, ok := c.calls[dialogID(res.CallID(), localTag, remoteTag)]
+	c.mutex.Unlock()
+	if !ok {
+		return
+	}
+	if ack := call.lastAck(res); ack != nil {
+		_ = c.write(ack)
+	}
+}
+
+//Options 查询对端的能力
+func (c *Client) Options(ctx context.Context, target string) (res *Response, err error) {
+	var uri *Uri
+	if uri, err = parseTarget(target); err != nil {
+		return
+	}
+	req := c.newRequest(MethodOptions, uri, c.account)
+	_, _, res, err = c.exchange(ctx, req, c.account, nil)
+	return
+}
+
+//Message 发送即时消息
+func (c *Client) Message(ctx context.Context, target string, contentType string, body []byte) (res *Response, err error) {
+	var uri *Uri
+	if uri, err = parseTarget(target); err != nil {
+		return
+	}
+	req := c.newRequest(MethodMessage, uri, c.account)
+	req.Header.Set(HeaderContentType, NewPlainHeader(contentType))
+	req.Body = body
+	_, _, res, err = c.exchange(ctx, req, c.account, nil)
+	return
+}
+
+//NewClient 创建客户端, account为客户端默认的账号
+func NewClient(tp Transport, account *Account) *Client {
+	return &Client{
+		transport:     tp,
+		account:       account,
+		dialogs:       NewDialogStore(),
+		calls:         make(map[string]*Call),
+		registrations: make(map[string]*registration),
+		nonces:        make(map[string]*nonceCount),
+	}
+}
+
+//nextRequest 复制请求用于重新发送, 使用新的branch并且增加CSeq
+func nextRequest(req *Request) *Request {
+	next := req.Clone()
+	if via, ok := next.Header.Get(HeaderVia).(*ViaHeader); ok {
+		via.Uri.Params.Set("branch", NewBranch())
+	}
+	if seq, ok := next.Header.Get(HeaderCSeq).(*SequenceHeader); ok {
+		seq.Sequence++
+	}
+	return next
+}
+
+//parseTarget 解析呼叫的目标, 可以省略sip:前缀
+func parseTarget(target string) (uri *Uri, err error) {
+	if uri, err = parseUri(target); err != nil {
+		return
+	}
+	if uri.Host == "" {
+		err = ErrorInvalidTarget
+		return
+	}
+	uri.HasProtocol = true
+	return
+}
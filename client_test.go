@@ -0,0 +1,269 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+//testServer 用于测试客户端的用户代理服务端
+type testServer struct {
+	t             *testing.T
+	tp            Transport
+	authenticator *DigestAuthenticator
+	dialogs       *DialogStore
+	acks          chan *Request
+	answers       chan *Response
+	registers     chan *Request
+	cancels       chan *Request
+	pending       map[string]*Request
+}
+
+func (s *testServer) respond(req *Request, code int) *Response {
+	res := NewResponse(code, req)
+	if err := s.tp.Respond(res); err != nil {
+		s.t.Error(err)
+	}
+	return res
+}
+
+func (s *testServer) serve() {
+	for req := range s.tp.Request() {
+		if d, res := s.dialogs.Receive(req); res != nil {
+			_ = s.tp.Respond(res)
+			continue
+		} else if d != nil {
+			switch req.Method {
+			case MethodAck:
+				s.acks <- req
+			default:
+				s.respond(req, StatusOK)
+			}
+			continue
+		}
+		to := req.Header.Get(HeaderTo).(*AddressHeader)
+		switch req.Method {
+		case MethodRegister:
+			if _, err := s.authenticator.Verify(req); err != nil {
+				_ = s.tp.Respond(s.authenticator.Challenge(req, StatusUnauthorized, err == ErrorAuthorizationStale))
+				continue
+			}
+			//响应列出该AOR的所有绑定, 其他设备的绑定在前面
+			res := NewResponse(StatusOK, req)
+			contact := req.Header.Get(HeaderContact).(*AddressHeader).Clone().(*AddressHeader)
+			contact.Params = Map{"expires": "60"}
+			other := &AddressHeader{Uri: NewUri("1001", "192.0.2.1:5060", Map{}).EnableProtocol(), Params: Map{"expires": "3600"}}
+			other.append(contact)
+			res.Header.Set(HeaderContact, other)
+			res.Header.Set(HeaderExpires, NewPlainHeader(3600))
+			_ = s.tp.Respond(res)
+			select {
+			case s.registers <- req:
+			default:
+			}
+		case MethodInvite:
+			switch req.Username {
+			case "redirect":
+				res := NewResponse(StatusMovedTemporarily, req)
+				res.Header.Set(HeaderContact, &AddressHeader{Uri: NewUri("1002", "127.0.0.1", Map{}).EnableProtocol()})
+				_ = s.tp.Respond(res)
+			case "1002":
+				if _, err := s.authenticator.Verify(req); err != nil {
+					_ = s.tp.Respond(s.authenticator.Challenge(req, StatusProxyAuthenticationRequired, false))
+					continue
+				}
+				s.respond(req, StatusRinging)
+				res := NewResponse(StatusOK, req)
+				res.Header.Set(HeaderContact, &AddressHeader{Uri: NewUri("1002", s.tp.LocalAddr().String(), Map{}).EnableProtocol()})
+				d, err := NewDialogFromRequest(req, res)
+				if err != nil {
+					s.t.Error(err)
+					continue
+				}
+				s.dialogs.Add(d)
+				_ = s.tp.Respond(res)
+				select {
+				case s.answers <- res:
+				default:
+				}
+			default:
+				//等待客户端取消
+				s.respond(req, StatusRinging)
+				s.pending[req.CallID()] = req
+			}
+		case MethodCancel:
+			s.respond(req, StatusOK)
+			if invite, ok := s.pending[req.CallID()]; ok {
+				s.respond(invite, StatusRequestTerminated)
+			}
+			s.cancels <- req
+		case MethodMessage:
+			if string(req.Body) != "hello" || to.Uri.User != "1003" {
+				s.respond(req, StatusBadRequest)
+				continue
+			}
+			s.respond(req, StatusOK)
+		default:
+			s.respond(req, StatusOK)
+		}
+	}
+}
+
+func newTestClient(t *testing.T) (*Client, *testServer) {
+	tp := NewUDPTransport()
+	if err := tp.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryCredentialStore()
+	store.Add("1001", "example.com", "secret")
+	server := &testServer{
+		t:             t,
+		tp:            tp,
+		authenticator: NewDigestAuthenticator("example.com", store),
+		dialogs:       NewDialogStore(),
+		acks:          make(chan *Request, 1),
+		answers:       make(chan *Response, 1),
+		registers:     make(chan *Request, 1),
+		cancels:       make(chan *Request, 1),
+		pending:       make(map[string]*Request),
+	}
+	go server.serve()
+	t.Cleanup(func() {
+		_ = tp.Close()
+	})
+	clientTransport := NewUDPTransport()
+	if err := clientTransport.Dial(tp.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = clientTransport.Close()
+	})
+	return NewClient(clientTransport, &Account{Username: "1001", Password: "secret", Domain: "example.com"}), server
+}
+
+func TestClient_Register(t *testing.T) {
+	client, server := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	expires, err := client.Register(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires != time.Minute {
+		t.Errorf("unexpected expires %s", expires)
+	}
+	//认证后重发的注册使用了新的CSeq, 下一次注册以及它的认证重发需要继续增加
+	seq := (<-server.registers).Header.Get(HeaderCSeq).(*SequenceHeader).Sequence
+	if _, err = client.Register(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if next := (<-server.registers).Header.Get(HeaderCSeq).(*SequenceHeader).Sequence; next != seq+2 {
+		t.Errorf("unexpected cseq %d after %d", next, seq)
+	}
+	_, err = client.Register(ctx, &Account{Username: "1001", Password: "wrong", Domain: "example.com"})
+	if !errors.Is(err, ErrorAuthenticationFailed) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestClient_Invite(t *testing.T) {
+	client, server := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	//302重定向到1002, 1002需要代理认证
+	call, err := client.Invite(ctx, "sip:redirect@127.0.0.1", []byte("v=0\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call.Request().Username != "1002" || call.Dialog().State() != DialogStateConfirmed {
+		t.Fatalf("unexpected call %s", call.Request().Uri().String())
+	}
+	select {
+	case ack := <-server.acks:
+		if seq := ack.Header.Get(HeaderCSeq).(*SequenceHeader); seq.Sequence != call.Dialog().LocalSeq() {
+			t.Errorf("unexpected ack cseq %d", seq.Sequence)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ack not received")
+	}
+	//重传的2xx需要重新发送ACK
+	res := <-server.answers
+	if _, err = server.tp.WriteTo(res.Bytes(), client.transport.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-server.acks:
+	case <-time.After(time.Second):
+		t.Fatal("ack not retransmitted")
+	}
+	if err = call.Hangup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = call.Hangup(ctx); err == nil {
+		t.Error("bye on terminated dialog accepted")
+	}
+}
+
+func TestClient_Cancel(t *testing.T) {
+	client, server := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+	if _, err := client.Invite(ctx, "sip:1009@127.0.0.1", nil); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+	select {
+	case <-server.cancels:
+	case <-time.After(time.Second):
+		t.Fatal("cancel not received")
+	}
+}
+
+func TestClient_OptionsMessage(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if res, err := client.Options(ctx, "127.0.0.1"); err != nil || res.StatusCode != StatusOK {
+		t.Fatalf("options failed: %v", err)
+	}
+	//服务端通过rport返回客户端的来源地址
+	if public := client.PublicAddr(); public != client.Transport().LocalAddr().String() {
+		t.Errorf("unexpected public address %s", public)
+	}
+	if _, err := client.Message(ctx, "sip:1003@127.0.0.1", "text/plain", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	var sipErr *SipError
+	if _, err := client.Message(ctx, "sip:1004@127.0.0.1", "text/plain", []byte("hello")); !errors.As(err, &sipErr) || sipErr.Code != StatusBadRequest {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestClient_authorizeNonces(t *testing.T) {
+	account := &Account{Username: "1001", Password: "secret", Domain: "example.com"}
+	client := NewClient(NewUDPTransport(), account)
+	req := client.newRequest(MethodRegister, account.Uri(), account)
+	req.Header.Set(HeaderCSeq, NewSequenceHeader(MethodRegister, 1))
+	challenge := func(nonce string, stale bool) (nc string) {
+		res := NewResponse(StatusUnauthorized, req)
+		res.Header.Set(HeaderWWWAuthenticate, &AuthorizationHeader{Method: "Digest", Realm: "example.com", Nonce: nonce, QOP: "auth", Algorithm: "MD5", Stale: stale})
+		next, err := client.authorize(req, res, account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return next.Header.Get(HeaderAuthorization).(*AuthorizationHeader).NC
+	}
+	//同一个nonce的计数递增, 新的nonce替换旧的nonce
+	for i, nonce := range []string{"a", "a", "b", "c", "c"} {
+		nc := challenge(nonce, false)
+		if expected := []string{"00000001", "00000002", "00000001", "00000001", "00000002"}[i]; nc != expected {
+			t.Errorf("%d: unexpected nc %s", i, nc)
+		}
+	}
+	if nc := challenge("c", true); nc != "00000001" {
+		t.Errorf("unexpected nc %s after stale", nc)
+	}
+	if len(client.nonces) != 1 {
+		t.Errorf("unexpected nonces %d", len(client.nonces))
+	}
+}
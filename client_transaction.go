@@ -0,0 +1,270 @@
+package sip
+
+import (
+	"sync"
+	"time"
+)
+
+//ClientTransaction RFC 3261 17.1 客户端事物
+type ClientTransaction struct {
+	key             string
+	request         *Request
+	payload         []byte
+	ack             []byte
+	invite          bool
+	reliable        bool
+	clock           Clock
+	send            func(p []byte) error
+	state           int
+	interval        time.Duration
+	retransmitTimer Timer //Timer A or E
+	timeoutTimer    Timer //Timer B or F
+	waitTimer       Timer //Timer D, K or M
+	responses       chan *Response
+	done            chan struct{}
+	err             error
+	mutex           sync.Mutex
+	logger          Logger
+	onTerminated    func(t *ClientTransaction)
+}
+
+//Key 事物的key
+func (t *ClientTransaction) Key() string {
+	return t.key
+}
+
+//Request 事物的请求
+func (t *ClientTransaction) Request() *Request {
+	return t.request
+}
+
+//State 事物的状态
+func (t *ClientTransaction) State() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.state
+}
+
+//Responses 事物收到的响应, 除了INVITE的2xx以外重传的响应不会重复投递
+func (t *ClientTransaction) Responses() <-chan *Response {
+	return t.responses
+}
+
+//Done 事物结束后关闭
+func (t *ClientTransaction) Done() <-chan struct{} {
+	return t.done
+}
+
+//Err 事物结束的原因, 正常结束返回nil
+func (t *ClientTransaction) Err() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.err
+}
+
+//start 发送请求并开启定时器
+func (t *ClientTransaction) start() (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.invite {
+		t.state = TransactionStateCalling
+	} else {
+		t.state = TransactionStateTrying
+	}
+	if err = t.send(t.payload); err != nil {
+		return
+	}
+	if !t.reliable {
+		t.interval = T1
+		t.retransmitTimer = t.clock.AfterFunc(t.interval, t.retransmit)
+	}
+	t.timeoutTimer = t.clock.AfterFunc(T1*64, t.timeout)
+	return
+}
+
+//retransmit Timer A和Timer E触发时重传请求
+func (t *ClientTransaction) retransmit() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.invite {
+		if t.state != TransactionStateCalling {
+			return
+		}
+		t.interval *= 2
+	} else {
+		switch t.state {
+		case TransactionStateTrying:
+			if t.interval *= 2; t.interval > T2 {
+				t.interval = T2
+			}
+		case TransactionStateProceeding:
+			t.interval = T2
+		default:
+			return
+		}
+	}
+	_ = t.send(t.payload)
+	t.retransmitTimer = t.clock.AfterFunc(t.interval, t.retransmit)
+}
+
+//timeout Timer B和Timer F触发时事物超时
+func (t *ClientTransaction) timeout() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch t.state {
+	case TransactionStateCalling, TransactionStateTrying:
+	case TransactionStateProceeding:
+		//INVITE收到临时响应后不再超时
+		if t.invite {
+			return
+		}
+	default:
+		return
+	}
+	t.terminate(ErrorTransactionTimeout)
+}
+
+//receive 处理收到的响应
+func (t *ClientTransaction) receive(res *Response) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch t.state {
+	case TransactionStateCalling, TransactionStateTrying, TransactionStateProceeding:
+		if res.StatusCode < 200 {
+			t.state = TransactionStateProceeding
+			if t.invite {
+				t.stopTimer(t.retransmitTimer)
+			}
+			t.deliver(res)
+			return
+		}
+		t.stopTimer(t.retransmitTimer)
+		t.stopTimer(t.timeoutTimer)
+		t.deliver(res)
+		if t.invite {
+			if res.StatusCode < 300 {
+				//2xx由TU发送ACK, 重传的2xx继续交给TU(RFC 6026 Timer M)
+				t.state = TransactionStateAccepted
+				t.waitTimer = t.clock.AfterFunc(T1*64, t.expire)
+				return
+			}
+			t.state = TransactionStateCompleted
+			t.ack = newAckRequest(t.request, res).Bytes()
+			_ = t.send(t.ack)
+			t.wait(T1 * 64)
+		} else {
+			t.state = TransactionStateCompleted
+			t.wait(T4)
+		}
+	case TransactionStateCompleted:
+		//重传的最终响应, INVITE需要重新发送ACK
+		if t.invite && res.StatusCode >= 300 {
+			_ = t.send(t.ack)
+		}
+	case TransactionStateAccepted:
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			t.deliver(res)
+		}
+	}
+}
+
+//wait Timer D和Timer K, 可靠传输时立即结束
+func (t *ClientTransaction) wait(d time.Duration) {
+	if t.reliable {
+		t.terminate(nil)
+		return
+	}
+	t.waitTimer = t.clock.AfterFunc(d, t.expire)
+}
+
+//expire 等待重传的定时器到期后结束事物
+func (t *ClientTransaction) expire() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.terminate(nil)
+}
+
+//cancel 提前结束事物
+func (t *ClientTransaction) cancel(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.terminate(err)
+}
+
+func (t *ClientTransaction) deliver(res *Response) {
+	select {
+	case t.responses <- res:
+	default:
+		t.logger.Warn("transaction response dropped", FieldCallID, res.CallID(), "key", t.key, "status", res.StatusCode)
+	}
+}
+
+func (t *ClientTransaction) stopTimer(timer Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+//terminate 结束事物, 调用前需要持有锁
+func (t *ClientTransaction) terminate(err error) {
+	if t.state == TransactionStateTerminated {
+		return
+	}
+	t.state = TransactionStateTerminated
+	t.err = err
+	t.stopTimer(t.retransmitTimer)
+	t.stopTimer(t.timeoutTimer)
+	t.stopTimer(t.waitTimer)
+	close(t.done)
+	if t.onTerminated != nil {
+		go t.onTerminated(t)
+	}
+}
+
+//newAckRequest 为非2xx的最终响应创建ACK, 使用和INVITE相同的branch
+func newAckRequest(req *Request, res *Response) *Request {
+	ack := NewRequest(MethodAck, req.Address)
+	ack.Username = req.Username
+	ack.Proto = req.Proto
+	ack.RemoteAddr = req.RemoteAddr
+	if req.Params != nil {
+		ack.Params = req.Params.Clone()
+	}
+	if via, ok := req.Header.Get(HeaderVia).(*ViaHeader); ok {
+		ack.Header.Set(HeaderVia, via.Clone().(*ViaHeader).SetNext(nil))
+	}
+	ack.Header.Set(HeaderMaxForwards, NewMaxForwardHeader(70))
+	for _, name := range []string{HeaderFrom, HeaderCallID, HeaderRoute} {
+		if req.Header.Has(name) {
+			ack.Header.Set(name, req.Header.Get(name).Clone())
+		}
+	}
+	if res.Header.Has(HeaderTo) {
+		ack.Header.Set(HeaderTo, res.Header.Get(HeaderTo).Clone())
+	}
+	if seq, ok := req.Header.Get(HeaderCSeq).(*SequenceHeader); ok {
+		ack.Header.Set(HeaderCSeq, NewSequenceHeader(MethodAck, seq.Sequence))
+	}
+	return ack
+}
+
+//newClientTransaction 创建客户端事物
+func newClientTransaction(req *Request, reliable bool, clock Clock, send func(p []byte) error) (t *ClientTransaction, err error) {
+	var key string
+	if key, err = transactionKey(req.Header, req.Method); err != nil {
+		return
+	}
+	t = &ClientTransaction{
+		key:       key,
+		request:   req,
+		payload:   req.Bytes(),
+		invite:    req.Method == MethodInvite,
+		reliable:  reliable,
+		clock:     clock,
+		send:      send,
+		responses: make(chan *Response, 16),
+		done:      make(chan struct{}),
+		logger:    nopLogger{},
+	}
+	return
+}
@@ -0,0 +1,332 @@
+package sip
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	//fakeClock 手动推进的时钟
+	fakeClock struct {
+		mutex  sync.Mutex
+		now    time.Time
+		timers []*fakeTimer
+	}
+
+	fakeTimer struct {
+		clock   *fakeClock
+		when    time.Time
+		fun     func()
+		stopped bool
+	}
+)
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	stopped := t.stopped
+	t.stopped = true
+	return !stopped
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := &fakeTimer{clock: c, when: c.now.Add(d), fun: f}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+//Advance 推进时钟并按顺序触发到期的定时器
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	deadline := c.now.Add(d)
+	c.mutex.Unlock()
+	for {
+		c.mutex.Lock()
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].when.Before(c.timers[j].when)
+		})
+		var timer *fakeTimer
+		for len(c.timers) > 0 && timer == nil {
+			if c.timers[0].stopped {
+				c.timers = c.timers[1:]
+				continue
+			}
+			if c.timers[0].when.After(deadline) {
+				break
+			}
+			timer = c.timers[0]
+			timer.stopped = true
+			c.timers = c.timers[1:]
+			c.now = timer.when
+		}
+		if timer == nil {
+			c.now = deadline
+			c.mutex.Unlock()
+			return
+		}
+		c.mutex.Unlock()
+		timer.fun()
+	}
+}
+
+//recorder 记录事物发送的数据
+type recorder struct {
+	mutex   sync.Mutex
+	packets [][]byte
+}
+
+func (r *recorder) send(p []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.packets = append(r.packets, p)
+	return nil
+}
+
+func (r *recorder) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.packets)
+}
+
+func (r *recorder) last() []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.packets[len(r.packets)-1]
+}
+
+func newTestTransaction(t *testing.T, method Method, reliable bool) (*ClientTransaction, *fakeClock, *recorder) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	rec := &recorder{}
+	trans, err := newClientTransaction(newTestRequest(method, "trans-"+method.String()), reliable, clock, rec.send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = trans.start(); err != nil {
+		t.Fatal(err)
+	}
+	return trans, clock, rec
+}
+
+func TestClientTransaction_InviteTimeout(t *testing.T) {
+	trans, clock, rec := newTestTransaction(t, MethodInvite, false)
+	//Timer A: 0.5s, 1s, 2s, 4s, 8s, 16s
+	for i, d := range []time.Duration{T1, T1 * 2, T1 * 4, T1 * 8, T1 * 16, T1 * 32} {
+		clock.Advance(d)
+		if rec.count() != i+2 {
+			t.Fatalf("retransmission %d: sent %d", i, rec.count())
+		}
+	}
+	if trans.State() != TransactionStateCalling {
+		t.Fatalf("unexpected state %d", trans.State())
+	}
+	//Timer B: 64*T1
+	clock.Advance(T1)
+	select {
+	case <-trans.Done():
+	default:
+		t.Fatal("transaction not terminated")
+	}
+	if trans.Err() != ErrorTransactionTimeout {
+		t.Errorf("unexpected error %v", trans.Err())
+	}
+}
+
+func TestClientTransaction_InviteFailure(t *testing.T) {
+	trans, clock, rec := newTestTransaction(t, MethodInvite, false)
+	trans.receive(NewResponse(StatusTrying, trans.Request()))
+	clock.Advance(T1 * 64)
+	if trans.State() != TransactionStateProceeding || rec.count() != 1 {
+		t.Fatalf("unexpected state %d, sent %d", trans.State(), rec.count())
+	}
+	res := NewResponse(StatusBusyHere, trans.Request())
+	res.Header.Set(HeaderTo, &AddressHeader{Uri: NewUri("1001", "127.0.0.1", Map{}).EnableProtocol(), Params: Map{"tag": "to-tag"}})
+	trans.receive(res)
+	if trans.State() != TransactionStateCompleted || rec.count() != 2 {
+		t.Fatalf("unexpected state %d, sent %d", trans.State(), rec.count())
+	}
+	ack, err := ReadRequest(bufio.NewReader(bytes.NewReader(rec.last())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Method != MethodAck {
+		t.Fatalf("unexpected method %s", ack.Method)
+	}
+	if key, _ := transactionKey(ack.Header, MethodInvite); key != trans.Key() {
+		t.Errorf("ack branch mismatch %s", key)
+	}
+	if to, ok := ack.Header.Get(HeaderTo).(*AddressHeader); !ok || to.Params.Get("tag") != "to-tag" {
+		t.Error("ack To tag missing")
+	}
+	//重传的最终响应需要重发ACK, 但是不重复投递
+	trans.receive(res)
+	if rec.count() != 3 {
+		t.Errorf("ack not retransmitted, sent %d", rec.count())
+	}
+	if len(trans.Responses()) != 2 {
+		t.Errorf("unexpected responses %d", len(trans.Responses()))
+	}
+	//Timer D
+	clock.Advance(T1 * 64)
+	if trans.State() != TransactionStateTerminated || trans.Err() != nil {
+		t.Errorf("unexpected state %d, error %v", trans.State(), trans.Err())
+	}
+}
+
+func TestClientTransaction_InviteAccepted(t *testing.T) {
+	trans, clock, rec := newTestTransaction(t, MethodInvite, true)
+	logger := &recordLogger{}
+	trans.logger = logger
+	res := NewResponse(StatusOK, trans.Request())
+	trans.receive(res)
+	if trans.State() != TransactionStateAccepted || rec.count() != 1 {
+		t.Fatalf("unexpected state %d, sent %d", trans.State(), rec.count())
+	}
+	//重传的2xx继续交给TU, 由TU重发ACK
+	trans.receive(res)
+	trans.receive(NewResponse(StatusBusyHere, trans.Request()))
+	if len(trans.Responses()) != 2 || rec.count() != 1 {
+		t.Errorf("unexpected responses %d, sent %d", len(trans.Responses()), rec.count())
+	}
+	for i := 0; i < cap(trans.responses); i++ {
+		trans.receive(res)
+	}
+	if len(logger.Entries()) == 0 {
+		t.Error("dropped response not logged")
+	}
+	//Timer M
+	clock.Advance(T1*64 - time.Millisecond)
+	if trans.State() != TransactionStateAccepted {
+		t.Fatalf("unexpected state %d", trans.State())
+	}
+	clock.Advance(time.Millisecond)
+	if trans.State() != TransactionStateTerminated || trans.Err() != nil {
+		t.Errorf("unexpected state %d, error %v", trans.State(), trans.Err())
+	}
+}
+
+func TestClientTransaction_NonInvite(t *testing.T) {
+	trans, clock, rec := newTestTransaction(t, MethodOptions, false)
+	//Timer E: 0.5s, 1s, 2s, 4s, 4s
+	for i, d := range []time.Duration{T1, T1 * 2, T1 * 4, T2, T2} {
+		clock.Advance(d)
+		if rec.count() != i+2 {
+			t.Fatalf("retransmission %d: sent %d", i, rec.count())
+		}
+	}
+	trans.receive(NewResponse(StatusTrying, trans.Request()))
+	clock.Advance(T2)
+	if trans.State() != TransactionStateProceeding || rec.count() != 7 {
+		t.Fatalf("unexpected state %d, sent %d", trans.State(), rec.count())
+	}
+	trans.receive(NewResponse(StatusOK, trans.Request()))
+	clock.Advance(T2)
+	if trans.State() != TransactionStateCompleted || rec.count() != 7 {
+		t.Fatalf("unexpected state %d, sent %d", trans.State(), rec.count())
+	}
+	//Timer K
+	clock.Advance(T4)
+	if trans.State() != TransactionStateTerminated {
+		t.Errorf("unexpected state %d", trans.State())
+	}
+
+	//Timer F
+	trans, clock, _ = newTestTransaction(t, MethodOptions, false)
+	clock.Advance(T1 * 64)
+	if trans.Err() != ErrorTransactionTimeout {
+		t.Errorf("unexpected error %v", trans.Err())
+	}
+}
+
+func TestClientTransaction_Reliable(t *testing.T) {
+	trans, clock, rec := newTestTransaction(t, MethodRegister, true)
+	clock.Advance(T1 * 8)
+	if rec.count() != 1 {
+		t.Fatalf("unexpected retransmission, sent %d", rec.count())
+	}
+	trans.receive(NewResponse(StatusOK, trans.Request()))
+	if trans.State() != TransactionStateTerminated {
+		t.Errorf("unexpected state %d", trans.State())
+	}
+}
+
+func TestTransactionStore_Notify(t *testing.T) {
+	store := &transactionStore{}
+	invite, _, _ := newTestTransaction(t, MethodInvite, false)
+	req := newTestRequest(MethodCancel, "trans-INVITE")
+	cancel, err := newClientTransaction(req, false, &fakeClock{}, (&recorder{}).send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cancel.start(); err != nil {
+		t.Fatal(err)
+	}
+	store.add(invite)
+	store.add(cancel)
+	//CANCEL和INVITE使用相同的branch, 不能互相抢占响应
+	if !store.notify(NewResponse(StatusOK, req)) {
+		t.Fatal("response not matched")
+	}
+	if len(invite.Responses()) != 0 || len(cancel.Responses()) != 1 {
+		t.Errorf("response delivered to wrong transaction")
+	}
+	req = newTestRequest(MethodCancel, "trans-unknown")
+	if store.notify(NewResponse(StatusOK, req)) {
+		t.Error("unexpected match")
+	}
+}
+
+func TestTransactionStore_Do(t *testing.T) {
+	store := &transactionStore{}
+	trans, err := newClientTransaction(newTestRequest(MethodInvite, "trans-do"), false, &fakeClock{}, (&recorder{}).send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans.onTerminated = store.release
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = store.do(ctx, trans, func(res *Response) (bool, error) { return true, nil }); err != context.Canceled {
+		t.Fatalf("unexpected error %v", err)
+	}
+	//ctx结束后事物被结束并且移除
+	if trans.State() != TransactionStateTerminated {
+		t.Errorf("unexpected state %d", trans.State())
+	}
+	if store.notify(NewResponse(StatusOK, trans.Request())) {
+		t.Error("cancelled transaction still matched")
+	}
+
+	//接受2xx后重传的2xx继续交给回调
+	trans, _ = newClientTransaction(newTestRequest(MethodInvite, "trans-accepted"), false, &fakeClock{}, (&recorder{}).send)
+	responses := make(chan *Response, 4)
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		store.notify(NewResponse(StatusOK, trans.Request()))
+	}()
+	if err = store.do(context.Background(), trans, func(res *Response) (bool, error) {
+		responses <- res
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	store.notify(NewResponse(StatusOK, trans.Request()))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-responses:
+		case <-time.After(time.Second):
+			t.Fatalf("response %d not passed to callback", i)
+		}
+	}
+}
@@ -1,17 +1,31 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"github.com/uole/sip"
 	"github.com/uole/sip/proxy"
 	yaml "gopkg.in/yaml.v2"
 	"os"
 )
 
-type Config struct {
-	Listen string         `json:"listen" yaml:"listen"`
-	Routes []*proxy.Route `json:"routes" yaml:"routes"`
-}
+type (
+	WebSocketConfig struct {
+		Listen   string `json:"listen" yaml:"listen"`
+		CertFile string `json:"cert_file" yaml:"certFile"` //证书文件, 配置后使用wss
+		KeyFile  string `json:"key_file" yaml:"keyFile"`
+	}
+
+	Config struct {
+		Listen      string           `json:"listen" yaml:"listen"`
+		Credentials string           `json:"credentials" yaml:"credentials"` //认证凭证文件
+		WebSocket   *WebSocketConfig `json:"websocket" yaml:"websocket"`     //websocket监听配置
+		Metrics     string           `json:"metrics" yaml:"metrics"`         //Prometheus指标的监听地址, 为空时不开启
+		Lifecycle   *proxy.Lifecycle `json:"lifecycle" yaml:"lifecycle"`     //处理器以及绑定关系的过期配置
+		Routes      []*proxy.Route   `json:"routes" yaml:"routes"`
+	}
+)
 
 var (
 	configFlag = flag.String("config", "", "")
@@ -19,8 +33,9 @@ var (
 
 func main() {
 	var (
-		fp  *os.File
-		err error
+		fp    *os.File
+		err   error
+		store *sip.FileCredentialStore
 	)
 	flag.Parse()
 	cfg := &Config{Listen: "0.0.0.0:5060"}
@@ -36,5 +51,39 @@ func main() {
 		}
 	}
 	serve := proxy.NewReverse(cfg.Routes)
+	serve.SetLogger(sip.NewStdLogger(nil))
+	if cfg.Lifecycle != nil {
+		serve.SetLifecycle(*cfg.Lifecycle)
+	}
+	if cfg.Credentials != "" {
+		if store, err = sip.NewFileCredentialStore(cfg.Credentials); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		serve.SetCredentialStore(store)
+	}
+	if cfg.WebSocket != nil && cfg.WebSocket.Listen != "" {
+		var tlsConfig *tls.Config
+		if cfg.WebSocket.CertFile != "" {
+			var cert tls.Certificate
+			if cert, err = tls.LoadX509KeyPair(cfg.WebSocket.CertFile, cfg.WebSocket.KeyFile); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		go func() {
+			if err := serve.ServeWS(cfg.WebSocket.Listen, tlsConfig); err != nil {
+				fmt.Println(err)
+			}
+		}()
+	}
+	if cfg.Metrics != "" {
+		go func() {
+			if err := serve.ServeMetrics(cfg.Metrics); err != nil {
+				fmt.Println(err)
+			}
+		}()
+	}
 	_ = serve.Serve(cfg.Listen)
 }
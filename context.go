@@ -1,12 +1,35 @@
 package sip
 
 import (
-	"strconv"
+	"context"
+	"errors"
+	"net"
 )
 
+var (
+	ErrorInvalidStatus = errors.New("invalid status code")
+)
+
+//Context 服务端处理请求的上下文
 type Context struct {
-	req  *Request
-	sess *Session
+	context context.Context
+	req     *Request
+	sess    *Session
+}
+
+//Context 服务端的上下文, 服务端停止后结束
+func (ctx *Context) Context() context.Context {
+	return ctx.context
+}
+
+//Session 请求所属的会话
+func (ctx *Context) Session() *Session {
+	return ctx.sess
+}
+
+//Transport 接收请求的传输层
+func (ctx *Context) Transport() Transport {
+	return ctx.sess.transport
 }
 
 //CallID 返回当前的ID
@@ -37,33 +60,121 @@ func (ctx *Context) SipTo() *AddressHeader {
 
 //write 返回一个Response对象
 func (ctx *Context) Write(res *Response) (err error) {
+	//Via包含收到请求时标记的received以及rport
 	if !res.Header.Has(HeaderVia) {
-		viaHead := ctx.req.Header.Get(HeaderVia).(*ViaHeader)
-		if viaHead.Uri.Port == 0 {
-			viaHead.Uri.Port = 5060
-		}
-		resViaHead := &ViaHeader{
-			Protocol:        viaHead.Protocol,
-			ProtocolVersion: viaHead.ProtocolVersion,
-			Transport:       ctx.sess.transport.Protocol(),
-			Uri:             viaHead.Uri.Clone(),
-		}
-		if viaHead.Uri.Port > 0 {
-			resViaHead.Uri.Params.Set("rport", strconv.Itoa(viaHead.Uri.Port))
-		}
-		if viaHead.Uri.Params.Get("branch") != "" {
-			resViaHead.Uri.Params.Set("branch", viaHead.Uri.Params.Get("branch"))
+		if via, ok := ctx.req.Header.Get(HeaderVia).(*ViaHeader); ok {
+			res.Header.Set(HeaderVia, via.Clone())
 		}
-		res.Header.Set(HeaderVia, resViaHead)
 	}
 	if !res.Header.Has(HeaderUserAgent) {
 		res.Header.Set(HeaderUserAgent, defaultUserAgentHead)
 	}
-	if !res.Header.Has(HeaderContact) {
-		res.Header.Set(HeaderContact, &AddressHeader{Uri: &Uri{IsEncrypted: false, User: ctx.sess.Id, Host: ctx.sess.transport.Conn().LocalAddr().String(), Params: map[string]string{
+	if !res.Header.Has(HeaderContact) && needContact(ctx.req.Method, res.StatusCode) {
+		res.Header.Set(HeaderContact, &AddressHeader{Uri: &Uri{IsEncrypted: false, User: ctx.sess.Id, Host: ctx.contactHost(), Params: map[string]string{
 			"transport": ctx.sess.transport.Protocol(),
 		}}})
 	}
-	_, err = ctx.sess.transport.Write(res.Bytes())
+	if res.RemoteAddr == nil {
+		res.RemoteAddr = ctx.req.RemoteAddr
+	}
+	err = ctx.sess.transport.Respond(res)
+	return
+}
+
+//contactHost Contact使用的本地地址, 监听在通配地址时按照请求Via的received选择到达对端的本地地址
+func (ctx *Context) contactHost() string {
+	addr := ctx.sess.transport.LocalAddr()
+	if addr == nil {
+		return "0.0.0.0"
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+		return addr.String()
+	}
+	var remote string
+	if via, ok := ctx.req.Header.Get(HeaderVia).(*ViaHeader); ok && via.Uri != nil {
+		remote = via.ResponseAddress()
+	} else if ctx.req.RemoteAddr != nil {
+		remote = ctx.req.RemoteAddr.String()
+	} else {
+		return addr.String()
+	}
+	//udp的Dial只查询路由, 不发送数据
+	conn, err := net.Dial("udp", remote)
+	if err != nil {
+		return addr.String()
+	}
+	defer conn.Close()
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return addr.String()
+	}
+	return net.JoinHostPort(local.IP.String(), port)
+}
+
+//needContact 响应是否需要Contact, 建立对话或者刷新目标的请求的2xx, 3xx以及485需要(RFC 3261 8.2.6.2, 21.4.23)
+func needContact(method Method, code int) bool {
+	switch {
+	case code >= 200 && code < 300:
+		switch method {
+		case MethodInvite, MethodSubscribe, MethodNotify, MethodRefer, MethodUpdate:
+			return true
+		}
+		return false
+	case code >= 300 && code < 400:
+		return true
+	}
+	return code == StatusAmbiguous
+}
+
+//Reply 回复指定状态码的响应
+func (ctx *Context) Reply(code int) (err error) {
+	return ctx.Write(NewResponse(code, ctx.req))
+}
+
+//ReplyWithBody 回复带有消息体的响应
+func (ctx *Context) ReplyWithBody(code int, contentType string, body []byte) (err error) {
+	res := NewResponse(code, ctx.req)
+	res.Header.Set(HeaderContentType, NewPlainHeader(contentType))
+	res.Body = body
+	return ctx.Write(res)
+}
+
+//Provisional 回复临时响应, 状态码需要在101到199之间, 100由服务端事物自动发送
+func (ctx *Context) Provisional(code int) (err error) {
+	if code <= StatusTrying || code >= 200 {
+		return ErrorInvalidStatus
+	}
+	return ctx.Reply(code)
+}
+
+//Redirect 将请求重定向到target
+func (ctx *Context) Redirect(code int, target *Uri) (err error) {
+	if code < 300 || code >= 400 {
+		return ErrorInvalidStatus
+	}
+	res := NewResponse(code, ctx.req)
+	res.Header.Set(HeaderContact, &AddressHeader{Uri: target.Clone()})
+	return ctx.Write(res)
+}
+
+//Challenge 回复认证挑战, code为401或者407
+func (ctx *Context) Challenge(authenticator *DigestAuthenticator, code int, stale bool) (err error) {
+	if code != StatusUnauthorized && code != StatusProxyAuthenticationRequired {
+		return ErrorInvalidStatus
+	}
+	return ctx.Write(authenticator.Challenge(ctx.req, code, stale))
+}
+
+//Authenticate 校验请求的认证信息, 校验失败时回复认证挑战并返回错误
+func (ctx *Context) Authenticate(authenticator *DigestAuthenticator, code int) (username string, err error) {
+	if username, err = authenticator.Verify(ctx.req); err != nil {
+		if e := ctx.Challenge(authenticator, code, err == ErrorAuthorizationStale); e != nil {
+			err = e
+		}
+	}
 	return
 }
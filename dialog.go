@@ -0,0 +1,421 @@
+package sip
+
+import (
+	"errors"
+	"github.com/rs/xid"
+	"strings"
+	"sync"
+)
+
+const (
+	DialogStateEarly = iota + 1
+	DialogStateConfirmed
+	DialogStateTerminated
+)
+
+var (
+	ErrorDialogTagMissing     = errors.New("dialog tag missing")
+	ErrorDialogCSeqOutOfOrder = errors.New("dialog cseq out of order")
+)
+
+type (
+	//Dialog RFC 3261 12 对话, 保存对话双方的tag, 路由以及CSeq
+	Dialog struct {
+		callID       string
+		localTag     string
+		remoteTag    string
+		localUri     *AddressHeader
+		remoteUri    *AddressHeader
+		remoteTarget *Uri
+		routeSet     []*AddressHeader
+		localSeq     int
+		remoteSeq    int
+		server       bool
+		state        int
+		mutex        sync.RWMutex
+	}
+
+	//DialogStore 保存已经建立的对话, 按照对话的ID进行匹配
+	DialogStore struct {
+		mutex   sync.RWMutex
+		dialogs map[string]*Dialog
+	}
+)
+
+//NewTag 生成一个新的tag
+func NewTag() string {
+	return xid.New().String()
+}
+
+//ID 对话的ID, 由Call-ID, 本地tag以及远端tag组成
+func (d *Dialog) ID() string {
+	return dialogID(d.callID, d.localTag, d.remoteTag)
+}
+
+func (d *Dialog) CallID() string {
+	return d.callID
+}
+
+func (d *Dialog) LocalTag() string {
+	return d.localTag
+}
+
+func (d *Dialog) RemoteTag() string {
+	return d.remoteTag
+}
+
+//RemoteTarget 远端的Contact地址
+func (d *Dialog) RemoteTarget() *Uri {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.remoteTarget.Clone()
+}
+
+//RouteSet 对话的路由, 按照发送请求时Route的顺序
+func (d *Dialog) RouteSet() []*AddressHeader {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return cloneRoutes(d.routeSet)
+}
+
+func (d *Dialog) LocalSeq() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.localSeq
+}
+
+//advanceLocalSeq 对话外增加了本地的CSeq(例如认证后重发请求)时同步到对话
+func (d *Dialog) advanceLocalSeq(seq int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if seq > d.localSeq {
+		d.localSeq = seq
+	}
+}
+
+func (d *Dialog) RemoteSeq() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.remoteSeq
+}
+
+func (d *Dialog) State() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.state
+}
+
+//Terminate 结束对话
+func (d *Dialog) Terminate() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.state = DialogStateTerminated
+}
+
+//Update 使用对话中的响应更新对话的状态, 客户端收到的响应会刷新远端的Contact
+func (d *Dialog) Update(res *Response) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.state == DialogStateTerminated {
+		return
+	}
+	seq, _ := res.Header.Get(HeaderCSeq).(*SequenceHeader)
+	if seq != nil && seq.Method == MethodInvite && res.StatusCode >= 300 && d.state == DialogStateEarly {
+		d.state = DialogStateTerminated
+		return
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return
+	}
+	if d.state == DialogStateEarly && seq != nil && seq.Method == MethodInvite {
+		d.state = DialogStateConfirmed
+		//早期对话的路由以2xx响应为准
+		if !d.server && res.Header.Has(HeaderRecordRoute) {
+			d.routeSet = reverseRoutes(res.Header.Get(HeaderRecordRoute))
+		}
+	}
+	if !d.server {
+		if contact, ok := res.Header.Get(HeaderContact).(*AddressHeader); ok {
+			d.remoteTarget = contact.Uri.Clone()
+		}
+	}
+}
+
+//ReceiveRequest 校验对话中收到的请求的CSeq, 并处理目标刷新以及BYE
+func (d *Dialog) ReceiveRequest(req *Request) (err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	seq, ok := req.Header.Get(HeaderCSeq).(*SequenceHeader)
+	if !ok {
+		err = ErrorDialogCSeqOutOfOrder
+		return
+	}
+	//ACK和CANCEL使用INVITE的CSeq
+	if req.Method == MethodAck || req.Method == MethodCancel {
+		if seq.Sequence != d.remoteSeq {
+			err = ErrorDialogCSeqOutOfOrder
+		}
+		return
+	}
+	if d.remoteSeq > 0 && seq.Sequence <= d.remoteSeq {
+		err = ErrorDialogCSeqOutOfOrder
+		return
+	}
+	d.remoteSeq = seq.Sequence
+	switch req.Method {
+	case MethodInvite, MethodUpdate, MethodSubscribe, MethodNotify, MethodRefer:
+		if contact, ok := req.Header.Get(HeaderContact).(*AddressHeader); ok {
+			d.remoteTarget = contact.Uri.Clone()
+		}
+	case MethodBye:
+		d.state = DialogStateTerminated
+	}
+	return
+}
+
+//NewRequest 创建对话中的请求, ACK和CANCEL不会增加本地的CSeq
+func (d *Dialog) NewRequest(method Method) *Request {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if method != MethodAck && method != MethodCancel {
+		d.localSeq++
+	}
+	req := NewRequest(method, "")
+	routes := cloneRoutes(d.routeSet)
+	if len(routes) > 0 && !isLooseRoute(routes[0]) {
+		//严格路由, 第一个路由作为Request-URI, 远端地址放在最后
+		req.SetUri(routes[0].Uri)
+		routes = append(routes[1:], &AddressHeader{Uri: d.remoteTarget.Clone()})
+	} else {
+		req.SetUri(d.remoteTarget)
+	}
+	req.Header.Set(HeaderMaxForwards, NewMaxForwardHeader(70))
+	if len(routes) > 0 {
+		req.Header.Set(HeaderRoute, NewRouteHeader(routes...))
+	}
+	req.Header.Set(HeaderFrom, withTag(d.localUri, d.localTag))
+	req.Header.Set(HeaderTo, withTag(d.remoteUri, d.remoteTag))
+	req.Header.Set(HeaderCallID, NewPlainHeader(d.callID))
+	req.Header.Set(HeaderCSeq, NewSequenceHeader(method, d.localSeq))
+	return req
+}
+
+//Add 保存一个对话
+func (s *DialogStore) Add(d *Dialog) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.dialogs == nil {
+		s.dialogs = make(map[string]*Dialog)
+	}
+	s.dialogs[d.ID()] = d
+}
+
+//Get 获取指定ID的对话
+func (s *DialogStore) Get(id string) (d *Dialog, ok bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	d, ok = s.dialogs[id]
+	return
+}
+
+//Remove 删除一个对话
+func (s *DialogStore) Remove(d *Dialog) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if v, ok := s.dialogs[d.ID()]; ok && v == d {
+		delete(s.dialogs, d.ID())
+	}
+}
+
+//Match 查找请求所属的对话
+func (s *DialogStore) Match(req *Request) (d *Dialog, ok bool) {
+	var (
+		err       error
+		localTag  string
+		remoteTag string
+	)
+	if localTag, err = headerTag(req.Header, HeaderTo); err != nil {
+		return
+	}
+	if remoteTag, err = headerTag(req.Header, HeaderFrom); err != nil {
+		return
+	}
+	return s.Get(dialogID(req.CallID(), localTag, remoteTag))
+}
+
+//Receive 处理对话中的请求, 返回的响应不为空时需要使用该响应拒绝请求.
+//不在对话中的请求返回的对话和响应都为空, 未知对话回复481, CSeq乱序回复500
+func (s *DialogStore) Receive(req *Request) (d *Dialog, res *Response) {
+	var ok bool
+	if tag, err := headerTag(req.Header, HeaderTo); err != nil || tag == "" {
+		return
+	}
+	if d, ok = s.Match(req); !ok {
+		//ACK不需要响应
+		if req.Method != MethodAck {
+			res = NewResponse(StatusCallTransactionDoesNotExist, req)
+		}
+		return
+	}
+	if err := d.ReceiveRequest(req); err != nil {
+		d = nil
+		if req.Method != MethodAck {
+			res = NewResponse(StatusServerInternalError, req)
+		}
+		return
+	}
+	if d.State() == DialogStateTerminated {
+		s.Remove(d)
+	}
+	return
+}
+
+//NewDialogStore 创建对话存储
+func NewDialogStore() *DialogStore {
+	return &DialogStore{dialogs: make(map[string]*Dialog)}
+}
+
+//NewDialogFromResponse 客户端使用请求以及收到的1xx或者2xx响应创建对话
+func NewDialogFromResponse(req *Request, res *Response) (d *Dialog, err error) {
+	var (
+		ok        bool
+		seq       *SequenceHeader
+		from, to  *AddressHeader
+		localTag  string
+		remoteTag string
+	)
+	if localTag, err = headerTag(req.Header, HeaderFrom); err != nil {
+		return
+	}
+	if remoteTag, err = headerTag(res.Header, HeaderTo); err != nil {
+		return
+	}
+	if localTag == "" || remoteTag == "" {
+		err = ErrorDialogTagMissing
+		return
+	}
+	from = req.Header.Get(HeaderFrom).(*AddressHeader)
+	to = res.Header.Get(HeaderTo).(*AddressHeader)
+	d = &Dialog{
+		callID:       req.CallID(),
+		localTag:     localTag,
+		remoteTag:    remoteTag,
+		localUri:     from.Clone().(*AddressHeader),
+		remoteUri:    to.Clone().(*AddressHeader),
+		remoteTarget: req.Uri(),
+		routeSet:     reverseRoutes(res.Header.Get(HeaderRecordRoute)),
+		state:        DialogStateEarly,
+	}
+	if seq, ok = req.Header.Get(HeaderCSeq).(*SequenceHeader); ok {
+		d.localSeq = seq.Sequence
+	}
+	if contact, ok := res.Header.Get(HeaderContact).(*AddressHeader); ok {
+		d.remoteTarget = contact.Uri.Clone()
+	}
+	if res.StatusCode >= 200 {
+		d.state = DialogStateConfirmed
+	}
+	return
+}
+
+//NewDialogFromRequest 服务端使用收到的请求以及回复的1xx或者2xx响应创建对话,
+//响应的To没有tag时会生成新的tag, 请求中的Record-Route会复制到响应中
+func NewDialogFromRequest(req *Request, res *Response) (d *Dialog, err error) {
+	var (
+		ok        bool
+		seq       *SequenceHeader
+		from, to  *AddressHeader
+		remoteTag string
+	)
+	if remoteTag, err = headerTag(req.Header, HeaderFrom); err != nil {
+		return
+	}
+	if remoteTag == "" {
+		err = ErrorDialogTagMissing
+		return
+	}
+	if to, ok = res.Header.Get(HeaderTo).(*AddressHeader); !ok {
+		err = ErrorDialogTagMissing
+		return
+	}
+	if to.Params.Get("tag") == "" {
+		to.Params.Set("tag", NewTag())
+	}
+	if req.Header.Has(HeaderRecordRoute) && !res.Header.Has(HeaderRecordRoute) {
+		res.Header.Set(HeaderRecordRoute, req.Header.Get(HeaderRecordRoute).Clone())
+	}
+	from = req.Header.Get(HeaderFrom).(*AddressHeader)
+	d = &Dialog{
+		callID:    req.CallID(),
+		localTag:  to.Params.Get("tag"),
+		remoteTag: remoteTag,
+		localUri:  to.Clone().(*AddressHeader),
+		remoteUri: from.Clone().(*AddressHeader),
+		server:    true,
+		state:     DialogStateEarly,
+	}
+	if route, ok := req.Header.Get(HeaderRecordRoute).(*RouteHeader); ok {
+		d.routeSet = cloneRoutes(route.Values)
+	}
+	if seq, ok = req.Header.Get(HeaderCSeq).(*SequenceHeader); ok {
+		d.remoteSeq = seq.Sequence
+	}
+	if contact, ok := req.Header.Get(HeaderContact).(*AddressHeader); ok {
+		d.remoteTarget = contact.Uri.Clone()
+	} else {
+		d.remoteTarget = from.Uri.Clone()
+	}
+	if res.StatusCode >= 200 {
+		d.state = DialogStateConfirmed
+	}
+	return
+}
+
+func dialogID(callID, localTag, remoteTag string) string {
+	return strings.Join([]string{callID, localTag, remoteTag}, ";")
+}
+
+//headerTag 获取From或者To头部的tag
+func headerTag(header *Header, name string) (tag string, err error) {
+	addr, ok := header.Get(name).(*AddressHeader)
+	if !ok {
+		err = ErrorDialogTagMissing
+		return
+	}
+	tag = addr.Params.Get("tag")
+	return
+}
+
+func withTag(addr *AddressHeader, tag string) *AddressHeader {
+	hv := addr.Clone().(*AddressHeader)
+	if tag != "" {
+		hv.Params.Set("tag", tag)
+	}
+	return hv
+}
+
+func isLooseRoute(route *AddressHeader) bool {
+	_, ok := route.Uri.Params["lr"]
+	return ok
+}
+
+func cloneRoutes(routes []*AddressHeader) []*AddressHeader {
+	values := make([]*AddressHeader, 0, len(routes))
+	for _, v := range routes {
+		values = append(values, v.Clone().(*AddressHeader))
+	}
+	return values
+}
+
+//reverseRoutes 客户端的路由为Record-Route的逆序
+func reverseRoutes(value Value) []*AddressHeader {
+	route, ok := value.(*RouteHeader)
+	if !ok {
+		return nil
+	}
+	values := make([]*AddressHeader, 0, len(route.Values))
+	for i := len(route.Values) - 1; i >= 0; i-- {
+		values = append(values, route.Values[i].Clone().(*AddressHeader))
+	}
+	return values
+}
@@ -0,0 +1,125 @@
+package sip
+
+import (
+	"testing"
+)
+
+func newTestRoute(s string) *RouteHeader {
+	hv, err := parseRouteHeaderFunc(s)
+	if err != nil {
+		panic(err)
+	}
+	return hv.(*RouteHeader)
+}
+
+func Test_parseRouteHeaderFunc(t *testing.T) {
+	hv := newTestRoute(`<sip:p1.example.com;lr>, "Proxy, Two" <sip:p2.example.com;lr>`)
+	if len(hv.Values) != 2 {
+		t.Fatalf("unexpected routes %d", len(hv.Values))
+	}
+	if hv.Values[1].DisplayName != "Proxy, Two" || hv.Values[1].Uri.Host != "p2.example.com" {
+		t.Errorf("unexpected route %s", hv.Values[1].String())
+	}
+	if !hv.append(newTestRoute("<sip:p3.example.com>")) || len(hv.Values) != 3 {
+		t.Error("route not appended")
+	}
+}
+
+func TestDialog_Client(t *testing.T) {
+	invite := newTestRequest(MethodInvite, "dialog-client")
+	res := NewResponse(StatusOK, invite)
+	res.Header.Set(HeaderTo, &AddressHeader{Uri: NewUri("1001", "127.0.0.1", Map{}).EnableProtocol(), Params: Map{"tag": "remote"}})
+	res.Header.Set(HeaderContact, &AddressHeader{Uri: NewUri("1001", "10.0.0.2:5070", Map{"transport": "tcp"}).EnableProtocol()})
+	res.Header.Set(HeaderRecordRoute, newTestRoute("<sip:p2.example.com;lr>, <sip:p1.example.com;lr>"))
+	d, err := NewDialogFromResponse(invite, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.State() != DialogStateConfirmed || d.LocalTag() != "from-dialog-client" || d.RemoteTag() != "remote" {
+		t.Fatalf("unexpected dialog %s", d.ID())
+	}
+	ack := d.NewRequest(MethodAck)
+	bye := d.NewRequest(MethodBye)
+	if seq := ack.Header.Get(HeaderCSeq).(*SequenceHeader); seq.Sequence != 1 {
+		t.Errorf("unexpected ack cseq %d", seq.Sequence)
+	}
+	if seq := bye.Header.Get(HeaderCSeq).(*SequenceHeader); seq.Sequence != 2 {
+		t.Errorf("unexpected bye cseq %d", seq.Sequence)
+	}
+	if bye.Address != "10.0.0.2:5070" || bye.Username != "1001" || bye.Params.Get("transport") != "tcp" {
+		t.Errorf("unexpected request uri %s", bye.Uri().String())
+	}
+	route := bye.Header.Get(HeaderRoute).(*RouteHeader)
+	if len(route.Values) != 2 || route.Values[0].Uri.Host != "p1.example.com" {
+		t.Errorf("unexpected route %s", route.String())
+	}
+	if to := bye.Header.Get(HeaderTo).(*AddressHeader); to.Params.Get("tag") != "remote" {
+		t.Error("to tag missing")
+	}
+}
+
+func TestDialog_StrictRoute(t *testing.T) {
+	invite := newTestRequest(MethodInvite, "dialog-strict")
+	res := NewResponse(StatusOK, invite)
+	res.Header.Set(HeaderTo, &AddressHeader{Uri: NewUri("1001", "127.0.0.1", Map{}).EnableProtocol(), Params: Map{"tag": "remote"}})
+	res.Header.Set(HeaderContact, &AddressHeader{Uri: NewUri("1001", "10.0.0.2", Map{}).EnableProtocol()})
+	res.Header.Set(HeaderRecordRoute, newTestRoute("<sip:p2.example.com;lr>, <sip:p1.example.com>"))
+	d, err := NewDialogFromResponse(invite, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bye := d.NewRequest(MethodBye)
+	if bye.Address != "p1.example.com" {
+		t.Errorf("unexpected request uri %s", bye.Uri().String())
+	}
+	route := bye.Header.Get(HeaderRoute).(*RouteHeader)
+	if len(route.Values) != 2 || route.Values[1].Uri.Host != "10.0.0.2" {
+		t.Errorf("unexpected route %s", route.String())
+	}
+}
+
+func TestDialogStore_Receive(t *testing.T) {
+	store := NewDialogStore()
+	invite := newTestRequest(MethodInvite, "dialog-server")
+	invite.Header.Set(HeaderContact, &AddressHeader{Uri: NewUri("1000", "10.0.0.1", Map{}).EnableProtocol()})
+	invite.Header.Set(HeaderRecordRoute, newTestRoute("<sip:p1.example.com;lr>"))
+	res := NewResponse(StatusOK, invite)
+	d, err := NewDialogFromRequest(invite, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Header.Has(HeaderRecordRoute) || d.LocalTag() == "" {
+		t.Fatal("response not prepared")
+	}
+	store.Add(d)
+
+	//远端发送的请求, From和To相对于服务端交换
+	newRemoteRequest := func(method Method, seq int, localTag string) *Request {
+		req := newTestRequest(method, "dialog-server")
+		req.Header.Set(HeaderTo, &AddressHeader{Uri: NewUri("1001", "127.0.0.1", Map{}).EnableProtocol(), Params: Map{"tag": localTag}})
+		req.Header.Set(HeaderCSeq, NewSequenceHeader(method, seq))
+		return req
+	}
+	if v, res := store.Receive(newRemoteRequest(MethodAck, 1, d.LocalTag())); v != d || res != nil {
+		t.Fatal("ack not matched")
+	}
+	if _, res := store.Receive(newRemoteRequest(MethodBye, 2, "unknown")); res == nil || res.StatusCode != StatusCallTransactionDoesNotExist {
+		t.Error("unknown dialog not rejected")
+	}
+	if _, res := store.Receive(newRemoteRequest(MethodBye, 1, d.LocalTag())); res == nil || res.StatusCode != StatusServerInternalError {
+		t.Error("cseq out of order not rejected")
+	}
+	if v, res := store.Receive(newRemoteRequest(MethodBye, 2, d.LocalTag())); v != d || res != nil {
+		t.Fatal("bye not matched")
+	}
+	if _, ok := store.Get(d.ID()); ok || d.State() != DialogStateTerminated {
+		t.Error("dialog not terminated")
+	}
+	if v, res := store.Receive(newTestRequest(MethodInvite, "dialog-new")); v != nil || res != nil {
+		t.Error("out of dialog request matched")
+	}
+	//UAS发送的请求使用对端的Contact以及Record-Route
+	if req := d.NewRequest(MethodBye); req.Address != "10.0.0.1" || req.Header.Get(HeaderRoute).String() != "<sip:p1.example.com;lr>" {
+		t.Errorf("unexpected request %s", req.String())
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/rs/xid"
 	"io"
+	"net"
 	"net/textproto"
 	"strconv"
 	"strings"
@@ -17,17 +18,21 @@ var (
 )
 
 func init() {
-	funcMap["Via"] = parseViaHeaderFunc
-	funcMap["Contact"] = parseAddressHeaderFunc
-	funcMap["From"] = parseAddressHeaderFunc
-	funcMap["To"] = parseAddressHeaderFunc
-	funcMap["CSeq"] = parseSequenceHeaderFunc
-	funcMap["Allow"] = parseArrayHeaderFunc
-	funcMap["Supported"] = parseArrayHeaderFunc
-	funcMap["Allow-Events"] = parseArrayHeaderFunc
-	funcMap["Max-Forwards"] = parseMaxForwardHeaderFunc
-	funcMap["Authorization"] = parseAuthorizationHeaderFunc
-	funcMap["WWW-Authenticate"] = parseAuthorizationHeaderFunc
+	AttachParseFunc("Via", parseViaHeaderFunc)
+	AttachParseFunc("Contact", parseContactHeaderFunc)
+	AttachParseFunc("From", parseAddressHeaderFunc)
+	AttachParseFunc("To", parseAddressHeaderFunc)
+	AttachParseFunc("CSeq", parseSequenceHeaderFunc)
+	AttachParseFunc("Allow", parseArrayHeaderFunc)
+	AttachParseFunc("Supported", parseArrayHeaderFunc)
+	AttachParseFunc("Allow-Events", parseArrayHeaderFunc)
+	AttachParseFunc("Max-Forwards", parseMaxForwardHeaderFunc)
+	AttachParseFunc("Authorization", parseAuthorizationHeaderFunc)
+	AttachParseFunc("WWW-Authenticate", parseAuthorizationHeaderFunc)
+	AttachParseFunc("Proxy-Authorization", parseAuthorizationHeaderFunc)
+	AttachParseFunc("Proxy-Authenticate", parseAuthorizationHeaderFunc)
+	AttachParseFunc("Route", parseRouteHeaderFunc)
+	AttachParseFunc("Record-Route", parseRouteHeaderFunc)
 }
 
 const (
@@ -48,11 +53,20 @@ const (
 	HeaderAuthorization      = "Authorization"
 	HeaderWWWAuthenticate    = "WWW-Authenticate"
 	HeaderProxyAuthorization = "Proxy-Authorization"
+	HeaderProxyAuthenticate  = "Proxy-Authenticate"
 	HeaderDate               = "Date"
 	HeaderReason             = "Reason"
 	HeaderRequire            = "Require"
 	HeaderSessionExpires     = "Session-Expires"
 	HeaderMinSE              = "Min-SE"
+	HeaderMinExpires         = "Min-Expires"
+	HeaderEvent              = "Event"
+	HeaderReferTo            = "Refer-To"
+	HeaderReferredBy         = "Referred-By"
+	HeaderSubscriptionState  = "Subscription-State"
+	HeaderRetryAfter         = "Retry-After"
+	HeaderRoute              = "Route"
+	HeaderRecordRoute        = "Record-Route"
 )
 
 type (
@@ -83,6 +97,13 @@ type (
 		ProtocolVersion string
 		Transport       string
 		Uri             *Uri
+		next            *ViaHeader
+	}
+
+	//multipleValue 允许出现多次的头部, 多次出现时合并保存
+	multipleValue interface {
+		Value
+		append(v Value) bool
 	}
 
 	AuthorizationHeader struct {
@@ -95,7 +116,10 @@ type (
 		Response  string
 		CNonce    string
 		NC        string
+		Opaque    string
+		Stale     bool
 		Uri       *Uri
+		rawUri    string
 	}
 
 	SequenceHeader struct {
@@ -111,6 +135,12 @@ type (
 		DisplayName string
 		Uri         *Uri
 		Params      Map
+		next        *AddressHeader
+	}
+
+	//RouteHeader Route以及Record-Route头部, 按照出现的顺序保存
+	RouteHeader struct {
+		Values []*AddressHeader
 	}
 )
 
@@ -123,7 +153,7 @@ func (h *MaxForwardsHeader) Clone() Value {
 }
 
 func AttachParseFunc(s string, f ParserHeaderFunc) {
-	funcMap[s] = f
+	funcMap[textproto.CanonicalMIMEHeaderKey(s)] = f
 }
 
 func (h *AuthorizationHeader) String() string {
@@ -156,6 +186,12 @@ func (h *AuthorizationHeader) String() string {
 	if h.Algorithm != "" {
 		sb.WriteString("algorithm=" + h.Algorithm + ", ")
 	}
+	if h.Opaque != "" {
+		sb.WriteString("opaque=\"" + h.Opaque + "\", ")
+	}
+	if h.Stale {
+		sb.WriteString("stale=true, ")
+	}
 	return strings.TrimRight(sb.String(), ", ")
 }
 
@@ -170,6 +206,9 @@ func (h *AuthorizationHeader) Clone() Value {
 		Response:  h.Response,
 		CNonce:    h.CNonce,
 		NC:        h.NC,
+		Opaque:    h.Opaque,
+		Stale:     h.Stale,
+		rawUri:    h.rawUri,
 	}
 	if h.Uri != nil {
 		head.Uri = h.Uri.Clone()
@@ -213,16 +252,103 @@ func (h *ViaHeader) String() string {
 	sb.WriteString(h.Protocol + "/" + h.ProtocolVersion + "/" + h.Transport)
 	sb.WriteString(" ")
 	sb.WriteString(h.Uri.String())
+	if h.next != nil {
+		sb.WriteString(", ")
+		sb.WriteString(h.next.String())
+	}
 	return sb.String()
 }
 
 func (h *ViaHeader) Clone() Value {
-	return &ViaHeader{
+	hc := &ViaHeader{
 		Protocol:        h.Protocol,
 		ProtocolVersion: h.ProtocolVersion,
 		Transport:       h.Transport,
 		Uri:             h.Uri.Clone(),
 	}
+	if h.next != nil {
+		hc.next = h.next.Clone().(*ViaHeader)
+	}
+	return hc
+}
+
+//Next 下一个Via, 头部的第一个值为最上面的Via
+func (h *ViaHeader) Next() *ViaHeader {
+	return h.next
+}
+
+//SetNext 设置下一个Via
+func (h *ViaHeader) SetNext(next *ViaHeader) *ViaHeader {
+	h.next = next
+	return h
+}
+
+//Stamp 标记请求的来源地址, 来源和sent-by不一致或者请求了rport时添加received, 请求了rport时填充来源端口(RFC 3581 4)
+func (h *ViaHeader) Stamp(addr net.Addr) {
+	if h.Uri == nil || addr == nil {
+		return
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+	_, rport := h.Uri.Params["rport"]
+	//sent-by的IPv6地址带有方括号, 按照解析后的IP比较
+	sentBy := net.ParseIP(trimBrackets(h.Uri.Host))
+	if rport || sentBy == nil || !sentBy.Equal(net.ParseIP(host)) {
+		h.Uri.Params.Set("received", host)
+	}
+	if rport {
+		h.Uri.Params.Set("rport", port)
+	}
+}
+
+//trimBrackets 去掉IPv6地址的方括号
+func trimBrackets(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+//ResponseAddress 响应需要发送到的地址, received以及rport优先于sent-by(RFC 3581 5)
+func (h *ViaHeader) ResponseAddress() string {
+	host := trimBrackets(h.Uri.Host)
+	if received := h.Uri.Params.Get("received"); received != "" {
+		host = received
+	}
+	port := h.Uri.Port
+	if rport, err := strconv.Atoi(h.Uri.Params.Get("rport")); err == nil && rport > 0 {
+		port = rport
+	}
+	if port == 0 {
+		port = defaultPort(strings.ToUpper(h.Transport))
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+//PublicAddress 服务器看到的客户端地址, 响应的Via没有received以及rport时返回false
+func (h *ViaHeader) PublicAddress() (addr string, ok bool) {
+	if h.Uri == nil {
+		return
+	}
+	if h.Uri.Params.Get("received") == "" && h.Uri.Params.Get("rport") == "" {
+		return
+	}
+	return h.ResponseAddress(), true
+}
+
+func (h *ViaHeader) append(v Value) bool {
+	vv, ok := v.(*ViaHeader)
+	if !ok {
+		return false
+	}
+	tail := h
+	for tail.next != nil {
+		tail = tail.next
+	}
+	tail.next = vv
+	return true
 }
 
 func (h *ArrayHeader) String() string {
@@ -265,6 +391,9 @@ func (h *AddressHeader) String() string {
 	if h.Params != nil && len(h.Params) > 0 {
 		s += ";" + h.Params.String()
 	}
+	if h.next != nil {
+		s += ", " + h.next.String()
+	}
 	return s
 }
 
@@ -274,9 +403,60 @@ func (h *AddressHeader) Clone() Value {
 		Uri:         h.Uri.Clone(),
 		Params:      h.Params.Clone(),
 	}
+	if h.next != nil {
+		hc.next = h.next.Clone().(*AddressHeader)
+	}
 	return hc
 }
 
+//Next 下一个地址, 只有Contact会包含多个地址
+func (h *AddressHeader) Next() *AddressHeader {
+	return h.next
+}
+
+func (h *AddressHeader) append(v Value) bool {
+	vv, ok := v.(*AddressHeader)
+	if !ok {
+		return false
+	}
+	tail := h
+	for tail.next != nil {
+		tail = tail.next
+	}
+	tail.next = vv
+	return true
+}
+
+func (h *RouteHeader) String() string {
+	ss := make([]string, 0, len(h.Values))
+	for _, v := range h.Values {
+		ss = append(ss, v.String())
+	}
+	return strings.Join(ss, ", ")
+}
+
+func (h *RouteHeader) Clone() Value {
+	hc := &RouteHeader{Values: make([]*AddressHeader, 0, len(h.Values))}
+	for _, v := range h.Values {
+		hc.Values = append(hc.Values, v.Clone().(*AddressHeader))
+	}
+	return hc
+}
+
+func (h *RouteHeader) append(v Value) bool {
+	vv, ok := v.(*RouteHeader)
+	if !ok {
+		return false
+	}
+	h.Values = append(h.Values, vv.Values...)
+	return true
+}
+
+//NewRouteHeader 创建Route头部
+func NewRouteHeader(values ...*AddressHeader) *RouteHeader {
+	return &RouteHeader{Values: values}
+}
+
 func (h *PlainHeader) String() string {
 	return h.Content
 }
@@ -343,6 +523,23 @@ func (h *Header) Has(name string) bool {
 	return false
 }
 
+//Del 删除指定的头信息
+func (h *Header) Del(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	if _, ok := h.Values[name]; !ok {
+		return
+	}
+	delete(h.Values, name)
+	for i, k := range h.Keys {
+		if k == name {
+			h.Keys = append(h.Keys[:i], h.Keys[i+1:]...)
+			break
+		}
+	}
+}
+
 //String 返回字符串数据
 func (h *Header) String() string {
 	var (
@@ -398,6 +595,73 @@ func parseAddressHeaderFunc(s string) (header Value, err error) {
 	return
 }
 
+//parseContactHeaderFunc 解析逗号分隔的Contact列表
+func parseContactHeaderFunc(s string) (header Value, err error) {
+	var (
+		value Value
+		head  *AddressHeader
+	)
+	for _, str := range splitHeaderValues(s) {
+		if value, err = parseAddressHeaderFunc(str); err != nil {
+			return
+		}
+		if head == nil {
+			head = value.(*AddressHeader)
+		} else {
+			head.append(value)
+		}
+	}
+	if head == nil {
+		err = fmt.Errorf("missing '<>' %s", s)
+		return
+	}
+	header = head
+	return
+}
+
+//parseRouteHeaderFunc 解析逗号分隔的路由列表
+func parseRouteHeaderFunc(s string) (header Value, err error) {
+	var value Value
+	hv := &RouteHeader{}
+	for _, str := range splitHeaderValues(s) {
+		if value, err = parseAddressHeaderFunc(str); err != nil {
+			return
+		}
+		hv.Values = append(hv.Values, value.(*AddressHeader))
+	}
+	header = hv
+	return
+}
+
+//splitHeaderValues 按照逗号拆分头部的值, 忽略引号以及尖括号中的逗号
+func splitHeaderValues(s string) []string {
+	var (
+		quoted  bool
+		bracket bool
+		start   int
+		values  []string
+	)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case '<':
+			bracket = !quoted
+		case '>':
+			bracket = false
+		case ',':
+			if !quoted && !bracket {
+				values = append(values, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if str := strings.TrimSpace(s[start:]); str != "" {
+		values = append(values, str)
+	}
+	return values
+}
+
 func parseAuthorizationHeaderFunc(s string) (header Value, err error) {
 	var (
 		pos int
@@ -432,7 +696,12 @@ func parseAuthorizationHeaderFunc(s string) (header Value, err error) {
 				hv.QOP = val
 			case "algorithm":
 				hv.Algorithm = val
+			case "opaque":
+				hv.Opaque = val
+			case "stale":
+				hv.Stale = strings.EqualFold(val, "true")
 			case "uri":
+				hv.rawUri = val
 				hv.Uri, err = parseUri(val)
 			}
 		}
@@ -482,11 +751,31 @@ func parseSequenceHeaderFunc(s string) (header Value, err error) {
 }
 
 func parseViaHeaderFunc(s string) (header Value, err error) {
+	var (
+		head *ViaHeader
+		hv   *ViaHeader
+	)
+	for _, vs := range strings.Split(s, ",") {
+		if hv, err = parseViaValue(strings.TrimSpace(vs)); err != nil {
+			return
+		}
+		if head == nil {
+			head = hv
+		} else {
+			head.append(hv)
+		}
+	}
+	header = head
+	return
+}
+
+//parseViaValue 解析单个Via值
+func parseViaValue(s string) (hv *ViaHeader, err error) {
 	var (
 		ps string
 	)
-	hv := &ViaHeader{}
-	ss := strings.Split(s, " ")
+	hv = &ViaHeader{}
+	ss := strings.Fields(s)
 	if len(ss) < 2 {
 		err = fmt.Errorf("unknown string '%s'", s)
 		return
@@ -503,7 +792,6 @@ func parseViaHeaderFunc(s string) (header Value, err error) {
 		return
 	}
 	hv.Uri, err = parseUri(ps)
-	header = hv
 	return
 }
 
@@ -522,7 +810,7 @@ func parseHeader(s string) (key string, value Value, err error) {
 	}
 	key = s[:pos]
 	str = strings.TrimSpace(s[pos+1:])
-	if fun, ok = funcMap[key]; ok {
+	if fun, ok = funcMap[textproto.CanonicalMIMEHeaderKey(key)]; ok {
 		value, err = fun(str)
 	} else {
 		value, err = parsePlainsHeaderFunc(str)
@@ -553,6 +841,9 @@ func readHeader(b *bufio.Reader) (header *Header, err error) {
 		if key, value, err = parseHeader(strings.TrimSpace(line)); err != nil {
 			continue
 		}
+		if current, ok := header.Get(key).(multipleValue); ok && current.append(value) {
+			continue
+		}
 		header.Set(key, value)
 	}
 	return
@@ -2,6 +2,7 @@ package sip
 
 import (
 	"fmt"
+	"net"
 	"testing"
 )
 
@@ -12,3 +13,54 @@ func Test_parseViaHeaderFunc(t *testing.T) {
 		fmt.Println(hv)
 	}
 }
+
+func Test_parseContactHeaderFunc(t *testing.T) {
+	hv, err := parseContactHeaderFunc(`"Desk, 1" <sip:1001@192.0.2.1:5060>;expires=3600, <sip:1001@192.0.2.2>;expires=60`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contact := hv.(*AddressHeader)
+	if contact.DisplayName != "Desk, 1" || contact.Uri.Host != "192.0.2.1" || contact.Params.Get("expires") != "3600" {
+		t.Errorf("unexpected first contact %s", contact)
+	}
+	if next := contact.Next(); next == nil || next.Uri.Host != "192.0.2.2" || next.Params.Get("expires") != "60" || next.Next() != nil {
+		t.Fatalf("unexpected contact list %s", contact)
+	}
+	if s := contact.Clone().String(); s != `"Desk, 1" <sip:1001@192.0.2.1:5060>;expires=3600, <sip:1001@192.0.2.2>;expires=60` {
+		t.Errorf("unexpected string %s", s)
+	}
+}
+
+func TestViaHeader_Stamp(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+	cases := map[string]string{
+		"SIP/2.0/UDP 192.168.1.10:5060;rport;branch=z9hG4bK-1":  "203.0.113.7:40000",
+		"SIP/2.0/UDP 192.168.1.10:5060;branch=z9hG4bK-2":        "203.0.113.7:5060",
+		"SIP/2.0/UDP 203.0.113.7:5070;branch=z9hG4bK-3":         "203.0.113.7:5070",
+		"SIP/2.0/TLS example.com;branch=z9hG4bK-4":              "203.0.113.7:5061",
+		"SIP/2.0/UDP 203.0.113.7:5060;rport=5090;branch=z9hG4b": "203.0.113.7:40000",
+	}
+	for s, expected := range cases {
+		hv, err := parseViaHeaderFunc(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		via := hv.(*ViaHeader)
+		via.Stamp(addr)
+		if result := via.ResponseAddress(); result != expected {
+			t.Errorf("%s: unexpected response address %s", s, result)
+		}
+	}
+	hv, _ := parseViaHeaderFunc("SIP/2.0/UDP 203.0.113.7:5060;branch=z9hG4bK-5")
+	via := hv.(*ViaHeader)
+	via.Stamp(&net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 5060})
+	if _, ok := via.PublicAddress(); ok || via.Uri.Params.Get("received") != "" {
+		t.Errorf("unexpected received %s", via)
+	}
+	hv, _ = parseViaHeaderFunc("SIP/2.0/UDP [2001:db8::1]:5060;branch=z9hG4bK-6")
+	via = hv.(*ViaHeader)
+	via.Stamp(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5060})
+	if via.Uri.Params.Get("received") != "" || via.ResponseAddress() != "[2001:db8::1]:5060" {
+		t.Errorf("unexpected received %s", via)
+	}
+}
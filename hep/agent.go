@@ -0,0 +1,145 @@
+package hep
+
+import (
+	"bytes"
+	"github.com/uole/sip"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//DefaultQueueSize 等待发送的消息数量, 超过时丢弃
+	DefaultQueueSize = 1024
+
+	dialTimeout = time.Second * 5
+)
+
+type (
+	//Agent HEPv3抓包代理, 作为sip.Tracer把收发的sip消息镜像到采集器(Homer)
+	Agent struct {
+		CaptureID uint32 //抓包代理的ID
+		Password  string //采集器的认证密码
+		network   string
+		addr      string
+		conn      net.Conn
+		queue     chan []byte
+		done      chan struct{}
+		closeOnce sync.Once
+		wg        sync.WaitGroup
+	}
+)
+
+//Trace 编码跟踪事件并放入发送队列, 队列已满时丢弃
+func (a *Agent) Trace(e *sip.TraceEvent) {
+	if len(e.Raw) == 0 || sip.IsSTUN(e.Raw) || len(bytes.Trim(e.Raw, "\r\n")) == 0 {
+		return
+	}
+	m := &Message{
+		Time:      e.Time,
+		Network:   NetworkTCP,
+		Src:       e.LocalAddr,
+		Dst:       e.RemoteAddr,
+		CaptureID: a.CaptureID,
+		Password:  a.Password,
+		Payload:   append([]byte{}, e.Raw...),
+	}
+	if e.Transport == sip.ProtoUDP {
+		m.Network = NetworkUDP
+	}
+	if e.Direction == sip.TraceReceive {
+		m.Src, m.Dst = m.Dst, m.Src
+	}
+	if e.Request != nil {
+		m.CorrelationID = e.Request.CallID()
+	} else if e.Response != nil {
+		m.CorrelationID = e.Response.CallID()
+	}
+	b, err := Encode(m)
+	if err != nil {
+		return
+	}
+	select {
+	case <-a.done:
+	case a.queue <- b:
+	default:
+	}
+}
+
+//connect 连接采集器, tcp连接断开后重新连接
+func (a *Agent) connect() (err error) {
+	if a.conn != nil {
+		return
+	}
+	a.conn, err = net.DialTimeout(a.network, a.addr, dialTimeout)
+	return
+}
+
+//send 发送一个消息, tcp发送失败时重连一次
+func (a *Agent) send(b []byte) {
+	for i := 0; i < 2; i++ {
+		if err := a.connect(); err != nil {
+			return
+		}
+		if _, err := a.conn.Write(b); err == nil || a.network == NetworkUDP {
+			return
+		}
+		_ = a.conn.Close()
+		a.conn = nil
+	}
+}
+
+func (a *Agent) loop() {
+	defer a.wg.Done()
+	for {
+		select {
+		case b := <-a.queue:
+			a.send(b)
+		case <-a.done:
+			//发送剩余的消息
+			for {
+				select {
+				case b := <-a.queue:
+					a.send(b)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+//Close 发送队列中剩余的消息后关闭连接
+func (a *Agent) Close() (err error) {
+	a.closeOnce.Do(func() {
+		close(a.done)
+		a.wg.Wait()
+		if a.conn != nil {
+			err = a.conn.Close()
+		}
+	})
+	return
+}
+
+//NewAgent 创建抓包代理, network为udp或者tcp, addr为采集器的地址
+func NewAgent(network string, addr string, captureID uint32) (a *Agent, err error) {
+	network = strings.ToLower(network)
+	if network != NetworkUDP && network != NetworkTCP {
+		err = net.UnknownNetworkError(network)
+		return
+	}
+	a = &Agent{
+		CaptureID: captureID,
+		network:   network,
+		addr:      addr,
+		queue:     make(chan []byte, DefaultQueueSize),
+		done:      make(chan struct{}),
+	}
+	if err = a.connect(); err != nil {
+		return nil, err
+	}
+	a.wg.Add(1)
+	go a.loop()
+	return
+}
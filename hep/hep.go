@@ -0,0 +1,219 @@
+package hep
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/uole/sip"
+	"net"
+	"time"
+)
+
+const (
+	//chunk类型(HEPv3 4.2)
+	chunkFamily        = 0x0001
+	chunkProtocol      = 0x0002
+	chunkIPv4Src       = 0x0003
+	chunkIPv4Dst       = 0x0004
+	chunkIPv6Src       = 0x0005
+	chunkIPv6Dst       = 0x0006
+	chunkSrcPort       = 0x0007
+	chunkDstPort       = 0x0008
+	chunkTimestamp     = 0x0009
+	chunkTimestampUsec = 0x000a
+	chunkProtocolType  = 0x000b
+	chunkCaptureID     = 0x000c
+	chunkAuthKey       = 0x000e
+	chunkPayload       = 0x000f
+	chunkCorrelationID = 0x0011
+
+	familyIPv4 = 2
+	familyIPv6 = 10
+
+	protocolTCP = 6
+	protocolUDP = 17
+
+	//ProtocolSIP 负载类型为sip
+	ProtocolSIP = 1
+
+	NetworkUDP = "udp"
+	NetworkTCP = "tcp"
+
+	headerSize      = 6
+	chunkHeaderSize = 6
+)
+
+var (
+	ErrorInvalidMessage = errors.New("invalid hep message")
+	ErrorInvalidAddress = sip.ErrorInvalidAddress
+
+	magic = []byte("HEP3")
+)
+
+type (
+	//Message 一个HEPv3消息
+	Message struct {
+		Time          time.Time
+		Network       string //NetworkUDP或者NetworkTCP
+		Src           net.Addr
+		Dst           net.Addr
+		ProtocolType  uint8 //负载类型, 默认ProtocolSIP
+		CaptureID     uint32
+		Password      string
+		CorrelationID string //关联ID, sip消息使用Call-ID
+		Payload       []byte
+	}
+)
+
+func appendChunk(b []byte, typ uint16, value []byte) []byte {
+	b = append(b, 0, 0, byte(typ>>8), byte(typ), 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(chunkHeaderSize+len(value)))
+	return append(b, value...)
+}
+
+func appendUint8(b []byte, typ uint16, v uint8) []byte {
+	return appendChunk(b, typ, []byte{v})
+}
+
+func appendUint16(b []byte, typ uint16, v uint16) []byte {
+	return appendChunk(b, typ, []byte{byte(v >> 8), byte(v)})
+}
+
+func appendUint32(b []byte, typ uint16, v uint32) []byte {
+	p := make([]byte, 4)
+	binary.BigEndian.PutUint32(p, v)
+	return appendChunk(b, typ, p)
+}
+
+//Encode 编码HEPv3消息
+func Encode(m *Message) (b []byte, err error) {
+	var (
+		srcIP, dstIP     net.IP
+		srcPort, dstPort int
+	)
+	if srcIP, srcPort, err = sip.SplitAddr(m.Src); err != nil {
+		return
+	}
+	if dstIP, dstPort, err = sip.SplitAddr(m.Dst); err != nil {
+		return
+	}
+	b = make([]byte, headerSize, 128+len(m.Payload))
+	copy(b, magic)
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		b = appendUint8(b, chunkFamily, familyIPv4)
+	} else {
+		b = appendUint8(b, chunkFamily, familyIPv6)
+	}
+	protocol := uint8(protocolUDP)
+	if m.Network == NetworkTCP {
+		protocol = protocolTCP
+	}
+	b = appendUint8(b, chunkProtocol, protocol)
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		b = appendChunk(b, chunkIPv4Src, srcIP.To4())
+		b = appendChunk(b, chunkIPv4Dst, dstIP.To4())
+	} else {
+		b = appendChunk(b, chunkIPv6Src, srcIP.To16())
+		b = appendChunk(b, chunkIPv6Dst, dstIP.To16())
+	}
+	b = appendUint16(b, chunkSrcPort, uint16(srcPort))
+	b = appendUint16(b, chunkDstPort, uint16(dstPort))
+	b = appendUint32(b, chunkTimestamp, uint32(m.Time.Unix()))
+	b = appendUint32(b, chunkTimestampUsec, uint32(m.Time.Nanosecond()/1000))
+	protocolType := m.ProtocolType
+	if protocolType == 0 {
+		protocolType = ProtocolSIP
+	}
+	b = appendUint8(b, chunkProtocolType, protocolType)
+	b = appendUint32(b, chunkCaptureID, m.CaptureID)
+	if m.Password != "" {
+		b = appendChunk(b, chunkAuthKey, []byte(m.Password))
+	}
+	if m.CorrelationID != "" {
+		b = appendChunk(b, chunkCorrelationID, []byte(m.CorrelationID))
+	}
+	b = appendChunk(b, chunkPayload, m.Payload)
+	if len(b) > 0xFFFF {
+		b = nil
+		err = ErrorInvalidMessage
+		return
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)))
+	return
+}
+
+//Decode 解析HEPv3消息, 忽略不认识的chunk
+func Decode(b []byte) (m *Message, err error) {
+	if len(b) < headerSize || string(b[:4]) != string(magic) {
+		err = ErrorInvalidMessage
+		return
+	}
+	size := int(binary.BigEndian.Uint16(b[4:]))
+	if size < headerSize || size > len(b) {
+		err = ErrorInvalidMessage
+		return
+	}
+	var (
+		protocol         uint8
+		srcIP, dstIP     net.IP
+		srcPort, dstPort int
+		sec, usec        uint32
+	)
+	m = &Message{}
+	chunks := b[headerSize:size]
+	for len(chunks) > 0 {
+		if len(chunks) < chunkHeaderSize {
+			err = ErrorInvalidMessage
+			return
+		}
+		vendor := binary.BigEndian.Uint16(chunks)
+		typ := binary.BigEndian.Uint16(chunks[2:])
+		length := int(binary.BigEndian.Uint16(chunks[4:]))
+		if length < chunkHeaderSize || length > len(chunks) {
+			err = ErrorInvalidMessage
+			return
+		}
+		value := chunks[chunkHeaderSize:length]
+		chunks = chunks[length:]
+		//忽略厂商自定义的chunk
+		if vendor != 0 {
+			continue
+		}
+		switch {
+		case typ == chunkProtocol && len(value) == 1:
+			protocol = value[0]
+		case (typ == chunkIPv4Src || typ == chunkIPv6Src) && (len(value) == net.IPv4len || len(value) == net.IPv6len):
+			srcIP = append(net.IP{}, value...)
+		case (typ == chunkIPv4Dst || typ == chunkIPv6Dst) && (len(value) == net.IPv4len || len(value) == net.IPv6len):
+			dstIP = append(net.IP{}, value...)
+		case typ == chunkSrcPort && len(value) == 2:
+			srcPort = int(binary.BigEndian.Uint16(value))
+		case typ == chunkDstPort && len(value) == 2:
+			dstPort = int(binary.BigEndian.Uint16(value))
+		case typ == chunkTimestamp && len(value) == 4:
+			sec = binary.BigEndian.Uint32(value)
+		case typ == chunkTimestampUsec && len(value) == 4:
+			usec = binary.BigEndian.Uint32(value)
+		case typ == chunkProtocolType && len(value) == 1:
+			m.ProtocolType = value[0]
+		case typ == chunkCaptureID && len(value) == 4:
+			m.CaptureID = binary.BigEndian.Uint32(value)
+		case typ == chunkAuthKey:
+			m.Password = string(value)
+		case typ == chunkCorrelationID:
+			m.CorrelationID = string(value)
+		case typ == chunkPayload:
+			m.Payload = append([]byte{}, value...)
+		}
+	}
+	m.Time = time.Unix(int64(sec), int64(usec)*1000)
+	if protocol == protocolTCP {
+		m.Network = NetworkTCP
+		m.Src = &net.TCPAddr{IP: srcIP, Port: srcPort}
+		m.Dst = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	} else {
+		m.Network = NetworkUDP
+		m.Src = &net.UDPAddr{IP: srcIP, Port: srcPort}
+		m.Dst = &net.UDPAddr{IP: dstIP, Port: dstPort}
+	}
+	return
+}
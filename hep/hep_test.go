@@ -0,0 +1,133 @@
+package hep
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/uole/sip"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testInvite = "INVITE sip:1001@127.0.0.1 SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 192.168.1.10:5060;branch=z9hG4bK-hep\r\n" +
+	"From: <sip:1000@127.0.0.1>;tag=hep\r\n" +
+	"To: <sip:1001@127.0.0.1>\r\n" +
+	"Call-ID: hep-call\r\n" +
+	"CSeq: 1 INVITE\r\n" +
+	"Content-Length: 0\r\n\r\n"
+
+func TestEncode(t *testing.T) {
+	now := time.Now()
+	cases := []*Message{
+		{Time: now, Network: NetworkUDP, Src: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5060}, Dst: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5080}},
+		{Time: now, Network: NetworkTCP, Src: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5060}, Dst: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 5061}},
+	}
+	for _, m := range cases {
+		m.CaptureID, m.Password, m.CorrelationID, m.Payload = 2001, "secret", "hep-call", []byte(testInvite)
+		b, err := Encode(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:4]) != "HEP3" || int(binary.BigEndian.Uint16(b[4:])) != len(b) {
+			t.Fatalf("unexpected header %q", b[:6])
+		}
+		decoded, err := Decode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Network != m.Network || decoded.Src.String() != m.Src.String() || decoded.Dst.String() != m.Dst.String() {
+			t.Errorf("unexpected addresses %s %s %s", decoded.Network, decoded.Src, decoded.Dst)
+		}
+		if decoded.CaptureID != 2001 || decoded.Password != "secret" || decoded.CorrelationID != "hep-call" || decoded.ProtocolType != ProtocolSIP {
+			t.Errorf("unexpected message %+v", decoded)
+		}
+		if string(decoded.Payload) != testInvite || decoded.Time.UnixNano()/1000 != now.UnixNano()/1000 {
+			t.Error("unexpected payload or time")
+		}
+	}
+	if _, err := Decode([]byte("HEP3\x00\x20")); err != ErrorInvalidMessage {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func testEvent(t *testing.T) *sip.TraceEvent {
+	req, err := sip.ReadRequest(bufio.NewReader(strings.NewReader(testInvite)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sip.TraceEvent{
+		Time:       time.Now(),
+		Direction:  sip.TraceReceive,
+		Transport:  sip.ProtoUDP,
+		LocalAddr:  &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5060},
+		RemoteAddr: &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000},
+		Raw:        []byte(testInvite),
+		Request:    req,
+	}
+}
+
+func TestAgent_UDP(t *testing.T) {
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	agent, err := NewAgent("udp", collector.LocalAddr().String(), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	agent.Trace(testEvent(t))
+	buf := make([]byte, 4096)
+	_ = collector.SetReadDeadline(time.Now().Add(time.Second * 3))
+	n, _, err := collector.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Decode(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.CaptureID != 7 || m.CorrelationID != "hep-call" || m.Src.String() != "203.0.113.7:40000" || m.Dst.String() != "10.0.0.1:5060" {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
+
+func TestAgent_TCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	agent, err := NewAgent("tcp", l.Addr().String(), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	agent.Trace(testEvent(t))
+	agent.Trace(testEvent(t))
+	_ = agent.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	//tcp上的消息按照头部的长度分割
+	for i := 0; i < 2; i++ {
+		header := make([]byte, headerSize)
+		if _, err = io.ReadFull(conn, header); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, binary.BigEndian.Uint16(header[4:]))
+		copy(b, header)
+		if _, err = io.ReadFull(conn, b[headerSize:]); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := Decode(b); err != nil || m.CaptureID != 8 {
+			t.Errorf("unexpected message %v", err)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	//DefaultKeepAliveInterval 默认的保活间隔, 小于常见NAT的30秒超时
+	DefaultKeepAliveInterval = time.Second * 25
+	//DefaultKeepAliveTimeout 等待保活回应的时间(RFC 5626 4.4.1)
+	DefaultKeepAliveTimeout = time.Second * 10
+)
+
+var (
+	ErrorKeepAliveTimeout = errors.New("keep-alive timeout")
+
+	//crlfPing 流式传输层的保活请求, 对端回复一个CRLF
+	crlfPing = []byte("\r\n\r\n")
+	crlfPong = []byte("\r\n")
+)
+
+type (
+	//Pinger 支持传输层保活的传输层, TCP以及TLS使用CRLF, UDP使用STUN绑定请求
+	Pinger interface {
+		//Ping 向addr发送保活并等待回应, addr为空时使用已经建立的连接. 返回对端看到的本地地址, 只有STUN会返回
+		Ping(ctx context.Context, addr net.Addr) (mapped net.Addr, err error)
+	}
+
+	//LivenessEvent 对端状态变化的事件
+	LivenessEvent struct {
+		Target string
+		Alive  bool
+		Mapped net.Addr      //STUN返回的映射地址
+		RTT    time.Duration //保活的往返时间
+		Err    error
+	}
+
+	//KeepAlive 定时发送保活, 对端状态变化时通知
+	KeepAlive struct {
+		Interval time.Duration          //保活间隔
+		Timeout  time.Duration          //等待回应的时间
+		OnEvent  func(e *LivenessEvent) //状态变化的回调, 需要在Run之前设置
+		target   string
+		probe    func(ctx context.Context) (mapped net.Addr, err error)
+		events   chan *LivenessEvent
+		mutex    sync.Mutex
+		alive    bool
+		probed   bool
+	}
+
+	//pongTable 等待保活回应, 按照对端地址或者STUN事物ID区分
+	pongTable struct {
+		mutex   sync.Mutex
+		waiters map[string]chan net.Addr
+	}
+)
+
+func (t *pongTable) wait(key string) chan net.Addr {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.waiters == nil {
+		t.waiters = make(map[string]chan net.Addr)
+	}
+	c := make(chan net.Addr, 1)
+	t.waiters[key] = c
+	return c
+}
+
+func (t *pongTable) cancel(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.waiters, key)
+}
+
+//pending 是否在等待对端的保活回应
+func (t *pongTable) pending(key string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, ok := t.waiters[key]
+	return ok
+}
+
+//notify 收到保活回应, 没有等待时忽略
+func (t *pongTable) notify(key string, mapped net.Addr) {
+	t.mutex.Lock()
+	c, ok := t.waiters[key]
+	delete(t.waiters, key)
+	t.mutex.Unlock()
+	if ok {
+		c <- mapped
+	}
+}
+
+//await 等待保活回应
+func (t *pongTable) await(ctx context.Context, key string, c chan net.Addr) (mapped net.Addr, err error) {
+	select {
+	case mapped = <-c:
+	case <-ctx.Done():
+		t.cancel(key)
+		err = ErrorKeepAliveTimeout
+	}
+	return
+}
+
+//isKeepAlive 消息是否只包含CRLF
+func isKeepAlive(p []byte) bool {
+	for _, b := range p {
+		if b != '\r' && b != '\n' {
+			return false
+		}
+	}
+	return len(p) > 0
+}
+
+//Events 对端状态变化的事件, 事件没有及时读取时会被丢弃
+func (k *KeepAlive) Events() <-chan *LivenessEvent {
+	return k.events
+}
+
+//Alive 对端是否存活
+func (k *KeepAlive) Alive() bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.alive
+}
+
+//check 发送一次保活, 第一次保活以及状态变化时通知
+func (k *KeepAlive) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, k.Timeout)
+	defer cancel()
+	start := time.Now()
+	mapped, err := k.probe(ctx)
+	e := &LivenessEvent{Target: k.target, Alive: err == nil, Mapped: mapped, Err: err}
+	if err == nil {
+		e.RTT = time.Since(start)
+	}
+	k.mutex.Lock()
+	changed := !k.probed || k.alive != e.Alive
+	k.probed, k.alive = true, e.Alive
+	k.mutex.Unlock()
+	if !changed {
+		return
+	}
+	if k.OnEvent != nil {
+		k.OnEvent(e)
+	}
+	select {
+	case k.events <- e:
+	default:
+	}
+}
+
+//Run 立即发送保活, 之后按照Interval发送, ctx结束后返回
+func (k *KeepAlive) Run(ctx context.Context) (err error) {
+	ticker := time.NewTicker(k.Interval)
+	defer ticker.Stop()
+	for {
+		k.check(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func newKeepAlive(target string, probe func(ctx context.Context) (net.Addr, error)) *KeepAlive {
+	return &KeepAlive{
+		Interval: DefaultKeepAliveInterval,
+		Timeout:  DefaultKeepAliveTimeout,
+		target:   target,
+		probe:    probe,
+		events:   make(chan *LivenessEvent, 16),
+	}
+}
+
+//NewKeepAlive 创建传输层的保活, 流式传输层使用CRLF, UDP使用STUN. addr为空时使用已经建立的连接
+func NewKeepAlive(tp Transport, addr net.Addr) (k *KeepAlive, err error) {
+	pinger, ok := tp.(Pinger)
+	if !ok {
+		err = ErrorNotSupported
+		return
+	}
+	target := ""
+	if addr != nil {
+		target = addr.String()
+	} else if conn := tp.Conn(); conn != nil && conn.RemoteAddr() != nil {
+		target = conn.RemoteAddr().String()
+	}
+	k = newKeepAlive(target, func(ctx context.Context) (net.Addr, error) {
+		return pinger.Ping(ctx, addr)
+	})
+	return
+}
+
+//NewOptionsKeepAlive 创建使用OPTIONS请求的保活, 收到任何最终响应都认为对端存活
+func NewOptionsKeepAlive(client *Client, target string) *KeepAlive {
+	return newKeepAlive(target, func(ctx context.Context) (mapped net.Addr, err error) {
+		var sipErr *SipError
+		if _, err = client.Options(ctx, target); errors.As(err, &sipErr) || err == ErrorAuthenticationFailed {
+			err = nil
+		}
+		return
+	})
+}
@@ -0,0 +1,150 @@
+package sip
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPTransport_Ping(t *testing.T) {
+	server := NewTCPTransport()
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	tp := NewTCPTransport()
+	if err := tp.Dial(server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if _, err := tp.(Pinger).Ping(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPTransport_Ping(t *testing.T) {
+	server := NewUDPTransport()
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	tp := NewUDPTransport()
+	if err := tp.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	mapped, err := tp.(Pinger).Ping(ctx, server.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapped == nil || mapped.String() != tp.LocalAddr().String() {
+		t.Errorf("unexpected mapped address %v", mapped)
+	}
+}
+
+func TestKeepAlive_Run(t *testing.T) {
+	server := NewUDPTransport()
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	tp := NewUDPTransport()
+	if err := tp.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	k, err := NewKeepAlive(tp, server.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Interval = time.Millisecond * 50
+	k.Timeout = time.Millisecond * 200
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go k.Run(ctx)
+	for i, alive := range []bool{true, false} {
+		select {
+		case e := <-k.Events():
+			if e.Alive != alive {
+				t.Fatalf("event %d: unexpected liveness %v: %v", i, e.Alive, e.Err)
+			}
+			if alive && e.Mapped == nil {
+				t.Error("missing mapped address")
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("event %d: timeout", i)
+		}
+		if alive {
+			server.Close()
+		}
+	}
+	if k.Alive() {
+		t.Error("server still alive")
+	}
+}
+
+func TestNewOptionsKeepAlive(t *testing.T) {
+	server := NewUDPTransport()
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for req := range server.Request() {
+			_ = server.Respond(NewResponse(StatusNotFound, req))
+		}
+	}()
+	tp := NewUDPTransport()
+	if err := tp.Dial(server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	client := NewClient(tp, &Account{Username: "1001", Domain: "127.0.0.1"})
+	k := NewOptionsKeepAlive(client, "sip:"+server.LocalAddr().String())
+	k.OnEvent = func(e *LivenessEvent) {
+		if !e.Alive {
+			t.Errorf("final response should keep the peer alive: %v", e.Err)
+		}
+	}
+	k.check(context.Background())
+	if _, err := NewKeepAlive(NewWSTransport(), nil); err != ErrorNotSupported {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+//newSTUNAttr 创建只包含一个XOR-MAPPED-ADDRESS属性的绑定响应, value为属性的原始值
+func newSTUNAttr(value []byte) []byte {
+	msg := (&stunMessage{Type: stunBindingSuccess}).Bytes()
+	attr := make([]byte, 4, 4+len(value))
+	binary.BigEndian.PutUint16(attr[0:], stunAttrXorMappedAddress)
+	binary.BigEndian.PutUint16(attr[2:], uint16(len(value)))
+	attr = append(attr, value...)
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(attr)))
+	return append(msg, attr...)
+}
+
+func Test_parseSTUN(t *testing.T) {
+	for _, addr := range []*net.UDPAddr{{IP: net.IPv4(203, 0, 113, 7), Port: 5060}, {IP: net.ParseIP("2001:db8::1"), Port: 5061}} {
+		m, err := parseSTUN((&stunMessage{Type: stunBindingSuccess, Mapped: addr}).Bytes())
+		if err != nil || m.Mapped == nil || m.Mapped.String() != addr.String() {
+			t.Errorf("unexpected mapped address %v %v", m, err)
+		}
+	}
+	cases := map[string][]byte{
+		"oversized":      append([]byte{0, stunFamilyIPv6, 0, 0}, make([]byte, 20)...),
+		"truncated":      {0, stunFamilyIPv4, 0, 0},
+		"short ipv6":     append([]byte{0, stunFamilyIPv6, 0, 0}, make([]byte, 4)...),
+		"unknown family": append([]byte{0, 0x03, 0, 0}, make([]byte, 4)...),
+	}
+	for name, value := range cases {
+		m, err := parseSTUN(newSTUNAttr(value))
+		if err != nil || m.Mapped != nil {
+			t.Errorf("%s: unexpected mapped address %v %v", name, m, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package sip
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	//日志中常用的字段
+	FieldCallID = "call_id"
+	FieldMethod = "method"
+	FieldPeer   = "peer"
+	FieldError  = "error"
+)
+
+type (
+	//Logger 结构化日志接口, fields为交替出现的key以及value
+	Logger interface {
+		Debug(msg string, fields ...interface{})
+		Info(msg string, fields ...interface{})
+		Warn(msg string, fields ...interface{})
+		Error(msg string, fields ...interface{})
+	}
+
+	//nopLogger 丢弃所有日志, 默认使用
+	nopLogger struct{}
+
+	//stdLogger 使用标准库log输出的日志
+	stdLogger struct {
+		logger *log.Logger
+	}
+)
+
+func (nopLogger) Debug(msg string, fields ...interface{}) {}
+
+func (nopLogger) Info(msg string, fields ...interface{}) {}
+
+func (nopLogger) Warn(msg string, fields ...interface{}) {}
+
+func (nopLogger) Error(msg string, fields ...interface{}) {}
+
+func (l *stdLogger) output(level string, msg string, fields []interface{}) {
+	var sb strings.Builder
+	sb.WriteString(level)
+	sb.WriteString(" ")
+	sb.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		sb.WriteString(" ")
+		if i+1 < len(fields) {
+			sb.WriteString(fmt.Sprintf("%v=%v", fields[i], fields[i+1]))
+		} else {
+			sb.WriteString(fmt.Sprintf("%v", fields[i]))
+		}
+	}
+	_ = l.logger.Output(3, sb.String())
+}
+
+func (l *stdLogger) Debug(msg string, fields ...interface{}) {
+	l.output("DEBUG", msg, fields)
+}
+
+func (l *stdLogger) Info(msg string, fields ...interface{}) {
+	l.output("INFO", msg, fields)
+}
+
+func (l *stdLogger) Warn(msg string, fields ...interface{}) {
+	l.output("WARN", msg, fields)
+}
+
+func (l *stdLogger) Error(msg string, fields ...interface{}) {
+	l.output("ERROR", msg, fields)
+}
+
+//NopLogger 丢弃所有日志的Logger
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+//NewStdLogger 使用标准库log输出key=value格式的日志, logger为空时使用log的默认输出
+func NewStdLogger(logger *log.Logger) Logger {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &stdLogger{logger: logger}
+}
@@ -0,0 +1,37 @@
+//go:build go1.21
+// +build go1.21
+
+package sip
+
+import (
+	"context"
+	"log/slog"
+)
+
+type (
+	//slogLogger 使用log/slog输出的日志
+	slogLogger struct {
+		logger *slog.Logger
+	}
+)
+
+func (l *slogLogger) Debug(msg string, fields ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelDebug, msg, fields...)
+}
+
+func (l *slogLogger) Info(msg string, fields ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelInfo, msg, fields...)
+}
+
+func (l *slogLogger) Warn(msg string, fields ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelWarn, msg, fields...)
+}
+
+func (l *slogLogger) Error(msg string, fields ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelError, msg, fields...)
+}
+
+//NewSlogLogger 使用slog.Handler输出日志, 级别映射到slog的对应级别
+func NewSlogLogger(handler slog.Handler) Logger {
+	return &slogLogger{logger: slog.New(handler)}
+}
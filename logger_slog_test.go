@@ -0,0 +1,22 @@
+//go:build go1.21
+// +build go1.21
+
+package sip
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewSlogLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewSlogLogger(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	logger.Debug("dropped")
+	logger.Warn("request overloaded", FieldCallID, "abc", FieldMethod, "INVITE")
+	s := buf.String()
+	if strings.Contains(s, "dropped") || !strings.Contains(s, "level=WARN") || !strings.Contains(s, "call_id=abc method=INVITE") {
+		t.Errorf("unexpected output %q", s)
+	}
+}
@@ -0,0 +1,75 @@
+package sip
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//recordLogger 记录日志用于测试
+type recordLogger struct {
+	mutex   sync.Mutex
+	entries []string
+}
+
+func (l *recordLogger) record(level string, msg string, fields []interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, fmt.Sprint(level, " ", msg, " ", fields))
+}
+
+func (l *recordLogger) Debug(msg string, fields ...interface{}) { l.record("DEBUG", msg, fields) }
+
+func (l *recordLogger) Info(msg string, fields ...interface{}) { l.record("INFO", msg, fields) }
+
+func (l *recordLogger) Warn(msg string, fields ...interface{}) { l.record("WARN", msg, fields) }
+
+func (l *recordLogger) Error(msg string, fields ...interface{}) { l.record("ERROR", msg, fields) }
+
+func (l *recordLogger) Entries() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string{}, l.entries...)
+}
+
+func TestNewStdLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewStdLogger(log.New(buf, "", 0))
+	logger.Warn("parse message failed", FieldPeer, "127.0.0.1:5060", FieldCallID, "abc")
+	if s := buf.String(); s != "WARN parse message failed peer=127.0.0.1:5060 call_id=abc\n" {
+		t.Errorf("unexpected output %q", s)
+	}
+}
+
+func TestUDPTransport_SetLogger(t *testing.T) {
+	tp := NewUDPTransport()
+	if err := tp.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	logger := &recordLogger{}
+	tp.SetLogger(logger)
+	conn, err := net.Dial("udp", tp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("SIP/2.0 abc Bad\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if entries := logger.Entries(); len(entries) > 0 {
+			if !strings.HasPrefix(entries[0], "WARN parse message failed [peer "+conn.LocalAddr().String()) {
+				t.Errorf("unexpected entry %s", entries[0])
+			}
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Error("parse error not logged")
+}
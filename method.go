@@ -35,4 +35,7 @@ const (
 	MethodSubscribe Method = "SUBSCRIBE"
 	MethodNotify    Method = "NOTIFY"
 	MethodRefer     Method = "REFER"
+	MethodUpdate    Method = "UPDATE"
+	MethodMessage   Method = "MESSAGE"
+	MethodInfo      Method = "INFO"
 )
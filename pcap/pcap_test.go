@@ -0,0 +1,155 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/uole/sip"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const testInvite = "INVITE sip:1001@127.0.0.1 SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 192.168.1.10:5060;branch=z9hG4bK-pcap\r\n" +
+	"From: <sip:1000@127.0.0.1>;tag=pcap\r\n" +
+	"To: <sip:1001@127.0.0.1>\r\n" +
+	"Call-ID: pcap-call\r\n" +
+	"CSeq: 1 INVITE\r\n" +
+	"Content-Length: 0\r\n\r\n"
+
+const testResponse = "SIP/2.0 200 OK\r\n" +
+	"Via: SIP/2.0/UDP 192.168.1.10:5060;branch=z9hG4bK-pcap\r\n" +
+	"From: <sip:1000@127.0.0.1>;tag=pcap\r\n" +
+	"To: <sip:1001@127.0.0.1>;tag=callee\r\n" +
+	"Call-ID: pcap-call\r\n" +
+	"CSeq: 1 INVITE\r\n" +
+	"Content-Length: 0\r\n\r\n"
+
+func TestWriter_Reader(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5060}
+	remote := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+	now := time.Now()
+	w.Trace(&sip.TraceEvent{Time: now, Direction: sip.TraceReceive, Transport: sip.ProtoUDP, LocalAddr: local, RemoteAddr: remote, Raw: []byte(testInvite)})
+	w.Trace(&sip.TraceEvent{Time: now, Direction: sip.TraceSend, Transport: sip.ProtoUDP, LocalAddr: local, RemoteAddr: remote, Raw: []byte(testResponse)})
+	tcpLocal := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5060}
+	tcpRemote := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 50000}
+	for i := 0; i < 2; i++ {
+		if err = w.WritePacket(now, NetworkTCP, tcpRemote, tcpLocal, []byte(testInvite)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Network != NetworkUDP || packet.Src.String() != remote.String() || packet.Dst.String() != local.String() || packet.Time.UnixNano()/1000 != now.UnixNano()/1000 {
+		t.Errorf("unexpected packet %+v", packet)
+	}
+	req, _, err := ReadMessage(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.CallID() != "pcap-call" || req.RemoteAddr.String() != remote.String() {
+		t.Errorf("unexpected request %s", req.CallID())
+	}
+	if packet, err = r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, res, err := ReadMessage(packet); err != nil || res.StatusCode != sip.StatusOK || packet.Dst.String() != remote.String() {
+		t.Errorf("unexpected response %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if packet, err = r.Next(); err != nil {
+			t.Fatal(err)
+		}
+		if packet.Network != NetworkTCP || packet.Src.String() != tcpRemote.String() || string(packet.Payload) != testInvite {
+			t.Errorf("unexpected tcp packet %+v", packet)
+		}
+	}
+	if _, err = r.Next(); err != io.EOF {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 5060}
+	proxy := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5060}
+	_ = w.WritePacket(time.Now(), NetworkUDP, phone, proxy, []byte(testInvite))
+	_ = w.WritePacket(time.Now(), NetworkUDP, proxy, phone, []byte(testResponse))
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//只回放话机发送的消息
+	count, err := Replay(r, conn, func(packet *Packet) bool {
+		return packet.Src.String() == phone.String()
+	})
+	if err != nil || count != 1 {
+		t.Fatalf("unexpected replay %d %v", count, err)
+	}
+	p := make([]byte, 2048)
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := server.ReadFromUDP(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p[:n]) != testInvite {
+		t.Errorf("unexpected payload %q", p[:n])
+	}
+}
+
+func TestReader_recordTooLarge(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if _, err := NewWriter(buf); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[8:], 0xFFFFFFF0)
+	binary.LittleEndian.PutUint32(header[12:], 0xFFFFFFF0)
+	buf.Write(header)
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Next(); err != ErrorRecordTooLarge {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func Test_checksum(t *testing.T) {
+	src, dst := net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4()
+	segment := udpDatagram(src, dst, 5060, 5080, []byte("OPTIONS"))
+	if transportChecksum(src, dst, protocolUDP, segment) != 0 {
+		t.Error("invalid udp checksum")
+	}
+	if header := ipHeader(src, dst, protocolUDP, len(segment)); checksum(0, header) != 0 {
+		t.Error("invalid ipv4 header checksum")
+	}
+}
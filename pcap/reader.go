@@ -0,0 +1,219 @@
+package pcap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/uole/sip"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86DD
+	etherTypeVLAN = 0x8100
+)
+
+var (
+	responseFeature = []byte("SIP/")
+)
+
+type (
+	//Packet pcap文件中的一个UDP或者TCP数据包
+	Packet struct {
+		Time    time.Time
+		Network string //NetworkUDP或者NetworkTCP
+		Src     net.Addr
+		Dst     net.Addr
+		Payload []byte
+	}
+
+	//Reader 读取pcap文件中的UDP以及TCP负载, 支持LinkTypeRaw以及LinkTypeEthernet
+	Reader struct {
+		r        io.Reader
+		order    binary.ByteOrder
+		nano     bool
+		linkType uint32
+		snapLen  uint32 //数据包的最大长度, 超过时返回ErrorRecordTooLarge
+	}
+)
+
+//Next 读取下一个带有负载的UDP或者TCP数据包, 其他数据包会被跳过, 文件结束时返回io.EOF
+//数据包长度超过文件头部的抓包长度时返回ErrorRecordTooLarge
+func (r *Reader) Next() (packet *Packet, err error) {
+	header := make([]byte, 16)
+	for {
+		if _, err = io.ReadFull(r.r, header); err != nil {
+			return
+		}
+		size := r.order.Uint32(header[8:])
+		if size > r.snapLen {
+			err = ErrorRecordTooLarge
+			return
+		}
+		data := make([]byte, size)
+		if _, err = io.ReadFull(r.r, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		sec, frac := int64(r.order.Uint32(header[0:])), int64(r.order.Uint32(header[4:]))
+		if !r.nano {
+			frac *= 1000
+		}
+		if packet = r.decode(data); packet != nil {
+			packet.Time = time.Unix(sec, frac)
+			return
+		}
+	}
+}
+
+//decode 解析链路层以及网络层, 不是UDP或者TCP数据包时返回空
+func (r *Reader) decode(data []byte) *Packet {
+	if r.linkType == LinkTypeEthernet {
+		if len(data) < 14 {
+			return nil
+		}
+		etherType := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		if etherType == etherTypeVLAN && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+		if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+			return nil
+		}
+	}
+	if len(data) < 1 {
+		return nil
+	}
+	var (
+		protocol     byte
+		srcIP, dstIP net.IP
+		segment      []byte
+	)
+	switch data[0] >> 4 {
+	case 4:
+		size := int(data[0]&0x0F) * 4
+		if len(data) < ipv4HeaderSize || size < ipv4HeaderSize || len(data) < size {
+			return nil
+		}
+		total := int(binary.BigEndian.Uint16(data[2:]))
+		if total < size || total > len(data) {
+			total = len(data)
+		}
+		protocol = data[9]
+		srcIP, dstIP = net.IP(data[12:16]), net.IP(data[16:20])
+		segment = data[size:total]
+	case 6:
+		if len(data) < ipv6HeaderSize {
+			return nil
+		}
+		total := ipv6HeaderSize + int(binary.BigEndian.Uint16(data[4:]))
+		if total > len(data) {
+			total = len(data)
+		}
+		protocol = data[6]
+		srcIP, dstIP = net.IP(data[8:24]), net.IP(data[24:40])
+		segment = data[ipv6HeaderSize:total]
+	default:
+		return nil
+	}
+	switch protocol {
+	case protocolUDP:
+		if len(segment) < udpHeaderSize {
+			return nil
+		}
+		return &Packet{
+			Network: NetworkUDP,
+			Src:     &net.UDPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(segment[0:]))},
+			Dst:     &net.UDPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(segment[2:]))},
+			Payload: segment[udpHeaderSize:],
+		}
+	case protocolTCP:
+		if len(segment) < tcpHeaderSize {
+			return nil
+		}
+		offset := int(segment[12]>>4) * 4
+		if offset < tcpHeaderSize || offset >= len(segment) {
+			return nil
+		}
+		return &Packet{
+			Network: NetworkTCP,
+			Src:     &net.TCPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(segment[0:]))},
+			Dst:     &net.TCPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(segment[2:]))},
+			Payload: segment[offset:],
+		}
+	}
+	return nil
+}
+
+//ReadMessage 解析数据包负载中的sip消息
+func ReadMessage(packet *Packet) (req *sip.Request, res *sip.Response, err error) {
+	b := bufio.NewReader(bytes.NewReader(packet.Payload))
+	if bytes.HasPrefix(packet.Payload, responseFeature) {
+		res, err = sip.ReadResponse(b)
+		if res != nil {
+			res.RemoteAddr = packet.Src
+		}
+	} else {
+		req, err = sip.ReadRequest(b)
+		if req != nil {
+			req.RemoteAddr = packet.Src
+		}
+	}
+	return
+}
+
+//Replay 把文件中的sip负载依次写入w, filter为空时写入所有的负载, 返回写入的数量.
+//w可以是连接到代理的udp连接, 用于回归测试
+func Replay(r *Reader, w io.Writer, filter func(packet *Packet) bool) (count int, err error) {
+	var packet *Packet
+	for {
+		if packet, err = r.Next(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if filter != nil && !filter(packet) {
+			continue
+		}
+		if _, err = w.Write(packet.Payload); err != nil {
+			return
+		}
+		count++
+	}
+}
+
+//NewReader 读取pcap文件头部, 支持两种字节序以及纳秒精度的文件
+func NewReader(r io.Reader) (*Reader, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	reader := &Reader{r: r}
+	switch {
+	case binary.LittleEndian.Uint32(header) == magicMicroseconds:
+		reader.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header) == magicMicroseconds:
+		reader.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(header) == magicNanoseconds:
+		reader.order, reader.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(header) == magicNanoseconds:
+		reader.order, reader.nano = binary.BigEndian, true
+	default:
+		return nil, ErrorInvalidFile
+	}
+	reader.linkType = reader.order.Uint32(header[20:])
+	if reader.snapLen = reader.order.Uint32(header[16:]); reader.snapLen == 0 || reader.snapLen > MaxRecordLength {
+		reader.snapLen = MaxRecordLength
+	}
+	if reader.linkType != LinkTypeRaw && reader.linkType != LinkTypeEthernet {
+		return nil, ErrorInvalidFile
+	}
+	return reader, nil
+}
@@ -0,0 +1,218 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/uole/sip"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	magicMicroseconds = 0xA1B2C3D4
+	magicNanoseconds  = 0xA1B23C4D
+	versionMajor      = 2
+	versionMinor      = 4
+
+	//LinkTypeRaw 数据包直接以IPv4或者IPv6头部开始
+	LinkTypeRaw = 101
+	//LinkTypeEthernet 以太网帧
+	LinkTypeEthernet = 1
+
+	//DefaultSnapLength 默认的最大抓包长度
+	DefaultSnapLength = 65535
+	//MaxRecordLength 读取时允许的最大数据包长度, 与libpcap的最大抓包长度相同
+	MaxRecordLength = 262144
+
+	NetworkUDP = "udp"
+	NetworkTCP = "tcp"
+
+	protocolTCP = 6
+	protocolUDP = 17
+
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+	udpHeaderSize  = 8
+	tcpHeaderSize  = 20
+)
+
+var (
+	ErrorInvalidAddress = sip.ErrorInvalidAddress
+	ErrorInvalidFile    = errors.New("invalid pcap file")
+	ErrorRecordTooLarge = errors.New("pcap record too large")
+)
+
+type (
+	//Writer 写入pcap文件, 使用合成的IP以及UDP/TCP头部保存sip消息, 可以直接作为sip.Tracer使用
+	Writer struct {
+		mutex sync.Mutex
+		w     io.Writer
+		seqs  map[string]uint32 //TCP每个方向的序列号
+	}
+)
+
+//Trace 记录传输层或者代理的跟踪事件, 写入失败时忽略
+func (w *Writer) Trace(e *sip.TraceEvent) {
+	if len(e.Raw) == 0 {
+		return
+	}
+	network := NetworkTCP
+	if e.Transport == sip.ProtoUDP {
+		network = NetworkUDP
+	}
+	src, dst := e.LocalAddr, e.RemoteAddr
+	if e.Direction == sip.TraceReceive {
+		src, dst = dst, src
+	}
+	_ = w.WritePacket(e.Time, network, src, dst, e.Raw)
+}
+
+//WritePacket 写入一个数据包, network为udp或者tcp, 地址为空时使用未指定的地址
+func (w *Writer) WritePacket(t time.Time, network string, src, dst net.Addr, payload []byte) (err error) {
+	var (
+		srcIP, dstIP     net.IP
+		srcPort, dstPort int
+		segment          []byte
+	)
+	if srcIP, srcPort, err = sip.SplitAddr(src); err != nil {
+		return
+	}
+	if dstIP, dstPort, err = sip.SplitAddr(dst); err != nil {
+		return
+	}
+	//地址族不一致时统一使用IPv6
+	if (srcIP.To4() == nil) != (dstIP.To4() == nil) {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	} else if srcIP.To4() != nil {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	protocol := byte(protocolUDP)
+	if network == NetworkTCP {
+		protocol = protocolTCP
+		segment = w.tcpSegment(srcIP, dstIP, srcPort, dstPort, payload)
+	} else {
+		segment = udpDatagram(srcIP, dstIP, srcPort, dstPort, payload)
+	}
+	packet := append(ipHeader(srcIP, dstIP, protocol, len(segment)), segment...)
+	length := len(packet)
+	if len(packet) > DefaultSnapLength {
+		packet = packet[:DefaultSnapLength]
+	}
+	record := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(length))
+	_, err = w.w.Write(append(record, packet...))
+	return
+}
+
+//tcpSegment 创建TCP数据段, 每个方向的序列号按照负载长度递增
+func (w *Writer) tcpSegment(srcIP, dstIP net.IP, srcPort, dstPort int, payload []byte) []byte {
+	key := net.JoinHostPort(srcIP.String(), strconv.Itoa(srcPort)) + ">" + net.JoinHostPort(dstIP.String(), strconv.Itoa(dstPort))
+	reverse := net.JoinHostPort(dstIP.String(), strconv.Itoa(dstPort)) + ">" + net.JoinHostPort(srcIP.String(), strconv.Itoa(srcPort))
+	seq, ack := w.seqs[key], w.seqs[reverse]
+	w.seqs[key] = seq + uint32(len(payload))
+	b := make([]byte, tcpHeaderSize+len(payload))
+	binary.BigEndian.PutUint16(b[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:], uint16(dstPort))
+	binary.BigEndian.PutUint32(b[4:], seq)
+	binary.BigEndian.PutUint32(b[8:], ack)
+	b[12] = (tcpHeaderSize / 4) << 4
+	//PSH以及ACK
+	b[13] = 0x18
+	binary.BigEndian.PutUint16(b[14:], 0xFFFF)
+	copy(b[tcpHeaderSize:], payload)
+	binary.BigEndian.PutUint16(b[16:], transportChecksum(srcIP, dstIP, protocolTCP, b))
+	return b
+}
+
+//udpDatagram 创建UDP数据报
+func udpDatagram(srcIP, dstIP net.IP, srcPort, dstPort int, payload []byte) []byte {
+	b := make([]byte, udpHeaderSize+len(payload))
+	binary.BigEndian.PutUint16(b[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)))
+	copy(b[udpHeaderSize:], payload)
+	//校验和为0表示没有校验
+	s := transportChecksum(srcIP, dstIP, protocolUDP, b)
+	if s == 0 {
+		s = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(b[6:], s)
+	return b
+}
+
+//ipHeader 创建IPv4或者IPv6头部
+func ipHeader(srcIP, dstIP net.IP, protocol byte, length int) []byte {
+	if len(srcIP) == net.IPv4len {
+		b := make([]byte, ipv4HeaderSize)
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[2:], uint16(ipv4HeaderSize+length))
+		b[8] = 64
+		b[9] = protocol
+		copy(b[12:], srcIP)
+		copy(b[16:], dstIP)
+		binary.BigEndian.PutUint16(b[10:], checksum(0, b))
+		return b
+	}
+	b := make([]byte, ipv6HeaderSize)
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:], uint16(length))
+	b[6] = protocol
+	b[7] = 64
+	copy(b[8:], srcIP)
+	copy(b[24:], dstIP)
+	return b
+}
+
+//transportChecksum 计算UDP以及TCP包含伪头部的校验和
+func transportChecksum(srcIP, dstIP net.IP, protocol byte, segment []byte) uint16 {
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, srcIP...)
+	pseudo = append(pseudo, dstIP...)
+	if len(srcIP) == net.IPv4len {
+		pseudo = append(pseudo, 0, protocol, byte(len(segment)>>8), byte(len(segment)))
+	} else {
+		pseudo = append(pseudo, byte(len(segment)>>24), byte(len(segment)>>16), byte(len(segment)>>8), byte(len(segment)), 0, 0, 0, protocol)
+	}
+	return checksum(sum(0, pseudo), segment)
+}
+
+func sum(s uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+//checksum 互联网校验和(RFC 1071)
+func checksum(s uint32, b []byte) uint16 {
+	s = sum(s, b)
+	for s>>16 != 0 {
+		s = s&0xFFFF + s>>16
+	}
+	return ^uint16(s)
+}
+
+//NewWriter 创建pcap写入器并写入文件头部, 链路层类型为LinkTypeRaw
+func NewWriter(w io.Writer) (*Writer, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], magicMicroseconds)
+	binary.LittleEndian.PutUint16(header[4:], versionMajor)
+	binary.LittleEndian.PutUint16(header[6:], versionMinor)
+	binary.LittleEndian.PutUint32(header[16:], DefaultSnapLength)
+	binary.LittleEndian.PutUint32(header[20:], LinkTypeRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, seqs: make(map[string]uint32)}, nil
+}
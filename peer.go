@@ -0,0 +1,121 @@
+package sip
+
+import (
+	"net"
+	"sync"
+)
+
+type (
+	//peer 面向连接的传输层上的一个对端连接
+	peer interface {
+		Write(p []byte) (n int, err error)
+		Close() (err error)
+	}
+
+	//peerTable 按照对端地址保存连接
+	peerTable struct {
+		mutex   sync.RWMutex
+		peers   map[string]peer
+		dialers map[string]*peerDialer
+	}
+
+	//peerDialer 同一个对端的连接建立串行执行, 避免重复建立连接
+	peerDialer struct {
+		mutex sync.Mutex
+		refs  int
+	}
+
+	//streamPeer 流式连接, 写入需要串行
+	streamPeer struct {
+		conn  net.Conn
+		mutex sync.Mutex
+	}
+)
+
+func (p *streamPeer) Write(b []byte) (n int, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.conn.Write(b)
+}
+
+func (p *streamPeer) Close() (err error) {
+	return p.conn.Close()
+}
+
+func (t *peerTable) get(addr net.Addr) (p peer, ok bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	p, ok = t.peers[addr.String()]
+	return
+}
+
+func (t *peerTable) add(addr net.Addr, p peer) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.peers == nil {
+		t.peers = make(map[string]peer)
+	}
+	t.peers[addr.String()] = p
+}
+
+func (t *peerTable) remove(addr net.Addr) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.peers, addr.String())
+}
+
+//dial 获取对端的连接, 没有连接时使用dial建立, 返回的created表示连接是新建立的
+func (t *peerTable) dial(addr net.Addr, dial func() (peer, error)) (p peer, created bool, err error) {
+	var ok bool
+	key := addr.String()
+	t.mutex.Lock()
+	if t.dialers == nil {
+		t.dialers = make(map[string]*peerDialer)
+	}
+	d := t.dialers[key]
+	if d == nil {
+		d = &peerDialer{}
+		t.dialers[key] = d
+	}
+	d.refs++
+	t.mutex.Unlock()
+	d.mutex.Lock()
+	defer func() {
+		d.mutex.Unlock()
+		t.mutex.Lock()
+		if d.refs--; d.refs == 0 {
+			delete(t.dialers, key)
+		}
+		t.mutex.Unlock()
+	}()
+	if p, ok = t.get(addr); ok {
+		return
+	}
+	if p, err = dial(); err != nil {
+		return
+	}
+	t.add(addr, p)
+	created = true
+	return
+}
+
+//closeAll 关闭所有的连接
+func (t *peerTable) closeAll() {
+	t.mutex.Lock()
+	peers := t.peers
+	t.peers = nil
+	t.mutex.Unlock()
+	for _, p := range peers {
+		_ = p.Close()
+	}
+}
+
+//writeTo 写入指定的对端
+func (t *peerTable) writeTo(b []byte, addr net.Addr) (n int, err error) {
+	p, ok := t.get(addr)
+	if !ok {
+		err = ErrorPeerNotFound
+		return
+	}
+	return p.Write(b)
+}
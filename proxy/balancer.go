@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"github.com/uole/sip"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//后端的负载均衡策略
+	StrategyRoundRobin = "round_robin"  //轮询
+	StrategyWeighted   = "weighted"     //按照权重平滑轮询
+	StrategyLeastCalls = "least_calls"  //选择当前呼叫数最少的后端
+	StrategyHashCallID = "hash_call_id" //按照Call-ID一致性哈希
+	StrategyHashFrom   = "hash_from"    //按照From的用户一致性哈希, 同一个用户总是使用相同的后端
+)
+
+type (
+	//backend 路由的一个后端地址
+	backend struct {
+		addr      string
+		weight    int
+		current   int   //平滑加权轮询的当前权重
+		active    int32 //正在进行的呼叫数量
+		mutex     sync.Mutex
+		down      bool      //已经被摘除
+		downAt    time.Time //摘除或者最后一次失败的时间
+		failures  int       //连续失败的次数
+		successes int       //摘除后连续成功的次数
+	}
+
+	//balancer 从后端中选择一个地址, backends不为空
+	balancer interface {
+		pick(backends []*backend, req *sip.Request) *backend
+	}
+
+	roundRobinBalancer struct {
+		next uint32
+	}
+
+	//weightedBalancer 平滑加权轮询, 和nginx的算法相同
+	weightedBalancer struct {
+		mutex sync.Mutex
+	}
+
+	leastCallsBalancer struct {
+		fallback roundRobinBalancer
+	}
+
+	//hashBalancer 使用rendezvous哈希, 后端变化时只影响该后端上的key
+	hashBalancer struct {
+		key      func(req *sip.Request) string
+		fallback roundRobinBalancer
+	}
+)
+
+func (b *backend) acquire() {
+	atomic.AddInt32(&b.active, 1)
+}
+
+func (b *backend) release() {
+	atomic.AddInt32(&b.active, -1)
+}
+
+//activeCalls 正在进行的呼叫数量
+func (b *backend) activeCalls() int {
+	return int(atomic.LoadInt32(&b.active))
+}
+
+func (rb *roundRobinBalancer) pick(backends []*backend, req *sip.Request) *backend {
+	n := atomic.AddUint32(&rb.next, 1) - 1
+	return backends[int(n%uint32(len(backends)))]
+}
+
+func (wb *weightedBalancer) pick(backends []*backend, req *sip.Request) *backend {
+	var (
+		total    int
+		selected *backend
+	)
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	for _, b := range backends {
+		b.current += b.weight
+		total += b.weight
+		if selected == nil || b.current > selected.current {
+			selected = b
+		}
+	}
+	selected.current -= total
+	return selected
+}
+
+func (lb *leastCallsBalancer) pick(backends []*backend, req *sip.Request) *backend {
+	var (
+		selected []*backend
+		least    int
+	)
+	for _, b := range backends {
+		active := b.activeCalls()
+		if selected == nil || active < least {
+			selected = []*backend{b}
+			least = active
+		} else if active == least {
+			selected = append(selected, b)
+		}
+	}
+	//呼叫数相同的后端轮流使用
+	return lb.fallback.pick(selected, req)
+}
+
+func (hb *hashBalancer) pick(backends []*backend, req *sip.Request) *backend {
+	var (
+		key      string
+		score    uint64
+		selected *backend
+	)
+	if req != nil {
+		key = hb.key(req)
+	}
+	if key == "" {
+		return hb.fallback.pick(backends, req)
+	}
+	for _, b := range backends {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte(b.addr))
+		if v := h.Sum64(); selected == nil || v > score {
+			selected, score = b, v
+		}
+	}
+	return selected
+}
+
+func callIDKey(req *sip.Request) string {
+	return req.CallID()
+}
+
+func fromUserKey(req *sip.Request) string {
+	if from, ok := req.Header.Get(sip.HeaderFrom).(*sip.AddressHeader); ok && from.Uri != nil {
+		return from.Uri.User + "@" + from.Uri.Host
+	}
+	return ""
+}
+
+//newBalancer 创建策略对应的负载均衡, 未知的策略使用轮询
+func newBalancer(strategy string) balancer {
+	switch strategy {
+	case StrategyWeighted:
+		return &weightedBalancer{}
+	case StrategyLeastCalls:
+		return &leastCallsBalancer{}
+	case StrategyHashCallID:
+		return &hashBalancer{key: callIDKey}
+	case StrategyHashFrom:
+		return &hashBalancer{key: fromUserKey}
+	default:
+		return &roundRobinBalancer{}
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/uole/sip"
+	"testing"
+)
+
+func newBalancerRequest(callID string, user string) *sip.Request {
+	req := sip.NewRequest(sip.MethodInvite, "sip:1001@example.com")
+	req.Header.Set(sip.HeaderCallID, sip.NewPlainHeader(callID))
+	from, _ := sip.ParseUri("sip:" + user + "@example.com")
+	req.Header.Set(sip.HeaderFrom, &sip.AddressHeader{Uri: from, Params: sip.Map{}})
+	return req
+}
+
+func pickCounts(t *testing.T, route *Route, n int, req func(i int) *sip.Request) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		b, err := route.pick(req(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[b.addr]++
+	}
+	return counts
+}
+
+func TestRoute_pickRoundRobin(t *testing.T) {
+	route := &Route{Backend: []string{"a:5060", "b:5060", "c:5060"}}
+	counts := pickCounts(t, route, 30, func(i int) *sip.Request { return nil })
+	for _, addr := range route.Backend {
+		if counts[addr] != 10 {
+			t.Errorf("unexpected distribution %v", counts)
+		}
+	}
+}
+
+func TestRoute_pickWeighted(t *testing.T) {
+	route := &Route{Backend: []string{"a:5060", "b:5060", "c:5060"}, Strategy: StrategyWeighted, Weights: []int{5, 1}}
+	counts := pickCounts(t, route, 70, func(i int) *sip.Request { return nil })
+	if counts["a:5060"] != 50 || counts["b:5060"] != 10 || counts["c:5060"] != 10 {
+		t.Errorf("unexpected distribution %v", counts)
+	}
+}
+
+func TestRoute_pickLeastCalls(t *testing.T) {
+	route := &Route{Backend: []string{"a:5060", "b:5060"}, Strategy: StrategyLeastCalls}
+	for i := 0; i < 10; i++ {
+		b, err := route.pick(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.acquire()
+	}
+	for _, b := range route.backends {
+		if b.activeCalls() != 5 {
+			t.Errorf("unexpected active calls %d on %s", b.activeCalls(), b.addr)
+		}
+	}
+	route.backends[0].release()
+	if b, _ := route.pick(nil); b != route.backends[0] {
+		t.Errorf("expected least loaded backend, got %s", b.addr)
+	}
+}
+
+func TestRoute_pickHash(t *testing.T) {
+	route := &Route{Backend: []string{"a:5060", "b:5060", "c:5060", "d:5060"}, Strategy: StrategyHashFrom}
+	counts := pickCounts(t, route, 4000, func(i int) *sip.Request {
+		return newBalancerRequest(fmt.Sprintf("call-%d", i), fmt.Sprintf("%d", i%400))
+	})
+	for _, addr := range route.Backend {
+		if counts[addr] < 500 || counts[addr] > 1500 {
+			t.Errorf("unbalanced distribution %v", counts)
+		}
+	}
+	//同一个用户的不同呼叫使用相同的后端
+	first, _ := route.pick(newBalancerRequest("call-x", "1000"))
+	for i := 0; i < 10; i++ {
+		if b, _ := route.pick(newBalancerRequest(fmt.Sprintf("call-%d", i), "1000")); b != first {
+			t.Fatalf("user moved from %s to %s", first.addr, b.addr)
+		}
+	}
+
+	route = &Route{Backend: []string{"a:5060", "b:5060", "c:5060"}, Strategy: StrategyHashCallID}
+	first, _ = route.pick(newBalancerRequest("call-y", "1000"))
+	for i := 0; i < 10; i++ {
+		if b, _ := route.pick(newBalancerRequest("call-y", fmt.Sprintf("%d", i))); b != first {
+			t.Fatalf("call moved from %s to %s", first.addr, b.addr)
+		}
+	}
+}
+
+func TestRoute_pickEmpty(t *testing.T) {
+	route := &Route{Domain: "example.com"}
+	if _, err := route.pick(nil); err != ErrorNoBackend {
+		t.Errorf("unexpected error %v", err)
+	}
+	if addr := route.Address(); addr != "" {
+		t.Errorf("unexpected address %s", addr)
+	}
+}
@@ -2,19 +2,30 @@ package proxy
 
 import (
 	"github.com/uole/sip"
+	"github.com/uole/sip/websocket"
 	"net"
+	"time"
 )
 
 type (
 	Conn interface {
 		Addr() net.Addr
+		Transport() Transport
 		Request(req *sip.Request) (err error)
 		Response(res *sip.Response) (err error)
 	}
 
 	UdpConn struct {
-		addr *net.UDPAddr
-		conn *net.UDPConn
+		addr   *net.UDPAddr
+		conn   *net.UDPConn
+		tracer sip.Tracer
+	}
+
+	//WSConn websocket客户端连接
+	WSConn struct {
+		conn   *websocket.Conn
+		secure bool
+		tracer sip.Tracer
 	}
 )
 
@@ -22,20 +33,74 @@ func (conn *UdpConn) Addr() net.Addr {
 	return conn.addr
 }
 
+func (conn *UdpConn) Transport() Transport {
+	return newUDPTransport(conn.conn)
+}
+
 func (conn *UdpConn) Request(req *sip.Request) (err error) {
-	_, err = conn.conn.WriteToUDP(req.Bytes(), conn.addr)
+	p := req.Bytes()
+	_, err = conn.conn.WriteToUDP(p, conn.addr)
+	traceMessage(conn.tracer, sip.TraceSend, conn, p, req, nil, err)
 	return
 }
 
 func (conn *UdpConn) Response(res *sip.Response) (err error) {
-	_, err = conn.conn.WriteToUDP(res.Bytes(), conn.addr)
+	p := res.Bytes()
+	_, err = conn.conn.WriteToUDP(p, conn.addr)
+	traceMessage(conn.tracer, sip.TraceSend, conn, p, nil, res, err)
 	return
 }
 
-func newUDPConn(addr string, conn *net.UDPConn) *UdpConn {
+func (conn *WSConn) Addr() net.Addr {
+	return conn.conn.RemoteAddr()
+}
+
+func (conn *WSConn) Transport() Transport {
+	return newWSTransport(conn.conn, conn.secure)
+}
+
+func (conn *WSConn) Request(req *sip.Request) (err error) {
+	p := req.Bytes()
+	err = conn.conn.WriteMessage(websocket.OpText, p)
+	traceMessage(conn.tracer, sip.TraceSend, conn, p, req, nil, err)
+	return
+}
+
+func (conn *WSConn) Response(res *sip.Response) (err error) {
+	p := res.Bytes()
+	err = conn.conn.WriteMessage(websocket.OpText, p)
+	traceMessage(conn.tracer, sip.TraceSend, conn, p, nil, res, err)
+	return
+}
+
+//traceMessage 跟踪连接上发送或者收到的消息, tracer为空时忽略
+func traceMessage(tracer sip.Tracer, direction string, conn Conn, p []byte, req *sip.Request, res *sip.Response, err error) {
+	if tracer == nil {
+		return
+	}
+	tp := conn.Transport()
+	tracer.Trace(&sip.TraceEvent{
+		Time:       time.Now(),
+		Direction:  direction,
+		Transport:  tp.Network(),
+		LocalAddr:  tp.Addr(),
+		RemoteAddr: conn.Addr(),
+		Raw:        p,
+		Request:    req,
+		Response:   res,
+		Err:        err,
+	})
+}
+
+func newUDPConn(addr string, conn *net.UDPConn, tracer sip.Tracer) *UdpConn {
 	udpAddr, _ := net.ResolveUDPAddr("udp", addr)
 	return &UdpConn{
-		addr: udpAddr,
-		conn: conn,
+		addr:   udpAddr,
+		conn:   conn,
+		tracer: tracer,
 	}
 }
+
+func newWSConn(conn *websocket.Conn, secure bool, tracer sip.Tracer) *WSConn {
+	return &WSConn{conn: conn, secure: secure, tracer: tracer}
+}
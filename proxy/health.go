@@ -0,0 +1,431 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/uole/sip"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHealthTimeout    = time.Second * 2
+	DefaultFailureThreshold = 3
+	DefaultSuccessThreshold = 2
+	DefaultHealthCooldown   = time.Second * 30
+)
+
+var (
+	ErrorBackendTimeout     = errors.New("backend response timeout")
+	ErrorBackendUnavailable = errors.New("backend service unavailable")
+)
+
+type (
+	//RouteHealth 后端的健康检查配置, 为0的字段使用默认值
+	RouteHealth struct {
+		Interval         time.Duration `json:"interval" yaml:"interval"`                  //OPTIONS探测的间隔，为0时不主动探测
+		Timeout          time.Duration `json:"timeout" yaml:"timeout"`                    //探测以及INVITE等待响应的超时时间，超时后转发到下一个后端
+		FailureThreshold int           `json:"failure_threshold" yaml:"failureThreshold"` //连续失败多少次后摘除后端
+		SuccessThreshold int           `json:"success_threshold" yaml:"successThreshold"` //摘除后连续成功多少次后恢复后端
+		Cooldown         time.Duration `json:"cooldown" yaml:"cooldown"`                  //不主动探测时，摘除的后端经过多久后重新尝试
+	}
+
+	//failover 等待后端响应的初始INVITE
+	failover struct {
+		trans     *Transaction
+		timer     *time.Timer
+		tried     []*backend              //已经超时的后端
+		abandoned map[string]*sip.Request //已经放弃的后端地址以及转发给它的INVITE, 之后收到的响应不再转发
+		answered  bool
+	}
+)
+
+//withDefaults 返回填充默认值后的配置, h可以为空
+func (h *RouteHealth) withDefaults() *RouteHealth {
+	var health RouteHealth
+	if h != nil {
+		health = *h
+	}
+	if health.Timeout <= 0 {
+		health.Timeout = DefaultHealthTimeout
+	}
+	if health.FailureThreshold <= 0 {
+		health.FailureThreshold = DefaultFailureThreshold
+	}
+	if health.SuccessThreshold <= 0 {
+		health.SuccessThreshold = DefaultSuccessThreshold
+	}
+	if health.Cooldown <= 0 {
+		health.Cooldown = DefaultHealthCooldown
+	}
+	return &health
+}
+
+//fail 记录一次失败, 连续失败达到阈值时摘除后端
+func (b *backend) fail(threshold int) (removed bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.successes = 0
+	b.failures++
+	b.downAt = time.Now()
+	if !b.down && b.failures >= threshold {
+		b.down = true
+		removed = true
+	}
+	return
+}
+
+//succeed 记录一次成功, 摘除的后端连续成功达到阈值时恢复
+func (b *backend) succeed(threshold int) (reinstated bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+	if !b.down {
+		return
+	}
+	b.successes++
+	if b.successes >= threshold {
+		b.down = false
+		b.successes = 0
+		reinstated = true
+	}
+	return
+}
+
+//available 后端是否可以使用, cooldown大于0时摘除的后端经过cooldown后重新尝试
+func (b *backend) available(now time.Time, cooldown time.Duration) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return !b.down || (cooldown > 0 && now.Sub(b.downAt) >= cooldown)
+}
+
+func (b *backend) healthy() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return !b.down
+}
+
+func containsBackend(backends []*backend, b *backend) bool {
+	for _, v := range backends {
+		if v == b {
+			return true
+		}
+	}
+	return false
+}
+
+//markBackend 根据后端的结果更新健康状态
+func (rp *ReverseProxy) markBackend(route *Route, b *backend, err error) {
+	health := route.healthConfig()
+	if err != nil {
+		if b.fail(health.FailureThreshold) {
+			rp.logger.Warn("backend removed", "route", route.Domain, "backend", b.addr, sip.FieldError, err)
+		}
+		return
+	}
+	if b.succeed(health.SuccessThreshold) {
+		rp.logger.Info("backend reinstated", "route", route.Domain, "backend", b.addr)
+	}
+}
+
+//conn 代理的udp连接, 还没有开始监听时为空
+func (rp *ReverseProxy) conn() *net.UDPConn {
+	rp.connLocker.Lock()
+	defer rp.connLocker.Unlock()
+	return rp.udpConn
+}
+
+//newProbeRequest 创建探测后端的OPTIONS请求
+func newProbeRequest(local net.Addr, route *Route, addr string) *sip.Request {
+	req := sip.NewRequest(sip.MethodOptions, addr)
+	req.Header.Set(sip.HeaderVia, &sip.ViaHeader{
+		Protocol:        "SIP",
+		ProtocolVersion: "2.0",
+		Transport:       "UDP",
+		Uri:             sip.NewUri("", local.String(), sip.Map{"branch": sip.NewBranch(), "rport": ""}),
+	})
+	req.Header.Set(sip.HeaderMaxForwards, sip.NewMaxForwardHeader(70))
+	req.Header.Set(sip.HeaderFrom, &sip.AddressHeader{Uri: sip.NewUri("proxy", route.Domain, sip.Map{}).EnableProtocol(), Params: sip.Map{"tag": sip.NewTag()}})
+	req.Header.Set(sip.HeaderTo, &sip.AddressHeader{Uri: sip.NewUri("", addr, sip.Map{}).EnableProtocol(), Params: sip.Map{}})
+	req.Header.Set(sip.HeaderCallID, sip.NewPlainHeader(sip.NewTag()))
+	req.Header.Set(sip.HeaderCSeq, sip.NewSequenceHeader(sip.MethodOptions, 1))
+	return req
+}
+
+//probe 向后端发送OPTIONS, 超时内收到503以外的响应认为后端正常
+func (rp *ReverseProxy) probe(conn *net.UDPConn, route *Route, b *backend) (err error) {
+	var addrs []string
+	if addrs, err = rp.backendAddress(b.addr); err != nil {
+		return
+	}
+	callee := newUDPConn(addrs[0], conn, rp.tracer)
+	req := newProbeRequest(conn.LocalAddr(), route, callee.Addr().String())
+	ch := make(chan *sip.Response, 1)
+	rp.probeLocker.Lock()
+	rp.probes[req.CallID()] = ch
+	rp.probeLocker.Unlock()
+	defer func() {
+		rp.probeLocker.Lock()
+		delete(rp.probes, req.CallID())
+		rp.probeLocker.Unlock()
+	}()
+	if err = callee.Request(req); err != nil {
+		return
+	}
+	timer := time.NewTimer(route.healthConfig().Timeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		if res.StatusCode == sip.StatusServiceUnavailable {
+			err = ErrorBackendUnavailable
+		}
+	case <-timer.C:
+		err = ErrorBackendTimeout
+	case <-rp.ctx.Done():
+		err = rp.ctx.Err()
+	}
+	return
+}
+
+//probeResponse 处理探测请求的响应, 不是探测的响应时返回false
+func (rp *ReverseProxy) probeResponse(res *sip.Response) bool {
+	rp.probeLocker.Lock()
+	ch, ok := rp.probes[res.CallID()]
+	rp.probeLocker.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- res:
+	default:
+	}
+	return true
+}
+
+//probeRoute 并发探测路由的所有后端
+func (rp *ReverseProxy) probeRoute(route *Route) {
+	conn := rp.conn()
+	if conn == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	route.init()
+	for _, b := range route.backends {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			err := rp.probe(conn, route, b)
+			if rp.ctx.Err() == nil {
+				rp.markBackend(route, b, err)
+			}
+		}(b)
+	}
+	wg.Wait()
+}
+
+//healthLoop 定时探测路由的后端
+func (rp *ReverseProxy) healthLoop(route *Route) {
+	ticker := time.NewTicker(route.healthConfig().Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rp.probeRoute(route)
+		case <-rp.ctx.Done():
+			return
+		}
+	}
+}
+
+//observeResponse 根据后端的响应更新健康状态并停止故障转移, 返回false时响应来自已经放弃的后端
+func (rp *ReverseProxy) observeResponse(conn Conn, proc *Process, res *sip.Response) bool {
+	addr := conn.Addr().String()
+	proc.mutex.Lock()
+	b := proc.backend
+	fromCallee := proc.callee != nil && proc.callee.Addr().String() == addr
+	if fo := proc.failover; fo != nil {
+		if invite, ok := fo.abandoned[addr]; ok {
+			proc.mutex.Unlock()
+			rp.closeAbandoned(conn, invite, res)
+			return false
+		}
+		if fromCallee && !fo.answered {
+			fo.answered = true
+			fo.timer.Stop()
+		}
+	}
+	proc.mutex.Unlock()
+	if b == nil || !fromCallee {
+		return true
+	}
+	if res.StatusCode == sip.StatusServiceUnavailable {
+		rp.markBackend(proc.route, b, ErrorBackendUnavailable)
+	} else {
+		rp.markBackend(proc.route, b, nil)
+	}
+	return true
+}
+
+//armFailover 转发初始INVITE到后端时开始计时, 超时没有收到响应时转发到下一个后端
+func (rp *ReverseProxy) armFailover(proc *Process, trans *Transaction) {
+	if trans.message.Direction() != DirectionRequest || trans.Request().Method != sip.MethodInvite {
+		return
+	}
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	//重传的INVITE以及会话内的INVITE不需要计时
+	if proc.backend == nil || proc.failover != nil || proc.state != ProcessEarly || trans.Address() != proc.caller.Addr().String() {
+		return
+	}
+	proc.failover = &failover{trans: trans, abandoned: make(map[string]*sip.Request)}
+	proc.failover.timer = time.AfterFunc(proc.route.healthConfig().Timeout, func() {
+		rp.failoverInvite(proc)
+	})
+}
+
+//failoverInvite 后端超时没有响应INVITE, 先尝试后端的下一个地址, 再转发到下一个健康的后端, 没有可用的后端时返回503
+func (rp *ReverseProxy) failoverInvite(proc *Process) {
+	var (
+		next  *backend
+		addrs []string
+		err   error
+	)
+	proc.mutex.Lock()
+	fo := proc.failover
+	current := proc.backend
+	if fo == nil || fo.answered || proc.state != ProcessEarly || current == nil {
+		proc.mutex.Unlock()
+		return
+	}
+	tried := append(append([]*backend{}, fo.tried...), current)
+	next, addrs = current, proc.targets
+	proc.mutex.Unlock()
+	//转发给当前后端的INVITE, 用于取消以及确认它之后的响应
+	invite := rp.rewriteRequest(fo.trans)
+	if len(addrs) == 0 {
+		rp.markBackend(proc.route, current, ErrorBackendTimeout)
+		for {
+			if next, err = proc.route.pick(fo.trans.Request(), tried...); err != nil {
+				break
+			}
+			if addrs, err = rp.backendAddress(next.addr); err == nil {
+				break
+			}
+			rp.markBackend(proc.route, next, err)
+			tried = append(tried, next)
+		}
+	}
+	proc.mutex.Lock()
+	//等待期间收到了响应或者会话已经结束
+	if fo.answered || proc.state != ProcessEarly || proc.backend != current {
+		proc.mutex.Unlock()
+		return
+	}
+	fo.tried = tried
+	abandoned := proc.callee
+	fo.abandoned[abandoned.Addr().String()] = invite
+	if err != nil {
+		proc.terminate()
+		proc.mutex.Unlock()
+		_ = abandoned.Request(newCancelRequest(invite))
+		rp.logger.Warn("no backend answered invite", sip.FieldCallID, proc.id, sip.FieldError, err)
+		res := sip.NewResponse(sip.StatusServiceUnavailable, fo.trans.Request())
+		if to, ok := res.Header.Get(sip.HeaderTo).(*sip.AddressHeader); ok {
+			to.Params.Set("tag", sip.NewTag())
+		}
+		_ = proc.caller.Response(res)
+		return
+	}
+	if next != current {
+		current.release()
+		next.acquire()
+		proc.backend = next
+	}
+	proc.callee = newUDPConn(addrs[0], rp.conn(), rp.tracer)
+	proc.targets = addrs[1:]
+	fo.timer = time.AfterFunc(proc.route.healthConfig().Timeout, func() {
+		rp.failoverInvite(proc)
+	})
+	proc.mutex.Unlock()
+	_ = abandoned.Request(newCancelRequest(invite))
+	rp.logger.Warn("invite failover", sip.FieldCallID, proc.id, "backend", next.addr, sip.FieldPeer, addrs[0])
+	trans := &Transaction{
+		process:   proc,
+		message:   fo.trans.message,
+		address:   fo.trans.address,
+		transport: fo.trans.transport,
+		createdAt: time.Now(),
+	}
+	select {
+	case rp.transChan <- trans:
+	case <-rp.ctx.Done():
+	}
+}
+
+//closeAbandoned 处理已经放弃的后端对INVITE的最终响应, 失败响应回复ACK, 迟到的2xx回复ACK之后再发送BYE结束对话
+func (rp *ReverseProxy) closeAbandoned(conn Conn, invite *sip.Request, res *sip.Response) {
+	seq, ok := res.Header.Get(sip.HeaderCSeq).(*sip.SequenceHeader)
+	if !ok || seq.Method != sip.MethodInvite || res.StatusCode < 200 {
+		return
+	}
+	if res.StatusCode >= 300 {
+		_ = conn.Request(newAbandonedRequest(sip.MethodAck, invite, res, false))
+		return
+	}
+	rp.logger.Warn("abandoned backend answered invite", sip.FieldCallID, res.CallID(), sip.FieldPeer, conn.Addr().String())
+	_ = conn.Request(newAbandonedRequest(sip.MethodAck, invite, res, true))
+	_ = conn.Request(newAbandonedRequest(sip.MethodBye, invite, res, true))
+}
+
+//newCancelRequest 取消转发给放弃的后端的INVITE, 使用和INVITE相同的branch
+func newCancelRequest(invite *sip.Request) *sip.Request {
+	req := sip.NewRequest(sip.MethodCancel, "")
+	req.SetUri(invite.Uri())
+	if via, ok := invite.Header.Get(sip.HeaderVia).(*sip.ViaHeader); ok {
+		req.Header.Set(sip.HeaderVia, via.Clone().(*sip.ViaHeader).SetNext(nil))
+	}
+	req.Header.Set(sip.HeaderMaxForwards, sip.NewMaxForwardHeader(70))
+	for _, name := range []string{sip.HeaderFrom, sip.HeaderTo, sip.HeaderCallID, sip.HeaderRoute} {
+		if invite.Header.Has(name) {
+			req.Header.Set(name, invite.Header.Get(name).Clone())
+		}
+	}
+	if seq, ok := invite.Header.Get(sip.HeaderCSeq).(*sip.SequenceHeader); ok {
+		req.Header.Set(sip.HeaderCSeq, sip.NewSequenceHeader(sip.MethodCancel, seq.Sequence))
+	}
+	return req
+}
+
+//newAbandonedRequest 创建发给放弃的后端的ACK或者BYE. 失败响应的ACK和INVITE使用相同的branch,
+//2xx建立了对话, ACK以及BYE使用新的branch并发送到响应的Contact(RFC 3261 13.2.2.4, 17.1.1.3)
+func newAbandonedRequest(method sip.Method, invite *sip.Request, res *sip.Response, dialog bool) *sip.Request {
+	req := sip.NewRequest(method, "")
+	req.SetUri(invite.Uri())
+	if contact, ok := res.Header.Get(sip.HeaderContact).(*sip.AddressHeader); ok && dialog && contact.Uri != nil {
+		req.SetUri(contact.Uri)
+	}
+	if via, ok := invite.Header.Get(sip.HeaderVia).(*sip.ViaHeader); ok {
+		via = via.Clone().(*sip.ViaHeader).SetNext(nil)
+		if dialog {
+			via.Uri.Params.Set("branch", sip.NewBranch())
+		}
+		req.Header.Set(sip.HeaderVia, via)
+	}
+	req.Header.Set(sip.HeaderMaxForwards, sip.NewMaxForwardHeader(70))
+	for _, name := range []string{sip.HeaderFrom, sip.HeaderCallID} {
+		if invite.Header.Has(name) {
+			req.Header.Set(name, invite.Header.Get(name).Clone())
+		}
+	}
+	if res.Header.Has(sip.HeaderTo) {
+		req.Header.Set(sip.HeaderTo, res.Header.Get(sip.HeaderTo).Clone())
+	}
+	if seq, ok := invite.Header.Get(sip.HeaderCSeq).(*sip.SequenceHeader); ok {
+		sequence := seq.Sequence
+		if method == sip.MethodBye {
+			sequence++
+		}
+		req.Header.Set(sip.HeaderCSeq, sip.NewSequenceHeader(method, sequence))
+	}
+	return req
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/uole/sip"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+//readMessage 读取一个sip消息, 超时返回空
+func readMessage(conn *net.UDPConn, timeout time.Duration) []byte {
+	buf := make([]byte, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+func newFailoverInvite(callID string) []byte {
+	return []byte("INVITE sip:1001@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 127.0.0.1:9;branch=z9hG4bK-" + callID + "\r\n" +
+		"From: <sip:1000@example.com>;tag=failover\r\n" +
+		"To: <sip:1001@example.com>\r\n" +
+		"Call-ID: " + callID + "\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"Content-Length: 0\r\n\r\n")
+}
+
+func TestBackend_health(t *testing.T) {
+	b := &backend{addr: "a:5060", weight: 1}
+	if b.fail(2) || !b.healthy() {
+		t.Fatal("backend removed before threshold")
+	}
+	if !b.fail(2) || b.healthy() {
+		t.Fatal("backend not removed after threshold")
+	}
+	now := time.Now()
+	if b.available(now, 0) || b.available(now, time.Minute) {
+		t.Error("removed backend available")
+	}
+	if !b.available(now.Add(time.Minute), time.Minute) {
+		t.Error("removed backend not retried after cooldown")
+	}
+	if b.succeed(2) || b.healthy() {
+		t.Fatal("backend reinstated before threshold")
+	}
+	if !b.succeed(2) || !b.healthy() {
+		t.Fatal("backend not reinstated after threshold")
+	}
+}
+
+func TestRoute_pickHealthy(t *testing.T) {
+	route := &Route{Backend: []string{"a:5060", "b:5060"}, Health: &RouteHealth{Interval: time.Second, FailureThreshold: 1}}
+	route.init()
+	route.backends[0].fail(1)
+	for i := 0; i < 4; i++ {
+		if b, err := route.pick(nil); err != nil || b.addr != "b:5060" {
+			t.Fatalf("unexpected backend %v %v", b, err)
+		}
+	}
+	if _, err := route.pick(nil, route.backends[1]); err != ErrorNoHealthyBackend {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestReverseProxy_probe(t *testing.T) {
+	alive, dead := listenUDP(t), listenUDP(t)
+	defer alive.Close()
+	defer dead.Close()
+	route := &Route{
+		Domain:  "example.com",
+		Backend: []string{alive.LocalAddr().String(), dead.LocalAddr().String()},
+		Health:  &RouteHealth{Interval: time.Second, Timeout: time.Millisecond * 200, FailureThreshold: 1},
+	}
+	rp := NewReverse([]*Route{route})
+	rp.udpConn = listenUDP(t)
+	defer rp.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := rp.udpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			rp.serveMessage(&UdpConn{conn: rp.udpConn, addr: addr}, buf[:n])
+		}
+	}()
+	go func() {
+		p := readMessage(alive, time.Second)
+		if p == nil {
+			return
+		}
+		req, err := sip.ReadRequest(bufio.NewReader(bytes.NewReader(p)))
+		if err != nil {
+			return
+		}
+		res := sip.NewResponse(sip.StatusOK, req)
+		_, _ = alive.WriteToUDP(res.Bytes(), rp.udpConn.LocalAddr().(*net.UDPAddr))
+	}()
+	rp.probeRoute(route)
+	if !route.backends[0].healthy() {
+		t.Error("alive backend removed")
+	}
+	if route.backends[1].healthy() {
+		t.Error("dead backend not removed")
+	}
+}
+
+func TestReverseProxy_failoverInvite(t *testing.T) {
+	server, caller, dead, alive := listenUDP(t), listenUDP(t), listenUDP(t), listenUDP(t)
+	defer caller.Close()
+	defer dead.Close()
+	defer alive.Close()
+	route := &Route{
+		Domain:  "example.com",
+		Backend: []string{dead.LocalAddr().String(), alive.LocalAddr().String()},
+		Health:  &RouteHealth{Timeout: time.Millisecond * 100},
+	}
+	rp := NewReverse([]*Route{route})
+	rp.udpConn = server
+	defer rp.Close()
+	go rp.eventLoop()
+	conn := &UdpConn{conn: server, addr: caller.LocalAddr().(*net.UDPAddr)}
+
+	rp.serveMessage(conn, newFailoverInvite("failover-call"))
+	if readMessage(dead, time.Second) == nil {
+		t.Fatal("invite not forwarded to first backend")
+	}
+	if p := readMessage(alive, time.Second); !bytes.HasPrefix(p, []byte("INVITE")) {
+		t.Fatalf("invite not failed over, got %q", p)
+	}
+	if route.backends[1].activeCalls() != 1 || route.backends[0].activeCalls() != 0 {
+		t.Errorf("unexpected active calls %d %d", route.backends[0].activeCalls(), route.backends[1].activeCalls())
+	}
+
+	//所有后端都没有响应时返回503
+	rp.serveMessage(conn, newFailoverInvite("unanswered-call"))
+	p := readMessage(caller, time.Second)
+	res, err := sip.ReadResponse(bufio.NewReader(bytes.NewReader(p)))
+	if err != nil {
+		t.Fatalf("unexpected response %q: %v", p, err)
+	}
+	if res.StatusCode != sip.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d", res.StatusCode)
+	}
+}
+
+func TestReverseProxy_abandonedAnswer(t *testing.T) {
+	server, caller, late, alive := listenUDP(t), listenUDP(t), listenUDP(t), listenUDP(t)
+	defer caller.Close()
+	defer late.Close()
+	defer alive.Close()
+	route := &Route{
+		Domain:  "example.com",
+		Backend: []string{late.LocalAddr().String(), alive.LocalAddr().String()},
+		Health:  &RouteHealth{Timeout: time.Millisecond * 100},
+	}
+	rp := NewReverse([]*Route{route})
+	rp.udpConn = server
+	defer rp.Close()
+	go rp.eventLoop()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := server.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			rp.serveMessage(&UdpConn{conn: server, addr: addr}, buf[:n])
+		}
+	}()
+
+	rp.serveMessage(&UdpConn{conn: server, addr: caller.LocalAddr().(*net.UDPAddr)}, newFailoverInvite("abandoned-call"))
+	p := readMessage(late, time.Second)
+	invite, err := sip.ReadRequest(bufio.NewReader(bytes.NewReader(p)))
+	if err != nil {
+		t.Fatalf("invite not forwarded to first backend %q: %v", p, err)
+	}
+	if p = readMessage(alive, time.Second); !bytes.HasPrefix(p, []byte("INVITE")) {
+		t.Fatalf("invite not failed over, got %q", p)
+	}
+	//放弃的后端收到CANCEL
+	p = readMessage(late, time.Second)
+	cancel, err := sip.ReadRequest(bufio.NewReader(bytes.NewReader(p)))
+	if err != nil || cancel.Method != sip.MethodCancel {
+		t.Fatalf("unexpected request %q: %v", p, err)
+	}
+	if cancel.Header.Get(sip.HeaderVia).(*sip.ViaHeader).Uri.Params.Get("branch") != invite.Header.Get(sip.HeaderVia).(*sip.ViaHeader).Uri.Params.Get("branch") {
+		t.Errorf("cancel branch mismatch %s", cancel.Header.Get(sip.HeaderVia).String())
+	}
+
+	//超时之后放弃的后端仍然接听, 代理回复ACK并发送BYE
+	res := sip.NewResponse(sip.StatusOK, invite)
+	res.Header.Get(sip.HeaderTo).(*sip.AddressHeader).Params.Set("tag", "late")
+	res.Header.Set(sip.HeaderContact, &sip.AddressHeader{Uri: sip.NewUri("late", late.LocalAddr().String(), sip.Map{}).EnableProtocol()})
+	if _, err = late.WriteToUDP(res.Bytes(), server.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []sip.Method{sip.MethodAck, sip.MethodBye} {
+		p = readMessage(late, time.Second)
+		req, err := sip.ReadRequest(bufio.NewReader(bytes.NewReader(p)))
+		if err != nil || req.Method != method {
+			t.Fatalf("expected %s, got %q: %v", method, p, err)
+		}
+		if to := req.Header.Get(sip.HeaderTo).(*sip.AddressHeader); to.Params.Get("tag") != "late" {
+			t.Errorf("unexpected to %s", to.String())
+		}
+	}
+	//调用方只会收到所有后端都没有响应的503
+	for p = readMessage(caller, time.Millisecond*300); p != nil; p = readMessage(caller, time.Millisecond*300) {
+		if bytes.HasPrefix(p, []byte("SIP/2.0 200")) {
+			t.Fatalf("abandoned answer forwarded to caller %q", p)
+		}
+	}
+}
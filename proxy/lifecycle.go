@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"github.com/uole/sip"
+	"strconv"
+	"time"
+)
+
+const (
+	//处理器的状态
+	ProcessEarly      = 0x01 //还没有收到最终响应
+	ProcessConfirmed  = 0x02 //会话已经建立
+	ProcessTerminated = 0x03 //会话已经结束, 保留一段时间用于转发重传以及ACK
+
+	DefaultEarlyTimeout      = time.Minute * 3
+	DefaultConfirmedTimeout  = time.Hour * 12
+	DefaultTerminatedLinger  = time.Second * 32
+	DefaultRegistrationGrace = time.Second * 32
+	DefaultRegisterExpires   = time.Hour
+	DefaultMaxHistory        = 32
+	DefaultSweepInterval     = time.Second * 10
+)
+
+type (
+	//Lifecycle 处理器以及绑定关系的过期配置, 为0的字段使用默认值
+	Lifecycle struct {
+		EarlyTimeout      time.Duration `json:"early_timeout" yaml:"earlyTimeout"`           //没有收到最终响应的处理器在没有消息后的过期时间
+		ConfirmedTimeout  time.Duration `json:"confirmed_timeout" yaml:"confirmedTimeout"`   //已建立的会话在没有消息后的过期时间
+		TerminatedLinger  time.Duration `json:"terminated_linger" yaml:"terminatedLinger"`   //结束的处理器保留的时间
+		RegistrationGrace time.Duration `json:"registration_grace" yaml:"registrationGrace"` //绑定关系超过注册有效期后保留的时间
+		MaxHistory        int           `json:"max_history" yaml:"maxHistory"`               //每个处理器保存的最大消息数量
+		Interval          time.Duration `json:"interval" yaml:"interval"`                    //清理的间隔
+	}
+)
+
+//withDefaults 返回填充默认值后的配置
+func (lc Lifecycle) withDefaults() *Lifecycle {
+	if lc.EarlyTimeout <= 0 {
+		lc.EarlyTimeout = DefaultEarlyTimeout
+	}
+	if lc.ConfirmedTimeout <= 0 {
+		lc.ConfirmedTimeout = DefaultConfirmedTimeout
+	}
+	if lc.TerminatedLinger <= 0 {
+		lc.TerminatedLinger = DefaultTerminatedLinger
+	}
+	if lc.RegistrationGrace <= 0 {
+		lc.RegistrationGrace = DefaultRegistrationGrace
+	}
+	if lc.MaxHistory <= 0 {
+		lc.MaxHistory = DefaultMaxHistory
+	}
+	if lc.Interval <= 0 {
+		lc.Interval = DefaultSweepInterval
+	}
+	return &lc
+}
+
+//createsDialog 请求是否会建立会话, 会话在结束或者空闲超时后才过期
+func createsDialog(method sip.Method) bool {
+	return method == sip.MethodInvite || method == sip.MethodSubscribe || method == sip.MethodRefer
+}
+
+//transit 根据收到的消息更新处理器的状态, 调用时需要持有锁
+func (proc *Process) transit(msg *Message) {
+	if proc.state == ProcessTerminated && !proc.retry(msg) {
+		return
+	}
+	if msg.Direction() == DirectionRequest {
+		if proc.method == "" {
+			proc.method = msg.Request().Method
+		}
+		if seq, ok := msg.Request().Header.Get(sip.HeaderCSeq).(*sip.SequenceHeader); ok && createsDialog(msg.Request().Method) && seq.Sequence > proc.seq {
+			proc.seq = seq.Sequence
+		}
+		if msg.Request().Method == sip.MethodBye {
+			proc.terminate()
+		}
+		return
+	}
+	res := msg.Response()
+	if res.StatusCode < 200 {
+		return
+	}
+	seq, ok := res.Header.Get(sip.HeaderCSeq).(*sip.SequenceHeader)
+	if !ok {
+		return
+	}
+	switch {
+	case createsDialog(seq.Method):
+		if res.StatusCode < 300 {
+			proc.state = ProcessConfirmed
+		} else if proc.state == ProcessEarly {
+			//会话内的请求(re-INVITE)失败不会结束会话. 初始请求可能在认证挑战之后重新发送, 保留后端
+			proc.rejected = true
+			proc.retained = proc.backend
+			proc.terminate()
+		}
+	case seq.Method == sip.MethodBye, seq.Method == proc.method:
+		proc.terminate()
+	}
+}
+
+//retry 初始请求失败(例如401/407认证挑战)后, 相同的方法使用更大的CSeq重新发送时恢复处理器, 调用时需要持有锁
+func (proc *Process) retry(msg *Message) bool {
+	if !proc.rejected || msg.Direction() != DirectionRequest || msg.Request().Method != proc.method {
+		return false
+	}
+	seq, ok := msg.Request().Header.Get(sip.HeaderCSeq).(*sip.SequenceHeader)
+	if !ok || seq.Sequence <= proc.seq {
+		return false
+	}
+	proc.state = ProcessEarly
+	proc.rejected = false
+	proc.terminatedAt = time.Time{}
+	proc.failover = nil
+	if proc.retained != nil {
+		proc.retained.acquire()
+		proc.backend = proc.retained
+		proc.retained = nil
+	}
+	return true
+}
+
+func (proc *Process) terminate() {
+	proc.state = ProcessTerminated
+	proc.terminatedAt = time.Now()
+	proc.release()
+}
+
+//expired 处理器是否已经过期
+func (proc *Process) expired(now time.Time, lc *Lifecycle) (expired bool) {
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	switch proc.state {
+	case ProcessTerminated:
+		expired = now.Sub(proc.terminatedAt) > lc.TerminatedLinger
+	case ProcessConfirmed:
+		expired = now.Sub(proc.updatedAt) > lc.ConfirmedTimeout
+	default:
+		expired = now.Sub(proc.updatedAt) > lc.EarlyTimeout
+	}
+	//空闲过期的处理器没有结束, 需要释放后端的呼叫数
+	if expired {
+		proc.release()
+	}
+	return
+}
+
+//registerExpires 获取注册的有效期, 优先使用Contact的expires参数
+func registerExpires(header *sip.Header) (expires time.Duration, ok bool) {
+	if contact, exists := header.Get(sip.HeaderContact).(*sip.AddressHeader); exists && contact.Params.Get("expires") != "" {
+		if n, err := strconv.Atoi(contact.Params.Get("expires")); err == nil {
+			return time.Duration(n) * time.Second, true
+		}
+	}
+	if header.Has(sip.HeaderExpires) {
+		if n, err := strconv.Atoi(header.Get(sip.HeaderExpires).String()); err == nil {
+			return time.Duration(n) * time.Second, true
+		}
+	}
+	return
+}
+
+//expire 删除过期的处理器, 绑定关系以及认证挑战
+func (rp *ReverseProxy) expire(now time.Time) {
+	rp.processLocker.Lock()
+	for id, proc := range rp.processes {
+		if proc.expired(now, rp.lifecycle) {
+			delete(rp.processes, id)
+			rp.logger.Debug("process expired", sip.FieldCallID, id, "state", proc.State())
+		}
+	}
+	rp.processLocker.Unlock()
+	rp.relationshipLocker.Lock()
+	for username, relationship := range rp.relationships {
+		if relationship.Expired(now.Add(-rp.lifecycle.RegistrationGrace)) {
+			delete(rp.relationships, username)
+			rp.logger.Info("user relationship expired", "user", username)
+		}
+	}
+	rp.relationshipLocker.Unlock()
+	rp.authLocker.Lock()
+	for callID, challengedAt := range rp.challenges {
+		if now.Sub(challengedAt) > challengeTimeout {
+			delete(rp.challenges, callID)
+		}
+	}
+	rp.authLocker.Unlock()
+}
+
+//lifecycleLoop 定时清理过期的处理器以及绑定关系
+func (rp *ReverseProxy) lifecycleLoop() {
+	ticker := time.NewTicker(rp.lifecycle.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			rp.expire(now)
+		case <-rp.ctx.Done():
+			return
+		}
+	}
+}
+
+//SetLifecycle 设置处理器以及绑定关系的过期配置, 需要在Serve之前调用
+func (rp *ReverseProxy) SetLifecycle(lc Lifecycle) {
+	rp.lifecycle = lc.withDefaults()
+}
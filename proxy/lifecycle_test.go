@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"github.com/uole/sip"
+	"testing"
+	"time"
+)
+
+func newLifecycleMessage(method sip.Method, seqMethod sip.Method, code int) *Message {
+	req := sip.NewRequest(method, "sip:1001@example.com")
+	req.Header.Set(sip.HeaderCSeq, sip.NewSequenceHeader(seqMethod, 1))
+	if code == 0 {
+		return &Message{direction: DirectionRequest, request: req}
+	}
+	return &Message{direction: DirectionResponse, response: sip.NewResponse(code, req)}
+}
+
+func TestProcess_State(t *testing.T) {
+	proc := NewProcess("invite-call")
+	proc.Push(newLifecycleMessage(sip.MethodInvite, sip.MethodInvite, 0))
+	proc.Push(newLifecycleMessage(sip.MethodInvite, sip.MethodInvite, sip.StatusRinging))
+	if proc.State() != ProcessEarly {
+		t.Fatalf("unexpected state %d after 180", proc.State())
+	}
+	proc.Push(newLifecycleMessage(sip.MethodInvite, sip.MethodInvite, sip.StatusOK))
+	if proc.State() != ProcessConfirmed {
+		t.Fatalf("unexpected state %d after 200", proc.State())
+	}
+	//re-INVITE失败不会结束会话
+	proc.Push(newLifecycleMessage(sip.MethodInvite, sip.MethodInvite, sip.StatusBusyHere))
+	if proc.State() != ProcessConfirmed {
+		t.Fatalf("unexpected state %d after failed re-INVITE", proc.State())
+	}
+	proc.Push(newLifecycleMessage(sip.MethodBye, sip.MethodBye, 0))
+	if proc.State() != ProcessTerminated {
+		t.Fatalf("unexpected state %d after BYE", proc.State())
+	}
+
+	proc = NewProcess("register-call")
+	proc.Push(newLifecycleMessage(sip.MethodRegister, sip.MethodRegister, 0))
+	proc.Push(newLifecycleMessage(sip.MethodRegister, sip.MethodRegister, sip.StatusOK))
+	if proc.State() != ProcessTerminated {
+		t.Errorf("unexpected state %d after REGISTER 200", proc.State())
+	}
+}
+
+func TestProcess_maxHistory(t *testing.T) {
+	proc := NewProcess("history-call")
+	proc.maxHistory = 4
+	for i := 0; i < 10; i++ {
+		proc.Push(newLifecycleMessage(sip.MethodInfo, sip.MethodInfo, 0))
+	}
+	if len(proc.stacks) != 4 {
+		t.Errorf("unexpected history size %d", len(proc.stacks))
+	}
+}
+
+func TestReverseProxy_expire(t *testing.T) {
+	rp := NewReverse(nil)
+	rp.SetLifecycle(Lifecycle{EarlyTimeout: time.Minute, TerminatedLinger: time.Second, RegistrationGrace: time.Second})
+	now := time.Now()
+	early := NewProcess("early-call")
+	early.Push(newLifecycleMessage(sip.MethodInvite, sip.MethodInvite, 0))
+	finished := NewProcess("finished-call")
+	finished.Push(newLifecycleMessage(sip.MethodOptions, sip.MethodOptions, 0))
+	finished.Push(newLifecycleMessage(sip.MethodOptions, sip.MethodOptions, sip.StatusOK))
+	rp.processes[early.id] = early
+	rp.processes[finished.id] = finished
+	rp.relationships["1001@example.com"] = &Relationship{User: "1001", ExpiresAt: now.Add(time.Minute)}
+	rp.relationships["1002@example.com"] = &Relationship{User: "1002", ExpiresAt: now.Add(-time.Minute)}
+
+	rp.expire(now.Add(time.Second * 2))
+	if _, ok := rp.processes[early.id]; !ok {
+		t.Error("early process expired before timeout")
+	}
+	if _, ok := rp.processes[finished.id]; ok {
+		t.Error("terminated process not expired")
+	}
+	if _, ok := rp.relationships["1001@example.com"]; !ok {
+		t.Error("registered relationship expired")
+	}
+	if _, ok := rp.relationships["1002@example.com"]; ok {
+		t.Error("stale relationship not expired")
+	}
+
+	rp.expire(now.Add(time.Minute * 2))
+	if len(rp.processes) != 0 {
+		t.Errorf("unexpected processes %d", len(rp.processes))
+	}
+}
+
+func TestProcess_challengeRetry(t *testing.T) {
+	rp := NewReverse(nil)
+	rp.SetLifecycle(Lifecycle{TerminatedLinger: time.Second})
+	b := &backend{addr: "127.0.0.1:5060", weight: 1}
+	b.acquire()
+	proc := NewProcess("challenged-call")
+	proc.backend = b
+	rp.processes[proc.id] = proc
+	push := func(method sip.Method, seqMethod sip.Method, seq int, code int) {
+		msg := newLifecycleMessage(method, seqMethod, code)
+		if msg.Direction() == DirectionRequest {
+			msg.Request().Header.Set(sip.HeaderCSeq, sip.NewSequenceHeader(seqMethod, seq))
+		} else {
+			msg.Response().Header.Set(sip.HeaderCSeq, sip.NewSequenceHeader(seqMethod, seq))
+		}
+		proc.Push(msg)
+	}
+
+	push(sip.MethodInvite, sip.MethodInvite, 1, 0)
+	push(sip.MethodInvite, sip.MethodInvite, 1, sip.StatusProxyAuthenticationRequired)
+	push(sip.MethodAck, sip.MethodAck, 1, 0)
+	if proc.State() != ProcessTerminated || b.activeCalls() != 0 {
+		t.Fatalf("unexpected state %d calls %d after 407", proc.State(), b.activeCalls())
+	}
+	//重传的INVITE不会恢复处理器
+	push(sip.MethodInvite, sip.MethodInvite, 1, 0)
+	if proc.State() != ProcessTerminated {
+		t.Fatalf("unexpected state %d after retransmission", proc.State())
+	}
+	push(sip.MethodInvite, sip.MethodInvite, 2, 0)
+	if proc.State() != ProcessEarly || proc.backend != b || b.activeCalls() != 1 {
+		t.Fatalf("unexpected state %d calls %d after authenticated INVITE", proc.State(), b.activeCalls())
+	}
+	push(sip.MethodInvite, sip.MethodInvite, 2, sip.StatusOK)
+	if proc.State() != ProcessConfirmed {
+		t.Fatalf("unexpected state %d after 200", proc.State())
+	}
+
+	//超过结束处理器的保留时间之后会话仍然存在, BYE使用同一个后端
+	rp.expire(time.Now().Add(time.Second * 2))
+	if _, ok := rp.processes[proc.id]; !ok {
+		t.Fatal("confirmed process expired")
+	}
+	push(sip.MethodBye, sip.MethodBye, 3, 0)
+	if proc.State() != ProcessTerminated || b.activeCalls() != 0 {
+		t.Errorf("unexpected state %d calls %d after BYE", proc.State(), b.activeCalls())
+	}
+	//BYE之后的INVITE不会恢复处理器
+	push(sip.MethodInvite, sip.MethodInvite, 4, 0)
+	if proc.State() != ProcessTerminated {
+		t.Errorf("unexpected state %d after INVITE following BYE", proc.State())
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/uole/sip"
+	"strings"
+	"time"
+)
+
+const (
+	locateTimeout = time.Second * 3
+	//locateTTL 定位结果的缓存时间, 过期后先使用旧的结果并在后台刷新
+	locateTTL = time.Minute
+)
+
+var (
+	ErrorBackendUnresolved = errors.New("backend address unresolved")
+)
+
+//located 后端定位的缓存结果
+type located struct {
+	addrs      []string //按照优先级排序的udp地址
+	expires    time.Time
+	refreshing bool
+}
+
+//backendAddress 路由后端的udp地址, 按照优先级排序, 第一个地址没有响应时依次尝试后面的地址
+//sip uri格式的后端按照RFC 3263定位, 只有第一次定位在调用者的协程里进行
+func (rp *ReverseProxy) backendAddress(addr string) (addrs []string, err error) {
+	if !strings.HasPrefix(addr, "sip:") && !strings.HasPrefix(addr, "sips:") {
+		return []string{addr}, nil
+	}
+	rp.locateLocker.Lock()
+	entry, ok := rp.located[addr]
+	if ok {
+		addrs = entry.addrs
+		if !entry.refreshing && time.Now().After(entry.expires) {
+			entry.refreshing = true
+			go rp.refreshBackend(addr)
+		}
+	}
+	rp.locateLocker.Unlock()
+	if ok {
+		return
+	}
+	return rp.locateBackend(addr)
+}
+
+//locateBackend 定位后端的udp地址并缓存, 没有udp地址时返回ErrorBackendUnresolved
+func (rp *ReverseProxy) locateBackend(addr string) (addrs []string, err error) {
+	var (
+		uri     *sip.Uri
+		targets []*sip.Target
+	)
+	if uri, err = sip.ParseUri(addr); err == nil {
+		ctx, cancel := context.WithTimeout(rp.ctx, locateTimeout)
+		targets, err = rp.locator.Locate(ctx, uri)
+		cancel()
+	}
+	if err != nil {
+		rp.logger.Warn("locate backend failed", "backend", addr, sip.FieldError, err)
+		return nil, fmt.Errorf("%w %s: %v", ErrorBackendUnresolved, addr, err)
+	}
+	for _, target := range targets {
+		if target.Protocol == sip.ProtoUDP {
+			addrs = append(addrs, target.Addr)
+		}
+	}
+	if len(addrs) == 0 {
+		rp.logger.Warn("backend has no udp target", "backend", addr)
+		return nil, fmt.Errorf("%w %s", ErrorBackendUnresolved, addr)
+	}
+	rp.locateLocker.Lock()
+	rp.located[addr] = &located{addrs: addrs, expires: time.Now().Add(locateTTL)}
+	rp.locateLocker.Unlock()
+	return
+}
+
+//refreshBackend 后台刷新过期的定位结果, 失败时继续使用旧的结果
+func (rp *ReverseProxy) refreshBackend(addr string) {
+	if _, err := rp.locateBackend(addr); err == nil {
+		return
+	}
+	rp.locateLocker.Lock()
+	if entry, ok := rp.located[addr]; ok {
+		entry.refreshing = false
+	}
+	rp.locateLocker.Unlock()
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/uole/sip"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//srvResolver 测试用的dns, 按照名称返回SRV记录
+type srvResolver struct {
+	srv     map[string][]*net.SRV
+	lookups int32
+}
+
+func (r *srvResolver) LookupNAPTR(ctx context.Context, name string) ([]*sip.NAPTR, error) {
+	return nil, nil
+}
+
+func (r *srvResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	return r.srv[name], nil
+}
+
+func (r *srvResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if host == "localhost" {
+		return []string{"127.0.0.1"}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestReverseProxy_backendAddress(t *testing.T) {
+	resolver := &srvResolver{srv: map[string][]*net.SRV{
+		"_sip._udp.backend.test": {{Target: "localhost.", Port: 5080, Priority: 20}, {Target: "localhost.", Port: 5070, Priority: 10}},
+	}}
+	rp := NewReverse(nil)
+	defer rp.Close()
+	rp.SetLocator(sip.NewLocator(resolver))
+
+	addrs, err := rp.backendAddress("sip:backend.test")
+	if err != nil || len(addrs) != 2 || addrs[0] != "127.0.0.1:5070" || addrs[1] != "127.0.0.1:5080" {
+		t.Fatalf("unexpected addresses %v %v", addrs, err)
+	}
+	lookups := atomic.LoadInt32(&resolver.lookups)
+	if addrs, err = rp.backendAddress("sip:backend.test"); err != nil || len(addrs) != 2 || atomic.LoadInt32(&resolver.lookups) != lookups {
+		t.Errorf("cached addresses not used %v %v", addrs, err)
+	}
+	//过期的结果在后台刷新, 刷新期间仍然返回旧的结果
+	rp.locateLocker.Lock()
+	rp.located["sip:backend.test"].expires = time.Now()
+	rp.locateLocker.Unlock()
+	if addrs, err = rp.backendAddress("sip:backend.test"); err != nil || len(addrs) != 2 {
+		t.Errorf("stale addresses not used %v %v", addrs, err)
+	}
+	if _, err = rp.backendAddress("sip:missing.test"); !errors.Is(err, ErrorBackendUnresolved) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if addrs, err = rp.backendAddress("127.0.0.1:5060"); err != nil || len(addrs) != 1 || addrs[0] != "127.0.0.1:5060" {
+		t.Errorf("unexpected addresses %v %v", addrs, err)
+	}
+}
+
+func TestReverseProxy_unresolvedBackend(t *testing.T) {
+	server, caller := listenUDP(t), listenUDP(t)
+	defer caller.Close()
+	rp := NewReverse([]*Route{{Domain: "example.com", Backend: []string{"sip:missing.test"}}})
+	rp.SetLocator(sip.NewLocator(&srvResolver{}))
+	rp.udpConn = server
+	defer rp.Close()
+
+	rp.serveMessage(&UdpConn{conn: server, addr: caller.LocalAddr().(*net.UDPAddr)}, newFailoverInvite("unresolved-call"))
+	p := readMessage(caller, time.Second)
+	res, err := sip.ReadResponse(bufio.NewReader(bytes.NewReader(p)))
+	if err != nil {
+		t.Fatalf("unexpected response %q: %v", p, err)
+	}
+	if res.StatusCode != sip.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d", res.StatusCode)
+	}
+}
+
+func TestReverseProxy_failoverTarget(t *testing.T) {
+	server, caller, dead, alive := listenUDP(t), listenUDP(t), listenUDP(t), listenUDP(t)
+	defer caller.Close()
+	defer dead.Close()
+	defer alive.Close()
+	port := func(conn *net.UDPConn) uint16 {
+		return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+	resolver := &srvResolver{srv: map[string][]*net.SRV{
+		"_sip._udp.backend.test": {{Target: "localhost.", Port: port(dead), Priority: 10}, {Target: "localhost.", Port: port(alive), Priority: 20}},
+	}}
+	route := &Route{
+		Domain:  "example.com",
+		Backend: []string{"sip:backend.test"},
+		Health:  &RouteHealth{Timeout: time.Millisecond * 100},
+	}
+	rp := NewReverse([]*Route{route})
+	rp.SetLocator(sip.NewLocator(resolver))
+	rp.udpConn = server
+	defer rp.Close()
+	go rp.eventLoop()
+
+	rp.serveMessage(&UdpConn{conn: server, addr: caller.LocalAddr().(*net.UDPAddr)}, newFailoverInvite("target-call"))
+	if readMessage(dead, time.Second) == nil {
+		t.Fatal("invite not forwarded to first target")
+	}
+	//第一个地址超时后转发到同一个后端的下一个地址
+	if p := readMessage(alive, time.Second); !bytes.HasPrefix(p, []byte("INVITE")) {
+		t.Fatalf("invite not failed over, got %q", p)
+	}
+	if !route.backends[0].healthy() || route.backends[0].activeCalls() != 1 {
+		t.Errorf("unexpected backend state %v %d", route.backends[0].healthy(), route.backends[0].activeCalls())
+	}
+}
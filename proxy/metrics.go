@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/uole/sip"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricsNamespace = "sip_proxy"
+	//otherMethod 不认识的请求方法统计到同一个标签, 避免产生无限的指标
+	otherMethod = "other"
+)
+
+var (
+	//latencyBuckets 转发延迟直方图的上限, 单位秒
+	latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+)
+
+type (
+	//Metrics 代理的运行指标, 以Prometheus文本格式输出
+	Metrics struct {
+		mutex         sync.Mutex
+		requests      map[string]uint64 //按照请求方法统计
+		responses     map[string]uint64 //按照状态码类别统计
+		parseErrors   uint64
+		dropped       uint64   //转发队列已满被丢弃的事物
+		latencyCounts []uint64 //转发延迟的分桶计数
+		latencySum    float64  //转发延迟的总和
+		latencyCount  uint64   //转发延迟的样本数
+		gauges        []*gauge //抓取时计算的指标
+	}
+
+	//gauge 抓取时计算的瞬时指标
+	gauge struct {
+		name  string
+		help  string
+		value func() float64
+	}
+)
+
+//incRequest 统计收到的请求, 不认识的方法记为other
+func (m *Metrics) incRequest(method sip.Method) {
+	label := otherMethod
+	switch method {
+	case sip.MethodInvite, sip.MethodAck, sip.MethodCancel, sip.MethodBye, sip.MethodRegister, sip.MethodOptions,
+		sip.MethodSubscribe, sip.MethodNotify, sip.MethodRefer, sip.MethodUpdate, sip.MethodMessage, sip.MethodInfo:
+		label = string(method)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.requests[label]++
+}
+
+//incResponse 统计收到的响应, 按照1xx至6xx分类
+func (m *Metrics) incResponse(code int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.responses[strconv.Itoa(code/100)+"xx"]++
+}
+
+func (m *Metrics) incParseError() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.parseErrors++
+}
+
+func (m *Metrics) incDropped() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.dropped++
+}
+
+//observeLatency 记录一次转发的延迟
+func (m *Metrics) observeLatency(d time.Duration) {
+	seconds := d.Seconds()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			m.latencyCounts[i]++
+		}
+	}
+	m.latencySum += seconds
+	m.latencyCount++
+}
+
+//addGauge 添加抓取时计算的指标
+func (m *Metrics) addGauge(name, help string, value func() float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.gauges = append(m.gauges, &gauge{name: name, help: help, value: value})
+}
+
+//writeCounter 输出按照标签区分的计数器, 标签按照字母顺序输出
+func writeCounter(w io.Writer, name, help, label string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s_%s %s\n# TYPE %s_%s counter\n", metricsNamespace, name, help, metricsNamespace, name)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s_%s{%s=%q} %d\n", metricsNamespace, name, label, k, values[k])
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+//WriteTo 以Prometheus文本格式输出所有指标
+func (m *Metrics) WriteTo(w io.Writer) (n int64, err error) {
+	var sb strings.Builder
+	m.mutex.Lock()
+	writeCounter(&sb, "requests_total", "Received SIP requests by method.", "method", m.requests)
+	writeCounter(&sb, "responses_total", "Received SIP responses by status class.", "class", m.responses)
+	fmt.Fprintf(&sb, "# HELP %s_parse_errors_total Messages that failed to parse.\n# TYPE %s_parse_errors_total counter\n%s_parse_errors_total %d\n", metricsNamespace, metricsNamespace, metricsNamespace, m.parseErrors)
+	fmt.Fprintf(&sb, "# HELP %s_dropped_transactions_total Transactions dropped because the forwarding queue was full.\n# TYPE %s_dropped_transactions_total counter\n%s_dropped_transactions_total %d\n", metricsNamespace, metricsNamespace, metricsNamespace, m.dropped)
+	name := metricsNamespace + "_forward_duration_seconds"
+	fmt.Fprintf(&sb, "# HELP %s Time from receiving a message to forwarding it.\n# TYPE %s histogram\n", name, name)
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(&sb, "%s_bucket{le=%q} %d\n", name, formatFloat(bound), m.latencyCounts[i])
+	}
+	fmt.Fprintf(&sb, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", name, m.latencyCount, name, formatFloat(m.latencySum), name, m.latencyCount)
+	gauges := m.gauges
+	m.mutex.Unlock()
+	//计算瞬时指标时不持有锁, 避免和代理的锁互相等待
+	for _, g := range gauges {
+		fmt.Fprintf(&sb, "# HELP %s_%s %s\n# TYPE %s_%s gauge\n%s_%s %s\n", metricsNamespace, g.name, g.help, metricsNamespace, g.name, metricsNamespace, g.name, formatFloat(g.value()))
+	}
+	var written int
+	written, err = io.WriteString(w, sb.String())
+	return int64(written), err
+}
+
+//ServeHTTP 输出Prometheus文本格式的指标
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		requests:      make(map[string]uint64),
+		responses:     make(map[string]uint64),
+		latencyCounts: make([]uint64, len(latencyBuckets)),
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReverseProxy_Metrics(t *testing.T) {
+	rp := NewReverse(nil)
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn := &UdpConn{conn: server, addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}}
+	rp.serveMessage(conn, []byte("SIP/2.0 abc Bad\r\n\r\n"))
+	rp.serveMessage(conn, []byte("OPTIONS sip:1001@example.com SIP/2.0\r\n"+
+		"Via: SIP/2.0/UDP 127.0.0.1:9;branch=z9hG4bK-metrics\r\n"+
+		"From: <sip:1000@example.com>;tag=metrics\r\n"+
+		"To: <sip:1001@example.com>\r\n"+
+		"Call-ID: metrics-call\r\n"+
+		"CSeq: 1 OPTIONS\r\n"+
+		"Content-Length: 0\r\n\r\n"))
+	for _, method := range []string{"RANDOM1", "RANDOM2"} {
+		rp.serveMessage(conn, []byte(method+" sip:1001@example.com SIP/2.0\r\n"+
+			"Via: SIP/2.0/UDP 127.0.0.1:9;branch=z9hG4bK-"+method+"\r\n"+
+			"From: <sip:1000@example.com>;tag=metrics\r\n"+
+			"To: <sip:1001@example.com>\r\n"+
+			"Call-ID: metrics-"+method+"\r\n"+
+			"CSeq: 1 "+method+"\r\n"+
+			"Content-Length: 0\r\n\r\n"))
+	}
+	rp.metrics.observeLatency(time.Millisecond * 3)
+	rec := httptest.NewRecorder()
+	rp.Metrics().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`sip_proxy_requests_total{method="OPTIONS"} 1`,
+		`sip_proxy_requests_total{method="other"} 2`,
+		`sip_proxy_parse_errors_total 1`,
+		`sip_proxy_dropped_transactions_total 0`,
+		`sip_proxy_forward_duration_seconds_bucket{le="0.0025"} 0`,
+		`sip_proxy_forward_duration_seconds_bucket{le="0.005"} 1`,
+		`sip_proxy_forward_duration_seconds_count 1`,
+		`sip_proxy_processes 0`,
+		`sip_proxy_relationships 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %s in\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "RANDOM") {
+		t.Errorf("unknown method exported as label\n%s", body)
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("unexpected content type %s", rec.Header().Get("Content-Type"))
+	}
+}
@@ -1,20 +1,37 @@
 package proxy
 
-import "time"
+import (
+	"github.com/uole/sip"
+	"sync"
+	"time"
+)
 
 //Process the process flow
 type Process struct {
-	id           string //process call id
-	caller       Conn   //caller conn
-	callee       Conn   //callee conn
-	route        *Route //process route
+	id           string   //process call id
+	caller       Conn     //caller conn
+	callee       Conn     //callee conn
+	route        *Route   //process route
+	backend      *backend //route backend, released when the process ends
+	targets      []string //remaining addresses of the backend, tried in order on failover
 	relationship *Relationship
+	mutex        sync.Mutex
+	state        int        //ProcessEarly, ProcessConfirmed or ProcessTerminated
+	method       sip.Method //method of the first request
 	stacks       []*Message //stacks
+	maxHistory   int        //max messages kept in stacks
 	createdAt    time.Time
 	updatedAt    time.Time
+	terminatedAt time.Time
+	failover     *failover //initial INVITE waiting for the backend
+	seq          int       //CSeq of the latest dialog-creating request
+	rejected     bool      //initial request failed with a final response, e.g. an auth challenge
+	retained     *backend  //backend released by the rejected request, acquired again when the request is retried
 }
 
 func (proc *Process) Ready() bool {
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
 	return proc.caller != nil && proc.callee != nil
 }
 
@@ -22,15 +39,57 @@ func (proc *Process) Caller() Conn {
 	return proc.caller
 }
 
+//Callee 被叫的连接, 故障转移后会切换到新的后端
 func (proc *Process) Callee() Conn {
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
 	return proc.callee
 }
 
 func (proc *Process) Push(msg *Message) {
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
 	proc.updatedAt = time.Now()
+	proc.transit(msg)
 	proc.stacks = append(proc.stacks, msg)
+	//只保留最近的消息
+	if proc.maxHistory > 0 && len(proc.stacks) > proc.maxHistory {
+		proc.stacks = append(proc.stacks[:0], proc.stacks[len(proc.stacks)-proc.maxHistory:]...)
+	}
+}
+
+//State 处理器的状态
+func (proc *Process) State() int {
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	return proc.state
+}
+
+//requestVia 查找branch对应的请求收到时的Via, 响应需要原样返回
+func (proc *Process) requestVia(branch string) (via *sip.ViaHeader, ok bool) {
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	for i := len(proc.stacks) - 1; i >= 0; i-- {
+		msg := proc.stacks[i]
+		if msg.Direction() != DirectionRequest {
+			continue
+		}
+		if via, ok = msg.Request().Header.Get(sip.HeaderVia).(*sip.ViaHeader); ok && via.Uri.Params.Get("branch") == branch {
+			return via.Clone().(*sip.ViaHeader), true
+		}
+	}
+	return nil, false
+}
+
+//release 结束后释放后端的呼叫数, 调用时需要持有锁
+func (proc *Process) release() {
+	if proc.backend != nil {
+		proc.backend.release()
+		proc.backend = nil
+	}
 }
 
 func NewProcess(id string) *Process {
-	return &Process{id: id, createdAt: time.Now(), stacks: make([]*Message, 0)}
+	now := time.Now()
+	return &Process{id: id, state: ProcessEarly, maxHistory: DefaultMaxHistory, createdAt: now, updatedAt: now, stacks: make([]*Message, 0)}
 }
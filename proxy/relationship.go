@@ -1,8 +1,22 @@
 package proxy
 
+import "time"
+
 type Relationship struct {
 	User           string
 	Domain         string
 	OriginalDomain string
 	Conn           Conn
+	LastSeen       time.Time //最后一次收到消息或者保活的时间
+	ExpiresAt      time.Time //注册的过期时间
+}
+
+//Alive 在timeout内收到过消息或者保活
+func (r *Relationship) Alive(timeout time.Duration) bool {
+	return time.Since(r.LastSeen) <= timeout
+}
+
+//Expired 注册在now之前已经过期
+func (r *Relationship) Expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && now.After(r.ExpiresAt)
 }
@@ -3,17 +3,24 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/uole/sip"
 	"github.com/uole/sip/pool"
-	"log"
+	"github.com/uole/sip/websocket"
 	"net"
+	"net/http"
 	"strconv"
 	"sync"
 	"time"
 )
 
+const (
+	//challengeTimeout 认证挑战的ACK需要吸收的时间(64*T1)
+	challengeTimeout = time.Second * 32
+)
+
 var (
 	responseFeature = []byte("SIP")
 
@@ -23,6 +30,8 @@ var (
 type (
 	ReverseProxy struct {
 		ctx                context.Context
+		cancel             context.CancelFunc
+		connLocker         sync.Mutex
 		udpConn            *net.UDPConn
 		processLocker      sync.RWMutex
 		processes          map[string]*Process //处理铜须
@@ -30,6 +39,19 @@ type (
 		routes             []*Route            //路由表
 		relationshipLocker sync.RWMutex
 		relationships      map[string]*Relationship //关系表
+		authLocker         sync.Mutex
+		credentials        sip.CredentialStore                 //认证凭证
+		authenticators     map[string]*sip.DigestAuthenticator //认证器，按realm区分
+		challenges         map[string]time.Time                //已发送认证挑战的会话
+		locator            *sip.Locator                        //后端地址的定位器
+		locateLocker       sync.Mutex
+		located            map[string]*located //后端的定位结果, 按照后端配置的地址区分
+		tracer             sip.Tracer          //消息跟踪器
+		logger             sip.Logger
+		metrics            *Metrics   //运行指标
+		lifecycle          *Lifecycle //处理器以及绑定关系的过期配置
+		probeLocker        sync.Mutex
+		probes             map[string]chan *sip.Response //等待响应的健康检查, 按照Call-ID区分
 	}
 )
 
@@ -37,6 +59,7 @@ type (
 func (rp *ReverseProxy) rewriteRequest(trans *Transaction) *sip.Request {
 	originalRequest := trans.Request()
 	rewriteRequest := originalRequest.Clone()
+	outbound := trans.Outbound().Transport()
 	//match address
 	if rewriteRequest.Address == trans.transport.Addr().String() {
 		if trans.Address() == trans.Caller().Addr().String() {
@@ -51,10 +74,10 @@ func (rp *ReverseProxy) rewriteRequest(trans *Transaction) *sip.Request {
 	if originalRequest.Header.Has(sip.HeaderContact) {
 		originalContactHeader := originalRequest.Header.Get(sip.HeaderContact).(*sip.AddressHeader)
 		rewriteContactHeader := &sip.AddressHeader{
-			Uri:    sip.NewUri(originalContactHeader.Uri.User, trans.transport.Addr().String(), sip.Map{}).EnableProtocol(),
+			Uri:    sip.NewUri(originalContactHeader.Uri.User, outbound.Addr().String(), sip.Map{}).EnableProtocol(),
 			Params: originalContactHeader.Params.Clone(),
 		}
-		rewriteContactHeader.Uri.Params.Set("transport", trans.transport.Network())
+		rewriteContactHeader.Uri.Params.Set("transport", outbound.Network())
 		rewriteRequest.Header.Set(sip.HeaderContact, rewriteContactHeader)
 	}
 	if originalRequest.Header.Has(sip.HeaderVia) {
@@ -62,15 +85,15 @@ func (rp *ReverseProxy) rewriteRequest(trans *Transaction) *sip.Request {
 		rewriteViaHeader := &sip.ViaHeader{
 			Protocol:        "SIP",
 			ProtocolVersion: "2.0",
-			Transport:       "UDP",
-			Uri:             sip.NewUri("", trans.transport.Addr().String(), originalViaHeader.Uri.Params.Clone()),
+			Transport:       outbound.Network(),
+			Uri:             sip.NewUri("", outbound.Addr().String(), originalViaHeader.Uri.Params.Clone()),
 		}
 		rewriteRequest.Header.Set(sip.HeaderVia, rewriteViaHeader)
 	}
 
 	if rewriteRequest.Header.Has(sip.HeaderFrom) {
 		fromHeader := rewriteRequest.Header.Get(sip.HeaderFrom).(*sip.AddressHeader)
-		fromHeader.Uri.Params.Set("transport", trans.transport.Network())
+		fromHeader.Uri.Params.Set("transport", outbound.Network())
 		if rewrite, ok := trans.Rewrite(); ok {
 			if fromHeader.Uri.Host == rewrite.From {
 				fromHeader.Uri.Host = rewrite.To
@@ -83,7 +106,7 @@ func (rp *ReverseProxy) rewriteRequest(trans *Transaction) *sip.Request {
 
 	if rewriteRequest.Header.Has(sip.HeaderTo) {
 		toHeader := rewriteRequest.Header.Get(sip.HeaderTo).(*sip.AddressHeader)
-		toHeader.Uri.Params.Set("transport", trans.transport.Network())
+		toHeader.Uri.Params.Set("transport", outbound.Network())
 		if rewrite, ok := trans.Rewrite(); ok {
 			//呼出场景
 			if toHeader.Uri.Host == rewrite.From {
@@ -109,12 +132,13 @@ func (rp *ReverseProxy) rewriteRequest(trans *Transaction) *sip.Request {
 func (rp *ReverseProxy) rewriteResponse(trans *Transaction) *sip.Response {
 	originalResponse := trans.Response()
 	rewriteResponse := originalResponse.Clone()
+	outbound := trans.Outbound().Transport()
 	if originalResponse.Header.Has(sip.HeaderVia) {
 		originalViaHeader := originalResponse.Header.Get(sip.HeaderVia).(*sip.ViaHeader)
 		rewriteViaHeader := &sip.ViaHeader{
 			Protocol:        "SIP",
 			ProtocolVersion: "2.0",
-			Transport:       "UDP",
+			Transport:       outbound.Network(),
 			Uri:             sip.NewUri("", trans.Caller().Addr().String(), originalViaHeader.Uri.Params.Clone()),
 		}
 		if trans.Address() == trans.Caller().Addr().String() {
@@ -126,20 +150,24 @@ func (rp *ReverseProxy) rewriteResponse(trans *Transaction) *sip.Response {
 			rewriteViaHeader.Uri.Params.Set("branch", originalViaHeader.Uri.Params.Get("branch"))
 		}
 		rewriteViaHeader.Uri.Params.Set("rport", strconv.Itoa(rewriteViaHeader.Uri.Port))
+		//原样返回请求的Via, 包含收到请求时标记的received以及rport
+		if via, ok := trans.process.requestVia(originalViaHeader.Uri.Params.Get("branch")); ok {
+			rewriteViaHeader = via
+		}
 		rewriteResponse.Header.Set(sip.HeaderVia, rewriteViaHeader)
 	}
 	if originalResponse.Header.Has(sip.HeaderContact) {
 		originalContactHeader := originalResponse.Header.Get(sip.HeaderContact).(*sip.AddressHeader)
 		rewriteContactHeader := &sip.AddressHeader{
-			Uri:    sip.NewUri(originalContactHeader.Uri.User, trans.transport.Addr().String(), sip.Map{}).EnableProtocol(),
+			Uri:    sip.NewUri(originalContactHeader.Uri.User, outbound.Addr().String(), sip.Map{}).EnableProtocol(),
 			Params: originalContactHeader.Params.Clone(),
 		}
-		rewriteContactHeader.Uri.Params.Set("transport", trans.transport.Network())
+		rewriteContactHeader.Uri.Params.Set("transport", outbound.Network())
 		rewriteResponse.Header.Set(sip.HeaderContact, rewriteContactHeader)
 	}
 	if rewriteResponse.Header.Has(sip.HeaderFrom) {
 		fromHeader := rewriteResponse.Header.Get(sip.HeaderFrom).(*sip.AddressHeader)
-		fromHeader.Uri.Params.Set("transport", trans.transport.Network())
+		fromHeader.Uri.Params.Set("transport", outbound.Network())
 		if rewrite, ok := trans.Rewrite(); ok {
 			//呼出场景
 			if fromHeader.Uri.Host == rewrite.To {
@@ -151,7 +179,7 @@ func (rp *ReverseProxy) rewriteResponse(trans *Transaction) *sip.Response {
 	}
 	if rewriteResponse.Header.Has(sip.HeaderTo) {
 		toHeader := rewriteResponse.Header.Get(sip.HeaderTo).(*sip.AddressHeader)
-		toHeader.Uri.Params.Set("transport", trans.transport.Network())
+		toHeader.Uri.Params.Set("transport", outbound.Network())
 		if rewrite, ok := trans.Rewrite(); ok {
 			//呼出场景
 			if toHeader.Uri.Host == rewrite.To {
@@ -204,13 +232,8 @@ func (rp *ReverseProxy) roundTripper(trans *Transaction) (err error) {
 	return
 }
 
-//updateRelationship 更新绑定关系
-func (rp *ReverseProxy) updateRelationship(conn Conn, msg *Message) *Relationship {
-	var (
-		domainName string
-	)
-	req := msg.Request()
-	fromHead := req.Header.Get(sip.HeaderFrom).(*sip.AddressHeader)
+//relationshipKey 获取From对应的绑定关系的key以及改写后的域名
+func (rp *ReverseProxy) relationshipKey(fromHead *sip.AddressHeader) (username string, domainName string) {
 	domainName = fromHead.Uri.Host
 	//if domain rewrite rules exists
 	for _, route := range rp.routes {
@@ -221,7 +244,15 @@ func (rp *ReverseProxy) updateRelationship(conn Conn, msg *Message) *Relationshi
 			break
 		}
 	}
-	username := fmt.Sprintf("%s@%s", fromHead.Uri.User, domainName)
+	username = fmt.Sprintf("%s@%s", fromHead.Uri.User, domainName)
+	return
+}
+
+//updateRelationship 更新绑定关系
+func (rp *ReverseProxy) updateRelationship(conn Conn, msg *Message) *Relationship {
+	req := msg.Request()
+	fromHead := req.Header.Get(sip.HeaderFrom).(*sip.AddressHeader)
+	username, domainName := rp.relationshipKey(fromHead)
 	rp.relationshipLocker.Lock()
 	defer rp.relationshipLocker.Unlock()
 	relationship, ok := rp.relationships[username]
@@ -232,12 +263,83 @@ func (rp *ReverseProxy) updateRelationship(conn Conn, msg *Message) *Relationshi
 			OriginalDomain: fromHead.Uri.Host,
 		}
 		rp.relationships[username] = relationship
-		log.Printf("bind user %s relationship %s", username, conn.Addr().String())
+		rp.logger.Info("bind user relationship", "user", username, sip.FieldPeer, conn.Addr().String())
 	}
 	relationship.Conn = conn
+	relationship.LastSeen = time.Now()
+	//注销请求在收到成功的响应后才删除绑定关系
+	if expires, ok := registerExpires(req.Header); !ok {
+		relationship.ExpiresAt = relationship.LastSeen.Add(DefaultRegisterExpires)
+	} else if expires > 0 {
+		relationship.ExpiresAt = relationship.LastSeen.Add(expires)
+	}
 	return relationship
 }
 
+//updateRegistration 注册成功后使用注册服务器返回的有效期, 有效期为0时删除绑定关系
+func (rp *ReverseProxy) updateRegistration(res *sip.Response) {
+	fromHead, ok := res.Header.Get(sip.HeaderFrom).(*sip.AddressHeader)
+	if !ok {
+		return
+	}
+	expires, ok := registerExpires(res.Header)
+	if !ok {
+		return
+	}
+	username, _ := rp.relationshipKey(fromHead)
+	rp.relationshipLocker.Lock()
+	defer rp.relationshipLocker.Unlock()
+	relationship, ok := rp.relationships[username]
+	if !ok {
+		return
+	}
+	if expires <= 0 {
+		delete(rp.relationships, username)
+		rp.logger.Info("unbind user relationship", "user", username)
+		return
+	}
+	relationship.ExpiresAt = time.Now().Add(expires)
+}
+
+//touch 收到保活后更新对应连接的绑定关系
+func (rp *ReverseProxy) touch(addr net.Addr) {
+	rp.relationshipLocker.Lock()
+	defer rp.relationshipLocker.Unlock()
+	for _, relationship := range rp.relationships {
+		if relationship.Conn != nil && relationship.Conn.Addr().String() == addr.String() {
+			relationship.LastSeen = time.Now()
+		}
+	}
+}
+
+//keepAlive 处理STUN以及CRLF保活消息, 不是保活消息时返回false
+func (rp *ReverseProxy) keepAlive(conn Conn, buf []byte) bool {
+	var (
+		err error
+		b   []byte
+	)
+	if sip.IsSTUN(buf) {
+		if udpConn, ok := conn.(*UdpConn); ok {
+			if b, err = sip.NewSTUNBindingResponse(buf, udpConn.addr); err == nil {
+				_, _ = udpConn.conn.WriteToUDP(b, udpConn.addr)
+			}
+		}
+		rp.touch(conn.Addr())
+		return true
+	}
+	if len(buf) == 0 || len(bytes.Trim(buf, "\r\n")) > 0 {
+		return false
+	}
+	//双CRLF为ping, 回复单个CRLF
+	if len(buf) >= 4 {
+		if wsConn, ok := conn.(*WSConn); ok {
+			_ = wsConn.conn.WriteMessage(websocket.OpText, []byte("\r\n"))
+		}
+	}
+	rp.touch(conn.Addr())
+	return true
+}
+
 //findRoute 查找请求的路由
 func (rp *ReverseProxy) findRoute(req *sip.Request) (route *Route, err error) {
 	fromHead := req.Header.Get(sip.HeaderFrom).(*sip.AddressHeader)
@@ -285,16 +387,87 @@ func (rp *ReverseProxy) findRelationship(req *sip.Request) (relationship *Relati
 	return
 }
 
-//getProcess 获取一个处理器
+//getAuthenticator 获取realm对应的认证器
+func (rp *ReverseProxy) getAuthenticator(realm string) *sip.DigestAuthenticator {
+	authenticator, ok := rp.authenticators[realm]
+	if !ok {
+		authenticator = sip.NewDigestAuthenticator(realm, rp.credentials)
+		rp.authenticators[realm] = authenticator
+	}
+	return authenticator
+}
+
+//authenticate 对需要认证的请求进行校验，ok为false时请求不能转发, res不为空时需要回复认证挑战
+func (rp *ReverseProxy) authenticate(req *sip.Request) (res *sip.Response, ok bool) {
+	var (
+		err   error
+		route *Route
+	)
+	if rp.credentials == nil {
+		return nil, true
+	}
+	callID := req.CallID()
+	rp.authLocker.Lock()
+	defer rp.authLocker.Unlock()
+	//认证挑战的ACK由代理吸收, ACK不能回复响应
+	if req.Method == sip.MethodAck {
+		_, challenged := rp.challenges[callID]
+		return nil, !challenged
+	}
+	if route, err = rp.findRoute(req); err != nil || !route.RequireAuth(req.Method) {
+		return nil, true
+	}
+	authenticator := rp.getAuthenticator(route.Realm())
+	if _, err = authenticator.Verify(req); err == nil {
+		delete(rp.challenges, callID)
+		//认证信息已经被代理使用, 不需要转发给后端
+		for _, name := range []string{sip.HeaderProxyAuthorization, sip.HeaderAuthorization} {
+			if head, exists := req.Header.Get(name).(*sip.AuthorizationHeader); exists && head.Realm == route.Realm() {
+				req.Header.Del(name)
+			}
+		}
+		return nil, true
+	}
+	code := sip.StatusProxyAuthenticationRequired
+	if req.Method == sip.MethodRegister {
+		code = sip.StatusUnauthorized
+	}
+	res = authenticator.Challenge(req, code, err == sip.ErrorAuthorizationStale)
+	rp.challenges[callID] = time.Now()
+	return
+}
+
+//SetLogger 设置日志, 需要在Serve之前设置, 为空时不输出日志
+func (rp *ReverseProxy) SetLogger(logger sip.Logger) {
+	if logger == nil {
+		logger = sip.NopLogger()
+	}
+	rp.logger = logger
+}
+
+//SetTracer 设置消息跟踪器, 需要在Serve之前设置
+func (rp *ReverseProxy) SetTracer(tracer sip.Tracer) {
+	rp.tracer = tracer
+}
+
+//SetLocator 设置后端地址的定位器
+func (rp *ReverseProxy) SetLocator(locator *sip.Locator) {
+	rp.locator = locator
+}
+
+//getProcess 获取一个处理器, 后端的定位在锁外进行
 func (rp *ReverseProxy) getProcess(conn Conn, msg *Message) (process *Process, err error) {
 	var (
 		ok           bool
 		route        *Route
 		relationship *Relationship
+		b            *backend
+		addrs        []string
 	)
-	rp.processLocker.Lock()
-	defer rp.processLocker.Unlock()
-	if process, ok = rp.processes[msg.CallID()]; ok {
+	rp.processLocker.RLock()
+	process, ok = rp.processes[msg.CallID()]
+	rp.processLocker.RUnlock()
+	if ok {
 		return
 	}
 	if msg.Direction() == DirectionResponse {
@@ -303,78 +476,204 @@ func (rp *ReverseProxy) getProcess(conn Conn, msg *Message) (process *Process, e
 	}
 	process = NewProcess(msg.CallID())
 	process.caller = conn
+	process.maxHistory = rp.lifecycle.MaxHistory
 	//bypass route
 	if route, err = rp.findRoute(msg.Request()); err == nil {
-		process.callee = newUDPConn(route.Address(), rp.udpConn)
-		process.route = route
-		rp.processes[msg.CallID()] = process
-		if msg.Direction() == DirectionRequest && msg.Request().Method == sip.MethodRegister {
-			rp.updateRelationship(conn, msg)
+		if b, err = route.pick(msg.Request()); err != nil {
+			return
 		}
-		return
+		if addrs, err = rp.backendAddress(b.addr); err != nil {
+			return
+		}
+		b.acquire()
+		process.callee = newUDPConn(addrs[0], rp.udpConn, rp.tracer)
+		process.targets = addrs[1:]
+		process.route = route
+		process.backend = b
+		return rp.storeProcess(process), nil
 	}
 	//find relationship
 	if relationship, err = rp.findRelationship(msg.Request()); err == nil {
 		process.callee = relationship.Conn
 		process.relationship = relationship
-		rp.processes[msg.CallID()] = process
+		process = rp.storeProcess(process)
 	}
 	return
 }
 
+//storeProcess 保存新建的处理器, 同一个Call-ID已经有处理器时释放新建的处理器并返回已有的
+func (rp *ReverseProxy) storeProcess(process *Process) *Process {
+	rp.processLocker.Lock()
+	defer rp.processLocker.Unlock()
+	if exists, ok := rp.processes[process.id]; ok {
+		process.release()
+		return exists
+	}
+	rp.processes[process.id] = process
+	return process
+}
+
+//serveMessage 处理一个收到的sip消息
+func (rp *ReverseProxy) serveMessage(conn Conn, buf []byte) {
+	var (
+		err  error
+		proc *Process
+	)
+	if rp.keepAlive(conn, buf) {
+		return
+	}
+	if len(buf) < 3 {
+		return
+	}
+	msg := &Message{}
+	bytesReader := pool.GetBytesReader(buf)
+	bufioReader := pool.GetBufioReader(bytesReader)
+	if bytes.Compare(buf[:3], responseFeature) == 0 {
+		msg.direction = DirectionResponse
+		msg.response, err = sip.ReadResponse(bufioReader)
+	} else {
+		msg.direction = DirectionRequest
+		msg.request, err = sip.ReadRequest(bufioReader)
+	}
+	pool.PutBytesReader(bytesReader)
+	pool.PutBufioReader(bufioReader)
+	traceMessage(rp.tracer, sip.TraceReceive, conn, buf, msg.request, msg.response, err)
+	if err != nil {
+		rp.metrics.incParseError()
+		rp.logger.Warn("parse sip message failed", sip.FieldPeer, conn.Addr().String(), sip.FieldError, err)
+		return
+	}
+	//健康检查的响应不需要转发
+	if msg.Direction() == DirectionResponse && rp.probeResponse(msg.Response()) {
+		return
+	}
+	//标记请求的来源地址(RFC 3581)
+	if msg.Direction() == DirectionRequest {
+		rp.metrics.incRequest(msg.Request().Method)
+		if via, ok := msg.Request().Header.Get(sip.HeaderVia).(*sip.ViaHeader); ok {
+			via.Stamp(conn.Addr())
+		}
+	} else {
+		rp.metrics.incResponse(msg.Response().StatusCode)
+	}
+	//认证校验
+	if msg.Direction() == DirectionRequest {
+		if res, ok := rp.authenticate(msg.Request()); !ok {
+			if res != nil {
+				_ = conn.Response(res)
+			}
+			return
+		}
+	}
+	//获取处理程序
+	if proc, err = rp.getProcess(conn, msg); err != nil {
+		if msg.Direction() == DirectionRequest && msg.Request().Method != sip.MethodAck {
+			if err == ErrorNoHealthyBackend || errors.Is(err, ErrorBackendUnresolved) {
+				_ = conn.Response(sip.NewResponse(sip.StatusServiceUnavailable, msg.Request()))
+			} else {
+				_ = conn.Response(sip.NewResponse(sip.StatusTemporarilyUnavailable, msg.Request()))
+			}
+		}
+		rp.logger.Warn("get sip message process failed", sip.FieldCallID, msg.CallID(), sip.FieldPeer, conn.Addr().String(), sip.FieldError, err)
+		return
+	}
+	//丢弃故障转移后原后端的响应
+	if msg.Direction() == DirectionResponse && !rp.observeResponse(conn, proc, msg.Response()) {
+		return
+	}
+	//注册刷新使用相同的Call-ID, 每次注册都需要更新绑定关系
+	if proc.route != nil {
+		if msg.Direction() == DirectionRequest && msg.Request().Method == sip.MethodRegister {
+			rp.updateRelationship(conn, msg)
+		} else if msg.Direction() == DirectionResponse && msg.Response().StatusCode >= 200 && msg.Response().StatusCode < 300 {
+			if seq, ok := msg.Response().Header.Get(sip.HeaderCSeq).(*sip.SequenceHeader); ok && seq.Method == sip.MethodRegister {
+				rp.updateRegistration(msg.Response())
+			}
+		}
+	}
+	trans := newTransaction(msg, proc, conn.Addr(), conn.Transport())
+	trans.process.Push(msg)
+	rp.armFailover(proc, trans)
+	select {
+	case rp.transChan <- trans:
+	case <-rp.ctx.Done():
+	case <-time.After(time.Millisecond * 100):
+		rp.metrics.incDropped()
+		rp.logger.Warn("forwarding queue full, transaction dropped", sip.FieldCallID, msg.CallID(), sip.FieldPeer, conn.Addr().String())
+	}
+}
+
 func (rp *ReverseProxy) udpServe(addr string) (err error) {
 	var (
 		n          int
-		proc       *Process
+		conn       *net.UDPConn
 		remoteAddr *net.UDPAddr
 		localAddr  *net.UDPAddr
 	)
 	if localAddr, err = net.ResolveUDPAddr("udp", addr); err != nil {
 		return
 	}
-	if rp.udpConn, err = net.ListenUDP("udp", localAddr); err != nil {
+	rp.connLocker.Lock()
+	if rp.ctx.Err() != nil {
+		rp.connLocker.Unlock()
+		return rp.ctx.Err()
+	}
+	if conn, err = net.ListenUDP("udp", localAddr); err != nil {
+		rp.connLocker.Unlock()
 		return
 	}
+	rp.udpConn = conn
+	rp.connLocker.Unlock()
 	buf := make([]byte, 1024*32)
 	for {
-		if n, remoteAddr, err = rp.udpConn.ReadFromUDP(buf); err != nil {
+		if n, remoteAddr, err = conn.ReadFromUDP(buf); err != nil {
 			break
 		}
-		if n < 3 {
-			continue
+		rp.serveMessage(&UdpConn{conn: conn, addr: remoteAddr, tracer: rp.tracer}, buf[:n])
+	}
+	return
+}
+
+//wsServe 处理一个websocket连接上的消息
+func (rp *ReverseProxy) wsServe(conn *websocket.Conn, secure bool) {
+	var (
+		err error
+		buf []byte
+	)
+	defer conn.Close()
+	wsConn := newWSConn(conn, secure, rp.tracer)
+	for {
+		if _, buf, err = conn.ReadMessage(); err != nil {
+			break
 		}
-		msg := &Message{}
-		bytesReader := pool.GetBytesReader(buf[:n])
-		bufioReader := pool.GetBufioReader(bytesReader)
-		if bytes.Compare(buf[:3], responseFeature) == 0 {
-			msg.direction = DirectionResponse
-			msg.response, err = sip.ReadResponse(bufioReader)
-		} else {
-			msg.direction = DirectionRequest
-			msg.request, err = sip.ReadRequest(bufioReader)
-		}
-		pool.PutBytesReader(bytesReader)
-		pool.PutBufioReader(bufioReader)
-		if err != nil {
-			log.Printf("parse sip message error: %s", err.Error())
-			continue
-		}
-		//获取处理程序
-		if proc, err = rp.getProcess(&UdpConn{conn: rp.udpConn, addr: remoteAddr}, msg); err != nil {
-			if msg.Direction() == DirectionRequest {
-				res := sip.NewResponse(sip.StatusTemporarilyUnavailable, msg.Request())
-				_, _ = rp.udpConn.WriteToUDP(res.Bytes(), remoteAddr)
+		rp.serveMessage(wsConn, buf)
+	}
+}
+
+//ServeWS 开启websocket(RFC 7118)监听, config不为空时使用wss, 调用Close后返回
+func (rp *ReverseProxy) ServeWS(addr string, config *tls.Config) (err error) {
+	server := &http.Server{
+		Addr:      addr,
+		TLSConfig: config,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := websocket.Upgrade(w, r, []string{sip.WebSocketProtocol})
+			if err != nil {
+				return
 			}
-			log.Printf("get sip message %s process error: %s", msg.CallID(), err.Error())
-			continue
-		}
-		trans := newTransaction(msg, proc, remoteAddr, newUDPTransport(rp.udpConn))
-		trans.process.Push(msg)
-		select {
-		case rp.transChan <- trans:
-		case <-rp.ctx.Done():
-		case <-time.After(time.Millisecond * 100):
-		}
+			rp.wsServe(conn, r.TLS != nil)
+		}),
+	}
+	go func() {
+		<-rp.ctx.Done()
+		_ = server.Close()
+	}()
+	if config != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		err = nil
 	}
 	return
 }
@@ -384,7 +683,9 @@ func (rp *ReverseProxy) eventLoop() {
 		select {
 		case trans := <-rp.transChan:
 			if err := rp.roundTripper(trans); err != nil {
-				log.Printf(err.Error())
+				rp.logger.Warn("forward sip message failed", sip.FieldCallID, trans.ID(), sip.FieldPeer, trans.Address(), sip.FieldError, err)
+			} else {
+				rp.metrics.observeLatency(time.Since(trans.createdAt))
 			}
 		case <-rp.ctx.Done():
 			return
@@ -392,26 +693,111 @@ func (rp *ReverseProxy) eventLoop() {
 	}
 }
 
-//Serve 开启服务
+//Serve 开启服务, 监听失败或者调用Close后返回
 func (rp *ReverseProxy) Serve(addr string) (err error) {
+	errChan := make(chan error, 1)
 	go func() {
-		err = rp.udpServe(addr)
+		errChan <- rp.udpServe(addr)
 	}()
-	rp.eventLoop()
+	go rp.eventLoop()
+	go rp.lifecycleLoop()
+	for _, route := range rp.routes {
+		if route.healthConfig().Interval > 0 {
+			go rp.healthLoop(route)
+		}
+	}
+	select {
+	case err = <-errChan:
+		rp.cancel()
+	case <-rp.ctx.Done():
+		//关闭连接导致的读取错误不需要返回
+		<-errChan
+	}
+	return
+}
+
+//Metrics 代理的运行指标
+func (rp *ReverseProxy) Metrics() *Metrics {
+	return rp.metrics
+}
+
+//ServeMetrics 开启Prometheus指标的http监听, 路径为/metrics, 调用Close后返回
+func (rp *ReverseProxy) ServeMetrics(addr string) (err error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", rp.metrics)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-rp.ctx.Done()
+		_ = server.Close()
+	}()
+	if err = server.ListenAndServe(); err == http.ErrServerClosed {
+		err = nil
+	}
+	return
+}
+
+//Close 停止服务
+func (rp *ReverseProxy) Close() (err error) {
+	rp.cancel()
+	rp.connLocker.Lock()
+	defer rp.connLocker.Unlock()
+	if rp.udpConn != nil {
+		err = rp.udpConn.Close()
+	}
 	return
 }
 
+//SetCredentialStore 设置认证凭证，路由配置了auth时对请求进行摘要认证
+func (rp *ReverseProxy) SetCredentialStore(store sip.CredentialStore) {
+	rp.authLocker.Lock()
+	defer rp.authLocker.Unlock()
+	rp.credentials = store
+	rp.authenticators = make(map[string]*sip.DigestAuthenticator)
+}
+
 //NewReverse 穿件一个代理服务
 func NewReverse(routes []*Route) *ReverseProxy {
+	ctx, cancel := context.WithCancel(context.Background())
 	proxy := &ReverseProxy{
-		transChan:     make(chan *Transaction, 1024),
-		ctx:           context.Background(),
-		processes:     make(map[string]*Process),
-		relationships: make(map[string]*Relationship),
-		routes:        routes,
+		transChan:      make(chan *Transaction, 1024),
+		ctx:            ctx,
+		cancel:         cancel,
+		processes:      make(map[string]*Process),
+		relationships:  make(map[string]*Relationship),
+		authenticators: make(map[string]*sip.DigestAuthenticator),
+		challenges:     make(map[string]time.Time),
+		locator:        sip.NewLocator(nil),
+		located:        make(map[string]*located),
+		logger:         sip.NopLogger(),
+		metrics:        newMetrics(),
+		lifecycle:      Lifecycle{}.withDefaults(),
+		probes:         make(map[string]chan *sip.Response),
+		routes:         routes,
 	}
 	if proxy.routes == nil {
 		proxy.routes = make([]*Route, 0)
 	}
+	proxy.metrics.addGauge("processes", "Active call processes.", func() float64 {
+		proxy.processLocker.RLock()
+		defer proxy.processLocker.RUnlock()
+		return float64(len(proxy.processes))
+	})
+	proxy.metrics.addGauge("relationships", "Bound user relationships.", func() float64 {
+		proxy.relationshipLocker.RLock()
+		defer proxy.relationshipLocker.RUnlock()
+		return float64(len(proxy.relationships))
+	})
+	proxy.metrics.addGauge("healthy_backends", "Route backends currently receiving traffic.", func() float64 {
+		var n int
+		for _, route := range proxy.routes {
+			route.init()
+			for _, b := range route.backends {
+				if b.healthy() {
+					n++
+				}
+			}
+		}
+		return float64(n)
+	})
 	return proxy
 }
@@ -1,10 +1,146 @@
 package proxy
 
 import (
+	"encoding/hex"
+	"github.com/uole/sip"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestNewReverseProxy(t *testing.T) {
 	serve := NewReverse(nil)
 	_ = serve.Serve("192.168.4.169:5060")
 }
+
+func TestReverseProxy_Close(t *testing.T) {
+	serve := NewReverse(nil)
+	done := make(chan error, 1)
+	go func() {
+		done <- serve.Serve("127.0.0.1:0")
+	}()
+	time.Sleep(time.Millisecond * 100)
+	if err := serve.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("proxy not stopped")
+	}
+}
+
+func TestReverseProxy_ServeWS(t *testing.T) {
+	serve := NewReverse(nil)
+	done := make(chan error, 1)
+	go func() {
+		done <- serve.ServeWS("127.0.0.1:0", nil)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	if err := serve.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("websocket server not stopped")
+	}
+}
+
+func TestReverseProxy_keepAlive(t *testing.T) {
+	rp := NewReverse(nil)
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := &UdpConn{conn: server, addr: client.LocalAddr().(*net.UDPAddr)}
+	relationship := &Relationship{User: "1001", Conn: conn}
+	rp.relationships["1001@example.com"] = relationship
+	req := []byte{0, 1, 0, 0, 0x21, 0x12, 0xA4, 0x42, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	if !rp.keepAlive(conn, req) {
+		t.Fatal("stun binding request not handled")
+	}
+	buf := make([]byte, 128)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sip.IsSTUN(buf[:n]) || buf[1] != 0x01 {
+		t.Errorf("unexpected stun response %x", buf[:n])
+	}
+	if !relationship.Alive(time.Second) {
+		t.Error("relationship not touched")
+	}
+	if rp.keepAlive(conn, []byte("OPTIONS sip:1001@example.com SIP/2.0\r\n")) {
+		t.Error("sip message handled as keep-alive")
+	}
+}
+
+func newAuthInvite(seq int) *sip.Request {
+	req := sip.NewRequest(sip.MethodInvite, "example.com")
+	req.Username = "1001"
+	req.Header.Set(sip.HeaderVia, &sip.ViaHeader{Uri: sip.NewUri("", "127.0.0.1:9", sip.Map{"branch": "z9hG4bK-auth"})})
+	req.Header.Set(sip.HeaderFrom, &sip.AddressHeader{Uri: sip.NewUri("1000", "example.com", sip.Map{}).EnableProtocol(), Params: sip.Map{"tag": "auth"}})
+	req.Header.Set(sip.HeaderTo, &sip.AddressHeader{Uri: sip.NewUri("1001", "example.com", sip.Map{}).EnableProtocol()})
+	req.Header.Set(sip.HeaderCallID, sip.NewPlainHeader("auth-call"))
+	req.Header.Set(sip.HeaderCSeq, sip.NewSequenceHeader(sip.MethodInvite, seq))
+	return req
+}
+
+//newAuthorization 使用挑战计算请求的摘要认证头
+func newAuthorization(challenge *sip.AuthorizationHeader, req *sip.Request, username, password string) *sip.AuthorizationHeader {
+	head := sip.NewAuthorizationResponseHeader(username, password, challenge)
+	head.Uri = req.Uri()
+	ha2 := hex.EncodeToString(sip.MD5([]byte(req.Method.String() + ":" + head.Uri.String())))
+	head.Response = hex.EncodeToString(sip.MD5([]byte(sip.HA1(username, head.Realm, password) + ":" + head.Nonce + ":" + head.NC + ":" + head.CNonce + ":" + head.QOP + ":" + ha2)))
+	return head
+}
+
+func TestReverseProxy_authenticate(t *testing.T) {
+	store := sip.NewMemoryCredentialStore()
+	store.Add("1000", "example.com", "secret")
+	rp := NewReverse([]*Route{{Domain: "example.com", Backend: []string{"127.0.0.1:9"}, Auth: &RouteAuth{}}})
+	rp.SetCredentialStore(store)
+
+	res, ok := rp.authenticate(newAuthInvite(1))
+	if ok || res == nil || res.StatusCode != sip.StatusProxyAuthenticationRequired {
+		t.Fatalf("unexpected challenge %v %v", res, ok)
+	}
+	//认证挑战的ACK被代理吸收
+	ack := newAuthInvite(1)
+	ack.Method = sip.MethodAck
+	if res, ok := rp.authenticate(ack); ok || res != nil {
+		t.Fatalf("challenged ack not absorbed %v %v", res, ok)
+	}
+
+	challenge := res.Header.Get(sip.HeaderProxyAuthenticate).(*sip.AuthorizationHeader)
+	req := newAuthInvite(2)
+	authorization := newAuthorization(challenge, req, "1000", "secret")
+	req.Header.Set(sip.HeaderProxyAuthorization, authorization)
+	if res, ok := rp.authenticate(req); !ok || res != nil {
+		t.Fatalf("authenticated invite rejected %v", res)
+	}
+	if req.Header.Has(sip.HeaderProxyAuthorization) {
+		t.Error("credentials forwarded to backend")
+	}
+
+	//重放相同的认证信息
+	req = newAuthInvite(2)
+	req.Header.Set(sip.HeaderProxyAuthorization, authorization)
+	if res, ok := rp.authenticate(req); ok || res == nil || res.StatusCode != sip.StatusProxyAuthenticationRequired {
+		t.Errorf("replayed credentials accepted %v", res)
+	}
+}
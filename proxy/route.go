@@ -1,14 +1,118 @@
 package proxy
 
-//Route 代理走的路由规则
-type Route struct {
-	index     int32
-	Domain    string   `json:"domain" yaml:"domain"`        //域名
-	RewriteTo string   `json:"rewrite_to" yaml:"rewriteTo"` //对域名进行重写处理
-	Backend   []string `json:"backend" yaml:"backend"`      //代理的后端地址，多个地址使用轮询获取地址
+import (
+	"errors"
+	"github.com/uole/sip"
+	"sync"
+	"time"
+)
+
+var (
+	ErrorNoBackend        = errors.New("route has no backend")
+	ErrorNoHealthyBackend = errors.New("route has no healthy backend")
+)
+
+type (
+	//Route 代理走的路由规则
+	Route struct {
+		Domain    string       `json:"domain" yaml:"domain"`        //域名
+		RewriteTo string       `json:"rewrite_to" yaml:"rewriteTo"` //对域名进行重写处理
+		Backend   []string     `json:"backend" yaml:"backend"`      //代理的后端地址，多个地址按照Strategy获取地址，sip:example.com格式的地址通过dns定位
+		Strategy  string       `json:"strategy" yaml:"strategy"`    //负载均衡策略，默认轮询
+		Weights   []int        `json:"weights" yaml:"weights"`      //后端的权重，和Backend按照顺序对应，默认为1
+		Auth      *RouteAuth   `json:"auth" yaml:"auth"`            //认证配置，为空不进行认证
+		Health    *RouteHealth `json:"health" yaml:"health"`        //后端的健康检查配置，为空时使用默认值
+		once      sync.Once
+		backends  []*backend
+		balancer  balancer
+		health    *RouteHealth
+	}
+
+	//RouteAuth 路由的摘要认证配置
+	RouteAuth struct {
+		Realm   string   `json:"realm" yaml:"realm"`     //认证域，默认使用路由的域名
+		Methods []string `json:"methods" yaml:"methods"` //需要认证的方法，默认REGISTER和INVITE
+	}
+)
+
+//init 第一次使用时根据配置创建后端以及负载均衡
+func (r *Route) init() {
+	r.once.Do(func() {
+		r.backends = make([]*backend, 0, len(r.Backend))
+		for i, addr := range r.Backend {
+			b := &backend{addr: addr, weight: 1}
+			if i < len(r.Weights) && r.Weights[i] > 0 {
+				b.weight = r.Weights[i]
+			}
+			r.backends = append(r.backends, b)
+		}
+		r.balancer = newBalancer(r.Strategy)
+		r.health = r.Health.withDefaults()
+	})
+}
+
+//healthConfig 填充默认值后的健康检查配置
+func (r *Route) healthConfig() *RouteHealth {
+	r.init()
+	return r.health
 }
 
+//pick 按照负载均衡策略为请求选择一个健康的后端, 跳过exclude中的后端
+func (r *Route) pick(req *sip.Request, exclude ...*backend) (b *backend, err error) {
+	r.init()
+	if len(r.backends) == 0 {
+		err = ErrorNoBackend
+		return
+	}
+	var cooldown time.Duration
+	//主动探测时由探测结果恢复后端
+	if r.health.Interval <= 0 {
+		cooldown = r.health.Cooldown
+	}
+	now := time.Now()
+	candidates := make([]*backend, 0, len(r.backends))
+	for _, v := range r.backends {
+		if v.available(now, cooldown) && !containsBackend(exclude, v) {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		err = ErrorNoHealthyBackend
+		return
+	}
+	b = r.balancer.pick(candidates, req)
+	return
+}
+
+//Address 按照负载均衡策略获取一个后端地址, 没有后端时返回空
 func (r *Route) Address() string {
-	idx := int(r.index) % len(r.Backend)
-	return r.Backend[idx]
+	b, err := r.pick(nil)
+	if err != nil {
+		return ""
+	}
+	return b.addr
+}
+
+//Realm 返回认证域
+func (r *Route) Realm() string {
+	if r.Auth != nil && r.Auth.Realm != "" {
+		return r.Auth.Realm
+	}
+	return r.Domain
+}
+
+//RequireAuth 判断请求方法是否需要认证
+func (r *Route) RequireAuth(method sip.Method) bool {
+	if r.Auth == nil {
+		return false
+	}
+	if len(r.Auth.Methods) == 0 {
+		return method == sip.MethodRegister || method == sip.MethodInvite
+	}
+	for _, s := range r.Auth.Methods {
+		if method.Is(s) {
+			return true
+		}
+	}
+	return false
 }
@@ -3,6 +3,7 @@ package proxy
 import (
 	"github.com/uole/sip"
 	"net"
+	"time"
 )
 
 type (
@@ -16,6 +17,7 @@ type (
 		process   *Process
 		message   *Message
 		transport Transport
+		createdAt time.Time //收到消息的时间
 	}
 )
 
@@ -35,6 +37,14 @@ func (t *Transaction) Callee() Conn {
 	return t.process.Callee()
 }
 
+//Outbound 消息需要转发到的连接
+func (t *Transaction) Outbound() Conn {
+	if t.Address() == t.Caller().Addr().String() {
+		return t.Callee()
+	}
+	return t.Caller()
+}
+
 func (t *Transaction) Request() *sip.Request {
 	return t.message.Request()
 }
@@ -69,5 +79,6 @@ func newTransaction(msg *Message, proc *Process, source net.Addr, transport Tran
 		message:   msg,
 		address:   source.String(),
 		transport: transport,
+		createdAt: time.Now(),
 	}
 }
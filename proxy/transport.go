@@ -1,6 +1,10 @@
 package proxy
 
-import "net"
+import (
+	"github.com/uole/sip"
+	"github.com/uole/sip/websocket"
+	"net"
+)
 
 type Transport interface {
 	Network() string
@@ -11,6 +15,11 @@ type udpTransport struct {
 	conn *net.UDPConn
 }
 
+type wsTransport struct {
+	conn   *websocket.Conn
+	secure bool
+}
+
 func (t *udpTransport) Network() string {
 	return "UDP"
 }
@@ -19,6 +28,21 @@ func (t *udpTransport) Addr() net.Addr {
 	return t.conn.LocalAddr()
 }
 
+func (t *wsTransport) Network() string {
+	if t.secure {
+		return sip.ProtoWSS
+	}
+	return sip.ProtoWS
+}
+
+func (t *wsTransport) Addr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
 func newUDPTransport(conn *net.UDPConn) *udpTransport {
 	return &udpTransport{conn: conn}
 }
+
+func newWSTransport(conn *websocket.Conn, secure bool) *wsTransport {
+	return &wsTransport{conn: conn, secure: secure}
+}
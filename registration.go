@@ -0,0 +1,225 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	RegistrationStateRegistering = iota + 1
+	RegistrationStateRegistered
+	RegistrationStateFailed
+	RegistrationStateUnregistered
+)
+
+const (
+	//registrationMargin 注册到期前提前刷新的时间
+	registrationMargin = time.Second * 30
+	//registrationTimeout 单次注册请求的超时时间
+	registrationTimeout = T1 * 64
+	//registrationMaxRetryDelay 注册失败重试的最大间隔
+	registrationMaxRetryDelay = time.Minute * 5
+	//DefaultRegistrationRetryDelay RetryDelay没有设置时第一次重试的间隔
+	DefaultRegistrationRetryDelay = time.Second * 5
+)
+
+var (
+	ErrorAccountExists   = errors.New("account already exists")
+	ErrorAccountNotFound = errors.New("account not found")
+)
+
+type (
+	//RegistrationEvent 注册状态变化的事件
+	RegistrationEvent struct {
+		Account *Account
+		State   int
+		Expires time.Duration
+		Err     error
+	}
+
+	//RegistrationManager 维护多个账号的注册, 到期前自动刷新, 失败后按照指数退避重试
+	RegistrationManager struct {
+		RetryDelay    time.Duration              //注册失败后第一次重试的间隔, 小于等于0时使用DefaultRegistrationRetryDelay
+		OnStateChange func(e *RegistrationEvent) //状态变化的回调, 需要在Add之前设置
+		client        *Client
+		events        chan *RegistrationEvent
+		mutex         sync.Mutex
+		workers       map[string]*registrationWorker
+		wg            sync.WaitGroup
+	}
+
+	//registrationWorker 单个账号的注册
+	registrationWorker struct {
+		account *Account
+		state   int
+		cancel  context.CancelFunc
+		done    chan struct{}
+	}
+)
+
+//Events 注册状态变化的事件, 事件没有及时读取时会被丢弃
+func (m *RegistrationManager) Events() <-chan *RegistrationEvent {
+	return m.events
+}
+
+//State 账号当前的注册状态
+func (m *RegistrationManager) State(account *Account) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if w, ok := m.workers[account.Uri().String()]; ok {
+		return w.state
+	}
+	return RegistrationStateUnregistered
+}
+
+//emit 更新账号的状态并通知
+func (m *RegistrationManager) emit(w *registrationWorker, state int, expires time.Duration, err error) {
+	m.mutex.Lock()
+	w.state = state
+	m.mutex.Unlock()
+	e := &RegistrationEvent{Account: w.account, State: state, Expires: expires, Err: err}
+	if m.OnStateChange != nil {
+		m.OnStateChange(e)
+	}
+	select {
+	case m.events <- e:
+	default:
+	}
+}
+
+//Add 添加一个账号并开始注册
+func (m *RegistrationManager) Add(account *Account) (err error) {
+	key := account.Uri().String()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.workers[key]; ok {
+		err = ErrorAccountExists
+		return
+	}
+	if m.workers == nil {
+		m.workers = make(map[string]*registrationWorker)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &registrationWorker{account: account, cancel: cancel, done: make(chan struct{})}
+	m.workers[key] = w
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer close(w.done)
+		m.run(ctx, w)
+	}()
+	return
+}
+
+//Remove 停止刷新并注销账号
+func (m *RegistrationManager) Remove(ctx context.Context, account *Account) (err error) {
+	key := account.Uri().String()
+	m.mutex.Lock()
+	w, ok := m.workers[key]
+	delete(m.workers, key)
+	m.mutex.Unlock()
+	if !ok {
+		err = ErrorAccountNotFound
+		return
+	}
+	return m.stop(ctx, w)
+}
+
+//stop 停止账号的注册, 已经注册成功的账号需要注销
+func (m *RegistrationManager) stop(ctx context.Context, w *registrationWorker) (err error) {
+	w.cancel()
+	<-w.done
+	m.mutex.Lock()
+	registered := w.state == RegistrationStateRegistered
+	m.mutex.Unlock()
+	if registered {
+		err = m.client.Unregister(ctx, w.account)
+	}
+	m.emit(w, RegistrationStateUnregistered, 0, err)
+	return
+}
+
+//Close 注销所有的账号
+func (m *RegistrationManager) Close(ctx context.Context) (err error) {
+	m.mutex.Lock()
+	workers := m.workers
+	m.workers = make(map[string]*registrationWorker)
+	m.mutex.Unlock()
+	for _, w := range workers {
+		if e := m.stop(ctx, w); e != nil {
+			err = e
+		}
+	}
+	m.wg.Wait()
+	return
+}
+
+//run 注册账号并在到期前刷新, 传输层错误或者服务器拒绝时按照指数退避重试
+func (m *RegistrationManager) run(ctx context.Context, w *registrationWorker) {
+	var (
+		err     error
+		expires time.Duration
+		delay   time.Duration
+		wait    time.Duration
+	)
+	m.emit(w, RegistrationStateRegistering, 0, nil)
+	for {
+		reqCtx, cancel := context.WithTimeout(ctx, registrationTimeout)
+		expires, err = m.client.Register(reqCtx, w.account)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if delay == 0 {
+				delay = m.retryDelay()
+			} else if delay *= 2; delay > registrationMaxRetryDelay {
+				delay = registrationMaxRetryDelay
+			}
+			wait = delay
+			m.emit(w, RegistrationStateFailed, 0, err)
+		} else {
+			delay = 0
+			wait = refreshInterval(expires)
+			m.emit(w, RegistrationStateRegistered, expires, nil)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+//retryDelay 第一次重试的间隔, 没有设置时使用默认值, 避免注册失败后立即重试
+func (m *RegistrationManager) retryDelay() time.Duration {
+	if m.RetryDelay <= 0 {
+		return DefaultRegistrationRetryDelay
+	}
+	return m.RetryDelay
+}
+
+//refreshInterval 注册的刷新间隔, 较短的有效期在一半的时间刷新
+func refreshInterval(expires time.Duration) time.Duration {
+	if expires > registrationMargin*2 {
+		return expires - registrationMargin
+	}
+	if expires < time.Second*2 {
+		return time.Second
+	}
+	return expires / 2
+}
+
+//NewRegistrationManager 创建注册管理器
+func NewRegistrationManager(client *Client) *RegistrationManager {
+	return &RegistrationManager{
+		RetryDelay: DefaultRegistrationRetryDelay,
+		client:     client,
+		events:     make(chan *RegistrationEvent, 64),
+		workers:    make(map[string]*registrationWorker),
+	}
+}
@@ -0,0 +1,168 @@
+package sip
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//serveRegistrar 测试用的注册服务器
+//2001的有效期为2秒, 2002要求最小有效期30秒, 2003第一次注册失败
+func serveRegistrar(tp Transport, unregistered chan string) {
+	var (
+		mutex    sync.Mutex
+		requests = make(map[string]int)
+	)
+	for req := range tp.Request() {
+		user := req.Header.Get(HeaderTo).(*AddressHeader).Uri.User
+		expires, _ := strconv.Atoi(req.Header.Get(HeaderExpires).String())
+		mutex.Lock()
+		requests[user]++
+		count := requests[user]
+		mutex.Unlock()
+		res := NewResponse(StatusOK, req)
+		switch {
+		case expires == 0:
+			//只注销自己的绑定, 不能使用Contact: *
+			if contact, ok := req.Header.Get(HeaderContact).(*AddressHeader); ok && contact.Params.Get("expires") == "0" {
+				unregistered <- user
+			}
+		case user == "2001":
+			expires = 2
+		case user == "2002" && expires < 30:
+			res = NewResponse(StatusIntervalTooBrief, req)
+			res.Header.Set(HeaderMinExpires, NewPlainHeader(30))
+		case user == "2003" && count == 1:
+			res = NewResponse(StatusServiceUnavailable, req)
+		}
+		res.Header.Set(HeaderExpires, NewPlainHeader(expires))
+		_ = tp.Respond(res)
+	}
+}
+
+func TestRegistrationManager(t *testing.T) {
+	server := NewUDPTransport()
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	unregistered := make(chan string, 3)
+	go serveRegistrar(server, unregistered)
+	tp := NewUDPTransport()
+	if err := tp.Dial(server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+
+	manager := NewRegistrationManager(NewClient(tp, nil))
+	manager.RetryDelay = time.Millisecond * 100
+	accounts := make([]*Account, 0)
+	for _, user := range []string{"2001", "2002", "2003"} {
+		account := &Account{Username: user, Domain: "example.com", Expires: time.Second * 10}
+		accounts = append(accounts, account)
+		if err := manager.Add(account); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := manager.Add(accounts[0]); err != ErrorAccountExists {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	registered := make(map[string]int)
+	failed := make(map[string]int)
+	timeout := time.After(time.Second * 5)
+	for registered["2001"] < 2 || registered["2002"] < 1 || registered["2003"] < 1 {
+		select {
+		case e := <-manager.Events():
+			switch e.State {
+			case RegistrationStateRegistered:
+				registered[e.Account.Username]++
+				if e.Account.Username == "2002" && e.Expires != time.Second*30 {
+					t.Errorf("unexpected expires %s", e.Expires)
+				}
+			case RegistrationStateFailed:
+				failed[e.Account.Username]++
+			}
+		case <-timeout:
+			t.Fatalf("registration not refreshed %v", registered)
+		}
+	}
+	if failed["2003"] != 1 || failed["2002"] != 0 {
+		t.Errorf("unexpected failures %v", failed)
+	}
+	if manager.State(accounts[1]) != RegistrationStateRegistered {
+		t.Errorf("unexpected state %d", manager.State(accounts[1]))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if err := manager.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(accounts); i++ {
+		select {
+		case <-unregistered:
+		case <-time.After(time.Second):
+			t.Fatal("account not unregistered")
+		}
+	}
+	if manager.State(accounts[0]) != RegistrationStateUnregistered {
+		t.Errorf("unexpected state %d", manager.State(accounts[0]))
+	}
+}
+
+func TestRegistrationManager_retryDelay(t *testing.T) {
+	if delay := (&RegistrationManager{}).retryDelay(); delay != DefaultRegistrationRetryDelay {
+		t.Errorf("unexpected retry delay %s", delay)
+	}
+	//注册服务器一直拒绝
+	server := NewUDPTransport()
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for req := range server.Request() {
+			_ = server.Respond(NewResponse(StatusServiceUnavailable, req))
+		}
+	}()
+	tp := NewUDPTransport()
+	if err := tp.Dial(server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+
+	var (
+		mutex    sync.Mutex
+		failures []time.Time
+	)
+	manager := &RegistrationManager{RetryDelay: time.Millisecond * 50, client: NewClient(tp, nil)}
+	manager.OnStateChange = func(e *RegistrationEvent) {
+		if e.State == RegistrationStateFailed {
+			mutex.Lock()
+			failures = append(failures, time.Now())
+			mutex.Unlock()
+		}
+	}
+	if err := manager.Add(&Account{Username: "2004", Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 500)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = manager.Close(ctx)
+
+	//重试间隔为50ms, 100ms, 200ms..., 不会立即重试
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(failures) < 2 || len(failures) > 5 {
+		t.Fatalf("unexpected failures %d", len(failures))
+	}
+	for i := 2; i < len(failures); i++ {
+		if failures[i].Sub(failures[i-1]) < failures[i-1].Sub(failures[i-2]) {
+			t.Errorf("retry delay not increasing %s", failures[i].Sub(failures[i-1]))
+		}
+	}
+}
@@ -3,22 +3,33 @@ package sip
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"io"
+	"net"
 	"strconv"
 	"strings"
 	"unsafe"
 )
 
+var (
+	//MaxContentLength 允许的最大消息体长度, 超过时读取消息返回错误
+	MaxContentLength = MaxDatagramSize
+
+	ErrorContentLength = errors.New("invalid content length")
+)
+
 type Request struct {
-	Method   Method
-	Username string
-	Address  string
-	Proto    string
-	Header   *Header
-	Body     []byte
-	Params   Map
-	Context  context.Context
+	Method     Method
+	Username   string
+	Address    string
+	Proto      string
+	Header     *Header
+	Body       []byte
+	Params     Map
+	Context    context.Context
+	RemoteAddr net.Addr //对端地址, 收到的请求为来源地址, 发送时不为空则发送到该地址
 }
 
 func (r *Request) WithContext(ctx context.Context) *Request {
@@ -28,12 +39,13 @@ func (r *Request) WithContext(ctx context.Context) *Request {
 
 func (r *Request) Clone() *Request {
 	req := &Request{
-		Method:   r.Method,
-		Username: r.Username,
-		Address:  r.Address,
-		Proto:    r.Proto,
-		Header:   r.Header.Clone(),
-		Context:  r.Context,
+		Method:     r.Method,
+		Username:   r.Username,
+		Address:    r.Address,
+		Proto:      r.Proto,
+		Header:     r.Header.Clone(),
+		Context:    r.Context,
+		RemoteAddr: r.RemoteAddr,
 	}
 	if r.Params != nil {
 		req.Params = r.Params.Clone()
@@ -56,6 +68,28 @@ func (r *Request) CallID() string {
 	return callId
 }
 
+//Uri 请求的Request-URI
+func (r *Request) Uri() *Uri {
+	uri := NewUri(r.Username, r.Address, Map{}).EnableProtocol()
+	if r.Params != nil {
+		uri.Params = r.Params.Clone()
+	}
+	return uri
+}
+
+//SetUri 设置请求的Request-URI
+func (r *Request) SetUri(uri *Uri) {
+	r.Username = uri.User
+	r.Address = uri.Host
+	if uri.Port != 0 {
+		r.Address = net.JoinHostPort(uri.Host, strconv.Itoa(uri.Port))
+	}
+	r.Params = nil
+	if len(uri.Params) > 0 {
+		r.Params = uri.Params.Clone()
+	}
+}
+
 func (r *Request) Bytes() []byte {
 	str := r.String()
 	return *(*[]byte)(unsafe.Pointer(
@@ -116,6 +150,7 @@ func ReadRequest(b *bufio.Reader) (req *Request, err error) {
 		return
 	}
 	if method, str, req.Proto, ok = parseRequestLine(string(buf)); !ok {
+		err = fmt.Errorf("malformed request line %s", string(buf))
 		return
 	}
 	if pos = strings.Index(str, ":"); pos > -1 {
@@ -137,12 +172,24 @@ func ReadRequest(b *bufio.Reader) (req *Request, err error) {
 	if req.Header, err = readHeader(b); err != nil {
 		return
 	}
-	if req.Header.Has(HeaderContentLength) {
-		contentLength, _ = strconv.Atoi(req.Header.Get(HeaderContentLength).String())
-		if contentLength > 0 {
-			req.Body = make([]byte, contentLength)
-			contentLength, err = io.ReadFull(b, req.Body)
-		}
+	if contentLength, err = readContentLength(req.Header); err != nil {
+		return
+	}
+	if contentLength > 0 {
+		req.Body = make([]byte, contentLength)
+		contentLength, err = io.ReadFull(b, req.Body)
+	}
+	return
+}
+
+//readContentLength 读取消息体的长度, 负数或者超过MaxContentLength时返回错误
+func readContentLength(h *Header) (n int, err error) {
+	if !h.Has(HeaderContentLength) {
+		return
+	}
+	n, _ = strconv.Atoi(strings.TrimSpace(h.Get(HeaderContentLength).String()))
+	if n < 0 || n > MaxContentLength {
+		err = fmt.Errorf("%w %d", ErrorContentLength, n)
 	}
 	return
 }
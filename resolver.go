@@ -0,0 +1,502 @@
+package sip
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeNAPTR = 35
+	dnsClassINET = 1
+	dnsTimeout   = time.Second * 5
+)
+
+var (
+	ErrorNoTarget   = errors.New("no target found")
+	ErrorDNSMessage = errors.New("invalid dns message")
+
+	//naptrServices NAPTR记录的服务对应的传输协议(RFC 3263, RFC 7118)
+	naptrServices = map[string]string{
+		"SIP+D2U":  ProtoUDP,
+		"SIP+D2T":  ProtoTCP,
+		"SIPS+D2T": ProtoTLS,
+		"SIP+D2W":  ProtoWS,
+		"SIPS+D2W": ProtoWSS,
+	}
+)
+
+type (
+	//NAPTR 一条NAPTR记录
+	NAPTR struct {
+		Order       uint16
+		Preference  uint16
+		Flags       string
+		Service     string
+		Regexp      string
+		Replacement string
+	}
+
+	//Resolver 服务器定位使用的dns查询
+	Resolver interface {
+		LookupNAPTR(ctx context.Context, name string) ([]*NAPTR, error)
+		LookupSRV(ctx context.Context, name string) ([]*net.SRV, error)
+		LookupHost(ctx context.Context, host string) ([]string, error)
+	}
+
+	//DNSResolver 使用系统的dns服务器, NAPTR直接查询Server
+	DNSResolver struct {
+		Server   string //NAPTR查询的dns服务器, 为空时使用/etc/resolv.conf中的第一个
+		resolver *net.Resolver
+	}
+
+	//Target 定位到的一个服务器地址
+	Target struct {
+		Protocol string
+		Host     string
+		Addr     string
+	}
+
+	//Locator 按照RFC 3263定位sip服务器, NAPTR选择传输协议, SRV选择端口以及优先级
+	Locator struct {
+		Resolver Resolver
+	}
+)
+
+func (t *Target) String() string {
+	return strings.ToLower(t.Protocol) + ":" + t.Addr
+}
+
+func (r *DNSResolver) LookupSRV(ctx context.Context, name string) (records []*net.SRV, err error) {
+	if _, records, err = r.resolver.LookupSRV(ctx, "", "", name); err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			err = nil
+		}
+	}
+	return
+}
+
+func (r *DNSResolver) LookupHost(ctx context.Context, host string) (addrs []string, err error) {
+	return r.resolver.LookupHost(ctx, host)
+}
+
+//LookupNAPTR 标准库不支持NAPTR, 直接通过udp查询dns服务器
+func (r *DNSResolver) LookupNAPTR(ctx context.Context, name string) (records []*NAPTR, err error) {
+	var (
+		n    int
+		conn net.Conn
+		msg  []byte
+	)
+	server := r.Server
+	if server == "" {
+		if server, err = systemNameserver(); err != nil {
+			return
+		}
+	}
+	dialer := &net.Dialer{Timeout: dnsTimeout}
+	if conn, err = dialer.DialContext(ctx, "udp", server); err != nil {
+		return
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dnsTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+	id := uint16(rand.Intn(1 << 16))
+	if msg, err = newDNSQuery(id, name, dnsTypeNAPTR); err != nil {
+		return
+	}
+	if _, err = conn.Write(msg); err != nil {
+		return
+	}
+	buf := make([]byte, MaxDatagramSize)
+	if n, err = conn.Read(buf); err != nil {
+		return
+	}
+	return parseNAPTRResponse(id, buf[:n])
+}
+
+//systemNameserver /etc/resolv.conf中的第一个dns服务器
+func systemNameserver() (server string, err error) {
+	var fp *os.File
+	if fp, err = os.Open("/etc/resolv.conf"); err != nil {
+		return
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	err = ErrorNoTarget
+	return
+}
+
+//newDNSQuery 创建一个递归查询的dns请求
+func newDNSQuery(id uint16, name string, qtype uint16) (msg []byte, err error) {
+	msg = make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			err = ErrorDNSMessage
+			return
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, dnsClassINET)
+	return
+}
+
+//readDNSName 读取dns消息中的域名, 支持压缩指针
+func readDNSName(msg []byte, offset int) (name string, next int, err error) {
+	var (
+		labels = make([]string, 0)
+		jumped bool
+	)
+	next = offset
+	for hops := 0; hops < 32; hops++ {
+		if offset >= len(msg) {
+			err = ErrorDNSMessage
+			return
+		}
+		size := int(msg[offset])
+		switch {
+		case size == 0:
+			if !jumped {
+				next = offset + 1
+			}
+			name = strings.Join(labels, ".")
+			return
+		case size&0xC0 == 0xC0:
+			if offset+1 >= len(msg) {
+				err = ErrorDNSMessage
+				return
+			}
+			if !jumped {
+				next = offset + 2
+			}
+			jumped = true
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+		default:
+			if offset+1+size > len(msg) {
+				err = ErrorDNSMessage
+				return
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+size]))
+			offset += 1 + size
+		}
+	}
+	err = ErrorDNSMessage
+	return
+}
+
+//readCharacterString 读取dns消息中的字符串
+func readCharacterString(msg []byte, offset int) (s string, next int, err error) {
+	if offset >= len(msg) || offset+1+int(msg[offset]) > len(msg) {
+		err = ErrorDNSMessage
+		return
+	}
+	next = offset + 1 + int(msg[offset])
+	s = string(msg[offset+1 : next])
+	return
+}
+
+//parseNAPTRResponse 解析NAPTR查询的响应, 域名不存在时返回空
+func parseNAPTRResponse(id uint16, msg []byte) (records []*NAPTR, err error) {
+	var offset int
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id {
+		err = ErrorDNSMessage
+		return
+	}
+	//NXDOMAIN
+	if rcode := msg[3] & 0x0F; rcode == 3 {
+		return
+	} else if rcode != 0 {
+		err = ErrorDNSMessage
+		return
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	offset = 12
+	for i := 0; i < questions; i++ {
+		if _, offset, err = readDNSName(msg, offset); err != nil {
+			return
+		}
+		offset += 4
+	}
+	records = make([]*NAPTR, 0, answers)
+	for i := 0; i < answers; i++ {
+		if _, offset, err = readDNSName(msg, offset); err != nil {
+			return
+		}
+		if offset+10 > len(msg) {
+			err = ErrorDNSMessage
+			return
+		}
+		rtype := binary.BigEndian.Uint16(msg[offset:])
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		end := offset + length
+		if end > len(msg) {
+			err = ErrorDNSMessage
+			return
+		}
+		if rtype == dnsTypeNAPTR && length > 4 {
+			record := &NAPTR{
+				Order:      binary.BigEndian.Uint16(msg[offset:]),
+				Preference: binary.BigEndian.Uint16(msg[offset+2:]),
+			}
+			pos := offset + 4
+			if record.Flags, pos, err = readCharacterString(msg, pos); err != nil {
+				return
+			}
+			if record.Service, pos, err = readCharacterString(msg, pos); err != nil {
+				return
+			}
+			if record.Regexp, pos, err = readCharacterString(msg, pos); err != nil {
+				return
+			}
+			if record.Replacement, _, err = readDNSName(msg, pos); err != nil {
+				return
+			}
+			records = append(records, record)
+		}
+		offset = end
+	}
+	return
+}
+
+//srvPrefix 传输协议对应的SRV前缀
+func srvPrefix(protocol string) string {
+	switch protocol {
+	case ProtoTLS:
+		return "_sips._tcp."
+	case ProtoTCP:
+		return "_sip._tcp."
+	case ProtoWS:
+		return "_sip._ws."
+	case ProtoWSS:
+		return "_sips._ws."
+	}
+	return "_sip._udp."
+}
+
+//orderSRV 按照RFC 2782排序SRV记录, 优先级相同的记录按照权重随机排列
+func orderSRV(records []*net.SRV) []*net.SRV {
+	sorted := make([]*net.SRV, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+	ordered := make([]*net.SRV, 0, len(sorted))
+	for i := 0; i < len(sorted); {
+		j := i
+		for j < len(sorted) && sorted[j].Priority == sorted[i].Priority {
+			j++
+		}
+		group := sorted[i:j]
+		for len(group) > 0 {
+			total := 0
+			for _, record := range group {
+				total += int(record.Weight)
+			}
+			pick := 0
+			if total > 0 {
+				n := rand.Intn(total + 1)
+				for sum := 0; pick < len(group); pick++ {
+					if sum += int(group[pick].Weight); sum >= n {
+						break
+					}
+				}
+				if pick == len(group) {
+					pick = len(group) - 1
+				}
+			}
+			ordered = append(ordered, group[pick])
+			group = append(group[:pick:pick], group[pick+1:]...)
+		}
+		i = j
+	}
+	return ordered
+}
+
+//resolveHost 解析主机地址, ip直接返回
+func (l *Locator) resolveHost(ctx context.Context, host string, port int, protocol string) (targets []*Target, err error) {
+	var addrs []string
+	if net.ParseIP(host) != nil {
+		addrs = []string{host}
+	} else if addrs, err = l.Resolver.LookupHost(ctx, host); err != nil {
+		return
+	}
+	for _, addr := range addrs {
+		targets = append(targets, &Target{Protocol: protocol, Host: host, Addr: net.JoinHostPort(addr, strconv.Itoa(port))})
+	}
+	return
+}
+
+//resolveSRV 解析SRV记录对应的地址, 没有SRV记录时返回空
+func (l *Locator) resolveSRV(ctx context.Context, name string, protocol string) (targets []*Target, err error) {
+	var (
+		records []*net.SRV
+		addrs   []*Target
+	)
+	if records, err = l.Resolver.LookupSRV(ctx, name); err != nil {
+		return
+	}
+	for _, record := range orderSRV(records) {
+		if addrs, err = l.resolveHost(ctx, strings.TrimSuffix(record.Target, "."), int(record.Port), protocol); err != nil {
+			continue
+		}
+		targets = append(targets, addrs...)
+	}
+	if len(targets) > 0 {
+		err = nil
+	}
+	return
+}
+
+//Locate 定位uri对应的服务器地址, 返回的地址按照优先级排序
+//uri指定了transport或者端口时不查询NAPTR, 指定了端口时不查询SRV
+func (l *Locator) Locate(ctx context.Context, uri *Uri) (targets []*Target, err error) {
+	var (
+		records  []*NAPTR
+		protocol string
+	)
+	host := uri.Host
+	if uri.Params != nil && uri.Params.Get("transport") != "" {
+		protocol = TransportOf(uri)
+	}
+	numeric := net.ParseIP(host) != nil
+	if protocol == "" && (numeric || uri.Port > 0) {
+		protocol = TransportOf(uri)
+	}
+	if protocol != "" {
+		if uri.Port > 0 || numeric {
+			port := uri.Port
+			if port == 0 {
+				port = defaultPort(protocol)
+			}
+			targets, err = l.resolveHost(ctx, host, port, protocol)
+		} else if targets, err = l.resolveSRV(ctx, srvPrefix(protocol)+host, protocol); err == nil && len(targets) == 0 {
+			targets, err = l.resolveHost(ctx, host, defaultPort(protocol), protocol)
+		}
+		if err == nil && len(targets) == 0 {
+			err = ErrorNoTarget
+		}
+		return
+	}
+	//NAPTR选择传输协议, sips只使用TLS
+	if records, err = l.Resolver.LookupNAPTR(ctx, host); err != nil {
+		records = nil
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Order != records[j].Order {
+			return records[i].Order < records[j].Order
+		}
+		return records[i].Preference < records[j].Preference
+	})
+	for _, record := range records {
+		p, ok := naptrServices[strings.ToUpper(record.Service)]
+		if !ok || !strings.EqualFold(record.Flags, "s") || (uri.IsEncrypted && p != ProtoTLS && p != ProtoWSS) {
+			continue
+		}
+		if srv, e := l.resolveSRV(ctx, strings.TrimSuffix(record.Replacement, "."), p); e == nil {
+			targets = append(targets, srv...)
+		}
+	}
+	if len(targets) > 0 {
+		err = nil
+		return
+	}
+	//没有NAPTR记录时依次查询SRV
+	protocols := []string{ProtoTCP, ProtoUDP}
+	if uri.IsEncrypted {
+		protocols = []string{ProtoTLS}
+	}
+	for _, p := range protocols {
+		if srv, e := l.resolveSRV(ctx, srvPrefix(p)+host, p); e == nil && len(srv) > 0 {
+			targets = srv
+			err = nil
+			return
+		}
+	}
+	protocol = TransportOf(uri)
+	if targets, err = l.resolveHost(ctx, host, defaultPort(protocol), protocol); err == nil && len(targets) == 0 {
+		err = ErrorNoTarget
+	}
+	return
+}
+
+//Dial 定位uri对应的服务器并建立连接, 连接失败时尝试下一个地址
+func (l *Locator) Dial(ctx context.Context, uri *Uri, config *tls.Config) (tp Transport, target *Target, err error) {
+	var targets []*Target
+	if targets, err = l.Locate(ctx, uri); err != nil {
+		return
+	}
+	for _, target = range targets {
+		if tp, err = NewTransport(target.Protocol, config); err != nil {
+			continue
+		}
+		if err = tp.Dial(target.Addr); err == nil {
+			return
+		}
+	}
+	tp, target = nil, nil
+	return
+}
+
+//targetAddr 目标的网络地址
+func targetAddr(target *Target) (addr net.Addr, err error) {
+	if target.Protocol == ProtoUDP {
+		return net.ResolveUDPAddr("udp", target.Addr)
+	}
+	return net.ResolveTCPAddr("tcp", target.Addr)
+}
+
+//Failover 依次尝试定位到的地址, fn返回事物超时, 连接错误或者503时尝试下一个地址
+func Failover(ctx context.Context, targets []*Target, fn func(target *Target) (res *Response, err error)) (res *Response, err error) {
+	var opErr *net.OpError
+	err = ErrorNoTarget
+	for _, target := range targets {
+		res, err = fn(target)
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case err == ErrorTransactionTimeout, errors.As(err, &opErr):
+			continue
+		case err == nil && res != nil && res.StatusCode == StatusServiceUnavailable:
+			continue
+		}
+		return
+	}
+	return
+}
+
+//NewDNSResolver 使用系统dns的解析器
+func NewDNSResolver() *DNSResolver {
+	return &DNSResolver{resolver: net.DefaultResolver}
+}
+
+//NewLocator 创建服务器定位器, resolver为空时使用系统的dns
+func NewLocator(resolver Resolver) *Locator {
+	if resolver == nil {
+		resolver = NewDNSResolver()
+	}
+	return &Locator{Resolver: resolver}
+}
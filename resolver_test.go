@@ -0,0 +1,183 @@
+package sip
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//memoryZone 测试用的内存dns记录
+type memoryZone struct {
+	naptr map[string][]*NAPTR
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (z *memoryZone) LookupNAPTR(ctx context.Context, name string) ([]*NAPTR, error) {
+	return z.naptr[name], nil
+}
+
+func (z *memoryZone) LookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	return z.srv[name], nil
+}
+
+func (z *memoryZone) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := z.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func newTestZone() *memoryZone {
+	return &memoryZone{
+		naptr: map[string][]*NAPTR{
+			"example.com": {
+				{Order: 20, Preference: 10, Flags: "s", Service: "SIP+D2U", Replacement: "_sip._udp.example.com."},
+				{Order: 10, Preference: 10, Flags: "s", Service: "SIP+D2T", Replacement: "_sip._tcp.example.com."},
+				{Order: 10, Preference: 5, Flags: "s", Service: "SIPS+D2T", Replacement: "_sips._tcp.example.com."},
+			},
+		},
+		srv: map[string][]*net.SRV{
+			"_sip._udp.example.com":  {{Target: "b.example.com.", Port: 5080, Priority: 20}, {Target: "a.example.com.", Port: 5060, Priority: 10}},
+			"_sip._tcp.example.com":  {{Target: "a.example.com.", Port: 5060, Priority: 10}},
+			"_sips._tcp.example.com": {{Target: "a.example.com.", Port: 5061, Priority: 10}},
+			"_sip._udp.srv.com":      {{Target: "a.example.com.", Port: 5070, Priority: 10}},
+		},
+		hosts: map[string][]string{
+			"example.com":   {"10.0.0.1"},
+			"a.example.com": {"10.0.0.1"},
+			"b.example.com": {"10.0.0.2"},
+			"plain.com":     {"10.0.0.3"},
+			"srv.com":       {"10.0.0.4"},
+		},
+	}
+}
+
+func TestLocator_Locate(t *testing.T) {
+	locator := NewLocator(newTestZone())
+	ctx := context.Background()
+	cases := map[string]string{
+		"sip:example.com":               "tls:10.0.0.1:5061 tcp:10.0.0.1:5060 udp:10.0.0.1:5060 udp:10.0.0.2:5080",
+		"sips:example.com":              "tls:10.0.0.1:5061",
+		"sip:example.com;transport=udp": "udp:10.0.0.1:5060 udp:10.0.0.2:5080",
+		"sip:example.com:5090":          "udp:10.0.0.1:5090", //指定了端口只解析A记录
+		"sip:srv.com":                   "udp:10.0.0.1:5070",
+		"sip:plain.com":                 "udp:10.0.0.3:5060",
+		"sip:plain.com;transport=tcp":   "tcp:10.0.0.3:5060",
+		"sip:192.168.1.1":               "udp:192.168.1.1:5060",
+	}
+	for s, expected := range cases {
+		uri, err := parseUri(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets, err := locator.Locate(ctx, uri)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		names := make([]string, 0, len(targets))
+		for _, target := range targets {
+			names = append(names, target.String())
+		}
+		if result := strings.Join(names, " "); result != expected {
+			t.Errorf("%s: unexpected targets %s", s, result)
+		}
+	}
+	if _, err := locator.Locate(ctx, NewUri("", "missing.com", Map{})); err == nil {
+		t.Error("missing host located")
+	}
+}
+
+func Test_orderSRV(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "c", Priority: 20, Weight: 100},
+		{Target: "a", Priority: 10, Weight: 90},
+		{Target: "b", Priority: 10, Weight: 10},
+	}
+	first := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		ordered := orderSRV(records)
+		if len(ordered) != 3 || ordered[2].Target != "c" {
+			t.Fatalf("unexpected order %v", ordered)
+		}
+		first[ordered[0].Target]++
+	}
+	if first["a"] < 800 || first["b"] == 0 {
+		t.Errorf("unexpected weight distribution %v", first)
+	}
+}
+
+func Test_parseNAPTRResponse(t *testing.T) {
+	msg, err := newDNSQuery(7, "example.com", dnsTypeNAPTR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg[2] |= 0x80
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	rdata := []byte{0, 10, 0, 20, 1, 's', 7}
+	rdata = append(rdata, "SIP+D2T"...)
+	rdata = append(rdata, 0, 4)
+	rdata = append(rdata, "_sip"...)
+	rdata = append(rdata, 4)
+	rdata = append(rdata, "_tcp"...)
+	//压缩指针指向问题中的example.com
+	rdata = append(rdata, 0xC0, 12)
+	msg = append(msg, 0xC0, 12, 0, dnsTypeNAPTR, 0, dnsClassINET, 0, 0, 0, 60, 0, byte(len(rdata)))
+	msg = append(msg, rdata...)
+	records, err := parseNAPTRResponse(7, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Order != 10 || records[0].Preference != 20 || records[0].Service != "SIP+D2T" || records[0].Replacement != "_sip._tcp.example.com" {
+		t.Errorf("unexpected records %+v", records)
+	}
+	if _, err = parseNAPTRResponse(8, msg); err != ErrorDNSMessage {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestClient_Failover(t *testing.T) {
+	servers := make([]Transport, 2)
+	for i := range servers {
+		servers[i] = NewUDPTransport()
+		if err := servers[i].Listen("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		defer servers[i].Close()
+	}
+	code := StatusServiceUnavailable
+	for _, server := range servers {
+		go func(tp Transport, code int) {
+			for req := range tp.Request() {
+				_ = tp.Respond(NewResponse(code, req))
+			}
+		}(server, code)
+		code = StatusOK
+	}
+	zone := &memoryZone{srv: map[string][]*net.SRV{"_sip._udp.example.com": {}}, hosts: map[string][]string{}}
+	for i, server := range servers {
+		addr := server.LocalAddr().(*net.UDPAddr)
+		zone.srv["_sip._udp.example.com"] = append(zone.srv["_sip._udp.example.com"], &net.SRV{Target: "127.0.0.1", Port: uint16(addr.Port), Priority: uint16(i)})
+	}
+
+	tp := NewUDPTransport()
+	if err := tp.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	client := NewClient(tp, &Account{Username: "1001", Domain: "example.com"})
+	client.SetLocator(NewLocator(zone))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	res, err := client.Options(ctx, "sip:example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RemoteAddr.String() != servers[1].LocalAddr().String() {
+		t.Errorf("unexpected response source %s", res.RemoteAddr)
+	}
+}
@@ -2,7 +2,9 @@ package sip
 
 import (
 	"bufio"
+	"fmt"
 	"io"
+	"net"
 	"strconv"
 	"strings"
 	"unsafe"
@@ -16,6 +18,7 @@ type Response struct {
 	Body          []byte
 	ContentLength int
 	Request       *Request
+	RemoteAddr    net.Addr //收到的响应的来源地址, 发送时不为空则发送到该地址
 }
 
 func parseResponseLine(line string) (proto string, statusCode int, status string, ok bool) {
@@ -44,12 +47,15 @@ func ReadResponse(b *bufio.Reader) (res *Response, err error) {
 		return
 	}
 	if res.Proto, res.StatusCode, res.Status, ok = parseResponseLine(string(buf)); !ok {
+		err = fmt.Errorf("malformed response line %s", string(buf))
 		return
 	}
 	if res.Header, err = readHeader(b); err != nil {
 		return
 	}
-	res.ContentLength, _ = strconv.Atoi(res.Header.Get(HeaderContentLength).String())
+	if res.ContentLength, err = readContentLength(res.Header); err != nil {
+		return
+	}
 	if res.ContentLength > 0 {
 		res.Body = make([]byte, res.ContentLength)
 		res.ContentLength, err = io.ReadFull(b, res.Body)
@@ -65,6 +71,7 @@ func (r *Response) Clone() *Response {
 		Body:          nil,
 		ContentLength: r.ContentLength,
 		Request:       r.Request,
+		RemoteAddr:    r.RemoteAddr,
 	}
 	if r.Body != nil {
 		res.Body = make([]byte, len(r.Body))
@@ -124,6 +131,10 @@ func NewResponse(code int, req *Request) *Response {
 	if req == nil {
 		return res
 	}
+	res.RemoteAddr = req.RemoteAddr
+	if req.Header.Has(HeaderVia) {
+		res.Header.Set(HeaderVia, req.Header.Get(HeaderVia).Clone())
+	}
 	if req.Header.Has(HeaderCSeq) {
 		res.Header.Set(HeaderCSeq, req.Header.Get(HeaderCSeq).Clone())
 	}
@@ -3,6 +3,7 @@ package sip
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -23,3 +24,12 @@ Content-Length: 0
 		fmt.Println(r)
 	}
 }
+
+func TestReadResponse_contentLength(t *testing.T) {
+	for _, length := range []string{"-1", "65536", "4294967296"} {
+		s := "SIP/2.0 200 OK\r\nCall-ID: length\r\nContent-Length: " + length + "\r\n\r\n"
+		if _, err := ReadResponse(bufio.NewReader(bytes.NewBufferString(s))); !errors.Is(err, ErrorContentLength) {
+			t.Errorf("content length %s: unexpected error %v", length, err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package sip
+
+import (
+	"context"
+	"crypto/tls"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	//Handler 处理服务端收到的请求
+	Handler interface {
+		ServeSIP(ctx *Context)
+	}
+
+	//HandlerFunc 函数形式的Handler
+	HandlerFunc func(ctx *Context)
+
+	//Middleware 包装Handler的中间件
+	Middleware func(next Handler) Handler
+
+	//ServeMux 按照请求方法分发请求, 没有注册的方法回复405
+	ServeMux struct {
+		mutex       sync.RWMutex
+		handlers    map[Method]Handler
+		middlewares []Middleware
+	}
+
+	//Session 服务端在一个传输层上的会话, Id作为响应中Contact的用户名
+	Session struct {
+		Id        string
+		transport Transport
+	}
+
+	//Server sip服务端, 通过服务端事物接收请求并交给Handler处理
+	Server struct {
+		Name       string
+		Handler    Handler
+		Workers    int                //并发处理的请求数量, 默认DefaultWorkers
+		OnOverload func(req *Request) //过载时的回调, 为空时回复503
+		mutex      sync.Mutex
+		wg         sync.WaitGroup
+		cancels    map[int]context.CancelFunc //正在运行的Serve, Serve返回时删除
+		serves     int
+	}
+)
+
+func (f HandlerFunc) ServeSIP(ctx *Context) {
+	f(ctx)
+}
+
+//Chain 按照顺序使用中间件包装Handler, 第一个中间件在最外层
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+//Handle 注册请求方法的处理器
+func (mux *ServeMux) Handle(method Method, h Handler) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	//零值的ServeMux也可以使用
+	if mux.handlers == nil {
+		mux.handlers = make(map[Method]Handler)
+	}
+	mux.handlers[method] = h
+}
+
+//HandleFunc 注册请求方法的处理函数
+func (mux *ServeMux) HandleFunc(method Method, f func(ctx *Context)) {
+	mux.Handle(method, HandlerFunc(f))
+}
+
+//Use 添加中间件, 中间件作用于所有的请求
+func (mux *ServeMux) Use(middlewares ...Middleware) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	mux.middlewares = append(mux.middlewares, middlewares...)
+}
+
+//allow 已经注册的请求方法
+func (mux *ServeMux) allow() string {
+	methods := make([]string, 0, len(mux.handlers))
+	for method := range mux.handlers {
+		methods = append(methods, string(method))
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+func (mux *ServeMux) ServeSIP(ctx *Context) {
+	mux.mutex.RLock()
+	h, ok := mux.handlers[ctx.Request().Method]
+	middlewares := mux.middlewares
+	allow := mux.allow()
+	mux.mutex.RUnlock()
+	if !ok {
+		h = HandlerFunc(func(ctx *Context) {
+			//ACK不需要回复
+			if ctx.Request().Method == MethodAck {
+				return
+			}
+			res := NewResponse(StatusMethodNotAllowed, ctx.Request())
+			res.Header.Set(HeaderAllow, NewPlainHeader(allow))
+			_ = ctx.Write(res)
+		})
+	}
+	Chain(h, middlewares...).ServeSIP(ctx)
+}
+
+//handle 处理一个请求
+func (s *Server) handle(ctx context.Context, sess *Session, req *Request) {
+	h := s.Handler
+	if h == nil {
+		h = NewServeMux()
+	}
+	h.ServeSIP(&Context{context: ctx, req: req, sess: sess})
+}
+
+//track 登记一个处理中的请求, ctx已经结束时返回false. 和Shutdown共用锁, 保证wg.Add发生在wg.Wait之前
+func (s *Server) track(ctx context.Context) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+//Serve 处理传输层收到的请求, 最多同时处理Workers个请求, 超过时回复503. ctx结束或者服务端关闭后返回
+func (s *Server) Serve(ctx context.Context, tp Transport) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.mutex.Lock()
+	if s.cancels == nil {
+		s.cancels = make(map[int]context.CancelFunc)
+	}
+	s.serves++
+	id := s.serves
+	s.cancels[id] = cancel
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.cancels, id)
+		s.mutex.Unlock()
+		cancel()
+	}()
+	sess := &Session{Id: s.Name, transport: tp}
+	//传输层在自己的协程里调用handler, 通过track和Shutdown同步
+	handler := func(req *Request) {
+		if !s.track(ctx) {
+			return
+		}
+		defer s.wg.Done()
+		s.handle(ctx, sess, req)
+	}
+	if s.OnOverload != nil {
+		tp.OnOverload(s.OnOverload)
+	}
+	tp.Handle(handler, s.Workers)
+	defer tp.Handle(nil, 0)
+	for {
+		select {
+		case req := <-tp.Request():
+			//设置处理函数之前已经投递的请求, 在启动协程之前登记
+			if !s.track(ctx) {
+				return ctx.Err()
+			}
+			go func() {
+				defer s.wg.Done()
+				s.handle(ctx, sess, req)
+			}()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//ListenAndServe 监听指定的地址并处理请求, network支持udp, tcp以及tls
+func (s *Server) ListenAndServe(ctx context.Context, network string, addr string, config *tls.Config) (err error) {
+	var (
+		tp Transport
+	)
+	switch strings.ToLower(network) {
+	case "udp":
+		tp = NewUDPTransport()
+	case "tcp":
+		tp = NewTCPTransport()
+	case "tls":
+		tp = NewTLSTransport(config)
+	default:
+		return ErrorNotSupported
+	}
+	if err = tp.Listen(addr); err != nil {
+		return
+	}
+	defer tp.Close()
+	return s.Serve(ctx, tp)
+}
+
+//Shutdown 停止所有的Serve并等待处理中的请求完成
+func (s *Server) Shutdown() {
+	//持有锁取消, 之后不会再有新的请求登记
+	s.mutex.Lock()
+	for _, cancel := range s.cancels {
+		cancel()
+	}
+	s.cancels = nil
+	s.mutex.Unlock()
+	s.wg.Wait()
+}
+
+//NewServeMux 创建请求分发器
+func NewServeMux() *ServeMux {
+	return &ServeMux{handlers: make(map[Method]Handler)}
+}
+
+//NewServer 创建服务端
+func NewServer(name string, handler Handler) *Server {
+	return &Server{Name: name, Handler: handler}
+}
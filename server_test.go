@@ -0,0 +1,250 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	order := ""
+	middleware := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx *Context) {
+				order += name
+				next.ServeSIP(ctx)
+			})
+		}
+	}
+	h := Chain(HandlerFunc(func(ctx *Context) {
+		order += "h"
+	}), middleware("a"), middleware("b"))
+	h.ServeSIP(&Context{})
+	if order != "abh" {
+		t.Errorf("unexpected order %s", order)
+	}
+}
+
+func TestServeMux_zero(t *testing.T) {
+	var (
+		mux    ServeMux
+		called bool
+	)
+	mux.HandleFunc(MethodOptions, func(ctx *Context) {
+		called = true
+	})
+	mux.ServeSIP(&Context{req: NewRequest(MethodOptions, "example.com")})
+	if !called {
+		t.Error("handler not called")
+	}
+}
+
+func TestServer_Serve(t *testing.T) {
+	var requests int32
+	store := NewMemoryCredentialStore()
+	store.Add("1001", "example.com", "secret")
+	authenticator := NewDigestAuthenticator("example.com", store)
+
+	mux := NewServeMux()
+	mux.Use(func(next Handler) Handler {
+		return HandlerFunc(func(ctx *Context) {
+			atomic.AddInt32(&requests, 1)
+			next.ServeSIP(ctx)
+		})
+	})
+	mux.HandleFunc(MethodRegister, func(ctx *Context) {
+		if _, err := ctx.Authenticate(authenticator, StatusUnauthorized); err != nil {
+			return
+		}
+		res := NewResponse(StatusOK, ctx.Request())
+		res.Header.Set(HeaderExpires, NewPlainHeader(60))
+		_ = ctx.Write(res)
+	})
+	mux.HandleFunc(MethodInvite, func(ctx *Context) {
+		if ctx.Request().Username == "redirect" {
+			_ = ctx.Redirect(StatusMovedTemporarily, NewUri("1002", ctx.Transport().LocalAddr().String(), Map{}).EnableProtocol())
+			return
+		}
+		if err := ctx.Provisional(StatusTrying); err != ErrorInvalidStatus {
+			t.Errorf("unexpected error %v", err)
+		}
+		_ = ctx.Provisional(StatusRinging)
+		res := NewResponse(StatusOK, ctx.Request())
+		if _, err := NewDialogFromRequest(ctx.Request(), res); err != nil {
+			t.Error(err)
+		}
+		_ = ctx.Write(res)
+	})
+	mux.HandleFunc(MethodBye, func(ctx *Context) {
+		_ = ctx.Reply(StatusOK)
+	})
+
+	tp := NewUDPTransport()
+	if err := tp.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	server := NewServer("uas", mux)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(context.Background(), tp)
+	}()
+
+	clientTransport := NewUDPTransport()
+	if err := clientTransport.Dial(tp.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer clientTransport.Close()
+	client := NewClient(clientTransport, &Account{Username: "1001", Password: "secret", Domain: "example.com"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	if _, err := client.Register(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	call, err := client.Invite(ctx, "sip:redirect@127.0.0.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call.Request().Username != "1002" {
+		t.Errorf("unexpected target %s", call.Request().Uri().String())
+	}
+	if contact := call.Response().Header.Get(HeaderContact).(*AddressHeader); contact.Uri.User != "uas" {
+		t.Errorf("unexpected contact %s", contact.String())
+	}
+	if e := <-call.Events(); e.Type != CallEventRinging {
+		t.Errorf("unexpected event %d", e.Type)
+	}
+	if err = call.Hangup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var sipErr *SipError
+	if _, err = client.Options(ctx, "127.0.0.1"); !errors.As(err, &sipErr) || sipErr.Code != StatusMethodNotAllowed {
+		t.Errorf("unexpected error %v", err)
+	}
+	//REGISTER两次, INVITE两次, ACK, BYE以及OPTIONS
+	if n := atomic.LoadInt32(&requests); n != 7 {
+		t.Errorf("unexpected requests %d", n)
+	}
+
+	server.Shutdown()
+	select {
+	case err = <-done:
+		if err != context.Canceled {
+			t.Errorf("unexpected error %v", err)
+		}
+		if len(server.cancels) != 0 {
+			t.Errorf("unexpected serves %d", len(server.cancels))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server not stopped")
+	}
+}
+
+func TestServer_contact(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc(MethodOptions, func(ctx *Context) {
+		_ = ctx.Reply(StatusOK)
+	})
+	mux.HandleFunc(MethodInvite, func(ctx *Context) {
+		res := NewResponse(StatusOK, ctx.Request())
+		if _, err := NewDialogFromRequest(ctx.Request(), res); err != nil {
+			t.Error(err)
+		}
+		_ = ctx.Write(res)
+	})
+	mux.HandleFunc(MethodBye, func(ctx *Context) {
+		_ = ctx.Reply(StatusOK)
+	})
+
+	tp := NewUDPTransport()
+	if err := tp.Listen("0.0.0.0:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	server := NewServer("uas", mux)
+	go func() {
+		_ = server.Serve(context.Background(), tp)
+	}()
+	defer server.Shutdown()
+
+	addr := "127.0.0.1:" + strconv.Itoa(tp.LocalAddr().(*net.UDPAddr).Port)
+	clientTransport := NewUDPTransport()
+	if err := clientTransport.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer clientTransport.Close()
+	client := NewClient(clientTransport, &Account{Username: "1001", Domain: "example.com"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	res, err := client.Options(ctx, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.Has(HeaderContact) {
+		t.Errorf("unexpected contact %s", res.Header.Get(HeaderContact).String())
+	}
+	call, err := client.Invite(ctx, "sip:1002@127.0.0.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//监听在通配地址时使用请求到达的本地地址
+	if contact := call.Response().Header.Get(HeaderContact).(*AddressHeader); contact.Uri.Host != "127.0.0.1" || contact.Uri.Port != tp.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("unexpected contact %s", contact.String())
+	}
+	if err = call.Hangup(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var finished int32
+	mux := NewServeMux()
+	mux.HandleFunc(MethodOptions, func(ctx *Context) {
+		close(started)
+		<-release
+		atomic.StoreInt32(&finished, 1)
+	})
+
+	tp := NewUDPTransport()
+	if err := tp.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	server := NewServer("uas", mux)
+	go func() {
+		_ = server.Serve(context.Background(), tp)
+	}()
+
+	clientTransport := NewUDPTransport()
+	if err := clientTransport.Dial(tp.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer clientTransport.Close()
+	client := NewClient(clientTransport, &Account{Username: "1001", Domain: "example.com"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		_, _ = client.Options(ctx, "127.0.0.1")
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("request not handled")
+	}
+	time.AfterFunc(time.Millisecond*100, func() {
+		close(release)
+	})
+	server.Shutdown()
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Error("shutdown returned before the handler finished")
+	}
+}
@@ -0,0 +1,312 @@
+package sip
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	//TryingDelay INVITE请求自动回复100 Trying的延迟
+	TryingDelay = time.Millisecond * 200
+	//TimerC INVITE服务端事物等待最终响应的最长时间
+	TimerC = time.Minute * 3
+)
+
+type (
+	//ServerTransaction RFC 3261 17.2 服务端事物
+	ServerTransaction struct {
+		key             string
+		request         *Request
+		invite          bool
+		reliable        bool
+		clock           Clock
+		send            func(p []byte) error
+		state           int
+		interval        time.Duration
+		last            []byte
+		tryingTimer     Timer //自动回复100 Trying
+		retransmitTimer Timer //Timer G
+		timeoutTimer    Timer //Timer H或者等待最终响应的超时
+		waitTimer       Timer //Timer I, J or L
+		done            chan struct{}
+		err             error
+		mutex           sync.Mutex
+		onTerminated    func(t *ServerTransaction)
+	}
+
+	//serverTransactionStore 传输层上的服务端事物
+	serverTransactionStore struct {
+		mutex        sync.Mutex
+		transactions map[string]*ServerTransaction
+	}
+)
+
+//Key 事物的key
+func (t *ServerTransaction) Key() string {
+	return t.key
+}
+
+//Request 创建事物的请求
+func (t *ServerTransaction) Request() *Request {
+	return t.request
+}
+
+//State 事物的状态
+func (t *ServerTransaction) State() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.state
+}
+
+//Done 事物结束后关闭
+func (t *ServerTransaction) Done() <-chan struct{} {
+	return t.done
+}
+
+//Err 事物结束的原因, 正常结束返回nil
+func (t *ServerTransaction) Err() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.err
+}
+
+//start 开启事物的定时器
+func (t *ServerTransaction) start() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.invite {
+		t.state = TransactionStateProceeding
+		t.tryingTimer = t.clock.AfterFunc(TryingDelay, t.trying)
+		t.timeoutTimer = t.clock.AfterFunc(TimerC, t.timeout)
+	} else {
+		t.state = TransactionStateTrying
+		t.timeoutTimer = t.clock.AfterFunc(T1*64, t.timeout)
+	}
+}
+
+//trying 应用没有及时响应时自动回复100 Trying
+func (t *ServerTransaction) trying() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.state != TransactionStateProceeding || t.last != nil {
+		return
+	}
+	t.last = NewResponse(StatusTrying, t.request).Bytes()
+	_ = t.send(t.last)
+}
+
+//timeout 应用没有回复最终响应, 或者Timer H触发时没有收到ACK
+func (t *ServerTransaction) timeout() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch t.state {
+	case TransactionStateTrying, TransactionStateProceeding, TransactionStateCompleted:
+		t.terminate(ErrorTransactionTimeout)
+	}
+}
+
+//retransmit Timer G触发时重传最终响应
+func (t *ServerTransaction) retransmit() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.state != TransactionStateCompleted {
+		return
+	}
+	_ = t.send(t.last)
+	if t.interval *= 2; t.interval > T2 {
+		t.interval = T2
+	}
+	t.retransmitTimer = t.clock.AfterFunc(t.interval, t.retransmit)
+}
+
+//receive 处理重传的请求以及ACK, Accepted状态下的ACK需要交给应用
+func (t *ServerTransaction) receive(req *Request) (deliver bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if req.Method == MethodAck {
+		switch t.state {
+		case TransactionStateCompleted:
+			t.state = TransactionStateConfirmed
+			t.stopTimer(t.retransmitTimer)
+			t.stopTimer(t.timeoutTimer)
+			t.wait(T4)
+		case TransactionStateAccepted:
+			deliver = true
+		}
+		return
+	}
+	//Accepted状态下重传的INVITE直接吸收, 2xx的重传由应用负责
+	switch t.state {
+	case TransactionStateProceeding, TransactionStateCompleted:
+		if t.last != nil {
+			_ = t.send(t.last)
+		}
+	}
+	return
+}
+
+//Respond 通过事物发送响应
+func (t *ServerTransaction) Respond(res *Response) (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch t.state {
+	case TransactionStateTrying, TransactionStateProceeding:
+	case TransactionStateAccepted:
+		//应用重传的2xx
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			err = ErrorTransactionTerminated
+			return
+		}
+		err = t.send(res.Bytes())
+		return
+	default:
+		err = ErrorTransactionTerminated
+		return
+	}
+	p := res.Bytes()
+	if err = t.send(p); err != nil {
+		return
+	}
+	t.last = p
+	t.stopTimer(t.tryingTimer)
+	if res.StatusCode < 200 {
+		t.state = TransactionStateProceeding
+		return
+	}
+	t.stopTimer(t.timeoutTimer)
+	if !t.invite {
+		t.state = TransactionStateCompleted
+		t.wait(T1 * 64)
+		return
+	}
+	//2xx的重传由应用负责, Timer L期间吸收重传的INVITE(RFC 6026)
+	if res.StatusCode < 300 {
+		t.state = TransactionStateAccepted
+		t.waitTimer = t.clock.AfterFunc(T1*64, t.expire)
+		return
+	}
+	t.state = TransactionStateCompleted
+	if !t.reliable {
+		t.interval = T1
+		t.retransmitTimer = t.clock.AfterFunc(t.interval, t.retransmit)
+	}
+	t.timeoutTimer = t.clock.AfterFunc(T1*64, t.timeout)
+	return
+}
+
+//wait Timer I和Timer J, 可靠传输时立即结束
+func (t *ServerTransaction) wait(d time.Duration) {
+	if t.reliable {
+		t.terminate(nil)
+		return
+	}
+	t.waitTimer = t.clock.AfterFunc(d, t.expire)
+}
+
+//expire 等待重传的定时器到期后结束事物
+func (t *ServerTransaction) expire() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.terminate(nil)
+}
+
+func (t *ServerTransaction) stopTimer(timer Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+//terminate 结束事物, 调用前需要持有锁
+func (t *ServerTransaction) terminate(err error) {
+	if t.state == TransactionStateTerminated {
+		return
+	}
+	t.state = TransactionStateTerminated
+	t.err = err
+	t.stopTimer(t.tryingTimer)
+	t.stopTimer(t.retransmitTimer)
+	t.stopTimer(t.timeoutTimer)
+	t.stopTimer(t.waitTimer)
+	close(t.done)
+	if t.onTerminated != nil {
+		go t.onTerminated(t)
+	}
+}
+
+//receive 查找请求对应的事物, 新的请求会创建事物并返回true, 重传的请求以及非2xx响应的ACK由事物吸收
+//Accepted状态下相同branch的ACK也返回true
+func (s *serverTransactionStore) receive(req *Request, reliable bool, clock Clock, send func(p []byte) error) (trans *ServerTransaction, ok bool) {
+	var (
+		err    error
+		key    string
+		method = req.Method
+	)
+	if method == MethodAck {
+		method = MethodInvite
+	}
+	//没有branch的请求无法匹配事物, 直接交给应用
+	if key, err = serverTransactionKey(req.Header, method); err != nil {
+		return nil, true
+	}
+	s.mutex.Lock()
+	if s.transactions == nil {
+		s.transactions = make(map[string]*ServerTransaction)
+	}
+	if trans, ok = s.transactions[key]; ok {
+		s.mutex.Unlock()
+		return trans, trans.receive(req)
+	}
+	//2xx的ACK属于新的事物, 交给应用处理
+	if req.Method == MethodAck {
+		s.mutex.Unlock()
+		return nil, true
+	}
+	trans = &ServerTransaction{
+		key:      key,
+		request:  req,
+		invite:   req.Method == MethodInvite,
+		reliable: reliable,
+		clock:    clock,
+		send:     send,
+		done:     make(chan struct{}),
+	}
+	trans.onTerminated = s.release
+	s.transactions[key] = trans
+	s.mutex.Unlock()
+	trans.start()
+	return trans, true
+}
+
+//lookup 查找响应对应的事物
+func (s *serverTransactionStore) lookup(res *Response) (trans *ServerTransaction, ok bool) {
+	var (
+		err error
+		key string
+	)
+	if key, err = serverTransactionKey(res.Header, ""); err != nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	trans, ok = s.transactions[key]
+	return
+}
+
+//release 释放一个指定的事物
+func (s *serverTransactionStore) release(t *ServerTransaction) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if v, ok := s.transactions[t.key]; ok && v == t {
+		delete(s.transactions, t.key)
+	}
+}
+
+//serverTransactionKey 服务端事物的key, 由最上面Via的branch, sent-by以及方法组成
+func serverTransactionKey(header *Header, method Method) (key string, err error) {
+	if key, err = transactionKey(header, method); err != nil {
+		return
+	}
+	via := header.Get(HeaderVia).(*ViaHeader)
+	key = via.Uri.Address() + " " + key
+	return
+}
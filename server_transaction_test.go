@@ -0,0 +1,168 @@
+package sip
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServerTransaction(t *testing.T, store *serverTransactionStore, method Method) (*ServerTransaction, *fakeClock, *recorder) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	rec := &recorder{}
+	trans, ok := store.receive(newTestRequest(method, "server-"+method.String()), false, clock, rec.send)
+	if !ok || trans == nil {
+		t.Fatal("transaction not created")
+	}
+	return trans, clock, rec
+}
+
+func TestServerTransaction_Invite(t *testing.T) {
+	store := &serverTransactionStore{}
+	trans, clock, rec := newTestServerTransaction(t, store, MethodInvite)
+	//200ms后自动回复100 Trying
+	clock.Advance(TryingDelay)
+	if rec.count() != 1 || !strings.HasPrefix(string(rec.last()), "SIP/2.0 100") {
+		t.Fatalf("100 trying not sent, sent %d", rec.count())
+	}
+	//重传的INVITE不交给应用, 重发最后的响应
+	if _, ok := store.receive(newTestRequest(MethodInvite, "server-INVITE"), false, clock, rec.send); ok {
+		t.Fatal("retransmission delivered")
+	}
+	if rec.count() != 2 {
+		t.Fatalf("provisional response not retransmitted, sent %d", rec.count())
+	}
+	if err := trans.Respond(NewResponse(StatusBusyHere, trans.Request())); err != nil {
+		t.Fatal(err)
+	}
+	//Timer G: 0.5s, 1s, 2s
+	for i, d := range []time.Duration{T1, T1 * 2, T1 * 4} {
+		clock.Advance(d)
+		if rec.count() != i+4 {
+			t.Fatalf("retransmission %d: sent %d", i, rec.count())
+		}
+	}
+	ack := newTestRequest(MethodAck, "server-INVITE")
+	if _, ok := store.receive(ack, false, clock, rec.send); ok {
+		t.Fatal("ack delivered")
+	}
+	if trans.State() != TransactionStateConfirmed {
+		t.Fatalf("unexpected state %d", trans.State())
+	}
+	clock.Advance(T2)
+	if rec.count() != 6 {
+		t.Errorf("unexpected retransmission, sent %d", rec.count())
+	}
+	//Timer I
+	clock.Advance(T4)
+	if trans.State() != TransactionStateTerminated || trans.Err() != nil {
+		t.Errorf("unexpected state %d, error %v", trans.State(), trans.Err())
+	}
+}
+
+func TestServerTransaction_InviteTimeout(t *testing.T) {
+	store := &serverTransactionStore{}
+	trans, clock, _ := newTestServerTransaction(t, store, MethodInvite)
+	if err := trans.Respond(NewResponse(StatusNotFound, trans.Request())); err != nil {
+		t.Fatal(err)
+	}
+	//Timer H
+	clock.Advance(T1 * 64)
+	if trans.Err() != ErrorTransactionTimeout {
+		t.Errorf("unexpected error %v", trans.Err())
+	}
+}
+
+func TestServerTransaction_Accepted(t *testing.T) {
+	store := &serverTransactionStore{}
+	trans, clock, rec := newTestServerTransaction(t, store, MethodInvite)
+	if err := trans.Respond(NewResponse(StatusOK, trans.Request())); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(TryingDelay)
+	if rec.count() != 1 || trans.State() != TransactionStateAccepted {
+		t.Fatalf("unexpected state %d, sent %d", trans.State(), rec.count())
+	}
+	//2xx之后重传的INVITE被事物吸收, 不交给应用也不重发响应
+	clock.Advance(T1 * 4)
+	if _, ok := store.receive(newTestRequest(MethodInvite, "server-INVITE"), false, clock, rec.send); ok {
+		t.Fatal("retransmission after 2xx delivered")
+	}
+	if rec.count() != 1 {
+		t.Fatalf("unexpected response, sent %d", rec.count())
+	}
+	//应用重传的2xx通过事物发送
+	if err := trans.Respond(NewResponse(StatusOK, trans.Request())); err != nil || rec.count() != 2 {
+		t.Fatalf("2xx retransmission failed %v, sent %d", err, rec.count())
+	}
+	//2xx的ACK使用新的branch, 需要交给应用
+	if _, ok := store.receive(newTestRequest(MethodAck, "server-ack"), false, clock, rec.send); !ok {
+		t.Error("2xx ack not delivered")
+	}
+	//Timer L
+	clock.Advance(T1*60 - TryingDelay)
+	if trans.State() != TransactionStateTerminated || trans.Err() != nil {
+		t.Errorf("unexpected state %d, error %v", trans.State(), trans.Err())
+	}
+}
+
+func TestServerTransaction_NonInvite(t *testing.T) {
+	store := &serverTransactionStore{}
+	trans, clock, rec := newTestServerTransaction(t, store, MethodRegister)
+	if _, ok := store.receive(newTestRequest(MethodRegister, "server-REGISTER"), false, clock, rec.send); ok {
+		t.Fatal("retransmission delivered")
+	}
+	clock.Advance(TryingDelay)
+	if rec.count() != 0 {
+		t.Fatalf("unexpected response, sent %d", rec.count())
+	}
+	if err := trans.Respond(NewResponse(StatusOK, trans.Request())); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.receive(newTestRequest(MethodRegister, "server-REGISTER"), false, clock, rec.send); ok {
+		t.Fatal("retransmission delivered")
+	}
+	if rec.count() != 2 {
+		t.Fatalf("final response not retransmitted, sent %d", rec.count())
+	}
+	if err := trans.Respond(NewResponse(StatusOK, trans.Request())); err != ErrorTransactionTerminated {
+		t.Errorf("unexpected error %v", err)
+	}
+	//Timer J
+	clock.Advance(T1 * 64)
+	if trans.State() != TransactionStateTerminated {
+		t.Errorf("unexpected state %d", trans.State())
+	}
+}
+
+func TestUDPTransport_Respond(t *testing.T) {
+	server := NewUDPTransport()
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := NewUDPTransport()
+	if err := client.Dial(server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	req := newTestRequest(MethodOptions, "udp-respond")
+	p := req.Bytes()
+	for i := 0; i < 3; i++ {
+		if _, err := client.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case req = <-server.Request():
+	case <-time.After(time.Second):
+		t.Fatal("request not delivered")
+	}
+	if err := server.Respond(NewResponse(StatusOK, req)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case req = <-server.Request():
+		t.Fatal("retransmission delivered")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
@@ -0,0 +1,136 @@
+package sip
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	stunMagicCookie          = 0x2112A442
+	stunHeaderSize           = 20
+	stunBindingRequest       = 0x0001
+	stunBindingSuccess       = 0x0101
+	stunAttrXorMappedAddress = 0x0020
+	stunFamilyIPv4           = 0x01
+	stunFamilyIPv6           = 0x02
+)
+
+var (
+	ErrorInvalidSTUN = errors.New("invalid stun message")
+)
+
+type (
+	//stunMessage 保活使用的STUN绑定消息(RFC 5389)
+	stunMessage struct {
+		Type        uint16
+		Transaction [12]byte
+		Mapped      *net.UDPAddr
+	}
+)
+
+//IsSTUN 判断udp消息是否为STUN消息, sip消息的第一个字节不会是0x00或者0x01
+func IsSTUN(p []byte) bool {
+	return len(p) >= stunHeaderSize && p[0]&0xC0 == 0 && binary.BigEndian.Uint32(p[4:]) == stunMagicCookie
+}
+
+//Bytes 编码STUN消息, 只包含XOR-MAPPED-ADDRESS属性
+func (m *stunMessage) Bytes() []byte {
+	var attr []byte
+	if m.Mapped != nil {
+		ip := m.Mapped.IP.To4()
+		family := byte(stunFamilyIPv4)
+		if ip == nil {
+			ip = m.Mapped.IP.To16()
+			family = stunFamilyIPv6
+		}
+		attr = make([]byte, 8+len(ip))
+		binary.BigEndian.PutUint16(attr[0:], stunAttrXorMappedAddress)
+		binary.BigEndian.PutUint16(attr[2:], uint16(4+len(ip)))
+		attr[5] = family
+		binary.BigEndian.PutUint16(attr[6:], uint16(m.Mapped.Port)^uint16(stunMagicCookie>>16))
+		key := m.xorKey()
+		for i := range ip {
+			attr[8+i] = ip[i] ^ key[i]
+		}
+	}
+	msg := make([]byte, stunHeaderSize, stunHeaderSize+len(attr))
+	binary.BigEndian.PutUint16(msg[0:], m.Type)
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(attr)))
+	binary.BigEndian.PutUint32(msg[4:], stunMagicCookie)
+	copy(msg[8:], m.Transaction[:])
+	return append(msg, attr...)
+}
+
+//xorKey XOR-MAPPED-ADDRESS使用的异或值, 由magic cookie和事物ID组成
+func (m *stunMessage) xorKey() []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint32(key, stunMagicCookie)
+	copy(key[4:], m.Transaction[:])
+	return key
+}
+
+//parseSTUN 解析STUN消息, 忽略不认识的属性
+func parseSTUN(p []byte) (m *stunMessage, err error) {
+	if !IsSTUN(p) {
+		err = ErrorInvalidSTUN
+		return
+	}
+	length := int(binary.BigEndian.Uint16(p[2:]))
+	if stunHeaderSize+length > len(p) {
+		err = ErrorInvalidSTUN
+		return
+	}
+	m = &stunMessage{Type: binary.BigEndian.Uint16(p)}
+	copy(m.Transaction[:], p[8:stunHeaderSize])
+	attrs := p[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs)
+		size := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+size > len(attrs) {
+			err = ErrorInvalidSTUN
+			return
+		}
+		value := attrs[4 : 4+size]
+		//只接受IPv4(8字节)以及IPv6(20字节)的地址, 其他长度或者地址族直接忽略
+		if typ == stunAttrXorMappedAddress && ((size == 8 && value[1] == stunFamilyIPv4) || (size == 20 && value[1] == stunFamilyIPv6)) {
+			ip := make(net.IP, size-4)
+			key := m.xorKey()
+			for i := range ip {
+				ip[i] = value[4+i] ^ key[i]
+			}
+			m.Mapped = &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(value[2:]) ^ uint16(stunMagicCookie>>16))}
+		}
+		//属性按照4字节对齐
+		if size%4 != 0 {
+			size += 4 - size%4
+		}
+		if 4+size > len(attrs) {
+			break
+		}
+		attrs = attrs[4+size:]
+	}
+	return
+}
+
+//newSTUNRequest 创建一个随机事物ID的绑定请求
+func newSTUNRequest() *stunMessage {
+	m := &stunMessage{Type: stunBindingRequest}
+	_, _ = rand.Read(m.Transaction[:])
+	return m
+}
+
+//NewSTUNBindingResponse 创建绑定请求的成功响应, addr为请求的来源地址
+func NewSTUNBindingResponse(p []byte, addr *net.UDPAddr) (b []byte, err error) {
+	var req *stunMessage
+	if req, err = parseSTUN(p); err != nil {
+		return
+	}
+	if req.Type != stunBindingRequest {
+		err = ErrorInvalidSTUN
+		return
+	}
+	res := &stunMessage{Type: stunBindingSuccess, Transaction: req.Transaction, Mapped: addr}
+	return res.Bytes(), nil
+}
@@ -0,0 +1,353 @@
+package sip
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tcpDialTimeout       = time.Second * 5
+	tcpMinReconnectDelay = time.Millisecond * 100
+	tcpMaxReconnectDelay = time.Second * 5
+)
+
+type (
+	dialFunc func(addr string) (net.Conn, error)
+
+	listenFunc func(addr string) (net.Listener, error)
+
+	TCPTransport struct {
+		baseTransport
+		addr       string
+		protocol   string
+		dial       dialFunc
+		listen     listenFunc
+		listener   net.Listener
+		conn       net.Conn
+		connMutex  sync.RWMutex
+		writeMutex sync.Mutex
+		peers      peerTable
+		closed     int32
+	}
+)
+
+func (tp *TCPTransport) Protocol() string {
+	return tp.protocol
+}
+
+func (tp *TCPTransport) Conn() net.Conn {
+	tp.connMutex.RLock()
+	defer tp.connMutex.RUnlock()
+	return tp.conn
+}
+
+func (tp *TCPTransport) LocalAddr() net.Addr {
+	if tp.listener != nil {
+		return tp.listener.Addr()
+	}
+	if conn := tp.Conn(); conn != nil {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+//Dial 新建立一个连接, 连接断开后会自动重连
+func (tp *TCPTransport) Dial(addr string) (err error) {
+	var conn net.Conn
+	tp.addr = addr
+	if conn, err = tp.dial(addr); err != nil {
+		return
+	}
+	tp.connMutex.Lock()
+	tp.conn = conn
+	tp.connMutex.Unlock()
+	go tp.exchange(conn)
+	return
+}
+
+//Listen 监听指定的地址, 每个接入的连接按照对端地址进行区分
+func (tp *TCPTransport) Listen(addr string) (err error) {
+	if tp.listen == nil {
+		err = ErrorNotSupported
+		return
+	}
+	if tp.listener, err = tp.listen(addr); err != nil {
+		return
+	}
+	go tp.accept()
+	return
+}
+
+//accept 接收新的连接
+func (tp *TCPTransport) accept() {
+	for {
+		conn, err := tp.listener.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&tp.closed) == 0 {
+				tp.getLogger().Error("accept connection failed", "protocol", tp.protocol, FieldError, err)
+			}
+			return
+		}
+		tp.peers.add(conn.RemoteAddr(), &streamPeer{conn: conn})
+		go tp.serve(conn)
+	}
+}
+
+//serve 处理一个对端连接, 连接断开后移除
+func (tp *TCPTransport) serve(conn net.Conn) {
+	if err := tp.readLoop(conn); err != io.EOF && atomic.LoadInt32(&tp.closed) == 0 {
+		tp.getLogger().Warn("read message failed", FieldPeer, conn.RemoteAddr().String(), FieldError, err)
+	}
+	tp.peers.remove(conn.RemoteAddr())
+	_ = conn.Close()
+}
+
+//reconnect 断线重连, 服务端接收的连接不进行重连
+func (tp *TCPTransport) reconnect() (conn net.Conn, err error) {
+	delay := tcpMinReconnectDelay
+	if tp.dial == nil {
+		atomic.StoreInt32(&tp.closed, 1)
+		err = ErrorTransportClosed
+		return
+	}
+	for atomic.LoadInt32(&tp.closed) == 0 {
+		if conn, err = tp.dial(tp.addr); err == nil {
+			tp.connMutex.Lock()
+			//关闭和重连同时发生
+			if atomic.LoadInt32(&tp.closed) == 1 {
+				tp.connMutex.Unlock()
+				_ = conn.Close()
+				break
+			}
+			tp.conn = conn
+			tp.connMutex.Unlock()
+			return
+		}
+		tp.getLogger().Warn("reconnect failed", FieldPeer, tp.addr, FieldError, err, "delay", delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > tcpMaxReconnectDelay {
+			delay = tcpMaxReconnectDelay
+		}
+	}
+	err = ErrorTransportClosed
+	return
+}
+
+//readLoop 读取流上的消息, 通过Content-Length进行分帧
+func (tp *TCPTransport) readLoop(conn net.Conn) (err error) {
+	var (
+		res *Response
+		req *Request
+	)
+	var n, crlf int
+	key := conn.RemoteAddr().String()
+	bufioReader := bufio.NewReader(conn)
+	for {
+		if n, err = readKeepAlive(bufioReader); err != nil {
+			return
+		}
+		if n > 0 {
+			//CRLF可能被分到多个分段中, 累计后再判断是ping还是pong
+			crlf += n
+			if crlf >= len(crlfPing) {
+				//收到ping, 回复一个CRLF
+				crlf = 0
+				_, _ = tp.writeConn(conn, crlfPong)
+			} else if crlf == len(crlfPong) && tp.pongs.pending(key) {
+				crlf = 0
+				tp.pongs.notify(key, nil)
+			}
+			continue
+		}
+		//消息前多余的CRLF直接忽略
+		crlf = 0
+		if req, res, err = readMessage(bufioReader); err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				tp.traceReceive(tp, nil, nil, nil, conn.RemoteAddr(), err)
+			}
+			return
+		}
+		tp.traceReceive(tp, nil, req, res, conn.RemoteAddr(), nil)
+		tp.dispatch(tp, req, res, conn.RemoteAddr())
+	}
+}
+
+//exchange 读取主动建立的连接, 断开后自动重连
+func (tp *TCPTransport) exchange(conn net.Conn) {
+	var err error
+	for {
+		err = tp.readLoop(conn)
+		_ = conn.Close()
+		if atomic.LoadInt32(&tp.closed) == 1 {
+			return
+		}
+		if err != io.EOF {
+			tp.getLogger().Warn("read message failed", FieldPeer, tp.addr, FieldError, err)
+		}
+		if conn, err = tp.reconnect(); err != nil {
+			return
+		}
+	}
+}
+
+func (tp *TCPTransport) Write(p []byte) (n int, err error) {
+	var addr net.Addr
+	if conn := tp.Conn(); conn != nil {
+		addr = conn.RemoteAddr()
+	}
+	n, err = tp.write(p)
+	tp.traceSend(tp, p, addr, err)
+	return
+}
+
+func (tp *TCPTransport) write(p []byte) (n int, err error) {
+	conn := tp.Conn()
+	if conn == nil || atomic.LoadInt32(&tp.closed) == 1 {
+		err = io.ErrClosedPipe
+		return
+	}
+	tp.writeMutex.Lock()
+	defer tp.writeMutex.Unlock()
+	return conn.Write(p)
+}
+
+//WriteTo 发送数据到指定的对端, 对端没有连接时主动建立连接
+func (tp *TCPTransport) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = tp.writeTo(p, addr)
+	tp.traceSend(tp, p, addr, err)
+	return
+}
+
+func (tp *TCPTransport) writeTo(p []byte, addr net.Addr) (n int, err error) {
+	var (
+		conn    net.Conn
+		pr      peer
+		created bool
+	)
+	if atomic.LoadInt32(&tp.closed) == 1 {
+		err = io.ErrClosedPipe
+		return
+	}
+	if conn = tp.Conn(); conn != nil && conn.RemoteAddr().String() == addr.String() {
+		return tp.write(p)
+	}
+	if n, err = tp.peers.writeTo(p, addr); err != ErrorPeerNotFound || tp.dial == nil {
+		return
+	}
+	//并发写入同一个对端时只建立一个连接
+	if pr, created, err = tp.peers.dial(addr, func() (peer, error) {
+		c, e := tp.dial(addr.String())
+		if e != nil {
+			return nil, e
+		}
+		return &streamPeer{conn: c}, nil
+	}); err != nil {
+		return
+	}
+	if created {
+		go tp.serve(pr.(*streamPeer).conn)
+	}
+	return pr.Write(p)
+}
+
+func (tp *TCPTransport) Do(ctx context.Context, req *Request, callback ProcessFunc) (err error) {
+	return tp.do(ctx, tp, req, callback)
+}
+
+func (tp *TCPTransport) Respond(res *Response) (err error) {
+	return tp.respond(tp, res)
+}
+
+func (tp *TCPTransport) Close() (err error) {
+	if !atomic.CompareAndSwapInt32(&tp.closed, 0, 1) {
+		return
+	}
+	if tp.listener != nil {
+		err = tp.listener.Close()
+	}
+	tp.peers.closeAll()
+	if conn := tp.Conn(); conn != nil {
+		err = conn.Close()
+	}
+	return
+}
+
+//readKeepAlive 读取流上的CRLF保活数据, 返回读取的字节数, 没有更多已经到达的数据时返回
+func readKeepAlive(b *bufio.Reader) (n int, err error) {
+	var p []byte
+	for {
+		if n > 0 && b.Buffered() == 0 {
+			return
+		}
+		if p, err = b.Peek(1); err != nil {
+			return
+		}
+		if p[0] != '\r' && p[0] != '\n' {
+			return
+		}
+		if _, err = b.Discard(1); err != nil {
+			return
+		}
+		n++
+	}
+}
+
+//writeConn 写入指定的连接, 和消息的写入串行
+func (tp *TCPTransport) writeConn(conn net.Conn, p []byte) (n int, err error) {
+	if conn == tp.Conn() {
+		return tp.Write(p)
+	}
+	n, err = tp.peers.writeTo(p, conn.RemoteAddr())
+	tp.traceSend(tp, p, conn.RemoteAddr(), err)
+	return
+}
+
+//Ping 发送CRLF保活并等待对端回复CRLF(RFC 5626 4.4.1)
+func (tp *TCPTransport) Ping(ctx context.Context, addr net.Addr) (mapped net.Addr, err error) {
+	if addr == nil {
+		conn := tp.Conn()
+		if conn == nil {
+			err = io.ErrClosedPipe
+			return
+		}
+		addr = conn.RemoteAddr()
+	}
+	key := addr.String()
+	c := tp.pongs.wait(key)
+	if _, err = tp.WriteTo(crlfPing, addr); err != nil {
+		tp.pongs.cancel(key)
+		return
+	}
+	return tp.pongs.await(ctx, key, c)
+}
+
+//newStreamTransport 使用一个已经建立的连接创建传输层
+func newStreamTransport(conn net.Conn, protocol string) *TCPTransport {
+	tp := &TCPTransport{
+		baseTransport: newBaseTransport(true),
+		addr:          conn.RemoteAddr().String(),
+		protocol:      protocol,
+		conn:          conn,
+	}
+	go tp.exchange(conn)
+	return tp
+}
+
+func NewTCPTransport() Transport {
+	return &TCPTransport{
+		baseTransport: newBaseTransport(true),
+		protocol:      ProtoTCP,
+		dial: func(addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, tcpDialTimeout)
+		},
+		listen: func(addr string) (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		},
+	}
+}
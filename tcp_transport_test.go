@@ -0,0 +1,193 @@
+package sip
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRequest(method Method, callID string) *Request {
+	req := NewDefaultRequest(method, "127.0.0.1")
+	req.Username = "1001"
+	req.Header.Set(HeaderVia, &ViaHeader{Uri: NewUri("", "127.0.0.1:5060", Map{"branch": "z9hG4bK-" + callID})})
+	req.Header.Set(HeaderFrom, &AddressHeader{Uri: NewUri("1000", "127.0.0.1", Map{}).EnableProtocol(), Params: Map{"tag": "from-" + callID}})
+	req.Header.Set(HeaderTo, &AddressHeader{Uri: NewUri("1001", "127.0.0.1", Map{}).EnableProtocol()})
+	req.Header.Set(HeaderCallID, NewPlainHeader(callID))
+	req.Header.Set(HeaderCSeq, NewSequenceHeader(method, 1))
+	return req
+}
+
+//serveTCPOnce 接收一个请求并分段写回响应
+func serveTCPOnce(t *testing.T, l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	req, err := ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res := NewResponse(StatusOK, req)
+	res.Body = []byte("v=0\r\n")
+	p := res.Bytes()
+	//keep-alive以及半包
+	_, _ = conn.Write([]byte("\r\n\r\n"))
+	_, _ = conn.Write(p[:10])
+	time.Sleep(time.Millisecond * 20)
+	_, _ = conn.Write(p[10:])
+	//每轮使用不同的branch, 避免被当作重传的请求
+	_, _ = conn.Write(newTestRequest(MethodOptions, "server-"+req.Header.Get(HeaderCallID).String()).Bytes())
+	time.Sleep(time.Millisecond * 50)
+}
+
+func TestTCPTransport_Do(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		serveTCPOnce(t, l)
+		done <- struct{}{}
+		//断开后客户端需要自动重连
+		serveTCPOnce(t, l)
+		done <- struct{}{}
+	}()
+	tp := NewTCPTransport()
+	if err = tp.Dial(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	for i, callID := range []string{"tcp-call-1", "tcp-call-2"} {
+		conn := tp.Conn()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		err = tp.Do(ctx, newTestRequest(MethodInvite, callID), func(res *Response) (bool, error) {
+			if string(res.Body) != "v=0\r\n" {
+				t.Errorf("unexpected body %q", res.Body)
+			}
+			return res.StatusCode == StatusOK, nil
+		})
+		cancel()
+		if err != nil {
+			t.Fatalf("round %d: %s", i, err)
+		}
+		select {
+		case req := <-tp.Request():
+			if req.Method != MethodOptions {
+				t.Errorf("unexpected request %s", req.Method)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("request not delivered")
+		}
+		//等待服务端断开连接并且客户端完成重连
+		<-done
+		for deadline := time.Now().Add(time.Second * 3); tp.Conn() == conn && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+func TestTCPTransport_Listen(t *testing.T) {
+	testListen(t, NewTCPTransport(), NewTCPTransport)
+}
+
+func TestTCPTransport_oversizedContentLength(t *testing.T) {
+	server := NewTCPTransport()
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := newTestRequest(MethodInvite, "oversized-call").Bytes()
+	p = bytes.Replace(p, []byte("Content-Length: 0"), []byte("Content-Length: 4294967296"), 1)
+	if _, err = conn.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	//超过长度限制的消息直接断开连接
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection not closed: %v", err)
+	}
+	select {
+	case req := <-server.Request():
+		t.Errorf("unexpected request %s", req.Method)
+	default:
+	}
+}
+
+func TestTCPTransport_splitPing(t *testing.T) {
+	server := NewTCPTransport()
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//ping被分成两个分段发送
+	_, _ = conn.Write(crlfPing[:2])
+	time.Sleep(time.Millisecond * 50)
+	_, _ = conn.Write(crlfPing[2:])
+	buf := make([]byte, 8)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != string(crlfPong) {
+		t.Fatalf("unexpected pong %q %v", buf[:n], err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if n, err = conn.Read(buf); err == nil {
+		t.Errorf("unexpected data %q", buf[:n])
+	}
+}
+
+func TestTCPTransport_dialOnce(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	tp := NewTCPTransport()
+	defer tp.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := tp.WriteTo(crlfPong, l.Addr()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	time.Sleep(time.Millisecond * 100)
+	if n := len(accepted); n != 1 {
+		t.Errorf("unexpected connections %d", n)
+	}
+	for len(accepted) > 0 {
+		_ = (<-accepted).Close()
+	}
+}
@@ -0,0 +1,52 @@
+package sip
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+const (
+	ProtoTLS = "TLS"
+)
+
+//tlsDialer 使用目标主机名作为SNI建立TLS连接
+func tlsDialer(config *tls.Config) dialFunc {
+	return func(addr string) (conn net.Conn, err error) {
+		var host string
+		cfg := &tls.Config{}
+		if config != nil {
+			cfg = config.Clone()
+		}
+		if cfg.ServerName == "" {
+			if host, _, err = net.SplitHostPort(addr); err != nil {
+				return
+			}
+			cfg.ServerName = host
+		}
+		dialer := &net.Dialer{Timeout: tcpDialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", addr, cfg)
+	}
+}
+
+//ListenTLS 监听TLS端口, 需要客户端证书时设置config.ClientAuth和ClientCAs
+func ListenTLS(addr string, config *tls.Config) (net.Listener, error) {
+	return tls.Listen("tcp", addr, config)
+}
+
+//NewTLSServerTransport 使用服务端接收到的TLS连接创建传输层
+func NewTLSServerTransport(conn net.Conn) Transport {
+	return newStreamTransport(conn, ProtoTLS)
+}
+
+//NewTLSTransport 创建TLS传输层, 客户端双向认证时在config.Certificates中设置客户端证书,
+//服务端监听时config需要包含服务端证书
+func NewTLSTransport(config *tls.Config) Transport {
+	return &TCPTransport{
+		baseTransport: newBaseTransport(true),
+		protocol:      ProtoTLS,
+		dial:          tlsDialer(config),
+		listen: func(addr string) (net.Listener, error) {
+			return ListenTLS(addr, config)
+		},
+	}
+}
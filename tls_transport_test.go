@@ -0,0 +1,101 @@
+package sip
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//newTestCertificate 生成自签名证书
+func newTestCertificate(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func TestTLSTransport_Do(t *testing.T) {
+	serverCert, serverLeaf := newTestCertificate(t, "localhost")
+	clientCert, clientLeaf := newTestCertificate(t, "client")
+	serverPool, clientPool := x509.NewCertPool(), x509.NewCertPool()
+	serverPool.AddCert(clientLeaf)
+	clientPool.AddCert(serverLeaf)
+
+	l, err := ListenTLS("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    serverPool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		tp := NewTLSServerTransport(conn)
+		defer tp.Close()
+		req := <-tp.Request()
+		if certs := conn.(*tls.Conn).ConnectionState().PeerCertificates; len(certs) == 0 || certs[0].Subject.CommonName != "client" {
+			t.Error("client certificate missing")
+		}
+		if _, err = tp.Write(NewResponse(StatusOK, req).Bytes()); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}()
+
+	uri := &Uri{IsEncrypted: true, HasProtocol: true, Host: "localhost", Port: l.Addr().(*net.TCPAddr).Port}
+	if protocol := TransportOf(uri); protocol != ProtoTLS {
+		t.Fatalf("sips uri select %s", protocol)
+	}
+	//使用localhost作为SNI, 实际连接到127.0.0.1
+	tp := NewTLSTransport(&tls.Config{RootCAs: clientPool, Certificates: []tls.Certificate{clientCert}, ServerName: uri.Host})
+	if err = tp.Dial(net.JoinHostPort("127.0.0.1", strconv.Itoa(uri.Port))); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	err = tp.Do(ctx, newTestRequest(MethodOptions, "tls-call"), func(res *Response) (bool, error) {
+		return res.StatusCode == StatusOK, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tp.Conn().(*tls.Conn).ConnectionState().ServerName != "localhost" {
+		t.Error("unexpected server name")
+	}
+}
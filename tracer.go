@@ -0,0 +1,126 @@
+package sip
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	TraceSend    = "send"
+	TraceReceive = "receive"
+)
+
+type (
+	//Tracer 传输层消息的跟踪器, 每次发送以及接收都会调用, 需要并发安全并且不能阻塞
+	Tracer interface {
+		Trace(e *TraceEvent)
+	}
+
+	//TracerFunc 函数形式的Tracer
+	TracerFunc func(e *TraceEvent)
+
+	//multiTracer 依次调用多个Tracer
+	multiTracer []Tracer
+
+	//TraceEvent 一次发送或者接收, Raw在回调返回后可能被复用
+	TraceEvent struct {
+		Time       time.Time
+		Direction  string //TraceSend或者TraceReceive
+		Transport  string
+		LocalAddr  net.Addr
+		RemoteAddr net.Addr
+		Raw        []byte
+		Request    *Request
+		Response   *Response
+		Err        error //解析或者发送的错误
+	}
+
+	//JSONTracer 每个事件写入一行json
+	JSONTracer struct {
+		mutex   sync.Mutex
+		encoder *json.Encoder
+	}
+
+	//jsonTraceRecord JSONTracer写入的记录
+	jsonTraceRecord struct {
+		Time       time.Time `json:"time"`
+		Direction  string    `json:"direction"`
+		Transport  string    `json:"transport"`
+		LocalAddr  string    `json:"local_addr,omitempty"`
+		RemoteAddr string    `json:"remote_addr,omitempty"`
+		Method     string    `json:"method,omitempty"`
+		StatusCode int       `json:"status_code,omitempty"`
+		CallID     string    `json:"call_id,omitempty"`
+		Message    string    `json:"message"`
+		Error      string    `json:"error,omitempty"`
+	}
+)
+
+func (f TracerFunc) Trace(e *TraceEvent) {
+	f(e)
+}
+
+func (m multiTracer) Trace(e *TraceEvent) {
+	for _, tracer := range m {
+		tracer.Trace(e)
+	}
+}
+
+//Trace 写入一行json, 写入失败时忽略
+func (t *JSONTracer) Trace(e *TraceEvent) {
+	record := &jsonTraceRecord{
+		Time:      e.Time,
+		Direction: e.Direction,
+		Transport: e.Transport,
+		Message:   string(e.Raw),
+	}
+	if e.LocalAddr != nil {
+		record.LocalAddr = e.LocalAddr.String()
+	}
+	if e.RemoteAddr != nil {
+		record.RemoteAddr = e.RemoteAddr.String()
+	}
+	if e.Request != nil {
+		record.Method = string(e.Request.Method)
+		record.CallID = e.Request.CallID()
+	}
+	if e.Response != nil {
+		record.StatusCode = e.Response.StatusCode
+		record.CallID = e.Response.CallID()
+	}
+	if e.Err != nil {
+		record.Error = e.Err.Error()
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_ = t.encoder.Encode(record)
+}
+
+//traceEvent 创建跟踪事件, 发送的数据不是保活时解析出sip消息
+func traceEvent(direction string, tp Transport, p []byte, addr net.Addr) *TraceEvent {
+	e := &TraceEvent{
+		Time:       time.Now(),
+		Direction:  direction,
+		Transport:  tp.Protocol(),
+		LocalAddr:  tp.LocalAddr(),
+		RemoteAddr: addr,
+		Raw:        p,
+	}
+	if direction == TraceSend && len(p) >= 3 && !IsSTUN(p) && !isKeepAlive(p) {
+		e.Request, e.Response, _ = parseMessage(p)
+	}
+	return e
+}
+
+//MultiTracer 组合多个Tracer, 例如同时写入json以及镜像到抓包服务
+func MultiTracer(tracers ...Tracer) Tracer {
+	return multiTracer(tracers)
+}
+
+//NewJSONTracer 创建写入json行的跟踪器
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	return &JSONTracer{encoder: json.NewEncoder(w)}
+}
@@ -0,0 +1,74 @@
+package sip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+//lockedBuffer 并发安全的bytes.Buffer
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Lines() [][]byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return bytes.Split(bytes.TrimSpace(b.buf.Bytes()), []byte("\n"))
+}
+
+func TestJSONTracer(t *testing.T) {
+	server := NewUDPTransport()
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for req := range server.Request() {
+			_ = server.Respond(NewResponse(StatusOK, req))
+		}
+	}()
+	tp := NewUDPTransport()
+	if err := tp.Dial(server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	out := &lockedBuffer{}
+	tp.SetTracer(NewJSONTracer(out))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if err := tp.Do(ctx, newTestRequest(MethodOptions, "trace-call"), func(res *Response) (bool, error) {
+		return res.StatusCode >= StatusOK, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	lines := out.Lines()
+	if len(lines) != 2 {
+		t.Fatalf("unexpected trace lines %q", lines)
+	}
+	var records [2]jsonTraceRecord
+	for i, line := range lines {
+		if err := json.Unmarshal(line, &records[i]); err != nil {
+			t.Fatal(err)
+		}
+		if records[i].CallID != "trace-call" || records[i].Transport != ProtoUDP || records[i].RemoteAddr != server.LocalAddr().String() {
+			t.Errorf("unexpected record %+v", records[i])
+		}
+	}
+	if records[0].Direction != TraceSend || records[0].Method != string(MethodOptions) {
+		t.Errorf("unexpected send record %+v", records[0])
+	}
+	if records[1].Direction != TraceReceive || records[1].StatusCode != StatusOK {
+		t.Errorf("unexpected receive record %+v", records[1])
+	}
+}
@@ -1,39 +1,191 @@
 package sip
 
 import (
+	"context"
+	"errors"
+	"github.com/rs/xid"
+	"sync"
 	"time"
 )
 
-type Transaction struct {
-	ID        string
-	CreatedAt time.Time
-	c         chan *Response
+const (
+	//T1 RTT估计值
+	T1 = time.Millisecond * 500
+	//T2 非INVITE请求和INVITE响应的最大重传间隔
+	T2 = time.Second * 4
+	//T4 消息在网络中的最大存活时间
+	T4 = time.Second * 5
+
+	//BranchMagicCookie RFC 3261 branch前缀
+	BranchMagicCookie = "z9hG4bK"
+)
+
+const (
+	TransactionStateCalling = iota + 1
+	TransactionStateTrying
+	TransactionStateProceeding
+	TransactionStateCompleted
+	TransactionStateConfirmed
+	TransactionStateTerminated
+	//TransactionStateAccepted INVITE收到或者发送2xx后吸收重传的状态(RFC 6026)
+	TransactionStateAccepted
+)
+
+var (
+	ErrorTransactionTimeout    = errors.New("transaction timeout")
+	ErrorTransactionMissing    = errors.New("transaction key missing")
+	ErrorTransactionTerminated = errors.New("transaction terminated")
+)
+
+type (
+	//Timer 定时器
+	Timer interface {
+		Stop() bool
+	}
+
+	//Clock 事物使用的时钟, 测试时可以替换为手动控制的时钟
+	Clock interface {
+		Now() time.Time
+		AfterFunc(d time.Duration, f func()) Timer
+	}
+
+	systemClock struct {
+	}
+
+	//transactionStore 传输层上未完成的客户端事物
+	transactionStore struct {
+		mutex        sync.RWMutex
+		transactions map[string]*ClientTransaction
+	}
+)
+
+func (c systemClock) Now() time.Time {
+	return time.Now()
 }
 
-func (t *Transaction) notify(res *Response) {
-	if t.c != nil {
-		select {
-		case t.c <- res:
-		default:
+func (c systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+//NewBranch 生成一个新的branch
+func NewBranch() string {
+	return BranchMagicCookie + xid.New().String()
+}
+
+//transactionKey 事物的key, 由最上面的Via的branch和CSeq的方法组成
+func transactionKey(header *Header, method Method) (key string, err error) {
+	via, ok := header.Get(HeaderVia).(*ViaHeader)
+	if !ok || via.Uri == nil {
+		err = ErrorTransactionMissing
+		return
+	}
+	branch := via.Uri.Params.Get("branch")
+	if branch == "" {
+		err = ErrorTransactionMissing
+		return
+	}
+	if method == "" {
+		seq, ok := header.Get(HeaderCSeq).(*SequenceHeader)
+		if !ok {
+			err = ErrorTransactionMissing
+			return
 		}
+		method = seq.Method
 	}
+	key = branch + " " + method.String()
+	return
 }
 
-//Chan 获取事件
-func (t *Transaction) Chan() chan *Response {
-	return t.c
+//add 添加一个事物
+func (s *transactionStore) add(t *ClientTransaction) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.transactions == nil {
+		s.transactions = make(map[string]*ClientTransaction)
+	}
+	s.transactions[t.key] = t
 }
 
-//Close 关闭事物
-func (t *Transaction) Close() (err error) {
-	close(t.c)
+//notify 将响应交给匹配的事物, 没有匹配的事物返回false
+func (s *transactionStore) notify(res *Response) (ok bool) {
+	var (
+		err   error
+		key   string
+		trans *ClientTransaction
+	)
+	if key, err = transactionKey(res.Header, ""); err != nil {
+		return
+	}
+	s.mutex.RLock()
+	trans, ok = s.transactions[key]
+	s.mutex.RUnlock()
+	if ok {
+		trans.receive(res)
+	}
 	return
 }
 
-func newTransaction(id string) *Transaction {
-	return &Transaction{
-		ID:        id,
-		CreatedAt: time.Now(),
-		c:         make(chan *Response, 1),
+//release 释放一个指定的事物
+func (s *transactionStore) release(t *ClientTransaction) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if v, ok := s.transactions[t.key]; ok && v == t {
+		delete(s.transactions, t.key)
+	}
+}
+
+//do 创建客户端事物发送请求并等待响应
+func (s *transactionStore) do(ctx context.Context, trans *ClientTransaction, callback ProcessFunc) (err error) {
+	var (
+		ok  bool
+		res *Response
+	)
+	s.add(trans)
+	if err = trans.start(); err != nil {
+		trans.cancel(err)
+		s.release(trans)
+		return
+	}
+	for {
+		select {
+		case res = <-trans.Responses():
+			if ok, err = callback(res); ok || err != nil {
+				if ok && trans.State() == TransactionStateAccepted {
+					go s.accepted(trans, callback)
+				}
+				return
+			}
+		case <-trans.Done():
+			//处理事物结束前收到的响应
+			for {
+				select {
+				case res = <-trans.Responses():
+					if ok, err = callback(res); ok || err != nil {
+						return
+					}
+				default:
+					return trans.Err()
+				}
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+			trans.cancel(err)
+			s.release(trans)
+			return
+		}
+	}
+}
+
+//accepted 事物接受2xx后, 将重传的2xx继续交给回调直到事物结束
+func (s *transactionStore) accepted(trans *ClientTransaction, callback ProcessFunc) {
+	for {
+		select {
+		case res := <-trans.Responses():
+			if res.StatusCode >= 200 && res.StatusCode < 300 {
+				_, _ = callback(res)
+			}
+		case <-trans.Done():
+			return
+		}
 	}
 }
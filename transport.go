@@ -1,8 +1,17 @@
 package sip
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/uole/sip/pool"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 const (
@@ -10,16 +19,374 @@ const (
 	ProtoTCP = "TCP"
 )
 
+var (
+	responseFeature = []byte("SIP")
+
+	ErrorTransportClosed = errors.New("transport closed")
+	ErrorPeerNotFound    = errors.New("transport peer not found")
+	ErrorNotSupported    = errors.New("transport operation not supported")
+)
+
+const (
+	DefaultPort    = 5060
+	DefaultTLSPort = 5061
+)
+
+const (
+	//DefaultWorkers 默认并发处理请求的数量
+	DefaultWorkers = 64
+	//DefaultRetryAfter 过载时503响应中的Retry-After, 单位秒
+	DefaultRetryAfter = 5
+)
+
 type (
 	ProcessFunc func(res *Response) (handled bool, err error)
 
+	//RequestHandler 处理传输层收到的新请求
+	RequestHandler func(req *Request)
+
 	Transport interface {
 		Dial(addr string) (err error)
+		Listen(addr string) (err error)
 		Protocol() string
 		Conn() net.Conn
+		LocalAddr() net.Addr
 		Request() chan *Request
 		Do(ctx context.Context, req *Request, fun ProcessFunc) (err error)
+		Respond(res *Response) (err error)
+		Handle(handler RequestHandler, workers int)
+		OnOverload(handler RequestHandler)
+		SetTracer(tracer Tracer)
+		SetLogger(logger Logger)
 		Write(p []byte) (n int, err error)
+		WriteTo(p []byte, addr net.Addr) (n int, err error)
 		Close() (err error)
 	}
+
+	//baseTransport 各个传输层共用的消息分发和事物处理
+	baseTransport struct {
+		reqChan      chan *Request
+		transactions transactionStore
+		servers      serverTransactionStore
+		reliable     bool
+		clock        Clock
+		mutex        sync.RWMutex
+		handler      RequestHandler
+		overload     RequestHandler
+		workers      chan struct{}
+		pongs        pongTable
+		tracer       Tracer
+		logger       Logger
+	}
 )
+
+func (b *baseTransport) Request() chan *Request {
+	return b.reqChan
+}
+
+//dispatch 分发收到的消息, 并标记消息的来源地址, 重传的请求由服务端事物吸收
+func (b *baseTransport) dispatch(tp Transport, req *Request, res *Response, addr net.Addr) {
+	if res != nil {
+		res.RemoteAddr = addr
+		_ = b.transactions.notify(res)
+		return
+	}
+	req.RemoteAddr = addr
+	if via, ok := req.Header.Get(HeaderVia).(*ViaHeader); ok {
+		via.Stamp(addr)
+	}
+	if _, ok := b.servers.receive(req, b.reliable, b.clock, func(p []byte) (err error) {
+		_, err = tp.WriteTo(p, addr)
+		return
+	}); ok {
+		b.deliver(tp, req)
+	}
+}
+
+//Handle 设置请求的处理函数, 最多同时处理workers个请求, 为空时请求投递到Request()
+func (b *baseTransport) Handle(handler RequestHandler, workers int) {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handler = handler
+	b.workers = make(chan struct{}, workers)
+}
+
+//OnOverload 设置过载时的处理函数, 为空时回复503
+func (b *baseTransport) OnOverload(handler RequestHandler) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.overload = handler
+}
+
+//SetTracer 设置消息跟踪器, 为空时不跟踪
+func (b *baseTransport) SetTracer(tracer Tracer) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tracer = tracer
+}
+
+//SetLogger 设置日志, 为空时不输出日志
+func (b *baseTransport) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.logger = logger
+}
+
+func (b *baseTransport) getLogger() Logger {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.logger
+}
+
+func (b *baseTransport) getTracer() Tracer {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.tracer
+}
+
+//traceSend 跟踪发送的数据
+func (b *baseTransport) traceSend(tp Transport, p []byte, addr net.Addr, err error) {
+	if tracer := b.getTracer(); tracer != nil {
+		e := traceEvent(TraceSend, tp, p, addr)
+		e.Err = err
+		tracer.Trace(e)
+	}
+}
+
+//traceReceive 跟踪收到的消息, p为空时使用消息重新编码
+func (b *baseTransport) traceReceive(tp Transport, p []byte, req *Request, res *Response, addr net.Addr, err error) {
+	tracer := b.getTracer()
+	if tracer == nil {
+		return
+	}
+	if p == nil {
+		if req != nil {
+			p = req.Bytes()
+		} else if res != nil {
+			p = res.Bytes()
+		}
+	}
+	e := traceEvent(TraceReceive, tp, p, addr)
+	e.Request, e.Response, e.Err = req, res, err
+	tracer.Trace(e)
+}
+
+//deliver 投递新的请求, 处理函数繁忙或者通道已满时视为过载
+func (b *baseTransport) deliver(tp Transport, req *Request) {
+	b.mutex.RLock()
+	handler, overload, workers := b.handler, b.overload, b.workers
+	b.mutex.RUnlock()
+	if handler == nil {
+		select {
+		case b.reqChan <- req:
+			return
+		default:
+		}
+	} else {
+		select {
+		case workers <- struct{}{}:
+			go func() {
+				defer func() {
+					<-workers
+				}()
+				handler(req)
+			}()
+			return
+		default:
+		}
+	}
+	b.getLogger().Warn("request overloaded", FieldCallID, req.CallID(), FieldMethod, string(req.Method), FieldPeer, req.RemoteAddr)
+	if overload != nil {
+		overload(req)
+		return
+	}
+	if req.Method != MethodAck {
+		res := NewResponse(StatusServiceUnavailable, req)
+		res.Header.Set(HeaderRetryAfter, NewPlainHeader(DefaultRetryAfter))
+		_ = tp.Respond(res)
+	}
+}
+
+//respond 发送响应, 匹配到服务端事物时通过事物发送, 否则直接发送到响应的RemoteAddr
+func (b *baseTransport) respond(tp Transport, res *Response) (err error) {
+	if trans, ok := b.servers.lookup(res); ok {
+		if err = trans.Respond(res); err != ErrorTransactionTerminated {
+			return
+		}
+	}
+	if res.RemoteAddr == nil {
+		res.RemoteAddr = viaAddr(tp, res)
+	}
+	if res.RemoteAddr != nil {
+		_, err = tp.WriteTo(res.Bytes(), res.RemoteAddr)
+	} else {
+		_, err = tp.Write(res.Bytes())
+	}
+	return
+}
+
+//SetClock 设置事物使用的时钟
+func (b *baseTransport) SetClock(clock Clock) {
+	b.clock = clock
+}
+
+//do 创建客户端事物发送请求, 请求指定了RemoteAddr时发送到对应的对端
+func (b *baseTransport) do(ctx context.Context, tp Transport, req *Request, callback ProcessFunc) (err error) {
+	var (
+		trans *ClientTransaction
+	)
+	prepareVia(tp, req)
+	trans, err = newClientTransaction(req, b.reliable, b.clock, func(p []byte) (err error) {
+		if req.RemoteAddr != nil {
+			_, err = tp.WriteTo(p, req.RemoteAddr)
+		} else {
+			_, err = tp.Write(p)
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	trans.logger = b.getLogger()
+	trans.onTerminated = b.transactions.release
+	return b.transactions.do(ctx, trans, callback)
+}
+
+//prepareVia 请求没有Via时添加本地的Via, Via没有branch时生成新的branch
+func prepareVia(tp Transport, req *Request) {
+	via, ok := req.Header.Get(HeaderVia).(*ViaHeader)
+	if !ok {
+		host := "0.0.0.0"
+		if addr := tp.LocalAddr(); addr != nil {
+			host = addr.String()
+		}
+		//rport为空, 请求服务器在响应中返回来源端口(RFC 3581 3)
+		req.Header.Set(HeaderVia, &ViaHeader{Transport: tp.Protocol(), Uri: NewUri("", host, Map{"branch": NewBranch(), "rport": ""})})
+		return
+	}
+	if via.Uri == nil {
+		return
+	}
+	if via.Uri.Params.Get("branch") == "" {
+		via.Uri.Params.Set("branch", NewBranch())
+	}
+}
+
+//viaAddr 按照响应最上面的Via获取发送地址, Via没有received以及rport时返回空
+func viaAddr(tp Transport, res *Response) net.Addr {
+	via, ok := res.Header.Get(HeaderVia).(*ViaHeader)
+	if !ok {
+		return nil
+	}
+	addr, ok := via.PublicAddress()
+	if !ok {
+		return nil
+	}
+	if tp.Protocol() == ProtoUDP {
+		if udpAddr, err := net.ResolveUDPAddr("udp", addr); err == nil {
+			return udpAddr
+		}
+		return nil
+	}
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		return tcpAddr
+	}
+	return nil
+}
+
+//newBaseTransport reliable表示传输层是否可靠, 可靠的传输层不需要重传
+func newBaseTransport(reliable bool) baseTransport {
+	return baseTransport{reqChan: make(chan *Request, 100), reliable: reliable, clock: systemClock{}, logger: nopLogger{}}
+}
+
+//TransportOf 获取uri需要使用的传输协议, sips默认使用TLS
+func TransportOf(uri *Uri) string {
+	protocol := strings.ToUpper(uri.Params.Get("transport"))
+	if uri.IsEncrypted {
+		if protocol == ProtoWS || protocol == ProtoWSS {
+			return ProtoWSS
+		}
+		return ProtoTLS
+	}
+	if protocol != "" {
+		return protocol
+	}
+	return ProtoUDP
+}
+
+//defaultPort 协议的默认端口
+func defaultPort(protocol string) int {
+	switch protocol {
+	case ProtoTLS:
+		return DefaultTLSPort
+	case ProtoWS:
+		return 80
+	case ProtoWSS:
+		return 443
+	default:
+		return DefaultPort
+	}
+}
+
+//NewTransport 根据协议创建传输层
+func NewTransport(protocol string, config *tls.Config) (tp Transport, err error) {
+	switch strings.ToUpper(protocol) {
+	case ProtoUDP:
+		tp = NewUDPTransport()
+	case ProtoTCP:
+		tp = NewTCPTransport()
+	case ProtoTLS:
+		tp = NewTLSTransport(config)
+	case ProtoWS:
+		tp = NewWSTransport()
+	case ProtoWSS:
+		tp = NewWSSTransport(config)
+	default:
+		err = fmt.Errorf("unsupported transport %s", protocol)
+	}
+	return
+}
+
+//DialUri 根据uri自动选择传输协议并建立连接
+func DialUri(uri *Uri, config *tls.Config) (tp Transport, err error) {
+	protocol := TransportOf(uri)
+	if tp, err = NewTransport(protocol, config); err != nil {
+		return
+	}
+	port := uri.Port
+	if port == 0 {
+		port = defaultPort(protocol)
+	}
+	err = tp.Dial(net.JoinHostPort(uri.Host, strconv.Itoa(port)))
+	return
+}
+
+//readMessage 从reader中读取一个sip请求或者响应
+func readMessage(b *bufio.Reader) (req *Request, res *Response, err error) {
+	var p []byte
+	if p, err = b.Peek(3); err != nil {
+		return
+	}
+	if bytes.Equal(p, responseFeature) {
+		res, err = ReadResponse(b)
+	} else {
+		req, err = ReadRequest(b)
+	}
+	return
+}
+
+//parseMessage 解析一个完整的数据包
+func parseMessage(p []byte) (req *Request, res *Response, err error) {
+	bytesReader := pool.GetBytesReader(p)
+	bufioReader := pool.GetBufioReader(bytesReader)
+	req, res, err = readMessage(bufioReader)
+	pool.PutBytesReader(bytesReader)
+	pool.PutBufioReader(bufioReader)
+	return
+}
@@ -1,25 +1,44 @@
 package sip
 
 import (
-	"bytes"
 	"context"
-	"github.com/uole/sip/pool"
+	"errors"
 	"io"
-	"log"
 	"net"
 	"sync"
 	"time"
 )
 
+const (
+	//DefaultMTU 默认的路径MTU
+	DefaultMTU = 1500
+	//MaxDatagramSize udp消息的最大长度
+	MaxDatagramSize = 65535
+	//DefaultMTUMargin 请求大小和MTU的差值小于该值时改用TCP发送(RFC 3261 18.1.1)
+	DefaultMTUMargin = 200
+	//udpMinReadDelay 读取失败后第一次重试的间隔
+	udpMinReadDelay = time.Millisecond * 5
+	//udpMaxReadDelay 读取连续失败时重试的最大间隔
+	udpMaxReadDelay = time.Second
+)
+
 var (
-	responseFeature = []byte("SIP")
+	ErrorMessageTruncated  = errors.New("udp datagram truncated")
+	ErrorInvalidBufferSize = errors.New("invalid udp buffer size")
+	ErrorMissingVia        = errors.New("request via header missing")
 )
 
 type UDPTransport struct {
-	conn         *net.UDPConn
-	transMutex   sync.RWMutex
-	reqChan      chan *Request
-	transactions []*Transaction
+	baseTransport
+	conn       *net.UDPConn
+	connected  bool
+	mtu        int
+	mtuMargin  int
+	bufferSize int
+	mutex      sync.Mutex
+	stream     Transport
+	done       chan struct{}
+	closeOnce  sync.Once
 }
 
 func (tp *UDPTransport) Protocol() string {
@@ -30,56 +49,71 @@ func (tp *UDPTransport) Conn() net.Conn {
 	return tp.conn
 }
 
-func (tp *UDPTransport) Request() chan *Request {
-	return tp.reqChan
+func (tp *UDPTransport) LocalAddr() net.Addr {
+	if tp.conn == nil {
+		return nil
+	}
+	return tp.conn.LocalAddr()
 }
 
-//traceTransaction 提交一个事物
-func (tp *UDPTransport) traceTransaction(t *Transaction) {
-	tp.transMutex.RLock()
-	defer tp.transMutex.RUnlock()
-	if tp.transactions == nil {
-		tp.transactions = make([]*Transaction, 0)
+//Dial 新建立一个连接
+func (tp *UDPTransport) Dial(addr string) (err error) {
+	var udpAddr *net.UDPAddr
+	if udpAddr, err = net.ResolveUDPAddr("udp", addr); err != nil {
+		return
+	}
+	if tp.conn, err = net.DialUDP("udp", nil, udpAddr); err != nil {
+		return
 	}
-	tp.transactions = append(tp.transactions, t)
+	tp.connected = true
+	go tp.exchange()
+	return
 }
 
-//notifyTransaction 通知一个事物完成
-func (tp *UDPTransport) notifyTransaction(res *Response) (err error) {
-	tp.transMutex.Lock()
-	defer tp.transMutex.Unlock()
-	callID := res.CallID()
-	for _, trans := range tp.transactions {
-		if trans.ID == callID {
-			trans.notify(res)
-			break
-		}
+//Listen 监听指定的地址, 接收所有对端的消息
+func (tp *UDPTransport) Listen(addr string) (err error) {
+	var udpAddr *net.UDPAddr
+	if udpAddr, err = net.ResolveUDPAddr("udp", addr); err != nil {
+		return
+	}
+	if tp.conn, err = net.ListenUDP("udp", udpAddr); err != nil {
+		return
 	}
+	go tp.exchange()
 	return
 }
 
-//releaseTransaction 释放一个指定的事物
-func (tp *UDPTransport) releaseTransaction(trans *Transaction) {
-	tp.transMutex.Lock()
-	defer tp.transMutex.Unlock()
-	for i, v := range tp.transactions {
-		if trans.ID == v.ID {
-			tp.transactions = append(tp.transactions[:i], tp.transactions[i+1:]...)
-			return
-		}
+//SetMTU 设置路径MTU, 请求的大小在MTU的margin字节以内时改用TCP发送, mtu小于等于0时不切换
+func (tp *UDPTransport) SetMTU(mtu int) {
+	tp.mtu = mtu
+}
+
+//SetMTUMargin 设置改用TCP发送的阈值, 请求的大小超过MTU减去margin时改用TCP, margin小于0时使用DefaultMTUMargin
+func (tp *UDPTransport) SetMTUMargin(margin int) {
+	if margin < 0 {
+		margin = DefaultMTUMargin
 	}
+	tp.mtuMargin = margin
 }
 
-//Dial 新建立一个连接
-func (tp *UDPTransport) Dial(addr string) (err error) {
-	var udpAddr *net.UDPAddr
-	if udpAddr, err = net.ResolveUDPAddr("udp", addr); err != nil {
-		return
+//SetBufferSize 设置接收缓冲区的大小, 需要在Dial或者Listen之前调用, 超过缓冲区的消息会被丢弃
+func (tp *UDPTransport) SetBufferSize(size int) (err error) {
+	if size < DefaultMTUMargin || size > MaxDatagramSize {
+		return ErrorInvalidBufferSize
 	}
-	if tp.conn, err = net.DialUDP("udp", nil, udpAddr); err != nil {
+	tp.bufferSize = size
+	return
+}
+
+//readDatagram 读取一个udp消息, 消息超过缓冲区时返回ErrorMessageTruncated
+//缓冲区比size多一个字节用于判断消息是否被截断. 默认的size为MaxDatagramSize, 大于udp负载的上限(65507), 这时消息不会被截断
+func readDatagram(conn *net.UDPConn, buf []byte, size int) (n int, addr *net.UDPAddr, err error) {
+	if n, addr, err = conn.ReadFromUDP(buf); err != nil {
 		return
 	}
-	go tp.exchange()
+	if n > size {
+		err = ErrorMessageTruncated
+	}
 	return
 }
 
@@ -89,86 +123,197 @@ func (tp *UDPTransport) exchange() {
 		n          int
 		err        error
 		buf        []byte
-		p          []byte
 		res        *Response
 		req        *Request
-		addr       *net.UDPAddr
-		isResponse bool
+		remoteAddr *net.UDPAddr
 	)
-	buf = make([]byte, 1024*10)
+	buf = make([]byte, tp.bufferSize+1)
+	delay := time.Duration(0)
 	for {
-		if n, err = tp.conn.Read(buf); err != nil {
+		if n, remoteAddr, err = readDatagram(tp.conn, buf, tp.bufferSize); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err == ErrorMessageTruncated {
+				tp.getLogger().Warn("read datagram failed", FieldPeer, remoteAddr.String(), FieldError, err)
+				continue
+			}
+			//其他错误可能一直出现, 退避之后重试, 传输层关闭时退出
+			if delay == 0 {
+				delay = udpMinReadDelay
+			} else if delay *= 2; delay > udpMaxReadDelay {
+				delay = udpMaxReadDelay
+			}
+			tp.getLogger().Warn("read datagram failed", FieldError, err, "delay", delay)
+			select {
+			case <-tp.done:
+				return
+			case <-time.After(delay):
+			}
 			continue
 		}
-		if n < 3 {
+		delay = 0
+		if IsSTUN(buf[:n]) {
+			tp.receiveSTUN(buf[:n], remoteAddr)
 			continue
 		}
-		p = buf[:n]
-		//parse the body
-		bytesReader := pool.GetBytesReader(buf[:n])
-		bufioReader := pool.GetBufioReader(bytesReader)
-		if bytes.Compare(p[:3], responseFeature) == 0 {
-			res, err = ReadResponse(bufioReader)
-			isResponse = true
-		} else {
-			req, err = ReadRequest(bufioReader)
-			isResponse = false
+		if n < 3 || isKeepAlive(buf[:n]) {
+			continue
 		}
-		pool.PutBytesReader(bytesReader)
-		pool.PutBufioReader(bufioReader)
-		//parse failed
+		//parse the body
+		req, res, err = parseMessage(buf[:n])
+		tp.traceReceive(tp, buf[:n], req, res, remoteAddr, err)
 		if err != nil {
-			log.Printf("parse buffer from %s: %s error: %s", addr.String(), string(p), err.Error())
+			tp.getLogger().Warn("parse message failed", FieldPeer, remoteAddr.String(), FieldError, err, "message", string(buf[:n]))
 			continue
 		}
-		if isResponse {
-			err = tp.notifyTransaction(res)
-		} else {
-			select {
-			case tp.reqChan <- req:
-			case <-time.After(time.Millisecond * 200):
-				log.Printf("put %s request timeout", req.Method)
-			}
-		}
+		tp.dispatch(tp, req, res, remoteAddr)
 	}
 }
 
 func (tp *UDPTransport) Write(p []byte) (n int, err error) {
-	if tp.conn != nil {
-		return tp.conn.Write(p)
+	var addr net.Addr
+	if tp.conn != nil && tp.connected {
+		addr = tp.conn.RemoteAddr()
+		n, err = tp.conn.Write(p)
 	} else {
 		err = io.ErrClosedPipe
 	}
+	tp.traceSend(tp, p, addr, err)
 	return
 }
 
-func (tp *UDPTransport) Do(ctx context.Context, req *Request, callback ProcessFunc) (err error) {
+//WriteTo 发送数据到指定的对端
+func (tp *UDPTransport) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = tp.writeTo(p, addr)
+	tp.traceSend(tp, p, addr, err)
+	return
+}
+
+func (tp *UDPTransport) writeTo(p []byte, addr net.Addr) (n int, err error) {
 	var (
-		ok    bool
-		res   *Response
-		trans *Transaction
+		ok      bool
+		udpAddr *net.UDPAddr
 	)
-	if _, err = tp.conn.Write(req.Bytes()); err != nil {
+	if tp.conn == nil {
+		err = io.ErrClosedPipe
 		return
 	}
-	trans = newTransaction(req.CallID())
-	tp.traceTransaction(trans)
-	defer tp.releaseTransaction(trans)
-	for {
-		select {
-		case res = <-trans.Chan():
-			ok, err = callback(res)
-			if ok || err != nil {
-				return
-			}
-		case <-ctx.Done():
-			err = ctx.Err()
+	//已经建立连接的socket只能发送到连接的地址
+	if tp.connected {
+		if addr.String() != tp.conn.RemoteAddr().String() {
+			err = ErrorPeerNotFound
+			return
+		}
+		return tp.conn.Write(p)
+	}
+	if udpAddr, ok = addr.(*net.UDPAddr); !ok {
+		if udpAddr, err = net.ResolveUDPAddr("udp", addr.String()); err != nil {
 			return
 		}
 	}
+	return tp.conn.WriteToUDP(p, udpAddr)
+}
+
+//receiveSTUN 回复STUN绑定请求, 通知绑定响应的等待者
+func (tp *UDPTransport) receiveSTUN(p []byte, addr *net.UDPAddr) {
+	m, err := parseSTUN(p)
+	if err != nil {
+		return
+	}
+	switch m.Type {
+	case stunBindingRequest:
+		res := &stunMessage{Type: stunBindingSuccess, Transaction: m.Transaction, Mapped: addr}
+		_, _ = tp.WriteTo(res.Bytes(), addr)
+	case stunBindingSuccess:
+		var mapped net.Addr
+		if m.Mapped != nil {
+			mapped = m.Mapped
+		}
+		tp.pongs.notify(string(m.Transaction[:]), mapped)
+	}
+}
+
+//Ping 发送STUN绑定请求保活, 返回对端看到的本地地址
+func (tp *UDPTransport) Ping(ctx context.Context, addr net.Addr) (mapped net.Addr, err error) {
+	req := newSTUNRequest()
+	key := string(req.Transaction[:])
+	c := tp.pongs.wait(key)
+	if addr != nil {
+		_, err = tp.WriteTo(req.Bytes(), addr)
+	} else {
+		_, err = tp.Write(req.Bytes())
+	}
+	if err != nil {
+		tp.pongs.cancel(key)
+		return
+	}
+	return tp.pongs.await(ctx, key, c)
+}
+
+//oversized 请求的大小是否接近MTU, 需要在添加Via之后判断
+func (tp *UDPTransport) oversized(req *Request) bool {
+	return tp.mtu > 0 && len(req.Bytes()) > tp.mtu-tp.mtuMargin
+}
+
+//streamTransport 发送大请求使用的TCP传输层, 按照对端地址建立连接
+func (tp *UDPTransport) streamTransport() Transport {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	if tp.stream == nil {
+		tp.stream = NewTCPTransport()
+		tp.stream.SetTracer(tp.getTracer())
+		tp.stream.SetLogger(tp.getLogger())
+	}
+	return tp.stream
+}
+
+//Do 发送请求, 请求的大小接近MTU时改用TCP发送到相同的地址, 连接建立失败时仍然使用UDP
+func (tp *UDPTransport) Do(ctx context.Context, req *Request, callback ProcessFunc) (err error) {
+	prepareVia(tp, req)
+	if !tp.oversized(req) {
+		return tp.do(ctx, tp, req, callback)
+	}
+	remoteAddr := req.RemoteAddr
+	if remoteAddr == nil && tp.connected {
+		remoteAddr = tp.conn.RemoteAddr()
+	}
+	if remoteAddr == nil {
+		return tp.do(ctx, tp, req, callback)
+	}
+	via, ok := req.Header.Get(HeaderVia).(*ViaHeader)
+	if !ok {
+		err = ErrorMissingVia
+		return
+	}
+	if req.RemoteAddr, err = net.ResolveTCPAddr("tcp", remoteAddr.String()); err != nil {
+		return
+	}
+	via.Transport = ProtoTCP
+	if err = tp.streamTransport().Do(ctx, req, callback); err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			via.Transport = ProtoUDP
+			req.RemoteAddr = remoteAddr
+			return tp.do(ctx, tp, req, callback)
+		}
+	}
+	return
+}
+
+func (tp *UDPTransport) Respond(res *Response) (err error) {
+	return tp.respond(tp, res)
 }
 
 func (tp *UDPTransport) Close() (err error) {
+	tp.closeOnce.Do(func() {
+		close(tp.done)
+	})
+	tp.mutex.Lock()
+	if tp.stream != nil {
+		_ = tp.stream.Close()
+	}
+	tp.mutex.Unlock()
 	if tp.conn != nil {
 		err = tp.conn.Close()
 	}
@@ -176,5 +321,5 @@ func (tp *UDPTransport) Close() (err error) {
 }
 
 func NewUDPTransport() Transport {
-	return &UDPTransport{reqChan: make(chan *Request, 100)}
+	return &UDPTransport{baseTransport: newBaseTransport(false), mtu: DefaultMTU, mtuMargin: DefaultMTUMargin, bufferSize: MaxDatagramSize, done: make(chan struct{})}
 }
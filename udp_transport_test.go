@@ -0,0 +1,259 @@
+package sip
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//serveEcho 对收到的请求回复200
+func serveEcho(t *testing.T, tp Transport) {
+	for req := range tp.Request() {
+		if req.RemoteAddr == nil {
+			t.Error("request without remote address")
+			continue
+		}
+		res := NewResponse(StatusOK, req)
+		if _, err := tp.WriteTo(res.Bytes(), req.RemoteAddr); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func testListen(t *testing.T, server Transport, newClient func() Transport) {
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go serveEcho(t, server)
+	for _, callID := range []string{"peer-1", "peer-2", "peer-3"} {
+		client := newClient()
+		if err := client.Dial(server.LocalAddr().String()); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		err := client.Do(ctx, newTestRequest(MethodRegister, callID), func(res *Response) (bool, error) {
+			if res.RemoteAddr == nil || res.RemoteAddr.String() != server.LocalAddr().String() {
+				t.Errorf("unexpected response source %v", res.RemoteAddr)
+			}
+			return true, nil
+		})
+		cancel()
+		_ = client.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", callID, err)
+		}
+	}
+}
+
+func TestUDPTransport_Listen(t *testing.T) {
+	testListen(t, NewUDPTransport(), NewUDPTransport)
+}
+
+func TestUDPTransport_Handle(t *testing.T) {
+	server := NewUDPTransport()
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	received := make(chan *Request, 1)
+	release := make(chan struct{})
+	server.Handle(func(req *Request) {
+		received <- req
+		<-release
+		_ = server.Respond(NewResponse(StatusOK, req))
+	}, 1)
+	client := NewUDPTransport()
+	if err := client.Dial(server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	do := func(callID string) (res *Response) {
+		if err := client.Do(ctx, newTestRequest(MethodOptions, callID), func(r *Response) (bool, error) {
+			res = r
+			return r.StatusCode >= 200, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	done := make(chan *Response, 1)
+	go func() {
+		done <- do("handle-1")
+	}()
+	<-received
+	//唯一的处理协程繁忙, 新的请求回复503
+	res := do("handle-2")
+	if res.StatusCode != StatusServiceUnavailable || res.Header.Get(HeaderRetryAfter).String() != "5" {
+		t.Errorf("unexpected response %d", res.StatusCode)
+	}
+	close(release)
+	if res = <-done; res.StatusCode != StatusOK {
+		t.Errorf("unexpected response %d", res.StatusCode)
+	}
+
+	overloaded := make(chan *Request, 1)
+	server.Handle(nil, 0)
+	server.OnOverload(func(req *Request) {
+		overloaded <- req
+	})
+	for i := 0; i < cap(server.Request())+1; i++ {
+		req := newTestRequest(MethodMessage, "overload-"+strconv.Itoa(i))
+		if _, err := client.Write(req.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case req := <-overloaded:
+		if req.CallID() != "overload-"+strconv.Itoa(cap(server.Request())) {
+			t.Errorf("unexpected request %s", req.CallID())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("overload not reported")
+	}
+}
+
+func TestUDPTransport_StreamFailover(t *testing.T) {
+	server := NewUDPTransport()
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go serveEcho(t, server)
+	stream := NewTCPTransport()
+	if err := stream.Listen(server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	received := make(chan *Request, 1)
+	stream.Handle(func(req *Request) {
+		received <- req
+		_ = stream.Respond(NewResponse(StatusOK, req))
+	}, 0)
+
+	client := NewUDPTransport()
+	client.(*UDPTransport).SetMTU(800)
+	if err := client.Dial(server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	ok := func(res *Response) (bool, error) {
+		return res.StatusCode >= 200, nil
+	}
+	if err := client.Do(ctx, newTestRequest(MethodOptions, "failover-small"), ok); err != nil {
+		t.Fatal(err)
+	}
+	req := newTestRequest(MethodMessage, "failover-large")
+	req.Body = make([]byte, 700)
+	if err := client.Do(ctx, req, ok); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case req = <-received:
+		if via := req.Header.Get(HeaderVia).(*ViaHeader); via.Transport != ProtoTCP || len(req.Body) != 700 {
+			t.Errorf("unexpected via %s", via.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("large request not sent over tcp")
+	}
+	//tcp连接失败时使用udp重新发送
+	_ = stream.Close()
+	client = NewUDPTransport()
+	client.(*UDPTransport).SetMTU(800)
+	if err := client.Dial(server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	req = newTestRequest(MethodMessage, "failover-refused")
+	req.Body = make([]byte, 700)
+	if err := client.Do(ctx, req, ok); err != nil {
+		t.Fatal(err)
+	}
+	if via := req.Header.Get(HeaderVia).(*ViaHeader); via.Transport != ProtoUDP {
+		t.Errorf("unexpected via %s", via.String())
+	}
+}
+
+func TestUDPTransport_oversized(t *testing.T) {
+	tp := NewUDPTransport().(*UDPTransport)
+	tp.SetMTU(1000)
+	req := newTestRequest(MethodMessage, "oversized")
+	req.Body = make([]byte, 850-len(req.Bytes()))
+	if !tp.oversized(req) {
+		t.Error("request within the default margin not switched")
+	}
+	tp.SetMTUMargin(100)
+	if tp.oversized(req) {
+		t.Error("request outside the margin switched")
+	}
+	tp.SetMTUMargin(-1)
+	if tp.mtuMargin != DefaultMTUMargin {
+		t.Errorf("unexpected margin %d", tp.mtuMargin)
+	}
+}
+
+func TestUDPTransport_readError(t *testing.T) {
+	tp := NewUDPTransport().(*UDPTransport)
+	logger := &recordLogger{}
+	tp.SetLogger(logger)
+	if err := tp.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	//过期的读取期限让每次读取都失败
+	_ = tp.conn.SetReadDeadline(time.Now())
+	time.Sleep(time.Millisecond * 200)
+	_ = tp.Close()
+	if n := len(logger.Entries()); n == 0 || n > 10 {
+		t.Errorf("unexpected read failures %d", n)
+	}
+	n := len(logger.Entries())
+	time.Sleep(time.Millisecond * 200)
+	if len(logger.Entries()) != n {
+		t.Error("read loop not stopped after close")
+	}
+}
+
+func Test_readDatagram(t *testing.T) {
+	if err := NewUDPTransport().(*UDPTransport).SetBufferSize(100); err != ErrorInvalidBufferSize {
+		t.Errorf("unexpected error %v", err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	buf := make([]byte, 513)
+	for _, size := range []int{512, 600} {
+		if _, err = sender.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := readDatagram(conn, buf, 512)
+		if size > 512 && err != ErrorMessageTruncated {
+			t.Errorf("truncated datagram accepted")
+		}
+		if size <= 512 && (err != nil || n != size) {
+			t.Errorf("unexpected read %d %v", n, err)
+		}
+	}
+	//默认的缓冲区可以接收最大的udp消息
+	tp := NewUDPTransport().(*UDPTransport)
+	buf = make([]byte, tp.bufferSize+1)
+	if _, err = sender.Write(make([]byte, 65507)); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := readDatagram(conn, buf, tp.bufferSize); err != nil || n != 65507 {
+		t.Errorf("unexpected read %d %v", n, err)
+	}
+}
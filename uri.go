@@ -214,6 +214,11 @@ func parseMap(s string) (m Map, err error) {
 	return
 }
 
+//ParseUri 从字符串解析sip uri
+func ParseUri(s string) (uri *Uri, err error) {
+	return parseUri(s)
+}
+
 //parseUri parse uri from string
 func parseUri(s string) (uri *Uri, err error) {
 	var (
@@ -226,12 +231,15 @@ func parseUri(s string) (uri *Uri, err error) {
 	uri = &Uri{}
 	p = s
 	//sip or sips
-	if pos = strings.Index(p, ":"); pos > -1 && pos < 4 {
-		uri.HasProtocol = true
-		if strings.ToLower(p[:pos]) == "sips" {
+	if pos = strings.Index(p, ":"); pos > -1 && pos <= 4 {
+		switch strings.ToLower(p[:pos]) {
+		case "sips":
 			uri.IsEncrypted = true
+			fallthrough
+		case "sip":
+			uri.HasProtocol = true
+			p = p[pos+1:]
 		}
-		p = p[pos+1:]
 	}
 	if pos = strings.Index(p, "@"); pos != -1 {
 		if endOfUserPos = strings.Index(p[:pos], ":"); endOfUserPos == -1 {
@@ -247,7 +255,17 @@ func parseUri(s string) (uri *Uri, err error) {
 	} else {
 		netAddrStr = p[:pos]
 	}
-	if netSplitPos = strings.Index(netAddrStr, ":"); netSplitPos == -1 {
+	//IPv6地址带有方括号, 端口在方括号之后
+	if strings.HasPrefix(netAddrStr, "[") {
+		if pos := strings.Index(netAddrStr, "]"); pos > -1 {
+			uri.Host = netAddrStr[:pos+1]
+			if strings.HasPrefix(netAddrStr[pos+1:], ":") {
+				uri.Port, _ = strconv.Atoi(netAddrStr[pos+2:])
+			}
+		} else {
+			uri.Host = netAddrStr
+		}
+	} else if netSplitPos = strings.Index(netAddrStr, ":"); netSplitPos == -1 {
 		uri.Host = netAddrStr
 	} else {
 		uri.Host = netAddrStr[:netSplitPos]
@@ -268,3 +286,17 @@ func parseUri(s string) (uri *Uri, err error) {
 	}
 	return
 }
+
+//matchUri 比较两个uri的用户, 主机以及端口是否相同, 没有端口时使用传输协议的默认端口
+func matchUri(a *Uri, b *Uri) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	port := func(uri *Uri) int {
+		if uri.Port != 0 {
+			return uri.Port
+		}
+		return defaultPort(TransportOf(uri))
+	}
+	return a.User == b.User && strings.EqualFold(a.Host, b.Host) && port(a) == port(b)
+}
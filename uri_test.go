@@ -20,3 +20,33 @@ func Test_parseUri(t *testing.T) {
 		fmt.Println(uri)
 	}
 }
+
+func Test_parseUriIPv6(t *testing.T) {
+	uri, err := parseUri("sip:1000@[2001:db8::1]:5070;transport=udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Host != "[2001:db8::1]" || uri.Port != 5070 || uri.String() != "sip:1000@[2001:db8::1]:5070;transport=udp" {
+		t.Errorf("unexpected uri %s %s %d", uri.String(), uri.Host, uri.Port)
+	}
+}
+
+func Test_matchUri(t *testing.T) {
+	for _, c := range []struct {
+		a, b  string
+		match bool
+	}{
+		{"sip:1000@example.com", "sip:1000@EXAMPLE.com:5060", true},
+		{"sips:1000@example.com", "sips:1000@example.com:5061", true},
+		{"sip:1000@example.com;transport=ws", "sip:1000@example.com:80;transport=ws", true},
+		{"sips:1000@example.com;transport=wss", "sips:1000@example.com:443;transport=wss", true},
+		{"sip:1000@example.com;transport=ws", "sip:1000@example.com:5060;transport=ws", false},
+		{"sip:1000@example.com", "sip:1001@example.com", false},
+	} {
+		a, _ := parseUri(c.a)
+		b, _ := parseUri(c.b)
+		if matchUri(a, b) != c.match {
+			t.Errorf("match %s %s expected %v", c.a, c.b, c.match)
+		}
+	}
+}
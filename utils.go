@@ -1,9 +1,51 @@
 package sip
 
-import "crypto/md5"
+import (
+	"crypto/md5"
+	"errors"
+	"net"
+	"strconv"
+)
+
+var (
+	ErrorInvalidAddress = errors.New("invalid address")
+)
 
 func MD5(b []byte) []byte {
 	hash := md5.New()
 	hash.Write(b)
 	return hash.Sum(nil)
 }
+
+//SplitAddr 获取地址的IP以及端口, 地址为空或者没有IP时使用未指定的IPv4地址
+func SplitAddr(addr net.Addr) (ip net.IP, port int, err error) {
+	switch v := addr.(type) {
+	case nil:
+	case *net.UDPAddr:
+		if v != nil {
+			ip, port = v.IP, v.Port
+		}
+	case *net.TCPAddr:
+		if v != nil {
+			ip, port = v.IP, v.Port
+		}
+	default:
+		var host, s string
+		if host, s, err = net.SplitHostPort(addr.String()); err != nil {
+			return
+		}
+		if ip = net.ParseIP(host); ip == nil {
+			err = ErrorInvalidAddress
+			return
+		}
+		port, _ = strconv.Atoi(s)
+	}
+	if ip == nil {
+		//IP为空的地址表示监听所有地址
+		ip = net.IPv4zero
+	}
+	if ip.To4() == nil && ip.To16() == nil {
+		err = ErrorInvalidAddress
+	}
+	return
+}
@@ -0,0 +1,260 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+
+	//关闭帧的状态码
+	CloseNormal        = 1000
+	CloseProtocolError = 1002
+	CloseTooLarge      = 1009
+
+	//MaxMessageSize 单个消息的最大长度
+	MaxMessageSize = 1024 * 1024
+)
+
+var (
+	ErrorMessageTooLarge = errors.New("websocket message too large")
+	ErrorProtocol        = errors.New("websocket protocol error")
+)
+
+//Conn websocket连接
+type Conn struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	client      bool
+	subprotocol string
+	writeMutex  sync.Mutex
+	closeOnce   sync.Once
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+//NetConn 底层的网络连接
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+//Subprotocol 协商的子协议
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+//readFrame 读取一个数据帧
+func (c *Conn) readFrame() (fin bool, op int, p []byte, err error) {
+	var (
+		head   [2]byte
+		ext    [8]byte
+		mask   [4]byte
+		length uint64
+	)
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	op = int(head[0] & 0x0f)
+	masked := head[1]&0x80 != 0
+	length = uint64(head[1] & 0x7f)
+	//客户端发送的帧必须掩码, 服务端发送的帧不能掩码(RFC 6455 5.1)
+	if masked == c.client {
+		err = ErrorProtocol
+		return
+	}
+	//控制帧不能分片, 长度不能超过125
+	if op >= OpClose && (!fin || length > 125) {
+		err = ErrorProtocol
+		return
+	}
+	switch length {
+	case 126:
+		if _, err = io.ReadFull(c.br, ext[:2]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:2]))
+	case 127:
+		if _, err = io.ReadFull(c.br, ext[:8]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:8])
+	}
+	if length > MaxMessageSize {
+		err = ErrorMessageTooLarge
+		return
+	}
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return
+		}
+	}
+	p = make([]byte, length)
+	if _, err = io.ReadFull(c.br, p); err != nil {
+		return
+	}
+	if masked {
+		maskBytes(mask, p)
+	}
+	return
+}
+
+//ReadMessage 读取一个完整的文本或者二进制消息, 控制帧在内部处理, 对端违反协议时关闭连接
+func (c *Conn) ReadMessage() (op int, p []byte, err error) {
+	if op, p, err = c.readMessage(); err == ErrorProtocol {
+		_ = c.close(CloseProtocolError)
+	} else if err == ErrorMessageTooLarge {
+		_ = c.close(CloseTooLarge)
+	}
+	return
+}
+
+func (c *Conn) readMessage() (op int, p []byte, err error) {
+	var (
+		fin     bool
+		frameOp int
+		frame   []byte
+	)
+	for {
+		if fin, frameOp, frame, err = c.readFrame(); err != nil {
+			return
+		}
+		switch frameOp {
+		case OpPing:
+			if err = c.writeFrame(OpPong, frame); err != nil {
+				return
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			_ = c.writeFrame(OpClose, frame)
+			err = io.EOF
+			return
+		case OpText, OpBinary:
+			if op != 0 {
+				err = ErrorProtocol
+				return
+			}
+			op = frameOp
+			p = frame
+		case OpContinuation:
+			if op == 0 {
+				err = ErrorProtocol
+				return
+			}
+			if len(p)+len(frame) > MaxMessageSize {
+				err = ErrorMessageTooLarge
+				return
+			}
+			p = append(p, frame...)
+		default:
+			err = ErrorProtocol
+			return
+		}
+		if fin {
+			return
+		}
+	}
+}
+
+//writeFrame 写入一个数据帧, 客户端需要对数据进行掩码处理
+func (c *Conn) writeFrame(op int, p []byte) (err error) {
+	var (
+		mask [4]byte
+		n    int
+	)
+	buf := make([]byte, 14+len(p))
+	buf[0] = 0x80 | byte(op)
+	length := len(p)
+	switch {
+	case length < 126:
+		buf[1] = byte(length)
+		n = 2
+	case length <= 0xffff:
+		buf[1] = 126
+		binary.BigEndian.PutUint16(buf[2:4], uint16(length))
+		n = 4
+	default:
+		buf[1] = 127
+		binary.BigEndian.PutUint64(buf[2:10], uint64(length))
+		n = 10
+	}
+	if c.client {
+		buf[1] |= 0x80
+		_, _ = rand.Read(mask[:])
+		copy(buf[n:], mask[:])
+		n += 4
+	}
+	copy(buf[n:], p)
+	if c.client {
+		maskBytes(mask, buf[n:n+length])
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err = c.conn.Write(buf[:n+length])
+	return
+}
+
+//WriteMessage 写入一个完整的消息
+func (c *Conn) WriteMessage(op int, p []byte) (err error) {
+	return c.writeFrame(op, p)
+}
+
+//Ping 发送ping帧
+func (c *Conn) Ping(p []byte) (err error) {
+	return c.writeFrame(OpPing, p)
+}
+
+//Close 发送关闭帧并关闭连接
+func (c *Conn) Close() (err error) {
+	return c.close(CloseNormal)
+}
+
+//close 发送指定状态码的关闭帧并关闭连接
+func (c *Conn) close(code uint16) (err error) {
+	c.closeOnce.Do(func() {
+		var p [2]byte
+		binary.BigEndian.PutUint16(p[:], code)
+		_ = c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = c.writeFrame(OpClose, p[:])
+		err = c.conn.Close()
+	})
+	return
+}
+
+func maskBytes(mask [4]byte, p []byte) {
+	for i := range p {
+		p[i] ^= mask[i%4]
+	}
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool, subprotocol string) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	return &Conn{
+		conn:        conn,
+		br:          br,
+		client:      client,
+		subprotocol: subprotocol,
+	}
+}
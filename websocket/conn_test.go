@@ -0,0 +1,165 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//newFrame 创建一个数据帧, mask不为空时对数据进行掩码
+func newFrame(fin bool, op int, p []byte, mask []byte) []byte {
+	var buf bytes.Buffer
+	b := byte(op)
+	if fin {
+		b |= 0x80
+	}
+	buf.WriteByte(b)
+	var l byte
+	if mask != nil {
+		l = 0x80
+	}
+	switch {
+	case len(p) < 126:
+		buf.WriteByte(l | byte(len(p)))
+	default:
+		buf.WriteByte(l | 126)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(p)))
+	}
+	if mask != nil {
+		var m [4]byte
+		copy(m[:], mask)
+		buf.Write(m[:])
+		q := append([]byte{}, p...)
+		maskBytes(m, q)
+		buf.Write(q)
+	} else {
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
+
+//newPipe 返回服务端的websocket连接以及客户端的原始连接
+func newPipe(t *testing.T) (*Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newConn(conn, nil, false, ""), raw
+}
+
+//readFrame 从原始连接上读取一个服务端发送的帧
+func readFrame(t *testing.T, raw net.Conn) (op int, p []byte) {
+	c := newConn(raw, nil, true, "")
+	_ = raw.SetReadDeadline(time.Now().Add(time.Second))
+	_, op, p, err := c.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestConn_masking(t *testing.T) {
+	p := bytes.Repeat([]byte("REGISTER sip:example.com SIP/2.0\r\n"), 8)
+	server, raw := newPipe(t)
+	defer server.Close()
+	client := newConn(raw, nil, true, "")
+	defer client.Close()
+
+	//客户端写入的帧需要掩码
+	if err := client.WriteMessage(OpText, p); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(p)+8)
+	_ = server.NetConn().SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(server.NetConn(), buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[1]&0x80 == 0 || bytes.Contains(buf, p[:8]) {
+		t.Errorf("client frame not masked %x", buf[:16])
+	}
+	_, _ = raw.Write(newFrame(true, OpBinary, p, []byte{0x12, 0x34, 0x56, 0x78}))
+	if op, q, err := server.ReadMessage(); err != nil || op != OpBinary || !bytes.Equal(q, p) {
+		t.Errorf("unexpected message %d %q %v", op, q, err)
+	}
+
+	//服务端写入的帧不能掩码
+	if err := server.WriteMessage(OpText, []byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if op, q, err := client.ReadMessage(); err != nil || op != OpText || string(q) != "pong" {
+		t.Errorf("unexpected message %d %q %v", op, q, err)
+	}
+}
+
+func TestConn_unmaskedFrame(t *testing.T) {
+	conn, raw := newPipe(t)
+	defer raw.Close()
+	_, _ = raw.Write(newFrame(true, OpText, []byte("OPTIONS"), nil))
+	if _, _, err := conn.ReadMessage(); err != ErrorProtocol {
+		t.Fatalf("unexpected error %v", err)
+	}
+	//服务端发送协议错误的关闭帧并断开连接
+	if op, p := readFrame(t, raw); op != OpClose || binary.BigEndian.Uint16(p) != CloseProtocolError {
+		t.Errorf("unexpected close frame %d %x", op, p)
+	}
+	_ = raw.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := raw.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection not closed: %v", err)
+	}
+}
+
+func TestConn_fragmentation(t *testing.T) {
+	conn, raw := newPipe(t)
+	defer conn.Close()
+	defer raw.Close()
+	mask := []byte{1, 2, 3, 4}
+	go func() {
+		_, _ = raw.Write(newFrame(false, OpText, []byte("INVITE "), mask))
+		//分片之间可以插入控制帧
+		_, _ = raw.Write(newFrame(true, OpPing, []byte("hb"), mask))
+		_, _ = raw.Write(newFrame(false, OpContinuation, []byte("sip:1001"), mask))
+		_, _ = raw.Write(newFrame(true, OpContinuation, []byte("@example.com"), mask))
+	}()
+	op, p, err := conn.ReadMessage()
+	if err != nil || op != OpText || string(p) != "INVITE sip:1001@example.com" {
+		t.Fatalf("unexpected message %d %q %v", op, p, err)
+	}
+	if op, p := readFrame(t, raw); op != OpPong || string(p) != "hb" {
+		t.Errorf("unexpected pong %d %q", op, p)
+	}
+}
+
+func TestConn_controlFrames(t *testing.T) {
+	conn, raw := newPipe(t)
+	defer raw.Close()
+	mask := []byte{5, 6, 7, 8}
+	_, _ = raw.Write(newFrame(true, OpPong, nil, mask))
+	_, _ = raw.Write(newFrame(true, OpClose, []byte{0x03, 0xe8}, mask))
+	if _, _, err := conn.ReadMessage(); err != io.EOF {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if op, p := readFrame(t, raw); op != OpClose || binary.BigEndian.Uint16(p) != CloseNormal {
+		t.Errorf("unexpected close frame %d %x", op, p)
+	}
+	_ = conn.Close()
+
+	//分片的控制帧违反协议
+	conn, raw2 := newPipe(t)
+	defer raw2.Close()
+	_, _ = raw2.Write(newFrame(false, OpPing, []byte("x"), mask))
+	if _, _, err := conn.ReadMessage(); err != ErrorProtocol {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	acceptGUID  = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	dialTimeout = time.Second * 5
+)
+
+var (
+	ErrorBadHandshake = errors.New("websocket bad handshake")
+)
+
+//acceptKey 计算Sec-WebSocket-Accept
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, s := range h.Values(name) {
+		for _, v := range strings.Split(s, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Dial 连接websocket服务, rawurl格式为ws://host:port/path或者wss://host:port/path
+func Dial(rawurl string, subprotocol string, config *tls.Config) (c *Conn, err error) {
+	var (
+		u    *url.URL
+		conn net.Conn
+		res  *http.Response
+		host string
+	)
+	if u, err = url.Parse(rawurl); err != nil {
+		return
+	}
+	host = u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", host)
+	case "wss":
+		cfg := &tls.Config{}
+		if config != nil {
+			cfg = config.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, cfg)
+	default:
+		err = fmt.Errorf("unsupported websocket scheme %s", u.Scheme)
+	}
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if subprotocol != "" {
+		req.Header.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return
+	}
+	br := bufio.NewReader(conn)
+	if res, err = http.ReadResponse(br, req); err != nil {
+		_ = conn.Close()
+		return
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(res.Header.Get("Upgrade"), "websocket") ||
+		res.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		_ = conn.Close()
+		err = ErrorBadHandshake
+		return
+	}
+	if subprotocol != "" && res.Header.Get("Sec-WebSocket-Protocol") != subprotocol {
+		_ = conn.Close()
+		err = fmt.Errorf("websocket subprotocol %s not accepted", subprotocol)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	c = newConn(conn, br, true, res.Header.Get("Sec-WebSocket-Protocol"))
+	return
+}
+
+//Upgrade 将http请求升级为websocket连接, subprotocols不为空时必须协商成功
+func Upgrade(w http.ResponseWriter, r *http.Request, subprotocols []string) (c *Conn, err error) {
+	var (
+		conn        net.Conn
+		brw         *bufio.ReadWriter
+		subprotocol string
+	)
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.Error(w, "bad websocket handshake", http.StatusBadRequest)
+		err = ErrorBadHandshake
+		return
+	}
+	for _, s := range subprotocols {
+		if headerContains(r.Header, "Sec-WebSocket-Protocol", s) {
+			subprotocol = s
+			break
+		}
+	}
+	if len(subprotocols) > 0 && subprotocol == "" {
+		http.Error(w, "unsupported websocket subprotocol", http.StatusBadRequest)
+		err = ErrorBadHandshake
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		err = errors.New("websocket response writer not support hijack")
+		return
+	}
+	if conn, brw, err = hijacker.Hijack(); err != nil {
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	sb.WriteString("Upgrade: websocket\r\n")
+	sb.WriteString("Connection: Upgrade\r\n")
+	sb.WriteString("Sec-WebSocket-Accept: " + acceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n")
+	if subprotocol != "" {
+		sb.WriteString("Sec-WebSocket-Protocol: " + subprotocol + "\r\n")
+	}
+	sb.WriteString("\r\n")
+	if _, err = conn.Write([]byte(sb.String())); err != nil {
+		_ = conn.Close()
+		return
+	}
+	c = newConn(conn, brw.Reader, false, subprotocol)
+	return
+}
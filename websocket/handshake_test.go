@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptKey(t *testing.T) {
+	//RFC 6455 1.3中的示例
+	if s := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); s != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected accept key %s", s)
+	}
+}
+
+func TestDial(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, []string{"sip"})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		op, p, err := conn.ReadMessage()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_ = conn.WriteMessage(op, p)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, err := Dial(url, "sip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "sip" {
+		t.Errorf("unexpected subprotocol %s", conn.Subprotocol())
+	}
+	if err = conn.WriteMessage(OpText, []byte("OPTIONS")); err != nil {
+		t.Fatal(err)
+	}
+	if op, p, err := conn.ReadMessage(); err != nil || op != OpText || string(p) != "OPTIONS" {
+		t.Errorf("unexpected echo %d %q %v", op, p, err)
+	}
+
+	//服务端不支持的子协议
+	if _, err = Dial(url, "mqtt", nil); err == nil {
+		t.Error("unsupported subprotocol accepted")
+	}
+}
+
+func TestUpgrade_badHandshake(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := Upgrade(w, r, nil); err != ErrorBadHandshake {
+			t.Errorf("unexpected error %v", err)
+		}
+	}))
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status %d", res.StatusCode)
+	}
+}
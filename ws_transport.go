@@ -0,0 +1,262 @@
+package sip
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/uole/sip/websocket"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	ProtoWS  = "WS"
+	ProtoWSS = "WSS"
+
+	//WebSocketProtocol RFC 7118定义的子协议
+	WebSocketProtocol = "sip"
+)
+
+type (
+	//WSTransport 基于websocket的传输层, 每个消息对应一个websocket帧
+	WSTransport struct {
+		baseTransport
+		protocol  string
+		config    *tls.Config
+		conn      *websocket.Conn
+		connMutex sync.RWMutex
+		listener  net.Listener
+		server    *http.Server
+		peers     peerTable
+		closed    int32
+	}
+
+	//wsPeer websocket对端连接
+	wsPeer struct {
+		conn *websocket.Conn
+	}
+)
+
+func (p *wsPeer) Write(b []byte) (n int, err error) {
+	if err = p.conn.WriteMessage(websocket.OpText, b); err == nil {
+		n = len(b)
+	}
+	return
+}
+
+func (p *wsPeer) Close() (err error) {
+	return p.conn.Close()
+}
+
+func (tp *WSTransport) Protocol() string {
+	return tp.protocol
+}
+
+func (tp *WSTransport) Conn() net.Conn {
+	if conn := tp.wsConn(); conn != nil {
+		return conn.NetConn()
+	}
+	return nil
+}
+
+//wsConn 主动建立的websocket连接
+func (tp *WSTransport) wsConn() *websocket.Conn {
+	tp.connMutex.RLock()
+	defer tp.connMutex.RUnlock()
+	return tp.conn
+}
+
+func (tp *WSTransport) LocalAddr() net.Addr {
+	if tp.listener != nil {
+		return tp.listener.Addr()
+	}
+	if conn := tp.wsConn(); conn != nil {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+//Dial 连接websocket服务, addr可以是host:port或者完整的ws(s)地址
+func (tp *WSTransport) Dial(addr string) (err error) {
+	if !strings.Contains(addr, "://") {
+		addr = strings.ToLower(tp.protocol) + "://" + addr
+	}
+	var conn *websocket.Conn
+	if conn, err = websocket.Dial(addr, WebSocketProtocol, tp.config); err != nil {
+		return
+	}
+	tp.connMutex.Lock()
+	tp.conn = conn
+	tp.connMutex.Unlock()
+	go func() {
+		tp.readLoop(conn)
+		_ = tp.Close()
+	}()
+	return
+}
+
+//Listen 监听websocket连接, wss需要在config中设置服务端证书
+func (tp *WSTransport) Listen(addr string) (err error) {
+	if tp.listener, err = net.Listen("tcp", addr); err != nil {
+		return
+	}
+	tp.server = &http.Server{Handler: http.HandlerFunc(tp.handle), TLSConfig: tp.config}
+	go func() {
+		var err error
+		if tp.protocol == ProtoWSS {
+			err = tp.server.ServeTLS(tp.listener, "", "")
+		} else {
+			err = tp.server.Serve(tp.listener)
+		}
+		if err != http.ErrServerClosed {
+			tp.getLogger().Error("serve websocket failed", "addr", addr, FieldError, err)
+		}
+	}()
+	return
+}
+
+//handle 升级websocket连接
+func (tp *WSTransport) handle(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Upgrade(w, r, []string{WebSocketProtocol})
+	if err != nil {
+		return
+	}
+	tp.peers.add(conn.RemoteAddr(), &wsPeer{conn: conn})
+	tp.readLoop(conn)
+	tp.peers.remove(conn.RemoteAddr())
+	_ = conn.Close()
+}
+
+//readLoop 读取websocket消息
+func (tp *WSTransport) readLoop(conn *websocket.Conn) {
+	var (
+		err error
+		p   []byte
+		res *Response
+		req *Request
+	)
+	for {
+		if _, p, err = conn.ReadMessage(); err != nil {
+			if atomic.LoadInt32(&tp.closed) == 0 && err != io.EOF {
+				tp.getLogger().Warn("read websocket message failed", FieldPeer, conn.RemoteAddr().String(), FieldError, err)
+			}
+			return
+		}
+		if isKeepAlive(p) {
+			//收到ping, 回复一个CRLF
+			if len(p) >= len(crlfPing) {
+				_ = conn.WriteMessage(websocket.OpText, crlfPong)
+			}
+			continue
+		}
+		if len(p) < 3 {
+			continue
+		}
+		req, res, err = parseMessage(p)
+		tp.traceReceive(tp, p, req, res, conn.RemoteAddr(), err)
+		if err != nil {
+			tp.getLogger().Warn("parse websocket message failed", FieldPeer, conn.RemoteAddr().String(), FieldError, err)
+			continue
+		}
+		tp.dispatch(tp, req, res, conn.RemoteAddr())
+	}
+}
+
+func (tp *WSTransport) Write(p []byte) (n int, err error) {
+	var addr net.Addr
+	if conn := tp.wsConn(); conn != nil {
+		addr = conn.RemoteAddr()
+	}
+	n, err = tp.write(p)
+	tp.traceSend(tp, p, addr, err)
+	return
+}
+
+func (tp *WSTransport) write(p []byte) (n int, err error) {
+	conn := tp.wsConn()
+	if conn == nil || atomic.LoadInt32(&tp.closed) == 1 {
+		err = io.ErrClosedPipe
+		return
+	}
+	return (&wsPeer{conn: conn}).Write(p)
+}
+
+//WriteTo 发送数据到指定的websocket对端
+func (tp *WSTransport) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = tp.writeTo(p, addr)
+	tp.traceSend(tp, p, addr, err)
+	return
+}
+
+func (tp *WSTransport) writeTo(p []byte, addr net.Addr) (n int, err error) {
+	if atomic.LoadInt32(&tp.closed) == 1 {
+		err = io.ErrClosedPipe
+		return
+	}
+	if conn := tp.wsConn(); conn != nil && conn.RemoteAddr().String() == addr.String() {
+		return tp.write(p)
+	}
+	return tp.peers.writeTo(p, addr)
+}
+
+func (tp *WSTransport) Do(ctx context.Context, req *Request, callback ProcessFunc) (err error) {
+	return tp.do(ctx, tp, req, callback)
+}
+
+func (tp *WSTransport) Respond(res *Response) (err error) {
+	return tp.respond(tp, res)
+}
+
+func (tp *WSTransport) Close() (err error) {
+	if !atomic.CompareAndSwapInt32(&tp.closed, 0, 1) {
+		return
+	}
+	if tp.server != nil {
+		err = tp.server.Close()
+	}
+	tp.peers.closeAll()
+	if conn := tp.wsConn(); conn != nil {
+		err = conn.Close()
+	}
+	return
+}
+
+//NewWSServerTransport 使用服务端升级后的websocket连接创建传输层
+func NewWSServerTransport(conn *websocket.Conn, protocol string) Transport {
+	tp := &WSTransport{
+		baseTransport: newBaseTransport(true),
+		protocol:      protocol,
+		conn:          conn,
+	}
+	go func() {
+		tp.readLoop(conn)
+		_ = tp.Close()
+	}()
+	return tp
+}
+
+//WSHandler 返回一个http处理器, 每个websocket连接都会回调一个传输层
+func WSHandler(fun func(tp Transport)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r, []string{WebSocketProtocol})
+		if err != nil {
+			return
+		}
+		protocol := ProtoWS
+		if r.TLS != nil {
+			protocol = ProtoWSS
+		}
+		fun(NewWSServerTransport(conn, protocol))
+	})
+}
+
+func NewWSTransport() Transport {
+	return &WSTransport{baseTransport: newBaseTransport(true), protocol: ProtoWS}
+}
+
+func NewWSSTransport(config *tls.Config) Transport {
+	return &WSTransport{baseTransport: newBaseTransport(true), protocol: ProtoWSS, config: config}
+}
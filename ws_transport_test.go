@@ -0,0 +1,55 @@
+package sip
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWSTransport_Do(t *testing.T) {
+	server := httptest.NewServer(WSHandler(func(tp Transport) {
+		go func() {
+			defer tp.Close()
+			req := <-tp.Request()
+			if via, ok := req.Header.Get(HeaderVia).(*ViaHeader); !ok || via.Transport != ProtoWS {
+				t.Error("unexpected via transport")
+			}
+			res := NewResponse(StatusOK, req)
+			if _, err := tp.Write(res.Bytes()); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(time.Millisecond * 100)
+		}()
+	}))
+	defer server.Close()
+
+	uri, err := parseUri("sip:" + strings.TrimPrefix(server.URL, "http://") + ";transport=ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp, err := DialUri(uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	if tp.Protocol() != ProtoWS {
+		t.Fatalf("unexpected protocol %s", tp.Protocol())
+	}
+	req := newTestRequest(MethodRegister, "ws-call")
+	req.Header.Set(HeaderVia, &ViaHeader{Transport: ProtoWS, Uri: NewUri("", "df7jal23ls0d.invalid", Map{"branch": "z9hG4bK-ws"})})
+	req.Header.Set(HeaderContact, &AddressHeader{Uri: NewUri("1000", "df7jal23ls0d.invalid", Map{"transport": "ws"}).EnableProtocol()})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	err = tp.Do(ctx, req, func(res *Response) (bool, error) {
+		return res.StatusCode == StatusOK, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWSTransport_Listen(t *testing.T) {
+	testListen(t, NewWSTransport(), NewWSTransport)
+}